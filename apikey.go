@@ -0,0 +1,361 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"github.com/golang/glog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// APIKEY_HEADER carries the API key token `<id>.<secret>'
+	APIKEY_HEADER = "X-API-Key"
+	// APIKEY_KEY is the name in kvpairs of the id of the validated
+	// API key.
+	APIKEY_KEY = "_api_key"
+	// Default scopes required for reading and writing
+	SCOPE_READ  = "read"
+	SCOPE_WRITE = "write"
+)
+
+// APIKey is a stored API key. Only the hash of its secret is kept.
+type APIKey struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Hash is the hash of the secret. It is left out of JSON so that
+	// KeysModel does not serve it, hence a KeyStore must persist it
+	// separately rather than by marshaling the APIKey to JSON.
+	Hash   string   `json:"-"`
+	Scopes []string `json:"scopes"`
+	// RateLimit is the number of requests allowed per minute. 0
+	// means unlimited.
+	RateLimit int       `json:"rate_limit"`
+	Usage     int64     `json:"usage"`
+	Created   time.Time `json:"created"`
+}
+
+// HasScope reports whether k is granted scope.
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// KeyStore stores API keys, Hash included, see APIKey.
+// Implementations must be safe for concurrent use.
+type KeyStore interface {
+	// Get returns the key with id, or nil if there is none.
+	Get(id string) (*APIKey, error)
+	Put(key *APIKey) error
+	Delete(id string) error
+	List() ([]*APIKey, error)
+	// Incr increments the usage counter of key id.
+	Incr(id string) error
+}
+
+// MemoryKeyStore is a KeyStore in memory.
+type MemoryKeyStore struct {
+	mutex sync.RWMutex
+	keys  map[string]*APIKey
+}
+
+func NewMemoryKeyStore() *MemoryKeyStore {
+	return &MemoryKeyStore{keys: make(map[string]*APIKey)}
+}
+
+func (s *MemoryKeyStore) Get(id string) (*APIKey, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	k, ok := s.keys[id]
+	if !ok {
+		return nil, nil
+	}
+	c := *k
+	return &c, nil
+}
+
+func (s *MemoryKeyStore) Put(key *APIKey) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	c := *key
+	s.keys[key.ID] = &c
+	return nil
+}
+
+func (s *MemoryKeyStore) Delete(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.keys, id)
+	return nil
+}
+
+func (s *MemoryKeyStore) List() ([]*APIKey, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	keys := make([]*APIKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		c := *k
+		keys = append(keys, &c)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].ID < keys[j].ID
+	})
+	return keys, nil
+}
+
+func (s *MemoryKeyStore) Incr(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if k, ok := s.keys[id]; ok {
+		k.Usage++
+	}
+	return nil
+}
+
+// bucket is a token bucket refilled at rate tokens per minute.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// APIKeys validates the X-API-Key header of requests against Store
+// and enforces per-key scopes and rate limits.
+type APIKeys struct {
+	Store KeyStore
+	// Scope returns the scope required by r. The default requires
+	// SCOPE_READ for GET, HEAD and OPTIONS, SCOPE_WRITE otherwise.
+	Scope func(r *http.Request) string
+
+	mutex   sync.Mutex
+	buckets map[string]*bucket
+}
+
+// NewAPIKeys returns APIKeys backed by store.
+func NewAPIKeys(store KeyStore) *APIKeys {
+	return &APIKeys{
+		Store:   store,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+func hashSecret(secret string) string {
+	b := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(b[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Create stores a new key and returns it with its token, which is
+// the only time the secret is available.
+func (t *APIKeys) Create(name string, scopes []string, rateLimit int) (
+	token string, key *APIKey, err error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return
+	}
+	secret, err := randomHex(24)
+	if err != nil {
+		return
+	}
+	key = &APIKey{
+		ID:        id,
+		Name:      name,
+		Hash:      hashSecret(secret),
+		Scopes:    scopes,
+		RateLimit: rateLimit,
+		Created:   time.Now(),
+	}
+	if err = t.Store.Put(key); err != nil {
+		return "", nil, err
+	}
+	return id + "." + secret, key, nil
+}
+
+// Revoke deletes key id.
+func (t *APIKeys) Revoke(id string) error {
+	t.mutex.Lock()
+	delete(t.buckets, id)
+	t.mutex.Unlock()
+	return t.Store.Delete(id)
+}
+
+// defaultScope requires SCOPE_READ for safe methods and SCOPE_WRITE
+// otherwise.
+func defaultScope(r *http.Request) string {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return SCOPE_READ
+	}
+	return SCOPE_WRITE
+}
+
+func (t *APIKeys) scope(r *http.Request) string {
+	if t.Scope != nil {
+		return t.Scope(r)
+	}
+	return defaultScope(r)
+}
+
+// allow takes a token from the bucket of k and returns how long to
+// wait if there is none left.
+func (t *APIKeys) allow(k *APIKey, now time.Time) (bool, time.Duration) {
+	if k.RateLimit <= 0 {
+		return true, 0
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.buckets == nil {
+		t.buckets = make(map[string]*bucket)
+	}
+	rate := float64(k.RateLimit) / float64(time.Minute)
+	b, ok := t.buckets[k.ID]
+	if !ok {
+		b = &bucket{float64(k.RateLimit), now}
+		t.buckets[k.ID] = b
+	}
+	b.tokens += float64(now.Sub(b.last)) * rate
+	if b.tokens > float64(k.RateLimit) {
+		b.tokens = float64(k.RateLimit)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate)
+	}
+	b.tokens--
+	return true, 0
+}
+
+// Authenticate validates the API key of r and returns it.
+func (t *APIKeys) Authenticate(r *http.Request) (*APIKey, error) {
+	unauthorized := &Error{
+		StatusCode: http.StatusUnauthorized,
+		Message:    "Invalid API key",
+	}
+	parts := strings.SplitN(r.Header.Get(APIKEY_HEADER), ".", 2)
+	if len(parts) != 2 {
+		return nil, unauthorized
+	}
+	k, err := t.Store.Get(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	if k == nil || subtle.ConstantTimeCompare(
+		[]byte(hashSecret(parts[1])), []byte(k.Hash)) != 1 {
+		return nil, unauthorized
+	}
+	if scope := t.scope(r); !k.HasScope(scope) {
+		return nil, &Error{
+			StatusCode: http.StatusForbidden,
+			Message:    fmt.Sprintf("Scope `%s' required", scope),
+		}
+	}
+	return k, nil
+}
+
+// Wrap returns a Handler that serves next only for requests with a
+// valid API key, whose id is then put into kvpairs as APIKEY_KEY.
+func (t *APIKeys) Wrap(next Handler) Handler {
+	return HandlerFunc(func(w http.ResponseWriter, r *http.Request,
+		kvpairs map[string]string) {
+		k, err := t.Authenticate(r)
+		if err != nil {
+			sendError(w, r, err)
+			return
+		}
+		if ok, wait := t.allow(k, time.Now()); !ok {
+			setRetryAfter(w, wait)
+			sendJSONMsg(w, r, http.StatusTooManyRequests,
+				http.StatusText(http.StatusTooManyRequests))
+			return
+		}
+		if err = t.Store.Incr(k.ID); err != nil {
+			glog.Errorf("API key %s usage: %v", k.ID, err)
+		}
+		kvpairs[APIKEY_KEY] = k.ID
+		next.ServeHTTP(w, r, kvpairs)
+	})
+}
+
+// KeysModel exposes the keys of APIKeys as a read-only resource that
+// supports revocation with DELETE. Keys are created with
+// APIKeys.Create since their token can only be shown once.
+type KeysModel struct {
+	Keys *APIKeys
+	// Key is the name of the key id in kvpairs
+	Key string
+}
+
+func (t *KeysModel) Get(kvpairs map[string]string) (interface{}, error) {
+	k, err := t.Keys.Store.Get(kvpairs[t.Key])
+	if err != nil {
+		return nil, err
+	}
+	if k == nil {
+		return nil, ErrNotFound
+	}
+	return k, nil
+}
+
+func (t *KeysModel) GetAll(kvpairs map[string]string) (interface{}, error) {
+	return t.Keys.Store.List()
+}
+
+func (t *KeysModel) Put(kvpairs map[string]string, v interface{}) error {
+	return ErrNotImplemented
+}
+
+func (t *KeysModel) PutAll(kvpairs map[string]string, v interface{}) error {
+	return ErrNotImplemented
+}
+
+func (t *KeysModel) Patch(kvpairs map[string]string, original interface{},
+	patched interface{}) error {
+	return ErrNotImplemented
+}
+
+func (t *KeysModel) Post(kvpairs map[string]string, v interface{}) (
+	string, error) {
+	return "", ErrNotImplemented
+}
+
+func (t *KeysModel) Delete(kvpairs map[string]string) error {
+	k, err := t.Get(kvpairs)
+	if err != nil {
+		return err
+	}
+	return t.Keys.Revoke(k.(*APIKey).ID)
+}
+
+func (t *KeysModel) DeleteAll(kvpairs map[string]string) error {
+	return ErrNotImplemented
+}
@@ -0,0 +1,61 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// BODY_KEY is the name in kvpairs of the raw request body kept by
+// RESTHandler.KeepBody.
+const BODY_KEY = "_body"
+
+// RawBody returns the request body as read by RESTHandler for PUT,
+// PATCH or POST, or nil unless KeepBody is set.
+func RawBody(kvpairs map[string]string) []byte {
+	body, ok := kvpairs[BODY_KEY]
+	if !ok {
+		return nil
+	}
+	return []byte(body)
+}
+
+// keepBody puts b into kvpairs if h.KeepBody is set.
+func (h *RESTHandler) keepBody(kvpairs map[string]string, b []byte) {
+	if h.KeepBody {
+		kvpairs[BODY_KEY] = string(b)
+	}
+}
+
+// rewriteBody drops the computed fields from the body of r and
+// normalizes its times. It returns the body as sent, for keepBody, or
+// nil if neither applies.
+func (h *RESTHandler) rewriteBody(r *http.Request) ([]byte, error) {
+	if len(h.ComputedSchema) == 0 && !h.normalizesTimes(h.DataType) {
+		return nil, nil
+	}
+	b, err := readBody(r)
+	if err != nil {
+		return nil, err
+	}
+	if err = h.dropComputed(r); err != nil {
+		return nil, err
+	}
+	if err = h.readTimes(r); err != nil {
+		return nil, err
+	}
+	return bytes.TrimPrefix(b, utf8BOM), nil
+}
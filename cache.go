@@ -0,0 +1,294 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/golang/glog"
+	"hash/crc32"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RING_REPLICAS is the number of points of each server on a HashRing.
+const RING_REPLICAS = 160
+
+// After CACHE_FAILURES consecutive memcache errors, memcache is
+// skipped for CACHE_COOLDOWN, so that an outage does not add a timeout
+// to every request. A single error after that skips it again.
+const (
+	CACHE_FAILURES = 3
+	CACHE_COOLDOWN = 10 * time.Second
+)
+
+// CacheConfig tunes the memcache client made by NewCache. Zero values
+// keep the defaults of memcache.
+type CacheConfig struct {
+	Servers      []string
+	Timeout      time.Duration
+	MaxIdleConns int
+	// Consistent spreads keys with a HashRing, so that adding or
+	// removing a server only moves the keys of that server.
+	Consistent bool
+}
+
+// NewCache returns a memcache client as configured by c, e.g. for
+// WithCache.
+func NewCache(c CacheConfig) (*memcache.Client, error) {
+	var selector memcache.ServerSelector
+	if c.Consistent {
+		ring, err := NewHashRing(c.Servers...)
+		if err != nil {
+			return nil, err
+		}
+		selector = ring
+	} else {
+		ss := new(memcache.ServerList)
+		if err := ss.SetServers(c.Servers...); err != nil {
+			return nil, err
+		}
+		selector = ss
+	}
+	client := memcache.NewFromSelector(selector)
+	client.Timeout = c.Timeout
+	client.MaxIdleConns = c.MaxIdleConns
+	return client, nil
+}
+
+// HashRing is a memcache.ServerSelector picking servers by consistent
+// hashing.
+type HashRing struct {
+	points []uint32
+	addrs  map[uint32]net.Addr
+	all    []net.Addr
+}
+
+func resolve(server string) (net.Addr, error) {
+	if strings.Contains(server, "/") {
+		return net.ResolveUnixAddr("unix", server)
+	}
+	return net.ResolveTCPAddr("tcp", server)
+}
+
+// NewHashRing returns a HashRing of servers, given as host:port or
+// the path of a unix socket.
+func NewHashRing(servers ...string) (*HashRing, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("no memcache servers")
+	}
+	ring := &HashRing{addrs: make(map[uint32]net.Addr)}
+	for _, server := range servers {
+		addr, err := resolve(server)
+		if err != nil {
+			return nil, err
+		}
+		ring.all = append(ring.all, addr)
+		for i := 0; i < RING_REPLICAS; i++ {
+			p := crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s-%d", server, i)))
+			if _, ok := ring.addrs[p]; ok {
+				continue
+			}
+			ring.addrs[p] = addr
+			ring.points = append(ring.points, p)
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool {
+		return ring.points[i] < ring.points[j]
+	})
+	return ring, nil
+}
+
+func (t *HashRing) PickServer(key string) (net.Addr, error) {
+	p := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(t.points), func(i int) bool {
+		return t.points[i] >= p
+	})
+	if i == len(t.points) {
+		i = 0
+	}
+	return t.addrs[t.points[i]], nil
+}
+
+func (t *HashRing) Each(f func(net.Addr) error) error {
+	for _, addr := range t.all {
+		if err := f(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CacheStats counts the memcache operations of a RESTHandler.
+type CacheStats struct {
+	Gets   int64 `json:"gets"`
+	Hits   int64 `json:"hits"`
+	Sets   int64 `json:"sets"`
+	Errors int64 `json:"errors"`
+	// Latency is the total time spent in memcache
+	Latency time.Duration `json:"latency"`
+}
+
+// cacheStats is CacheStats shared by copies of a RESTHandler, with
+// the health of memcache.
+type cacheStats struct {
+	mutex sync.Mutex
+	CacheStats
+	failures int
+	down     time.Time
+}
+
+// healthy tells whether memcache is to be used.
+func (t *cacheStats) healthy() bool {
+	if t == nil {
+		return true
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return !time.Now().Before(t.down)
+}
+
+// record counts an operation that took since start and failed with
+// err, if not nil. Cache misses are not failures.
+func (t *cacheStats) record(get bool, start time.Time, err error) {
+	if t == nil {
+		return
+	}
+	d := time.Since(start)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.Latency += d
+	if !get {
+		t.Sets++
+	} else if t.Gets++; err == nil {
+		t.Hits++
+	}
+	if err == nil || err == memcache.ErrCacheMiss {
+		t.failures = 0
+		return
+	}
+	t.Errors++
+	if t.failures++; t.failures >= CACHE_FAILURES {
+		glog.Warningf("memcache skipped for %v after %d errors",
+			CACHE_COOLDOWN, t.failures)
+		t.down = time.Now().Add(CACHE_COOLDOWN)
+		t.failures = CACHE_FAILURES - 1
+	}
+}
+
+// CacheStats returns the counts of memcache operations of h since it
+// was created by NewRESTHandler.
+func (h *RESTHandler) CacheStats() CacheStats {
+	if h.cacheStats == nil {
+		return CacheStats{}
+	}
+	h.cacheStats.mutex.Lock()
+	defer h.cacheStats.mutex.Unlock()
+	return h.cacheStats.CacheStats
+}
+
+// LocalCache is an in-process cache of at most Max values, evicting
+// the least recently used. It is meant as a tier in front of memcache,
+// see WithLocalCache.
+type LocalCache struct {
+	Max int
+
+	mutex sync.Mutex
+	items map[string]*list.Element
+	lru   *list.List
+}
+
+type localItem struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+func NewLocalCache(max int) *LocalCache {
+	return &LocalCache{
+		Max:   max,
+		items: make(map[string]*list.Element),
+		lru:   list.New(),
+	}
+}
+
+// Get returns the value of key, or nil if missing or expired.
+func (c *LocalCache) Get(key string) []byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return nil
+	}
+	item := e.Value.(*localItem)
+	if !item.expires.IsZero() && time.Now().After(item.expires) {
+		c.lru.Remove(e)
+		delete(c.items, key)
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return item.value
+}
+
+// Set keeps a copy of value under key for seconds, or until evicted
+// if NEVER_EXPIRE.
+func (c *LocalCache) Set(key string, value []byte, seconds int32) {
+	item := &localItem{
+		key:     key,
+		value:   append([]byte(nil), value...),
+		expires: time.Now().Add(time.Duration(seconds) * time.Second),
+	}
+	if seconds == NEVER_EXPIRE {
+		item.expires = time.Time{}
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if e, ok := c.items[key]; ok {
+		e.Value = item
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.lru.PushFront(item)
+	for c.Max > 0 && c.lru.Len() > c.Max {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.items, e.Value.(*localItem).key)
+	}
+}
+
+// Delete removes key.
+func (c *LocalCache) Delete(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.lru.Remove(e)
+		delete(c.items, key)
+	}
+}
+
+// localExpiration returns the lifetime in LocalCache of a value kept
+// for expiration seconds in memcache.
+func (h *RESTHandler) localExpiration(expiration int32) int32 {
+	if h.LocalExpiration > 0 && (expiration == NEVER_EXPIRE ||
+		h.LocalExpiration < expiration) {
+		return h.LocalExpiration
+	}
+	return expiration
+}
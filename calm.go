@@ -31,7 +31,7 @@ parameter names.
 package gocalm
 
 import (
-	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
@@ -40,9 +40,15 @@ import (
 	"github.com/bradfitz/gomemcache/memcache"
 	"github.com/evanphx/json-patch"
 	"github.com/golang/glog"
-	"io/ioutil"
 	"net/http"
+	"net/url"
 	"reflect"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -50,8 +56,17 @@ const (
 	NOT_FOUND          = "Not Found"
 	NOT_ALLOWED        = "Method Not Allowed"
 	TYPE_MISMATCH      = "Type mismatch"
+	NOT_ACCEPTABLE     = "Supported Content-Type: application/json"
+	EMPTY_BODY         = "Request body is empty"
+	TRAILING_DATA      = "Unexpected data after JSON value"
 	MEMCACHE_KEY_MAX   = 250
 	MEMCACHE_VALUE_MAX = 1000000
+	// RESERVED_PREFIX starts the kvpairs keys set by gocalm and its
+	// middleware, e.g. APIKEY_KEY, which query values never set.
+	RESERVED_PREFIX = "_"
+	// SCOPE_KEY holds the kvpairs RequestInterceptor changed, as a
+	// query string, to set GET responses apart in the cache.
+	SCOPE_KEY = "_scope"
 )
 
 // error with http status code
@@ -85,6 +100,16 @@ var ErrTypeMismatch *Error = &Error{
 	Message:    TYPE_MISMATCH,
 }
 
+var ErrEmptyBody *Error = &Error{
+	StatusCode: http.StatusBadRequest,
+	Message:    EMPTY_BODY,
+}
+
+var ErrTrailingData *Error = &Error{
+	StatusCode: http.StatusBadRequest,
+	Message:    TRAILING_DATA,
+}
+
 // ModelInterface feeds data to RESTHandler
 type ModelInterface interface {
 
@@ -94,8 +119,10 @@ type ModelInterface interface {
 
 	// GetAll returns something that is suitable to
 	// json.Marshal. It does not have to match
-	// RESTHandler.DataType. It can also be a channel and gocalm will
-	// try to fetch object from it until it closes.
+	// RESTHandler.DataType. It can also be a channel of any element
+	// type and gocalm will try to fetch object from it until it
+	// closes. An error received from the channel fails the request.
+	// See also ContextModel and StreamingModel.
 	GetAll(kvpairs map[string]string) (v interface{}, err error)
 
 	// Put `v' to replace object specified by kvpairs. The
@@ -129,7 +156,9 @@ type Msg struct {
 	Message string `json:"message"`
 }
 
-// Sends http status code and message in json format
+// Sends http status code and message in json format. The message is
+// translated according to Accept-Language. 429 and 503 get a RetryMsg
+// and Retry-After.
 func sendJSONMsg(w http.ResponseWriter, r *http.Request, status int,
 	msg string) {
 	s := fmt.Sprintf("%s %s: %d %s", r.Method, r.URL, status, msg)
@@ -141,11 +170,16 @@ func sendJSONMsg(w http.ResponseWriter, r *http.Request, status int,
 	default:
 		glog.Error(s)
 	}
-	b, err := json.Marshal(Msg{msg})
+	var body interface{} = Msg{Translate(r, msg, 1)}
+	if retryable(status) {
+		body = retryMsg(w, Translate(r, msg, 1))
+	}
+	b, err := json.Marshal(body)
 	if err != nil {
 		// that's enough reason to panic
 		panic(err)
 	}
+	setLength(w, len(b), BUFFER_MAX)
 	w.WriteHeader(status)
 	w.Write(b)
 }
@@ -155,20 +189,219 @@ func sendInternalError(e error, w http.ResponseWriter, r *http.Request) {
 	sendJSONMsg(w, r, http.StatusInternalServerError, e.Error())
 }
 
+// sendError sends the status code and message of e if it is an
+// *Error, or else 500.
+func sendError(w http.ResponseWriter, r *http.Request, e error) {
+	if err, ok := e.(*Error); ok {
+		sendJSONMsg(w, r, err.StatusCode, err.Message)
+		return
+	}
+	sendInternalError(e, w, r)
+}
+
+// Handler is implemented by RESTHandler and by middlewares wrapping
+// it. It is the same as goroute.Handler.
+type Handler interface {
+	ServeHTTP(w http.ResponseWriter, r *http.Request,
+		kvpairs map[string]string)
+}
+
+// HandlerFunc adapts an ordinary function to Handler.
+type HandlerFunc func(w http.ResponseWriter, r *http.Request,
+	kvpairs map[string]string)
+
+func (f HandlerFunc) ServeHTTP(w http.ResponseWriter, r *http.Request,
+	kvpairs map[string]string) {
+	f(w, r, kvpairs)
+}
+
 // RESTHandler is http.Handler as well as goroute.Handler.
 type RESTHandler struct {
 	// Name must be unique across all RESTHandlers
 	Name string
 	// Model is an interface to backend storage
 	Model ModelInterface
+	// ReadModel, if set, serves GET instead of Model, e.g. from a
+	// denormalized store that the application keeps up to date.
+	// Model, the system of record, still serves the reads of writes.
+	ReadModel ModelInterface
 	// reflect.TypeOf(<instance in model>)
 	DataType reflect.Type
-	// Cache expiration time in seconds. 0 means no cache.
+	// Cache expiration time in seconds. 0 means no cache. Use
+	// SetExpiration to change it while serving.
 	Expiration int32
+	// TTLFunc, if set, returns the expiration of each GET instead,
+	// e.g. by tenant or query, 0 to skip the cache and a negative
+	// value to use Expiration.
+	TTLFunc func(r *http.Request, kvpairs map[string]string) int32
+	// ImmutableFunc tells whether the object, or collection, in
+	// kvpairs is immutable, e.g. Immutable for the whole resource.
+	// Immutable objects are cached until evicted and sent with
+	// Cache-Control: immutable, and mutations but POST to the
+	// collection get 405.
+	ImmutableFunc func(kvpairs map[string]string) bool
 	// The name of the primary key in request path
 	Key string
+	// Route is the name of the item route registered with
+	// NameRoute. It is used to build the Location of created
+	// objects.
+	Route string
+	// CollectionRoute and SchemaRoute are the names of the routes of
+	// the collection and of SchemaHandler. If either is set, GET
+	// responses carry Allow and Link headers to related resources.
+	CollectionRoute string
+	SchemaRoute     string
+	// Timing tells whether to send timing and cache headers on the
+	// GET response to r, e.g. TimingOnRequest. Optional.
+	Timing func(r *http.Request) bool
+	// ReturnCreated makes POST respond 201 with the created object
+	// as returned by Model.Get instead of just its id.
+	ReturnCreated bool
+	// KeepBody puts the raw body of PUT, PATCH and POST requests
+	// into kvpairs for Model, see RawBody.
+	KeepBody bool
+	// Flags gates the fields of DataType tagged calm:"flag=<name>".
+	// Optional.
+	Flags *Flags
+	// StatusPolicy decides the status codes of successful
+	// mutations, default STATUS_LEGACY.
+	StatusPolicy StatusPolicy
+	// FieldPolicy decides whether unknown fields in request bodies
+	// are rejected.
+	FieldPolicy FieldPolicy
+	// ReturnDeleted makes DELETE respond with the last
+	// representation of the object. With a calm:"version" field,
+	// DELETE then requires If-Match with the stored version.
+	ReturnDeleted bool
+	// ReturnDiff makes PUT and PATCH respond with a DiffMsg holding
+	// the JSON Patch from the previous to the new object.
+	ReturnDiff bool
+	// Versions, if set, records every change in the history served
+	// by History.
+	Versions VersionStore
+	// Trash, if set, keeps deleted objects for TrashHandler to list
+	// and restore, for TrashRetention if not 0.
+	Trash          TrashStore
+	TrashRetention time.Duration
+	// DrainTimeout limits waiting for the GetAll channel to be
+	// closed once the response is done with it, default
+	// DRAIN_TIMEOUT.
+	DrainTimeout time.Duration
+	// Times, if set, normalizes the time.Time fields of requests and
+	// GET responses, see TimePolicy.
+	Times *TimePolicy
+	// UseNumber decodes numbers of request bodies into interface{}
+	// values, e.g. of a map DataType, as json.Number, which keeps
+	// 64-bit ids exact and is sent back as is, instead of float64.
+	UseNumber bool
+	// BufferMax is the size above which responses are sent chunked
+	// instead of with Content-Length, default BUFFER_MAX.
+	BufferMax int
+	// ErrorReporter is told about requests failed with 5xx.
+	// Optional.
+	ErrorReporter ErrorReporter
+	// Principal returns the identity of the caller, used to fill
+	// created_by/updated_by fields. Optional.
+	Principal func(r *http.Request) string
+	// IDGenerator fills the field tagged calm:"id" of new objects
+	// before Post if it is empty. Optional.
+	IDGenerator IDGenerator
+	// Clock tells the time of changes, default SystemClock.
+	Clock Clock
+	// ResponseTransformer is called on every object returned by
+	// Model before it is marshaled, e.g. to add computed fields.
+	// Its result is cached per URL like the rest of the response.
+	// Optional.
+	ResponseTransformer func(r *http.Request, v interface{}) interface{}
+	// MarshalWorkers, if above 1, is the number of goroutines
+	// representing and marshaling the items of GetAll, which keep
+	// their order unless Unordered is set. ResponseTransformer must
+	// then be safe for concurrent use.
+	MarshalWorkers int
+	Unordered      bool
+	// Computed fields are added to every object sent, before
+	// ResponseTransformer, and cached with the response.
+	// ComputedSchema gives their schemas by name; they are
+	// read-only and dropped from PUT and POST bodies.
+	Computed       []Computed
+	ComputedSchema Schema
+	// RequestInterceptor is called before every Model call with
+	// the decoded body, if any; for PATCH it is the
+	// jsonpatch.Patch. It may modify kvpairs, e.g. to scope by
+	// tenant, which sets cached GET responses apart, reject the
+	// request by returning an error, or answer it by returning a
+	// non-nil response to be sent instead. Optional.
+	RequestInterceptor func(r *http.Request, kvpairs map[string]string,
+		v interface{}) (response interface{}, err error)
 	// memcache client
 	Cache *memcache.Client
+	// LocalCache is an in-process tier in front of Cache, keeping
+	// values for at most LocalExpiration seconds if set. Either may
+	// be used without the other.
+	LocalCache      *LocalCache
+	LocalExpiration int32
+	// StaleExpiration, if not 0, keeps a copy of GET responses in
+	// the caches for the given seconds, sent with a Warning header
+	// when Model fails with a server error. It works without
+	// Expiration.
+	StaleExpiration int32
+	// Fallbacks replace error responses, the first one covering
+	// the error being sent. Optional.
+	Fallbacks []*Fallback
+	// CacheKeys, if set, are AES keys to encrypt cached values with
+	// AES-GCM. The first one encrypts, all are tried to decrypt so
+	// that keys can be rotated.
+	CacheKeys [][]byte
+	// CacheVersion tags cached values, which are not served by
+	// handlers of other versions. It defaults to the Fingerprint of
+	// DataType so that schema changes invalidate the cache.
+	CacheVersion string
+	// MigrateCache, if set, upgrades a cached value of another
+	// version instead of discarding it. It returns nil to discard.
+	MigrateCache func(version string, value []byte) ([]byte, error)
+	// Locales lists the locales supported by Model, the first one
+	// being the default. If set, the client's choice is put into
+	// kvpairs and responses are cached per locale. Optional.
+	Locales []string
+	// JSONP enables wrapping GET responses in the function named by
+	// the callback query parameter, for legacy clients that cannot
+	// do CORS. Disabled by default.
+	JSONP bool
+	// DescribeOptions makes OPTIONS respond with the request and
+	// response schemas of each allowed method, derived from
+	// DataType, besides the Allow header.
+	DescribeOptions bool
+	// Deprecation marks the resource as deprecated. Optional.
+	Deprecation *Deprecation
+	// Vary lists additional request headers the response depends
+	// on, e.g. Authorization. They are added to the Vary header and
+	// to the cache key. Optional.
+	Vary []string
+	// Profiles are the response profiles clients may request by
+	// name, see Profile.
+	Profiles map[string]*Profile
+	// ExtraMethods lists methods served by middlewares wrapping h,
+	// e.g. custom actions, so that OPTIONS includes them in Allow.
+	ExtraMethods []string
+	// SchemaGuard refuses to serve a backend of another schema
+	// version, see CheckSchema. Optional.
+	SchemaGuard *SchemaGuard
+	// Vars declares the types of variables in kvpairs, e.g. "int",
+	// "uuid" or a time layout. They are validated and converted
+	// before calling Model. See PathTemplate.
+	Vars map[string]string
+	// objects pools decoded request bodies, see WithObjectPool
+	objects *sync.Pool
+	// schemaState is set by CheckSchema
+	schemaState int32
+	// cacheStats, purgeState and gone are set by NewRESTHandler
+	cacheStats *cacheStats
+	purgeState *purgeState
+	gone       *int64
+	// examples are set by WithExample
+	examples map[exampleKey]*Example
+	// sandbox is set by WithSandbox
+	sandbox *sandbox
 }
 
 func (h *RESTHandler) String() string {
@@ -176,162 +409,499 @@ func (h *RESTHandler) String() string {
 		return fmt.Sprintf(
 			"{Name: %s, Model: %s, DataType: %s}",
 			h.Name,
-			reflect.TypeOf(h.Model).String(),
+			fmt.Sprintf("%T", h.Model),
 			h.DataType.String(),
 		)
 	}
 	return fmt.Sprintf(
 		"{Name: %s, Model: %s, DataType: nil}",
 		h.Name,
-		reflect.TypeOf(h.Model).String(),
+		fmt.Sprintf("%T", h.Model),
 	)
 }
 
-func (h *RESTHandler) makeKey(r *http.Request) string {
-	b := md5.Sum([]byte(r.URL.RequestURI()))
-	return hex.EncodeToString(b[:])
+// SetExpiration changes the cache expiration time. It is safe to
+// call while the handler is serving requests.
+func (h *RESTHandler) SetExpiration(seconds int32) {
+	atomic.StoreInt32(&h.Expiration, seconds)
+}
+
+// WithExpiration returns a copy of h with the given cache expiration
+// time.
+func (h *RESTHandler) WithExpiration(seconds int32) *RESTHandler {
+	c := *h
+	c.Expiration = seconds
+	return &c
+}
+
+func (h *RESTHandler) expiration() int32 {
+	return atomic.LoadInt32(&h.Expiration)
+}
+
+// ttl returns the cache expiration of the GET request r, from TTLFunc
+// if set, or NEVER_EXPIRE if frozen.
+func (h *RESTHandler) ttl(r *http.Request, kvpairs map[string]string) int32 {
+	if h.frozen(kvpairs) {
+		return NEVER_EXPIRE
+	}
+	if h.TTLFunc != nil {
+		if seconds := h.TTLFunc(r, kvpairs); seconds >= 0 {
+			return seconds
+		}
+	}
+	return h.expiration()
+}
+
+func (h *RESTHandler) now() time.Time {
+	if h.Clock == nil {
+		return SystemClock.Now()
+	}
+	return h.Clock.Now()
+}
+
+// reader returns the model serving GET.
+func (h *RESTHandler) reader() ModelInterface {
+	if h.ReadModel == nil {
+		return h.Model
+	}
+	return h.ReadModel
 }
 
-func (h *RESTHandler) cacheGet(key string) []byte {
+func (h *RESTHandler) principal(r *http.Request) string {
+	if h.Principal == nil {
+		return ""
+	}
+	return h.Principal(r)
+}
+
+// keepPrincipal puts the caller of r into kvpairs, if known, so that
+// Model can record who changed an object.
+func (h *RESTHandler) keepPrincipal(r *http.Request,
+	kvpairs map[string]string) {
+	if p := h.principal(r); p != "" {
+		kvpairs[PRINCIPAL_KEY] = p
+	}
+}
+
+// offers returns the media types h can respond with, preferred first.
+func (h *RESTHandler) offers() []string {
+	return []string{"application/json"}
+}
+
+// vary returns the request headers responses of h depend on.
+func (h *RESTHandler) vary() []string {
+	headers := []string{"Accept"}
+	if len(h.Locales) != 0 {
+		headers = append(headers, "Accept-Language")
+	}
+	if len(h.Profiles) != 0 {
+		headers = append(headers, "Prefer")
+	}
+	return append(headers, h.Vary...)
+}
+
+// makeKey returns the cache key of the response to r. Besides the
+// URL it covers every dimension in vary(): the chosen locale and
+// profile rather than the raw Accept-Language and Prefer, and the
+// values of h.Vary. Accept is left out as only JSON is ever cached.
+// Callers are set apart by the reserved kvpairs of scope(), and purges
+// by the generation of the path.
+func (h *RESTHandler) makeKey(r *http.Request,
+	kvpairs map[string]string) string {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	buf.WriteString(r.URL.RequestURI())
+	buf.WriteByte('\n')
+	buf.WriteString(kvpairs[LOCALE_KEY])
+	if profile := kvpairs[PROFILE_KEY]; profile != "" {
+		buf.WriteString("\nprofile=")
+		buf.WriteString(profile)
+	}
+	for _, line := range scope(kvpairs) {
+		buf.WriteByte('\n')
+		buf.WriteString(line)
+	}
+	for _, header := range h.Vary {
+		buf.WriteByte('\n')
+		for i, value := range r.Header[http.CanonicalHeaderKey(header)] {
+			if i != 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(value)
+		}
+	}
+	if gen := h.generation(r.URL.Path); gen != "" {
+		buf.WriteByte('\n')
+		buf.WriteString(gen)
+	}
+	sum := md5.Sum(buf.Bytes())
+	var key [2 * md5.Size]byte
+	hex.Encode(key[:], sum[:])
+	return string(key[:])
+}
+
+// cacheGet looks key up in LocalCache, then in memcache unless it is
+// failing. Values found in memcache are kept in LocalCache as if set
+// for expiration seconds.
+func (h *RESTHandler) cacheGet(key string, expiration int32) []byte {
+	if h.LocalCache != nil {
+		if value := h.LocalCache.Get(key); value != nil {
+			return value
+		}
+	}
+	if h.Cache == nil || !h.cacheStats.healthy() {
+		return nil
+	}
+	start := time.Now()
 	item, err := h.Cache.Get(key)
-	if err != nil {
+	h.cacheStats.record(true, start, err)
+	if err == memcache.ErrCacheMiss {
 		glog.V(1).Infof("memcache Get '%s' error: %v", key, err)
 		return nil
 	}
+	if err != nil {
+		glog.Warningf("memcache Get '%s' error: %v", key, err)
+		return nil
+	}
 	glog.V(1).Infof("memcache Get '%s'", key)
-	return item.Value
+	value := item.Value
+	if len(h.CacheKeys) != 0 {
+		value, err = open(h.CacheKeys, value, []byte(key))
+		if err != nil {
+			glog.Warningf("memcache Get '%s' %v", key, err)
+			return nil
+		}
+	}
+	value = h.unversioned(key, value)
+	if value != nil && h.LocalCache != nil {
+		h.LocalCache.Set(key, value, h.localExpiration(expiration))
+	}
+	return value
 }
 
-func (h *RESTHandler) cacheSet(key string, value []byte) {
+// cacheSet stores value in LocalCache and memcache, unless it is
+// failing.
+func (h *RESTHandler) cacheSet(key string, value []byte, expiration int32) {
+	if h.LocalCache != nil {
+		h.LocalCache.Set(key, value, h.localExpiration(expiration))
+	}
+	if h.Cache == nil || !h.cacheStats.healthy() {
+		return
+	}
+	value = h.versioned(value)
+	if len(h.CacheKeys) != 0 {
+		var err error
+		value, err = seal(h.CacheKeys[0], value, []byte(key))
+		if err != nil {
+			glog.Errorf("memcache Set '%s' %v", key, err)
+			return
+		}
+	}
 	if len(value) > MEMCACHE_VALUE_MAX {
 		glog.Warningf("Cannot cache, value too big: handler %s, key %s",
 			h.String(), key)
 		return
 	}
+	start := time.Now()
+	if expiration == NEVER_EXPIRE {
+		expiration = 0
+	}
 	err := h.Cache.Set(&memcache.Item{
 		Key:        key,
 		Value:      value,
-		Expiration: h.Expiration,
+		Expiration: expiration,
 	})
+	h.cacheStats.record(false, start, err)
 	if err != nil {
-		glog.V(1).Infof("memcache Set '%s' error: %v", key, err)
+		glog.Warningf("memcache Set '%s' error: %v", key, err)
 		return
 	}
 	glog.V(1).Infof("memcache Set '%s'", key)
 	return
 }
 
+// represent turns an object returned by Model into what is sent to
+// the client.
+func (h *RESTHandler) represent(r *http.Request, kvpairs map[string]string,
+	v interface{}) (interface{}, error) {
+	rep, err := refs(kvpairs, v)
+	if err != nil {
+		return nil, err
+	}
+	if rep, err = links(v, rep); err != nil {
+		return nil, err
+	}
+	if rep, err = h.embed(kvpairs, v, rep); err != nil {
+		return nil, err
+	}
+	if rep, err = h.compute(r, v, rep); err != nil {
+		return nil, err
+	}
+	if h.ResponseTransformer != nil {
+		rep = h.ResponseTransformer(r, rep)
+	}
+	return h.profileFields(kvpairs, rep)
+}
+
+// representAll applies represent to every item of v if it is a slice
+// or an array.
+func (h *RESTHandler) representAll(r *http.Request,
+	kvpairs map[string]string, v interface{}) (interface{}, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return h.represent(r, kvpairs, v)
+	}
+	a := make([]interface{}, rv.Len())
+	for i := range a {
+		vv, err := h.represent(r, kvpairs, rv.Index(i).Interface())
+		if err != nil {
+			return nil, err
+		}
+		a[i] = vv
+	}
+	return a, nil
+}
+
+// representation returns the JSON that GET sends of object v of
+// kvpairs, i.e. represented and shaped.
+func (h *RESTHandler) representation(r *http.Request,
+	kvpairs map[string]string, v interface{}) ([]byte, error) {
+	rep, err := h.represent(r, kvpairs, v)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(rep)
+	if err != nil {
+		return nil, err
+	}
+	return h.shape(r, kvpairs, b), nil
+}
+
+// intercept calls h.RequestInterceptor and reports whether it has
+// answered the request already.
+func (h *RESTHandler) intercept(w http.ResponseWriter, r *http.Request,
+	kvpairs map[string]string, v interface{}) bool {
+	if h.RequestInterceptor == nil {
+		return false
+	}
+	before := make(map[string]string, len(kvpairs))
+	for k, value := range kvpairs {
+		before[k] = value
+	}
+	response, err := h.RequestInterceptor(r, kvpairs, v)
+	if err != nil {
+		panic(err)
+	}
+	rescope(before, kvpairs)
+	if response == nil {
+		return false
+	}
+	b, err := json.Marshal(response)
+	if err != nil {
+		panic(err)
+	}
+	if _, err = w.Write(b); err != nil {
+		panic(err)
+	}
+	return true
+}
+
+// rescope records in SCOPE_KEY the kvpairs changed since before.
+func rescope(before, kvpairs map[string]string) {
+	changed := url.Values{}
+	for k, v := range kvpairs {
+		if old, ok := before[k]; !ok || old != v {
+			changed.Set(k, v)
+		}
+	}
+	for k := range before {
+		if _, ok := kvpairs[k]; !ok {
+			changed.Set(k, "")
+		}
+	}
+	delete(changed, SCOPE_KEY)
+	if len(changed) != 0 {
+		kvpairs[SCOPE_KEY] = changed.Encode()
+	}
+}
+
+// unscoped are the reserved kvpairs keys left out of cache keys, as
+// they do not tell callers apart or are covered otherwise.
+var unscoped = map[string]bool{
+	BODY_KEY:    true,
+	WORK_KEY:    true,
+	LOCALES_KEY: true,
+	LOCALE_KEY:  true,
+	PROFILE_KEY: true,
+}
+
+// scope returns the reserved kvpairs that set responses apart, e.g.
+// the caller told by middleware and SCOPE_KEY, as sorted lines.
+func scope(kvpairs map[string]string) []string {
+	var lines []string
+	for k, v := range kvpairs {
+		if strings.HasPrefix(k, RESERVED_PREFIX) && !unscoped[k] {
+			lines = append(lines, k+"="+v)
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// write sends the JSON b as the body of a successful GET.
+func (h *RESTHandler) write(w http.ResponseWriter, r *http.Request, b []byte) {
+	if callback := h.jsonpCallback(r); callback != "" {
+		b = jsonpBody(w, callback, b)
+	}
+	setLength(w, len(b), h.bufferMax())
+	if _, err := w.Write(b); err != nil {
+		panic(err)
+	}
+}
+
 // cached gets value from memcache if it exists or gets it from Model
-func (h *RESTHandler) cached(key string, kvpairs map[string]string) (
-	[]byte, error) {
-	if h.Expiration != 0 {
-		value := h.cacheGet(key)
+func (h *RESTHandler) cached(r *http.Request, key string,
+	kvpairs map[string]string) ([]byte, error) {
+	expiration := h.ttl(r, kvpairs)
+	if expiration != 0 {
+		value := h.cacheGet(key, expiration)
 		if value != nil {
+			timingOf(r).cached(CACHE_HIT)
 			return value, nil
 		}
+		timingOf(r).cached(CACHE_MISS)
+	}
+	if isGone(r) {
+		return nil, ErrClientGone
 	}
-	v, err := h.Model.Get(kvpairs)
+	defer timingOf(r).modelSince(time.Now())
+	v, err := h.reader().Get(kvpairs)
 	if err != nil {
 		return nil, err
 	}
 	if v == nil {
 		return nil, ErrNotFound
 	}
+	if v, err = h.represent(r, kvpairs, v); err != nil {
+		return nil, err
+	}
 	b, err := json.Marshal(v)
 	if err != nil {
 		return nil, err
 	}
-	if h.Expiration == 0 {
+	h.keepStale(key, b)
+	if expiration == 0 {
 		return b, nil
 	}
-	h.cacheSet(key, b)
+	h.cacheSet(key, b, expiration)
 	return b, nil
 }
 
 // getAllJSON gets value from memcache if it exists or gets it from Model
-func (h *RESTHandler) getAllJSON(key string, kvpairs map[string]string) (
-	[]byte, error) {
-	if h.Expiration != 0 {
-		value := h.cacheGet(key)
+func (h *RESTHandler) getAllJSON(r *http.Request, key string,
+	kvpairs map[string]string) ([]byte, error) {
+	expiration := h.ttl(r, kvpairs)
+	if expiration != 0 {
+		value := h.cacheGet(key, expiration)
 		if value != nil {
+			timingOf(r).cached(CACHE_HIT)
 			return value, nil
 		}
+		timingOf(r).cached(CACHE_MISS)
 	}
-	v, err := h.Model.GetAll(kvpairs)
-	if err != nil {
-		return nil, err
-	}
-	if v == nil {
-		return nil, ErrNotFound
+	if isGone(r) {
+		return nil, ErrClientGone
 	}
-	// model may return a `chan interface{}' to send items one by
-	// one, or return a slice with every item in it.
-	if reflect.ValueOf(v).Kind() != reflect.Chan {
-		b, err := json.Marshal(v)
+	defer timingOf(r).modelSince(time.Now())
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	var b []byte
+	var err error
+	if m, ok := h.reader().(StreamingModel); ok {
+		b, err = h.assemble(r, kvpairs, func(
+			yield func(interface{}) error) error {
+			return m.GetAllStream(ctx, kvpairs, yield)
+		})
 		if err != nil {
 			return nil, err
 		}
-		if h.Expiration == 0 {
-			return b, nil
+		h.keepStale(key, b)
+		if expiration != 0 {
+			h.cacheSet(key, b, expiration)
 		}
-		h.cacheSet(key, b)
 		return b, nil
 	}
-	c, ok := v.(chan interface{})
-	if !ok {
-		return nil, errors.New(
-			"type must be chan interface{}")
-	}
-	// drain channel before return
-	defer func() {
-		for _ = range c {
-		}
-	}()
-	buf := bytes.Buffer{}
-	err = buf.WriteByte('[')
+	v, err := h.getAll(ctx, kvpairs)
 	if err != nil {
 		return nil, err
 	}
-	i := 0
-	for vv := range c {
-		if err, ok := vv.(error); ok {
+	if v == nil {
+		return nil, ErrNotFound
+	}
+	// model may return a channel to send items one by one, or
+	// return a slice with every item in it.
+	c := reflect.ValueOf(v)
+	if c.Kind() != reflect.Chan {
+		if v, err = h.representAll(r, kvpairs, v); err != nil {
 			return nil, err
 		}
-		if i != 0 {
-			err = buf.WriteByte(',')
-			if err != nil {
-				return nil, err
-			}
-		}
-		b, err := json.Marshal(vv)
-		if err != nil {
+		if b, err = json.Marshal(v); err != nil {
 			return nil, err
 		}
-		_, err = buf.Write(b)
+	} else {
+		if c.Type().ChanDir()&reflect.RecvDir == 0 {
+			return nil, errors.New("GetAll channel is send-only")
+		}
+		// stop the producer and drain channel before return
+		defer func() {
+			cancel()
+			h.drain(c)
+		}()
+		b, err = h.assemble(r, kvpairs, func(
+			yield func(interface{}) error) error {
+			return receive(ctx, c, yield)
+		})
 		if err != nil {
 			return nil, err
 		}
-		i++
-	}
-	err = buf.WriteByte(']')
-	if err != nil {
-		return nil, err
 	}
-	b := buf.Bytes()
-	if h.Expiration == 0 {
+	h.keepStale(key, b)
+	if expiration == 0 {
 		return b, nil
 	}
-	h.cacheSet(key, b)
+	h.cacheSet(key, b, expiration)
 	return b, nil
 }
 
 func (h *RESTHandler) ServeHTTP(w http.ResponseWriter, r *http.Request,
 	kvpairs map[string]string) {
+	cw := &commitWriter{ResponseWriter: w}
+	w = cw
 	defer func() {
 		err := recover()
 		if err == nil {
 			return
 		}
+		// writes fail too once the client is gone
+		if e, ok := err.(error); ok && goneOr(r, e) == ErrClientGone {
+			h.clientGone(r)
+			return
+		}
+		h.report(r, err, debug.Stack())
+		if cw.committed {
+			// an error message would corrupt the response sent so
+			// far, make net/http close the connection instead
+			glog.Errorf("%s %s: %v after the response was committed",
+				r.Method, r.URL, err)
+			panic(http.ErrAbortHandler)
+		}
+		status := http.StatusInternalServerError
+		if e, ok := err.(*Error); ok {
+			status = e.StatusCode
+		}
+		if h.fallback(w, r, kvpairs, status) {
+			return
+		}
 		switch e := err.(type) {
 		case *Error:
 			sendJSONMsg(w, r, e.StatusCode, e.Message)
@@ -342,126 +912,299 @@ func (h *RESTHandler) ServeHTTP(w http.ResponseWriter, r *http.Request,
 				fmt.Errorf("Error: %v", err), w, r)
 		}
 	}()
+	r = h.startTiming(r)
 	// set content type in response header
 	header := w.Header()
 	header.Set("Content-Type", "application/json; charset=utf-8")
+	header.Set("Vary", strings.Join(h.vary(), ", "))
+	h.deprecate(w, r)
 	// check if request accept json
-	accept_json := true
-	accepts := r.Header["Accept"]
-	if len(accepts) > 0 {
-		accept_json = false
-	}
-	for _, accept := range accepts {
-		if acceptJSON(accept) {
-			accept_json = true
-			break
-		}
-	}
-	if !accept_json {
-		glog.Warningf("`%s' is not supported.\n", accepts)
-		sendJSONMsg(w, r, http.StatusNotAcceptable,
-			"Supported Content-Type: application/json")
+	if _, ok := negotiate(r.Header["Accept"], h.offers()); !ok {
+		glog.Warningf("`%s' is not supported.\n", r.Header["Accept"])
+		sendJSONMsg(w, r, http.StatusNotAcceptable, NOT_ACCEPTABLE)
 		return
 	}
 	// put the query values in URL into kvpairs
 	values := r.URL.Query()
 	for k, _ := range values {
+		// keys set by gocalm and middleware, e.g. the verified
+		// caller, must not be forged
+		if strings.HasPrefix(k, RESERVED_PREFIX) {
+			continue
+		}
 		// only get the first value, overwrite existing key
 		kvpairs[k] = values.Get(k)
 	}
+	if err := convertVars(h.Vars, kvpairs); err != nil {
+		panic(err)
+	}
+	h.setLocales(r, kvpairs)
+	h.setProfile(w, r, kvpairs)
+	h.guard(r)
+	if !h.freeze(w, r, kvpairs) {
+		return
+	}
 	key := kvpairs[h.Key]
+	if h.Model == nil {
+		h.serveExample(w, r, kvpairs, key != "")
+		return
+	}
+	// HEAD is served as GET, the body being discarded by net/http
+	get := r.Method == http.MethodGet || r.Method == http.MethodHead
+	if !get {
+		h.keepPrincipal(r, kvpairs)
+	}
 	switch {
-	case r.Method == http.MethodGet && key != "":
-		cachekey := h.makeKey(r)
-		b, err := h.cached(cachekey, kvpairs)
-		if err != nil {
-			panic(err)
+	case get && key != "":
+		if h.intercept(w, r, kvpairs, nil) {
+			return
+		}
+		cachekey := h.makeKey(r, kvpairs)
+		b, err := h.cached(r, cachekey, kvpairs)
+		if err = goneOr(r, err); err != nil {
+			if b = h.stale(w, cachekey, err); b == nil {
+				panic(err)
+			}
 		}
 		if b == nil {
 			panic(ErrNotFound)
 		}
-		_, err = w.Write(b)
-		if err != nil {
-			panic(err)
+		h.link(w, r, kvpairs, true)
+		sendTiming(w, r)
+		h.write(w, r, h.shape(r, kvpairs, b))
+	case get:
+		if h.intercept(w, r, kvpairs, nil) {
+			return
 		}
-	case r.Method == http.MethodGet:
-		cachekey := h.makeKey(r)
-		b, err := h.getAllJSON(cachekey, kvpairs)
-		if err != nil {
-			panic(err)
+		cachekey := h.makeKey(r, kvpairs)
+		b, err := h.getAllJSON(r, cachekey, kvpairs)
+		if err = goneOr(r, err); err != nil {
+			if b = h.stale(w, cachekey, err); b == nil {
+				panic(err)
+			}
 		}
 		if b == nil {
 			panic(ErrNotFound)
 		}
-		_, err = w.Write(b)
+		h.link(w, r, kvpairs, false)
+		sendTiming(w, r)
+		h.write(w, r, h.shape(r, kvpairs, b))
+	case r.Method == http.MethodPut && key != "":
+		v := h.newObject()
+		defer h.releaseObject(v)
+		sent, err := h.rewriteBody(r)
 		if err != nil {
 			panic(err)
 		}
-	case r.Method == http.MethodPut && key != "":
-		v := reflect.New(h.DataType).Interface()
-		_, err := readJSON(v, r)
+		b, err := readJSON(v, r, h.strictFields(r), h.UseNumber)
 		if err != nil {
 			panic(err)
 		}
+		if sent == nil {
+			sent = b
+		}
+		h.keepBody(kvpairs, sent)
+		stamp(v, h.now(), h.principal(r), false)
+		if err = h.checkRefs(v); err != nil {
+			panic(err)
+		}
+		if h.intercept(w, r, kvpairs, v) {
+			return
+		}
+		var previous interface{}
+		if h.ReturnDiff || versionIndex(h.DataType) >= 0 ||
+			hasCreation(h.DataType) {
+			previous, err = h.getPrimary(kvpairs)
+			if err == ErrNotFound {
+				previous, err = nil, nil
+			}
+			if err != nil {
+				panic(err)
+			}
+		}
+		if err = h.lock(previous, v); err != nil {
+			panic(err)
+		}
+		keepCreation(previous, v, h.now(), h.principal(r))
 		err = h.Model.Put(kvpairs, v)
 		if err != nil {
 			panic(err)
 		}
-		sendJSONMsg(w, r, http.StatusOK, SUCCESS)
+		h.record(r, key, v)
+		if h.ReturnDiff {
+			h.sendDiff(w, r, kvpairs, previous, v)
+			return
+		}
+		h.sendSuccess(w, r)
 	case r.Method == http.MethodPut:
 		// TODO: do not implement this until we have reflect.SliceOf
 		panic(ErrNotImplemented)
 	case r.Method == http.MethodPatch && key != "":
-		defer r.Body.Close()
-		b, err := ioutil.ReadAll(r.Body)
+		b, err := readUTF8(r)
 		if err != nil {
 			panic(err)
 		}
+		h.keepBody(kvpairs, b)
 		patch, err := jsonpatch.DecodePatch(b)
 		if err != nil {
 			glog.Errorf("jsonpatch.DecodePatch: %v", err)
 			panic(err)
 		}
-		original, err := h.Model.Get(kvpairs)
+		if h.intercept(w, r, kvpairs, patch) {
+			return
+		}
+		original, err := h.getPrimary(kvpairs)
 		if err != nil {
-			glog.Errorf("h.Model.Get %v", err)
+			glog.Errorf("h.getPrimary %v", err)
 			panic(err)
 		}
 		if b, err = json.Marshal(original); err != nil {
 			panic(err)
 		}
-		glog.V(1).Infof("original: %s", string(b))
+		if glog.V(1) {
+			glog.Infof("original: %s", redactJSON(h.DataType, b))
+		}
 		if b, err = patch.Apply(b); err != nil {
 			panic(err)
 		}
-		glog.V(1).Infof("patched: %s", string(b))
-		patched := reflect.New(h.DataType).Interface()
-		if err = json.Unmarshal(b, patched); err != nil {
+		if h.normalizesTimes(h.DataType) {
+			b = normalizeTimesJSON(h.DataType, b, h.Times)
+		}
+		if glog.V(1) {
+			glog.Infof("patched: %s", redactJSON(h.DataType, b))
+		}
+		patched := h.newObject()
+		defer h.releaseObject(patched)
+		if err = unmarshal(b, patched, h.UseNumber); err != nil {
+			panic(err)
+		}
+		err = h.lock(original, patched)
+		if err == ErrVersionConflict {
+			patched, err = h.merge(key, original, patched)
+		}
+		if err != nil {
+			panic(err)
+		}
+		stamp(patched, h.now(), h.principal(r), false)
+		keepCreation(original, patched, h.now(), h.principal(r))
+		if err = h.checkRefs(patched); err != nil {
 			panic(err)
 		}
 		if err = h.Model.Patch(kvpairs, original, patched); err != nil {
 			panic(err)
 		}
-		sendJSONMsg(w, r, http.StatusOK, SUCCESS)
+		h.record(r, key, patched)
+		if h.ReturnDiff {
+			h.sendDiff(w, r, kvpairs, original, patched)
+			return
+		}
+		h.sendSuccess(w, r)
 	case r.Method == http.MethodPost && key == "":
-		v := reflect.New(h.DataType).Interface()
-		_, err := readJSON(v, r)
+		v := h.newObject()
+		defer h.releaseObject(v)
+		sent, err := h.rewriteBody(r)
 		if err != nil {
 			panic(err)
 		}
+		b, err := readJSON(v, r, h.strictFields(r), h.UseNumber)
+		if err != nil {
+			panic(err)
+		}
+		if sent == nil {
+			sent = b
+		}
+		h.keepBody(kvpairs, sent)
+		stamp(v, h.now(), h.principal(r), true)
+		initVersion(v)
+		if err = h.checkRefs(v); err != nil {
+			panic(err)
+		}
+		if h.IDGenerator != nil {
+			if err = assignID(v, h.IDGenerator); err != nil {
+				panic(err)
+			}
+		}
+		if h.intercept(w, r, kvpairs, v) {
+			return
+		}
 		id, err := h.Model.Post(kvpairs, v)
+		_, partial := err.(*PartialError)
+		switch {
+		case partial && id != "":
+			glog.Warningf("%s POST %s: %v", h.Name, id, err)
+			header.Set("Warning", PARTIAL_WARNING)
+		case err != nil:
+			panic(err)
+		}
+		h.record(r, id, v)
+		location, err := h.itemURL(r, kvpairs, id)
+		if err != nil {
+			panic(err)
+		}
+		header.Set("Location", location)
+		if !h.ReturnCreated {
+			b = []byte(fmt.Sprintf(`{"id": "%s"}`, id))
+			setLength(w, len(b), h.bufferMax())
+			if h.StatusPolicy == STATUS_STRICT || partial {
+				w.WriteHeader(http.StatusCreated)
+			}
+			w.Write(b)
+			return
+		}
+		kvpairs[h.Key] = id
+		created, err := h.Model.Get(kvpairs)
+		if err != nil {
+			panic(err)
+		}
+		if b, err = h.representation(r, kvpairs, created); err != nil {
+			panic(err)
+		}
+		setLength(w, len(b), h.bufferMax())
+		w.WriteHeader(http.StatusCreated)
+		_, err = w.Write(b)
 		if err != nil {
 			panic(err)
 		}
-		fmt.Fprintf(w, `{"id": "%s"}`, id)
 	case r.Method == http.MethodDelete && key != "":
-		err := h.Model.Delete(kvpairs)
+		if h.intercept(w, r, kvpairs, nil) {
+			return
+		}
+		var deleted interface{}
+		var err error
+		if h.ReturnDeleted {
+			if deleted, err = h.lastRepresentation(r, kvpairs); err != nil {
+				panic(err)
+			}
+		}
+		item, err := h.trashed(r, kvpairs)
 		if err != nil {
 			panic(err)
 		}
-		sendJSONMsg(w, r, http.StatusOK, SUCCESS)
+		if err = h.discard(item); err != nil {
+			panic(err)
+		}
+		if err = h.cascade(r, kvpairs); err != nil {
+			h.undiscard(item)
+			panic(err)
+		}
+		if err = h.Model.Delete(kvpairs); err != nil {
+			h.undiscard(item)
+			panic(err)
+		}
+		h.record(r, key, nil)
+		if h.ReturnDeleted {
+			b, err := json.Marshal(deleted)
+			if err != nil {
+				panic(err)
+			}
+			h.write(w, r, h.shape(r, kvpairs, b))
+			return
+		}
+		h.sendSuccess(w, r)
 	case r.Method == http.MethodDelete && key == "":
 		panic(ErrNotImplemented)
+	case r.Method == http.MethodOptions:
+		h.serveOptions(w, r, kvpairs, key != "")
 	default:
 		panic(ErrNotImplemented)
 	}
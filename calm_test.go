@@ -16,15 +16,26 @@ package gocalm
 
 import (
 	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/4freewifi/goroute"
 	"github.com/bradfitz/gomemcache/memcache"
 	"github.com/golang/glog"
 	"io/ioutil"
+	"math/big"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
+	"net/url"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
@@ -40,10 +51,15 @@ type KeyValue struct {
 	Value string `json:"value"`
 }
 
-var dataStore map[int64]string = map[int64]string{
-	0: "Peter",
-	1: "Paul",
-	2: "Mary",
+var dataStore map[int64]string = seedData()
+
+// seedData returns the objects of Model before any test runs.
+func seedData() map[int64]string {
+	return map[int64]string{
+		0: "Peter",
+		1: "Paul",
+		2: "Mary",
+	}
 }
 
 type Model struct {
@@ -207,6 +223,13 @@ func TestRestful(t *testing.T) {
 		Key:        KEY,
 		Cache:      memcache.New("127.0.0.1:11211"),
 	}
+	// start over on reruns, e.g. go test -count=2
+	dataStore = seedData()
+	for _, u := range []string{"/", "/0", "/1", "/2", "/3"} {
+		if err := h.PurgeURL(u); err != nil {
+			t.Fatal(err)
+		}
+	}
 	s := httptest.NewServer(goroute.Handle(
 		"/", `(?P<key>[[:alnum:]]*)`, &h))
 	defer s.Close()
@@ -266,7 +289,7 @@ func TestRestful(t *testing.T) {
 	// GET /0 to verify
 	VerifyGet(t, s, "0")
 	// No need to cache now
-	h.Expiration = 0
+	h.SetExpiration(0)
 	// POST
 	j, _ = json.Marshal(KeyValue{3, "unknown"})
 	req, err = http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(j))
@@ -279,6 +302,9 @@ func TestRestful(t *testing.T) {
 		t.Fatal(err)
 	}
 	Expect(t, res, 200)
+	if location := res.Header.Get("Location"); location != s.URL+"/3" {
+		t.Fatalf("Expect Location %s/3, got %s", s.URL, location)
+	}
 	// GET /3 to verify
 	VerifyGet(t, s, "3")
 	// PATCH
@@ -353,3 +379,3804 @@ func TestRestful(t *testing.T) {
 	}
 	Expect(t, res, 200)
 }
+
+func TestPathTemplate(t *testing.T) {
+	pattern, types, err := PathTemplate("{id:int}/{date:2006-01-02}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := `(?P<id>[^/]*)/(?P<date>[^/]*)`
+	if pattern != expect {
+		t.Fatalf("Expect pattern `%s', got `%s'", expect, pattern)
+	}
+	kvpairs := map[string]string{"id": "007", "date": "2015-01-02"}
+	if err = convertVars(types, kvpairs); err != nil {
+		t.Fatal(err)
+	}
+	if kvpairs["id"] != "7" {
+		t.Fatalf("Expect id 7, got %s", kvpairs["id"])
+	}
+	kvpairs["date"] = "yesterday"
+	err = convertVars(types, kvpairs)
+	if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expect 400, got %v", err)
+	}
+}
+
+func TestURLFor(t *testing.T) {
+	err := NameRoute("book-item", "/books/{id:int}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveRoute("book-item")
+	if err = NameRoute("book-item", "/books/{id}"); err == nil {
+		t.Fatal("Expect error on duplicated route name")
+	}
+	if err = NameRoute("book", "/books/{isbn}"); err == nil {
+		t.Fatal("Expect error on conflicting route template")
+	}
+	if Routes()["book-item"] != "/books/{id:int}" {
+		t.Fatalf("Unexpected routes %v", Routes())
+	}
+	u, err := URLFor("book-item", map[string]string{"id": "42"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u != "/books/42" {
+		t.Fatalf("Expect /books/42, got %s", u)
+	}
+	if _, err = URLFor("book-item", nil); err == nil {
+		t.Fatal("Expect error on missing variable")
+	}
+	w := httptest.NewRecorder()
+	RoutesHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil),
+		nil)
+	m := map[string]string{}
+	if err = json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m["book-item"] != "/books/{id:int}" {
+		t.Fatalf("Unexpected routes %s", w.Body.String())
+	}
+}
+
+func TestAbsoluteURL(t *testing.T) {
+	r, err := http.NewRequest(http.MethodPost,
+		"http://backend:8080/books?x=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("X-Forwarded-Proto", "https")
+	r.Header.Set("X-Forwarded-Host", "api.example.com, backend")
+	r.Header.Set("X-Forwarded-Prefix", "/v1")
+	r.RemoteAddr = "192.0.2.1:1234"
+	u := AbsoluteURL(r, "/books/1")
+	if u != "http://backend:8080/books/1" {
+		t.Fatalf("Expect forwarding headers ignored, got %s", u)
+	}
+	if err = TrustProxies("192.0.2.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { TrustedProxies = nil }()
+	u = AbsoluteURL(r, "/books/1")
+	if u != "https://api.example.com/v1/books/1" {
+		t.Fatalf("Unexpected URL %s", u)
+	}
+	r.Header.Set("Forwarded", `proto=http;host="example.org"`)
+	u = AbsoluteURL(r, "/books/1")
+	if u != "http://example.org/v1/books/1" {
+		t.Fatalf("Unexpected URL %s", u)
+	}
+}
+
+func TestReturnCreated(t *testing.T) {
+	h, err := NewRESTHandler("created", &Model{},
+		WithDataType(KeyValue{}), WithKey(KEY), WithReturnCreated())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(goroute.Handle(
+		"/", `(?P<key>[[:alnum:]]*)`, h))
+	defer s.Close()
+	j, _ := json.Marshal(KeyValue{10, "Ten"})
+	res, err := http.Post(s.URL, "application/json", bytes.NewReader(j))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("Expect status 201, got %d", res.StatusCode)
+	}
+	Expect(t, res, j)
+	delete(dataStore, 10)
+}
+
+func TestStamp(t *testing.T) {
+	type Doc struct {
+		Created   time.Time  `calm:"created_at"`
+		Updated   *time.Time `calm:"updated_at"`
+		CreatedBy string     `calm:"created_by"`
+		UpdatedBy string     `calm:"updated_by"`
+	}
+	now := time.Date(2015, 1, 2, 3, 4, 5, 0, time.UTC)
+	doc := Doc{}
+	stamp(&doc, now, "alice", true)
+	if !doc.Created.Equal(now) || doc.Updated == nil ||
+		!doc.Updated.Equal(now) || doc.CreatedBy != "alice" ||
+		doc.UpdatedBy != "alice" {
+		t.Fatalf("Unexpected doc after create: %+v", doc)
+	}
+	later := now.Add(time.Hour)
+	stamp(&doc, later, "bob", false)
+	if !doc.Created.Equal(now) || !doc.Updated.Equal(later) ||
+		doc.CreatedBy != "alice" || doc.UpdatedBy != "bob" {
+		t.Fatalf("Unexpected doc after update: %+v", doc)
+	}
+	// PUT keeps the stored creation fields
+	forged := Doc{Created: later, CreatedBy: "mallory"}
+	keepCreation(doc, &forged, later, "bob")
+	if !forged.Created.Equal(now) || forged.CreatedBy != "alice" {
+		t.Fatalf("Unexpected doc after PUT: %+v", forged)
+	}
+	forged = Doc{CreatedBy: "mallory"}
+	keepCreation(nil, &forged, later, "bob")
+	if !forged.Created.Equal(later) || forged.CreatedBy != "bob" {
+		t.Fatalf("Unexpected doc after PUT creating it: %+v", forged)
+	}
+}
+
+func TestIDGenerators(t *testing.T) {
+	snowflake, err := NewSnowflake(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, g := range map[string]IDGenerator{
+		"uuidv4":    UUIDv4,
+		"uuidv7":    UUIDv7,
+		"ulid":      ULID,
+		"snowflake": snowflake,
+	} {
+		a, err := g.NewID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := g.NewID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a == b {
+			t.Fatalf("%s generated duplicated id %s", name, a)
+		}
+		glog.Infof("%s: %s", name, a)
+	}
+	type Doc struct {
+		ID int64 `calm:"id"`
+	}
+	doc := Doc{}
+	if err = assignID(&doc, snowflake); err != nil {
+		t.Fatal(err)
+	}
+	if doc.ID == 0 {
+		t.Fatal("Expect id to be assigned")
+	}
+	// snowflake ids take more than 32 bits
+	for _, v := range []interface{}{
+		&struct {
+			ID int32 `calm:"id"`
+		}{},
+		&struct {
+			ID uint32 `calm:"id"`
+		}{},
+	} {
+		if err = assignID(v, snowflake); err == nil {
+			t.Fatalf("Expect overflow error, got %+v", v)
+		}
+	}
+}
+
+func TestNewRESTHandler(t *testing.T) {
+	if _, err := NewRESTHandler("nil", nil,
+		WithDataType(KeyValue{})); err == nil {
+		t.Fatal("Expect error on nil Model")
+	}
+	if _, err := NewRESTHandler("nodatatype", &Model{}); err == nil {
+		t.Fatal("Expect error on nil DataType")
+	}
+	if _, err := NewRESTHandler("nocache", &Model{},
+		WithDataType(&KeyValue{}), WithCache(nil, 1)); err == nil {
+		t.Fatal("Expect error on nil Cache")
+	}
+	h, err := NewRESTHandler("ok", &Model{}, WithDataType(&KeyValue{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Key != DEFAULT_KEY || h.DataType != reflect.TypeOf(KeyValue{}) {
+		t.Fatalf("Unexpected handler %s", h)
+	}
+}
+
+type EmbedModel struct {
+	Model
+}
+
+func (t *EmbedModel) Embed(kvpairs map[string]string, v interface{},
+	names []string) (map[string]interface{}, error) {
+	related := make(map[string]interface{})
+	for _, name := range names {
+		if name == "upper" {
+			related[name] = strings.ToUpper(v.(*KeyValue).Value)
+		}
+	}
+	return related, nil
+}
+
+func TestEmbed(t *testing.T) {
+	dataStore[20] = "twenty"
+	defer delete(dataStore, 20)
+	h, err := NewRESTHandler("embed", &EmbedModel{},
+		WithDataType(KeyValue{}), WithKey(KEY))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// embedding is done by the model serving GET
+	read, err := NewRESTHandler("embed", &Model{},
+		WithDataType(KeyValue{}), WithKey(KEY),
+		WithReadModel(&EmbedModel{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range []*RESTHandler{h, read} {
+		s := httptest.NewServer(goroute.Handle(
+			"/", `(?P<key>[[:alnum:]]*)`, h))
+		defer s.Close()
+		res, err := http.Get(s.URL + "/20?embed=upper,unknown")
+		if err != nil {
+			t.Fatal(err)
+		}
+		Expect(t, res, []byte(
+			`{"_embedded":{"upper":"TWENTY"},"id":20,"value":"twenty"}`))
+	}
+}
+
+func TestRefs(t *testing.T) {
+	type Author struct {
+		ID   string `json:"id" calm:"id"`
+		Name string `json:"name"`
+	}
+	type Book struct {
+		Title  string  `json:"title"`
+		Author *Author `json:"author" calm:"ref=author-item"`
+	}
+	if err := NameRoute("author-item", "/authors/{id}"); err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveRoute("author-item")
+	book := &Book{"Walden", &Author{"thoreau", "Henry David Thoreau"}}
+	v, err := refs(map[string]string{REFS_PARAM: REFS_ID}, book)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := `{"author":{"id":"thoreau","href":"/authors/thoreau"},"title":"Walden"}`
+	if string(b) != expect {
+		t.Fatalf("Expect `%s', got `%s'", expect, b)
+	}
+	if v, _ = refs(map[string]string{}, book); v != book {
+		t.Fatal("Expect full representation by default")
+	}
+}
+
+func TestResponseTransformer(t *testing.T) {
+	h, err := NewRESTHandler("transform", &Model{},
+		WithDataType(KeyValue{}), WithKey(KEY))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.ResponseTransformer = func(r *http.Request, v interface{}) interface{} {
+		kv := *v.(*KeyValue)
+		kv.Value = strings.ToUpper(kv.Value)
+		return kv
+	}
+	dataStore[30] = "thirty"
+	defer delete(dataStore, 30)
+	s := httptest.NewServer(goroute.Handle(
+		"/", `(?P<key>[[:alnum:]]*)`, h))
+	defer s.Close()
+	res, err := http.Get(s.URL + "/30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	Expect(t, res, []byte(`{"id":30,"value":"THIRTY"}`))
+}
+
+func TestRequestInterceptor(t *testing.T) {
+	h, err := NewRESTHandler("intercept", &Model{},
+		WithDataType(KeyValue{}), WithKey(KEY))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.RequestInterceptor = func(r *http.Request, kvpairs map[string]string,
+		v interface{}) (interface{}, error) {
+		switch {
+		case r.Method == http.MethodDelete:
+			return nil, &Error{StatusCode: http.StatusForbidden}
+		case kvpairs[KEY] == "synthetic":
+			return KeyValue{-1, "synthetic"}, nil
+		}
+		return nil, nil
+	}
+	s := httptest.NewServer(goroute.Handle(
+		"/", `(?P<key>[[:alnum:]]*)`, h))
+	defer s.Close()
+	res, err := http.Get(s.URL + "/synthetic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	Expect(t, res, []byte(`{"id":-1,"value":"synthetic"}`))
+	req, err := http.NewRequest(http.MethodDelete, s.URL+"/0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Expect(t, res, http.StatusForbidden)
+}
+
+// TenantModel returns the tenant in kvpairs as value.
+type TenantModel struct {
+	Model
+}
+
+func (t *TenantModel) Get(kvpairs map[string]string) (interface{}, error) {
+	return &KeyValue{0, kvpairs["tenant"]}, nil
+}
+
+func TestCacheScope(t *testing.T) {
+	h, err := NewRESTHandler("scope", &TenantModel{},
+		WithDataType(KeyValue{}), WithKey(KEY),
+		WithLocalCache(NewLocalCache(10), 60))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.RequestInterceptor = func(r *http.Request, kvpairs map[string]string,
+		v interface{}) (interface{}, error) {
+		kvpairs["tenant"] = r.Header.Get("X-Tenant")
+		return nil, nil
+	}
+	for _, tenant := range []string{"a", "b"} {
+		r := httptest.NewRequest(http.MethodGet, "/0", nil)
+		r.Header.Set("X-Tenant", tenant)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r, map[string]string{KEY: "0"})
+		expect := `{"id":0,"value":"` + tenant + `"}`
+		if w.Body.String() != expect {
+			t.Fatalf("Expect %s, got %s", expect, w.Body)
+		}
+	}
+	r := httptest.NewRequest(http.MethodGet, "/0", nil)
+	key := h.makeKey(r, map[string]string{APIKEY_KEY: "alice"})
+	if key == h.makeKey(r, map[string]string{APIKEY_KEY: "bob"}) {
+		t.Fatal("Expect cache key to depend on the caller")
+	}
+	if key != h.makeKey(r, map[string]string{APIKEY_KEY: "alice",
+		WORK_KEY: "1"}) {
+		t.Fatal("Expect cache key not to depend on the unit of work")
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	RegisterCatalog(MapCatalog{
+		"fr": {"%d items": {"%d élément", "%d éléments"}},
+	})
+	r, err := http.NewRequest(http.MethodGet, "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Accept-Language", "de;q=0.5, fr-FR;q=0.8, zh-TW")
+	if s := Translate(r, NOT_FOUND, 1); s != "找不到" {
+		t.Fatalf("Expect zh-TW translation, got %s", s)
+	}
+	if s := Translate(r, "%d items", 2); s != "%d éléments" {
+		t.Fatalf("Expect French plural, got %s", s)
+	}
+	if s := Translate(r, "untranslated", 1); s != "untranslated" {
+		t.Fatalf("Expect message itself, got %s", s)
+	}
+}
+
+func TestLocales(t *testing.T) {
+	h, err := NewRESTHandler("locales", &Model{},
+		WithDataType(KeyValue{}), WithKey(KEY),
+		WithLocales("en", "zh-TW"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := http.NewRequest(http.MethodGet, "/0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Accept-Language", "fr;q=0.9, zh-tw;q=0.8, en-US;q=0.7")
+	kvpairs := map[string]string{}
+	h.setLocales(r, kvpairs)
+	if kvpairs[LOCALE_KEY] != "zh-TW" {
+		t.Fatalf("Expect zh-TW, got %s", kvpairs[LOCALE_KEY])
+	}
+	if kvpairs[LOCALES_KEY] != "fr,zh-TW,en-US" {
+		t.Fatalf("Unexpected locales %s", kvpairs[LOCALES_KEY])
+	}
+	h.Vary = []string{"Authorization"}
+	if vary := strings.Join(h.vary(), ", "); vary !=
+		"Accept, Accept-Language, Authorization" {
+		t.Fatalf("Unexpected Vary: %s", vary)
+	}
+	key := h.makeKey(r, kvpairs)
+	kvpairs[LOCALE_KEY] = "en"
+	if key == h.makeKey(r, kvpairs) {
+		t.Fatal("Expect cache key to depend on locale")
+	}
+	key = h.makeKey(r, kvpairs)
+	r.Header.Set("Authorization", "Bearer x")
+	if key == h.makeKey(r, kvpairs) {
+		t.Fatal("Expect cache key to depend on Authorization")
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	offers := []string{"application/json", "text/html"}
+	for _, c := range []struct {
+		accept string
+		offer  string
+		ok     bool
+	}{
+		{"", "application/json", true},
+		{"*/*", "application/json", true},
+		{"text/html, application/json;q=0.5", "text/html", true},
+		{"application/*;q=0.9, text/*;q=0.2", "application/json", true},
+		{"application/json;q=0, text/html;q=0", "", false},
+		{"*/*;q=0.1, application/json;q=0", "text/html", true},
+		{"image/png", "", false},
+	} {
+		accepts := []string{}
+		if c.accept != "" {
+			accepts = append(accepts, c.accept)
+		}
+		offer, ok := negotiate(accepts, offers)
+		if offer != c.offer || ok != c.ok {
+			t.Fatalf("Accept `%s': expect (%s, %v), got (%s, %v)",
+				c.accept, c.offer, c.ok, offer, ok)
+		}
+	}
+}
+
+func TestJSONP(t *testing.T) {
+	h, err := NewRESTHandler("jsonp", &Model{},
+		WithDataType(KeyValue{}), WithKey(KEY), WithJSONP())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataStore[40] = "forty"
+	defer delete(dataStore, 40)
+	s := httptest.NewServer(goroute.Handle(
+		"/", `(?P<key>[[:alnum:]]*)`, h))
+	defer s.Close()
+	res, err := http.Get(s.URL + "/40?callback=app.show")
+	if err != nil {
+		t.Fatal(err)
+	}
+	Expect(t, res, []byte(`/**/app.show({"id":40,"value":"forty"});`))
+	res, err = http.Get(s.URL + "/40?callback=alert(1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	Expect(t, res, http.StatusBadRequest)
+}
+
+func TestOptions(t *testing.T) {
+	h, err := NewRESTHandler("options", &Model{},
+		WithDataType(KeyValue{}), WithKey(KEY))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.DescribeOptions = true
+	s := httptest.NewServer(goroute.Handle(
+		"/", `(?P<key>[[:alnum:]]*)`, h))
+	defer s.Close()
+	req, err := http.NewRequest(http.MethodOptions, s.URL+"/1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allow := res.Header.Get("Allow")
+	if allow != "GET, HEAD, PUT, PATCH, DELETE, OPTIONS" {
+		t.Fatalf("Unexpected Allow: %s", allow)
+	}
+	v := struct {
+		Methods map[string]struct {
+			Request  map[string]interface{}
+			Response map[string]interface{}
+		}
+	}{}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(body, &v); err != nil {
+		t.Fatal(err)
+	}
+	props := v.Methods["PUT"].Request["properties"].(map[string]interface{})
+	if _, ok := props["value"]; !ok {
+		t.Fatalf("Expect value in PUT request schema: %s", body)
+	}
+}
+
+func TestDocHandler(t *testing.T) {
+	h, err := NewRESTHandler("doc", &Model{}, WithDataType(KeyValue{}),
+		WithKey(KEY), WithVars(map[string]string{KEY: VAR_INT}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(DocHandler(h))
+	defer s.Close()
+	res, err := http.Get(s.URL + "/_doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intros := []SelfIntro{}
+	if err = json.Unmarshal(body, &intros); err != nil {
+		t.Fatal(err)
+	}
+	if len(intros) != 1 || intros[0].Params[0].Type != VAR_INT {
+		t.Fatalf("Unexpected doc: %s", body)
+	}
+}
+
+func TestHTMLDoc(t *testing.T) {
+	if err := NameRoute("doc-item", "/docs/{key}"); err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveRoute("doc-item")
+	h, err := NewRESTHandler("doc", &Model{}, WithDataType(KeyValue{}),
+		WithKey(KEY), WithRoute("doc-item"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(DocHandler(h))
+	defer s.Close()
+	req, err := http.NewRequest(http.MethodGet, s.URL+"/_doc", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/html,application/xhtml+xml;q=0.9")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "text/html") ||
+		!bytes.Contains(body, []byte("curl -X DELETE &#39;"+s.URL+"/docs/{key}&#39;")) {
+		t.Fatalf("Unexpected doc: %s", body)
+	}
+}
+
+func TestDeprecation(t *testing.T) {
+	since := time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+	h, err := NewRESTHandler("deprecated", &Model{},
+		WithDataType(KeyValue{}), WithKey(KEY),
+		WithDeprecation(since, "/v2/kv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(goroute.Handle(
+		"/", `(?P<key>[[:alnum:]]*)`, h))
+	defer s.Close()
+	res, err := http.Get(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := res.Header.Get("Deprecation"); d != "@1433116800" {
+		t.Fatalf("Unexpected Deprecation: %s", d)
+	}
+	if l := res.Header.Get("Link"); l != `</v2/kv>; rel="successor-version"` {
+		t.Fatalf("Unexpected Link: %s", l)
+	}
+	now := time.Now()
+	d := h.Deprecation
+	if !d.first("alice", now) || d.first("alice", now) ||
+		!d.first("bob", now) {
+		t.Fatal("Expect each caller logged once")
+	}
+	if !d.first("alice", now.Add(DEPRECATION_LOG_INTERVAL)) {
+		t.Fatal("Expect caller logged again in the next interval")
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	keys := NewAPIKeys(NewMemoryKeyStore())
+	token, k, err := keys.Create("reader", []string{SCOPE_READ}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewRESTHandler("apikey", &Model{},
+		WithDataType(KeyValue{}), WithKey(KEY))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(goroute.Handle(
+		"/", `(?P<key>[[:alnum:]]*)`, keys.Wrap(h)))
+	defer s.Close()
+	do := func(method, key string, status int) {
+		req, err := http.NewRequest(method, s.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != "" {
+			req.Header.Set(APIKEY_HEADER, key)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		Expect(t, res, status)
+	}
+	do(http.MethodGet, "", http.StatusUnauthorized)
+	do(http.MethodGet, k.ID+".wrong", http.StatusUnauthorized)
+	do(http.MethodGet, token, http.StatusOK)
+	do(http.MethodPost, token, http.StatusForbidden)
+	do(http.MethodGet, token, http.StatusOK)
+	do(http.MethodGet, token, http.StatusTooManyRequests)
+	stored, err := keys.Store.Get(k.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Usage != 2 {
+		t.Fatalf("Expect usage 2, got %d", stored.Usage)
+	}
+}
+
+// PairsModel keeps the kvpairs of the last Get.
+type PairsModel struct {
+	Model
+	kvpairs map[string]string
+}
+
+func (t *PairsModel) Get(kvpairs map[string]string) (interface{}, error) {
+	t.kvpairs = kvpairs
+	return t.Model.Get(kvpairs)
+}
+
+func TestReservedKeys(t *testing.T) {
+	keys := NewAPIKeys(NewMemoryKeyStore())
+	token, k, err := keys.Create("reader", []string{SCOPE_READ}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &PairsModel{}
+	h, err := NewRESTHandler("reserved", m, WithDataType(KeyValue{}),
+		WithKey(KEY))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(goroute.Handle(
+		"/", `(?P<key>[[:alnum:]]*)`, keys.Wrap(h)))
+	defer s.Close()
+	dataStore[76] = "Seventy-six"
+	defer delete(dataStore, 76)
+	req, err := http.NewRequest(http.MethodGet,
+		s.URL+"/76?_api_key=admin&q=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(APIKEY_HEADER, token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Expect(t, res, http.StatusOK)
+	if m.kvpairs[APIKEY_KEY] != k.ID || m.kvpairs["q"] != "1" {
+		t.Fatalf("Unexpected kvpairs: %v", m.kvpairs)
+	}
+}
+
+func TestOAuth2(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwks := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `{"keys":[{"kty":"RSA","kid":"k1","n":"%s","e":"%s"}]}`,
+				b64(key.N.Bytes()), b64(big.NewInt(int64(key.E)).Bytes()))
+		}))
+	defer jwks.Close()
+	sign := func(claims string) string {
+		signed := b64([]byte(`{"alg":"RS256","kid":"k1"}`)) + "." +
+			b64([]byte(claims))
+		digest := sha256.Sum256([]byte(signed))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256,
+			digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed + "." + b64(sig)
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+	reader := sign(fmt.Sprintf(
+		`{"sub":"alice","aud":["api"],"scope":"read","exp":%d}`, exp))
+	expired := sign(`{"sub":"alice","aud":"api","scope":"read","exp":1}`)
+	o := &OAuth2{
+		Validator: &JWKSValidator{URL: jwks.URL, Audience: "api"},
+		Realm:     "test",
+		CacheTTL:  time.Minute,
+	}
+	m := &PairsModel{}
+	h, err := NewRESTHandler("oauth2", m,
+		WithDataType(KeyValue{}), WithKey(KEY))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(goroute.Handle(
+		"/", `(?P<key>[[:alnum:]]*)`, o.Wrap(h)))
+	defer s.Close()
+	do := func(method, token string, status int, challenge string) {
+		req, err := http.NewRequest(method, s.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c := res.Header.Get("WWW-Authenticate"); c != challenge {
+			t.Fatalf("Expect challenge `%s', got `%s'", challenge, c)
+		}
+		Expect(t, res, status)
+	}
+	do(http.MethodGet, "", http.StatusUnauthorized, `Bearer realm="test"`)
+	do(http.MethodGet, expired, http.StatusUnauthorized,
+		`Bearer realm="test", error="invalid_token"`)
+	do(http.MethodGet, reader, http.StatusOK, "")
+	do(http.MethodDelete, reader, http.StatusForbidden,
+		`Bearer realm="test", error="insufficient_scope", scope="write"`)
+	dataStore[77] = "Seventy-seven"
+	defer delete(dataStore, 77)
+	req, err := http.NewRequest(http.MethodGet,
+		s.URL+"/77?_subject=mallory", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+reader)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Expect(t, res, http.StatusOK)
+	if m.kvpairs[SUBJECT_KEY] != "alice" {
+		t.Fatalf("Expect subject alice, got %s", m.kvpairs[SUBJECT_KEY])
+	}
+}
+
+func TestSessions(t *testing.T) {
+	sessions := &Sessions{Keys: [][]byte{[]byte("0123456789abcdef")}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		SessionFrom(r).Set("user", "alice")
+	})
+	mux.HandleFunc("/me", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(SessionFrom(r).Get("user")))
+	})
+	mux.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
+		SessionFrom(r).Clear()
+	})
+	s := httptest.NewServer(sessions.Wrap(mux))
+	defer s.Close()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := http.Client{Jar: jar}
+	for _, c := range []struct {
+		path   string
+		expect string
+	}{
+		{"/me", ""},
+		{"/login", ""},
+		{"/me", "alice"},
+		{"/logout", ""},
+		{"/me", ""},
+	} {
+		res, err := client.Get(s.URL + c.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		Expect(t, res, []byte(c.expect))
+	}
+	// with a Store, Renew replaces the session id
+	store := &MapSessionStore{m: map[string]map[string]string{}}
+	sessions = &Sessions{Keys: sessions.Keys, Store: store}
+	mux = http.NewServeMux()
+	mux.HandleFunc("/visit", func(w http.ResponseWriter, r *http.Request) {
+		SessionFrom(r).Set("cart", "1")
+		if _, ok := w.(http.Flusher); !ok {
+			t.Error("Expect sessionWriter to be a Flusher")
+		}
+	})
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		SessionFrom(r).Set("user", "alice")
+		SessionFrom(r).Renew()
+	})
+	s2 := httptest.NewServer(sessions.Wrap(mux))
+	defer s2.Close()
+	ids := func() []string {
+		list := []string{}
+		for id := range store.m {
+			list = append(list, id)
+		}
+		return list
+	}
+	if _, err = client.Get(s2.URL + "/visit"); err != nil {
+		t.Fatal(err)
+	}
+	before := ids()
+	if _, err = client.Get(s2.URL + "/login"); err != nil {
+		t.Fatal(err)
+	}
+	after := ids()
+	if len(before) != 1 || len(after) != 1 || before[0] == after[0] ||
+		store.m[after[0]]["cart"] != "1" {
+		t.Fatalf("Expect session id renewed, got %v then %v", before, after)
+	}
+}
+
+// MapSessionStore is a SessionStore in a map, for one test at a time.
+type MapSessionStore struct {
+	m map[string]map[string]string
+}
+
+func (t *MapSessionStore) Load(id string) (map[string]string, error) {
+	return t.m[id], nil
+}
+
+func (t *MapSessionStore) Save(id string, values map[string]string,
+	maxAge time.Duration) error {
+	t.m[id] = values
+	return nil
+}
+
+func (t *MapSessionStore) Delete(id string) error {
+	delete(t.m, id)
+	return nil
+}
+
+func TestHMACVerifier(t *testing.T) {
+	secret := []byte("partner secret")
+	v := &HMACVerifier{Secret: func(keyID string) []byte {
+		if keyID == "partner" {
+			return secret
+		}
+		return nil
+	}}
+	m := &PairsModel{}
+	h, err := NewRESTHandler("hmac", m,
+		WithDataType(KeyValue{}), WithKey(KEY))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(goroute.Handle(
+		"/", `(?P<key>[[:alnum:]]*)`, v.Wrap(h)))
+	defer s.Close()
+	defer delete(dataStore, 50)
+	req, err := http.NewRequest(http.MethodPost, s.URL,
+		strings.NewReader(`{"id":50,"value":"fifty"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = SignRequest(req, "partner", secret); err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Expect(t, res, http.StatusOK)
+	// replay
+	req.Body = ioutil.NopCloser(strings.NewReader(`{"id":50,"value":"fifty"}`))
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Expect(t, res, http.StatusUnauthorized)
+	// tampered
+	req, err = http.NewRequest(http.MethodPost, s.URL,
+		strings.NewReader(`{"id":51,"value":"x"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = SignRequest(req, "partner", secret); err != nil {
+		t.Fatal(err)
+	}
+	req.Body = ioutil.NopCloser(strings.NewReader(`{"id":52,"value":"x"}`))
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Expect(t, res, http.StatusUnauthorized)
+	// key id forged in the query
+	dataStore[78] = "Seventy-eight"
+	defer delete(dataStore, 78)
+	req, err = http.NewRequest(http.MethodGet,
+		s.URL+"/78?_signature_key=admin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = SignRequest(req, "partner", secret); err != nil {
+		t.Fatal(err)
+	}
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Expect(t, res, http.StatusOK)
+	if m.kvpairs[SIGNATURE_KEY] != "partner" {
+		t.Fatalf("Expect key id partner, got %s", m.kvpairs[SIGNATURE_KEY])
+	}
+	// signatures are forgotten once they expire
+	now := time.Now()
+	v = &HMACVerifier{Window: time.Minute}
+	if v.replayed("a", now) || !v.replayed("a", now) {
+		t.Fatal("Expect replay detected")
+	}
+	if v.replayed("a", now.Add(3*time.Minute)) || len(v.expiring) != 1 {
+		t.Fatalf("Expect expired signature forgotten, got %+v", v.expiring)
+	}
+}
+
+func TestCacheEncryption(t *testing.T) {
+	oldKey := []byte("0123456789abcdef")
+	newKey := []byte("fedcba9876543210")
+	cache := memcache.New("127.0.0.1:11211")
+	h, err := NewRESTHandler("encrypted", &Model{},
+		WithDataType(KeyValue{}), WithKey(KEY), WithCache(cache, 10),
+		WithCacheKeys(oldKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.cacheSet("encrypted", []byte("secret"), 10)
+	item, err := cache.Get("encrypted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(item.Value, []byte("secret")) {
+		t.Fatal("Expect cached value to be encrypted")
+	}
+	h.CacheKeys = [][]byte{newKey, oldKey}
+	if v := h.cacheGet("encrypted", 10); string(v) != "secret" {
+		t.Fatalf("Expect secret after key rotation, got `%s'", v)
+	}
+	h.CacheKeys = [][]byte{newKey}
+	if v := h.cacheGet("encrypted", 10); v != nil {
+		t.Fatalf("Expect miss with retired key, got `%s'", v)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	type Contact struct {
+		Email string `json:"email" calm:"pii"`
+		Kind  string `json:"kind"`
+	}
+	type Person struct {
+		Name     string    `json:"name"`
+		SSN      string    `json:"ssn" calm:"pii"`
+		Contacts []Contact `json:"contacts"`
+	}
+	s := Redact(&Person{"john", "123-45-6789",
+		[]Contact{{"john@example.com", "work"}}})
+	if strings.Contains(s, "123-45-6789") ||
+		strings.Contains(s, "john@example.com") {
+		t.Fatalf("Expect PII redacted, got `%s'", s)
+	}
+	if !strings.Contains(s, `"john"`) || !strings.Contains(s, `"work"`) {
+		t.Fatalf("Expect other fields kept, got `%s'", s)
+	}
+	u, _ := url.Parse("/people?ssn=123-45-6789&name=john")
+	s = redactQuery(reflect.TypeOf(Person{}), u)
+	if strings.Contains(s, "123-45-6789") || !strings.Contains(s, "john") {
+		t.Fatalf("Expect PII redacted from the query, got `%s'", s)
+	}
+}
+
+func TestReturnDiff(t *testing.T) {
+	h, err := NewRESTHandler("diff", &Model{},
+		WithDataType(KeyValue{}), WithKey(KEY), WithReturnDiff())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(goroute.Handle(
+		"/", `(?P<key>[[:alnum:]]*)`, h))
+	defer s.Close()
+	dataStore[53] = "Fifty-three"
+	defer delete(dataStore, 53)
+	j, _ := json.Marshal(KeyValue{53, "Fifty-four"})
+	req, _ := http.NewRequest(http.MethodPut, s.URL+"/53", bytes.NewReader(j))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Expect(t, res, []byte(`{"message":"Success","diff":[`+
+		`{"op":"replace","path":"/value","value":"Fifty-four"}]}`))
+	ops, err := Diff([]byte(`{"a":[1,2],"b~/":1,"c":true}`),
+		[]byte(`{"a":[1,3],"c":true,"d":null}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(ops)
+	expect := `[{"op":"replace","path":"/a/1","value":3},` +
+		`{"op":"remove","path":"/b~0~1"},` +
+		`{"op":"add","path":"/d","value":null}]`
+	if string(b) != expect {
+		t.Fatalf("Expect %s, got %s", expect, b)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	h, err := NewRESTHandler("history", &Model{}, WithDataType(KeyValue{}),
+		WithKey(KEY), WithVersions(NewMemoryVersionStore()),
+		WithProfile("short", &Profile{Fields: []string{"value"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/kv/", goroute.Handle("/kv/",
+		`(?P<key>\d+)/_history/?(?P<rev>\d*)`, h.History()))
+	mux.Handle("/", goroute.Handle("/", `(?P<key>[[:alnum:]]*)`, h))
+	s := httptest.NewServer(mux)
+	defer s.Close()
+	dataStore[54] = "Fifty-four"
+	defer delete(dataStore, 54)
+	for _, value := range []string{"One", "Two"} {
+		j, _ := json.Marshal(KeyValue{54, value})
+		req, _ := http.NewRequest(http.MethodPut, s.URL+"/54",
+			bytes.NewReader(j))
+		if _, err = http.DefaultClient.Do(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, err := http.Post(s.URL+"/kv/54/_history/1", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK || dataStore[54] != "One" {
+		t.Fatalf("Expect revert to `One', got %d `%s'", res.StatusCode,
+			dataStore[54])
+	}
+	res, err = http.Get(s.URL + "/kv/54/_history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := []Revision{}
+	if err = json.NewDecoder(res.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 || list[2].Rev != 3 ||
+		string(list[2].Data) != `{"id":54,"value":"One"}` {
+		t.Fatalf("Unexpected history: %+v", list)
+	}
+	req, _ := http.NewRequest(http.MethodGet, s.URL+"/kv/54/_history/3", nil)
+	req.Header.Set("Prefer", "profile=short")
+	if res, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	rev := Revision{}
+	if err = json.NewDecoder(res.Body).Decode(&rev); err != nil {
+		t.Fatal(err)
+	}
+	if string(rev.Data) != `{"value":"One"}` {
+		t.Fatalf("Expect the revision shaped, got %s", rev.Data)
+	}
+	h.ImmutableFunc = Immutable
+	if res, err = http.Post(s.URL+"/kv/54/_history/2", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode == http.StatusOK || dataStore[54] != "One" {
+		t.Fatalf("Expect no revert of an immutable object, got %d `%s'",
+			res.StatusCode, dataStore[54])
+	}
+}
+
+// FailTrashStore fails every Put.
+type FailTrashStore struct {
+	*MemoryTrashStore
+}
+
+func (s *FailTrashStore) Put(resource string, item *TrashItem) error {
+	return errors.New("trash is full")
+}
+
+func TestTrashFailure(t *testing.T) {
+	h, err := NewRESTHandler("trash-failure", &Model{},
+		WithDataType(KeyValue{}), WithKey(KEY),
+		WithTrash(&FailTrashStore{NewMemoryTrashStore()}, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataStore[82] = "Eighty-two"
+	defer delete(dataStore, 82)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/82", nil),
+		map[string]string{KEY: "82"})
+	if w.Code != http.StatusInternalServerError ||
+		dataStore[82] != "Eighty-two" {
+		t.Fatalf("Expect the object kept, got %d `%s'", w.Code,
+			dataStore[82])
+	}
+}
+
+type FixedClock struct{ t time.Time }
+
+func (c *FixedClock) Now() time.Time {
+	return c.t
+}
+
+func TestTrash(t *testing.T) {
+	clock := &FixedClock{time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	h, err := NewRESTHandler("trash", &Model{}, WithDataType(KeyValue{}),
+		WithKey(KEY), WithClock(clock),
+		WithTrash(NewMemoryTrashStore(), time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/kv/", goroute.Handle("/kv/", `_trash/?(?P<key>\d*)`,
+		h.TrashHandler()))
+	mux.Handle("/", goroute.Handle("/", `(?P<key>[[:alnum:]]*)`, h))
+	s := httptest.NewServer(mux)
+	defer s.Close()
+	dataStore[72] = "Seventy-two"
+	defer delete(dataStore, 72)
+	req, _ := http.NewRequest(http.MethodDelete, s.URL+"/72", nil)
+	if _, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.Get(s.URL + "/kv/_trash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := []TrashItem{}
+	if err = json.NewDecoder(res.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID != "72" ||
+		string(list[0].Data) != `{"id":72,"value":"Seventy-two"}` {
+		t.Fatalf("Unexpected trash: %+v", list)
+	}
+	res, err = http.Post(s.URL+"/kv/_trash/72", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK || dataStore[72] != "Seventy-two" {
+		t.Fatalf("Expect restore, got %d", res.StatusCode)
+	}
+	Expect(t, res, []byte(`{"id":"72"}`))
+	if res, _ = http.Post(s.URL+"/kv/_trash/72", "", nil); res.StatusCode !=
+		http.StatusNotFound {
+		t.Fatalf("Expect 404 once restored, got %d", res.StatusCode)
+	}
+	req, _ = http.NewRequest(http.MethodDelete, s.URL+"/72", nil)
+	if _, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	clock.t = clock.t.Add(2 * time.Hour)
+	if err = h.EmptyTrash(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ = http.Get(s.URL + "/kv/_trash/72"); res.StatusCode !=
+		http.StatusNotFound {
+		t.Fatalf("Expect 404 once expired, got %d", res.StatusCode)
+	}
+	sched := NewScheduler()
+	if err = h.ScheduleTrash(sched); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCascade(t *testing.T) {
+	type Writer struct {
+		ID int `json:"id" calm:"id"`
+	}
+	type Essay struct {
+		ID       int `json:"id" calm:"id"`
+		WriterID int `json:"writer_id" calm:"link=cascade-writers,ondelete=delete"`
+	}
+	type Remark struct {
+		ID      int `json:"id" calm:"id"`
+		EssayID int `json:"essay_id" calm:"link=cascade-essays,ondelete=restrict"`
+	}
+	type Draft struct {
+		ID      int `json:"id" calm:"id"`
+		EssayID int `json:"essay_id"`
+		Version int `json:"version" calm:"version"`
+	}
+	handler := func(name string, v interface{}, seed ...interface{}) (
+		*RESTHandler, *MemoryModel) {
+		m, err := NewMemoryModel(DEFAULT_KEY, reflect.TypeOf(v), seed...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err := NewRESTHandler(name, m, WithDataType(v))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = Register(h); err != nil {
+			t.Fatal(err)
+		}
+		return h, m
+	}
+	defer func() {
+		for _, name := range []string{"cascade-writers", "cascade-essays",
+			"cascade-remarks", "cascade-drafts"} {
+			Unregister(name)
+		}
+	}()
+	writers, _ := handler("cascade-writers", Writer{}, &Writer{1}, &Writer{2})
+	essayHandler, essays := handler("cascade-essays", Essay{}, &Essay{1, 1},
+		&Essay{2, 2})
+	essayHandler.Trash = NewMemoryTrashStore()
+	essayHandler.LocalCache = NewLocalCache(10)
+	essayHandler.Expiration = 60
+	getEssay := func() int {
+		w := httptest.NewRecorder()
+		essayHandler.ServeHTTP(w, httptest.NewRequest(http.MethodGet,
+			"/cascade-essays/1", nil), map[string]string{DEFAULT_KEY: "1"})
+		return w.Code
+	}
+	getEssay()
+	_, remarks := handler("cascade-remarks", Remark{}, &Remark{1, 2})
+	draftHandler, drafts := handler("cascade-drafts", Draft{},
+		&Draft{1, 1, 1})
+	draftHandler.LocalCache = NewLocalCache(10)
+	draftHandler.Expiration = 60
+	getDraft := func() string {
+		w := httptest.NewRecorder()
+		draftHandler.ServeHTTP(w, httptest.NewRequest(http.MethodGet,
+			"/cascade-drafts/1", nil), map[string]string{DEFAULT_KEY: "1"})
+		return w.Body.String()
+	}
+	getDraft()
+	err := Relate(Relation{"cascade-essays", "cascade-drafts", "essay_id",
+		ON_DELETE_NULLIFY})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(goroute.Handle("/", `(?P<id>\d*)`, writers))
+	defer s.Close()
+	req, _ := http.NewRequest(http.MethodDelete, s.URL+"/2", nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := Msg{}
+	json.NewDecoder(res.Body).Decode(&msg)
+	if res.StatusCode != http.StatusConflict ||
+		msg.Message != "Referenced by cascade-remarks/1" {
+		t.Fatalf("Expect 409 listing the remark, got %d %+v",
+			res.StatusCode, msg)
+	}
+	if v, _ := essays.Get(map[string]string{DEFAULT_KEY: "2"}); v == nil {
+		t.Fatal("Expect essay 2 kept")
+	}
+	req, _ = http.NewRequest(http.MethodDelete, s.URL+"/1", nil)
+	if res, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expect 200, got %d", res.StatusCode)
+	}
+	if _, err = essays.Get(map[string]string{DEFAULT_KEY: "1"}); err !=
+		ErrNotFound {
+		t.Fatalf("Expect essay 1 deleted, got %v", err)
+	}
+	if code := getEssay(); code != http.StatusNotFound {
+		t.Fatalf("Expect essay 1 purged from the cache, got %d", code)
+	}
+	if list, _ := essayHandler.Trash.List("cascade-essays"); len(list) != 1 {
+		t.Fatalf("Expect essay 1 in the trash, got %+v", list)
+	}
+	v, err := drafts.Get(map[string]string{DEFAULT_KEY: "1"})
+	if err != nil || v.(*Draft).EssayID != 0 || v.(*Draft).Version != 2 {
+		t.Fatalf("Expect draft 1 nullified at version 2, got %+v %v", v,
+			err)
+	}
+	if body := getDraft(); !strings.Contains(body, `"essay_id":0`) {
+		t.Fatalf("Expect draft 1 purged from the cache, got %s", body)
+	}
+	if v, _ = remarks.Get(map[string]string{DEFAULT_KEY: "1"}); v == nil {
+		t.Fatal("Expect remark 1 kept")
+	}
+}
+
+func TestDanglingRefs(t *testing.T) {
+	type Owner struct {
+		ID int `json:"id" calm:"id"`
+	}
+	type Pet struct {
+		ID      int `json:"id" calm:"id"`
+		OwnerID int `json:"owner_id" calm:"link=refs-owners"`
+		VetID   int `json:"vet_id"`
+	}
+	owners, err := NewMemoryModel(DEFAULT_KEY, reflect.TypeOf(Owner{}),
+		&Owner{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pets, err := NewMemoryModel(DEFAULT_KEY, reflect.TypeOf(Pet{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range []*RESTHandler{
+		{Name: "refs-owners", Model: owners, DataType: reflect.TypeOf(Owner{}),
+			Key: DEFAULT_KEY},
+		{Name: "refs-vets", Model: owners, DataType: reflect.TypeOf(Owner{}),
+			Key: DEFAULT_KEY},
+	} {
+		if err = Register(h); err != nil {
+			t.Fatal(err)
+		}
+		defer Unregister(h.Name)
+	}
+	if err = Relate(Relation{"refs-vets", "refs-pets", "vet_id", ""}); err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewRESTHandler("refs-pets", pets, WithDataType(Pet{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(goroute.Handle("/", `(?P<id>\d*)`, h))
+	defer s.Close()
+	res, err := http.Post(s.URL, "application/json",
+		strings.NewReader(`{"owner_id":2,"vet_id":3}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := Msg{}
+	json.NewDecoder(res.Body).Decode(&msg)
+	if res.StatusCode != http.StatusUnprocessableEntity ||
+		msg.Message != "Dangling references: vet_id=3, owner_id=2" {
+		t.Fatalf("Expect 422 listing both fields, got %d %+v",
+			res.StatusCode, msg)
+	}
+	res, err = http.Post(s.URL, "application/json",
+		strings.NewReader(`{"owner_id":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expect 200, got %d", res.StatusCode)
+	}
+}
+
+func TestComputed(t *testing.T) {
+	type Person struct {
+		ID   int `json:"id" calm:"id"`
+		Born int `json:"born"`
+	}
+	age := func(ctx context.Context, v interface{}) (string, interface{}) {
+		return "age", 2020 - v.(*Person).Born
+	}
+	properties := Schema{"age": Schema{"type": "integer"}}
+	m, err := NewMemoryModel(DEFAULT_KEY, reflect.TypeOf(Person{}),
+		&Person{Born: 1990})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewRESTHandler("computed", m, WithDataType(Person{}),
+		WithComputed(Schema{"born": Schema{}}, age))
+	if err == nil {
+		t.Fatal("Expect error for a computed field hiding born")
+	}
+	h, err := NewRESTHandler("computed", m, WithDataType(Person{}),
+		WithComputed(properties, age), WithFieldPolicy(FIELDS_STRICT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(goroute.Handle("/", `(?P<id>\d*)`, h))
+	defer s.Close()
+	req, _ := http.NewRequest(http.MethodPut, s.URL+"/1",
+		strings.NewReader(`{"born":2000,"age":99}`))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expect age to be dropped, got %d", res.StatusCode)
+	}
+	if res, err = http.Get(s.URL + "/1"); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	if string(b) != `{"age":20,"born":2000,"id":1}` {
+		t.Fatalf("Unexpected response: %s", b)
+	}
+	data := h.dataSchema()["properties"].(Schema)["age"].(Schema)
+	if data["readOnly"] != true || data["type"] != "integer" {
+		t.Fatalf("Unexpected schema of age: %v", data)
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	type Card struct {
+		ID    int    `json:"id" calm:"id"`
+		Title string `json:"title"`
+		Body  string `json:"body"`
+	}
+	m, err := NewMemoryModel(DEFAULT_KEY, reflect.TypeOf(Card{}),
+		&Card{Title: "Hello", Body: "World"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewRESTHandler("profiles", m, WithDataType(Card{}),
+		WithLocalCache(NewLocalCache(10), 10),
+		WithProfile("mobile", &Profile{Fields: []string{"id", "title"}}),
+		WithProfile(PROFILE_MINIMAL, &Profile{Fields: []string{"id"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(goroute.Handle("/", `(?P<id>\d*)`, h))
+	defer s.Close()
+	for _, test := range []struct {
+		prefer, applied, expect string
+	}{
+		{"", "", `{"id":1,"title":"Hello","body":"World"}`},
+		{"profile=mobile", "profile=mobile", `{"id":1,"title":"Hello"}`},
+		{"return=minimal", "return=minimal", `{"id":1}`},
+		{"profile=tv", "", `{"id":1,"title":"Hello","body":"World"}`},
+	} {
+		for i := 0; i < 2; i++ {
+			req, _ := http.NewRequest(http.MethodGet, s.URL+"/1", nil)
+			if test.prefer != "" {
+				req.Header.Set("Prefer", test.prefer)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := ioutil.ReadAll(res.Body)
+			if string(b) != test.expect ||
+				res.Header.Get("Preference-Applied") != test.applied {
+				t.Fatalf("Prefer `%s': unexpected %s `%s'", test.prefer,
+					b, res.Header.Get("Preference-Applied"))
+			}
+			if !strings.Contains(res.Header.Get("Vary"), "Prefer") {
+				t.Fatal("Expect Vary to include Prefer")
+			}
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	h, err := NewRESTHandler("retry", &FailModel{}, WithDataType(KeyValue{}),
+		WithKey(KEY))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.RequestInterceptor = func(r *http.Request, kvpairs map[string]string,
+		v interface{}) (interface{}, error) {
+		return nil, &Error{StatusCode: http.StatusServiceUnavailable}
+	}
+	s := httptest.NewServer(goroute.Handle("/", `(?P<key>\d*)`, h))
+	defer s.Close()
+	res, err := http.Get(s.URL + "/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := RetryMsg{}
+	if err = json.NewDecoder(res.Body).Decode(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if res.Header.Get("Retry-After") != "1" || msg.RetryAfter != 1 ||
+		msg.Backoff == nil || *msg.Backoff != *Backoff {
+		t.Fatalf("Unexpected %s %+v", res.Header.Get("Retry-After"), msg)
+	}
+	if d, ok := Backoff.RetryDelay(res, 0); !ok || d != time.Second {
+		t.Fatalf("Expect 1s, got %v %v", d, ok)
+	}
+	res.Header.Del("Retry-After")
+	p := &BackoffPolicy{InitialMS: 100, MaxMS: 300, Multiplier: 2,
+		MaxAttempts: 3}
+	for attempt, expect := range []time.Duration{100, 200, 300} {
+		d, ok := p.RetryDelay(res, attempt)
+		if !ok || d != expect*time.Millisecond {
+			t.Fatalf("Attempt %d: expect %dms, got %v", attempt, expect, d)
+		}
+	}
+	if _, ok := p.RetryDelay(res, 3); ok {
+		t.Fatal("Expect no retry after MaxAttempts")
+	}
+}
+
+func TestClientGone(t *testing.T) {
+	h, err := NewRESTHandler("gone", &Model{}, WithDataType(KeyValue{}),
+		WithKey(KEY))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, path := range []string{"/1", "/"} {
+		r := httptest.NewRequest(http.MethodGet, path, nil).WithContext(ctx)
+		w := httptest.NewRecorder()
+		kvpairs := map[string]string{}
+		if path != "/" {
+			kvpairs[KEY] = path[1:]
+		}
+		h.ServeHTTP(w, r, kvpairs)
+		if w.Body.Len() != 0 || w.Code != http.StatusOK {
+			t.Fatalf("Expect nothing sent, got %d %s", w.Code, w.Body)
+		}
+	}
+	if h.ClientsGone() != 2 {
+		t.Fatalf("Expect 2 clients gone, got %d", h.ClientsGone())
+	}
+}
+
+// brokenWriter takes the first n bytes written, then fails.
+type brokenWriter struct {
+	*httptest.ResponseRecorder
+	n int
+}
+
+func (w *brokenWriter) Write(b []byte) (int, error) {
+	if len(b) > w.n {
+		b = b[:w.n]
+	}
+	w.n -= len(b)
+	n, _ := w.ResponseRecorder.Write(b)
+	if w.n == 0 {
+		return n, errors.New("broken pipe")
+	}
+	return n, nil
+}
+
+func TestCommittedResponse(t *testing.T) {
+	h, err := NewRESTHandler("committed", &Model{}, WithDataType(KeyValue{}),
+		WithKey(KEY))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataStore[73] = "Seventy-three"
+	defer delete(dataStore, 73)
+	w := &brokenWriter{httptest.NewRecorder(), 5}
+	defer func() {
+		if e := recover(); e != http.ErrAbortHandler {
+			t.Fatalf("Expect ErrAbortHandler, got %v", e)
+		}
+		if w.Body.String() != `{"id"` {
+			t.Fatalf("Expect the partial body only, got %s", w.Body)
+		}
+	}()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/73", nil),
+		map[string]string{KEY: "73"})
+}
+
+func TestContentLength(t *testing.T) {
+	h, err := NewRESTHandler("length", &Model{}, WithDataType(KeyValue{}),
+		WithKey(KEY), WithBufferMax(4096))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(goroute.Handle("/", `(?P<key>\d*)`, h))
+	defer s.Close()
+	dataStore[74] = "Seventy-four"
+	dataStore[75] = strings.Repeat("75", 4096)
+	defer delete(dataStore, 74)
+	defer delete(dataStore, 75)
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		req, _ := http.NewRequest(method, s.URL+"/74", nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.ContentLength != int64(len(`{"id":74,"value":"Seventy-four"}`)) {
+			t.Fatalf("%s: unexpected Content-Length %d", method,
+				res.ContentLength)
+		}
+	}
+	res, err := http.Get(s.URL + "/75")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	if res.ContentLength != -1 || len(res.TransferEncoding) == 0 ||
+		len(b) < 8192 {
+		t.Fatalf("Expect chunked response, got %d %v", res.ContentLength,
+			res.TransferEncoding)
+	}
+}
+
+func TestUseNumber(t *testing.T) {
+	type Doc map[string]interface{}
+	m, err := NewMemoryModel(DEFAULT_KEY, reflect.TypeOf(Doc{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.UseNumber = true
+	h, err := NewRESTHandler("numbers", m, WithDataType(Doc{}),
+		WithUseNumber())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(goroute.Handle("/", `(?P<id>\d*)`, h))
+	defer s.Close()
+	body := `{"big":9007199254740993,"large":100000000000000000000000}`
+	res, err := http.Post(s.URL, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := struct {
+		ID string `json:"id"`
+	}{}
+	if err = json.NewDecoder(res.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if res, err = http.Get(s.URL + "/" + created.ID); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	if string(b) != body {
+		t.Fatalf("Expect %s, got %s", body, b)
+	}
+}
+
+func TestTimes(t *testing.T) {
+	type Meeting struct {
+		ID   int        `json:"id" calm:"id"`
+		At   time.Time  `json:"at"`
+		Ends *time.Time `json:"ends,omitempty"`
+	}
+	m, err := NewMemoryModel(DEFAULT_KEY, reflect.TypeOf(Meeting{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewRESTHandler("times", m, WithDataType(Meeting{}),
+		WithTimes(&TimePolicy{Layouts: []string{"2006-01-02"}, Epoch: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(goroute.Handle("/", `(?P<id>\d*)`, h))
+	defer s.Close()
+	for _, test := range []struct {
+		body, at, ends string
+	}{
+		{`{"at":1577923200}`, "2020-01-02T00:00:00Z", ""},
+		{`{"at":1577923200500}`, "2020-01-02T00:00:00.5Z", ""},
+		{`{"at":"2020-01-02"}`, "2020-01-02T00:00:00Z", ""},
+		{`{"at":"2020-01-02T08:00:00+08:00",
+			"ends":"2020-01-02T09:00:00+08:00"}`,
+			"2020-01-02T00:00:00Z", "2020-01-02T01:00:00Z"},
+	} {
+		res, err := http.Post(s.URL, "application/json",
+			strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		created := struct {
+			ID string `json:"id"`
+		}{}
+		if err = json.NewDecoder(res.Body).Decode(&created); err != nil {
+			t.Fatalf("%s: %v", test.body, err)
+		}
+		if res, err = http.Get(s.URL + "/" + created.ID); err != nil {
+			t.Fatal(err)
+		}
+		got := map[string]interface{}{}
+		if err = json.NewDecoder(res.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		ends, _ := got["ends"].(string)
+		if got["at"] != test.at || ends != test.ends {
+			t.Fatalf("%s: unexpected %v", test.body, got)
+		}
+	}
+	at := h.dataSchema()["properties"].(Schema)["at"].(Schema)
+	if !strings.Contains(at["description"].(string), "epoch seconds") {
+		t.Fatalf("Expect the accepted formats described, got %v", at)
+	}
+}
+
+func TestCacheVersion(t *testing.T) {
+	type V1 struct {
+		Name string `json:"name"`
+	}
+	type V2 struct {
+		Name string `json:"full_name"`
+	}
+	if Fingerprint(reflect.TypeOf(V1{})) == Fingerprint(reflect.TypeOf(V2{})) {
+		t.Fatal("Expect different fingerprints")
+	}
+	cache := memcache.New("127.0.0.1:11211")
+	old, err := NewRESTHandler("versioned", &Model{}, WithDataType(V1{}),
+		WithCache(cache, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.cacheSet("versioned", []byte(`{"name":"john"}`), 10)
+	h := &RESTHandler{Name: "versioned", DataType: reflect.TypeOf(V2{}),
+		Cache: cache, Expiration: 10}
+	if v := h.cacheGet("versioned", 10); v != nil {
+		t.Fatalf("Expect miss for old version, got `%s'", v)
+	}
+	h.MigrateCache = func(version string, value []byte) ([]byte, error) {
+		if version != old.cacheVersion() {
+			t.Fatalf("Unexpected version %s", version)
+		}
+		return bytes.Replace(value, []byte(`"name"`),
+			[]byte(`"full_name"`), 1), nil
+	}
+	expect := `{"full_name":"john"}`
+	if v := h.cacheGet("versioned", 10); string(v) != expect {
+		t.Fatalf("Expect %s, got `%s'", expect, v)
+	}
+	h.MigrateCache = nil
+	if v := h.cacheGet("versioned", 10); string(v) != expect {
+		t.Fatalf("Expect migrated value cached, got `%s'", v)
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	h, err := NewRESTHandler("bench", &Model{}, WithDataType(KeyValue{}),
+		WithKey(KEY))
+	if err != nil {
+		b.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/1", nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r, map[string]string{KEY: "1"})
+	}
+}
+
+func BenchmarkGetAll(b *testing.B) {
+	h, err := NewRESTHandler("bench", &Model{}, WithDataType(KeyValue{}),
+		WithKey(KEY))
+	if err != nil {
+		b.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r, map[string]string{})
+	}
+}
+
+func BenchmarkMakeKey(b *testing.B) {
+	h := &RESTHandler{Vary: []string{"Accept-Language"}}
+	r := httptest.NewRequest(http.MethodGet, "/1?embed=author", nil)
+	r.Header.Set("Accept-Language", "zh-TW")
+	kvpairs := map[string]string{KEY: "1"}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		h.makeKey(r, kvpairs)
+	}
+}
+
+// ManyModel sends n items on a channel, then fail unless it is nil.
+type ManyModel struct {
+	Model
+	n    int
+	fail error
+}
+
+func (t *ManyModel) GetAll(kvpairs map[string]string) (interface{}, error) {
+	c := make(chan interface{})
+	go func() {
+		defer close(c)
+		for i := 0; i < t.n; i++ {
+			c <- &KeyValue{int64(i), strconv.Itoa(i)}
+		}
+		if t.fail != nil {
+			c <- t.fail
+		}
+	}()
+	return c, nil
+}
+
+func TestMarshalWorkers(t *testing.T) {
+	// later items are quicker to marshal so that workers finish
+	// out of order
+	slow := func(r *http.Request, v interface{}) interface{} {
+		time.Sleep(time.Duration(50-v.(*KeyValue).Key) *
+			time.Millisecond / 10)
+		return v
+	}
+	var expect []KeyValue
+	for i := 0; i < 50; i++ {
+		expect = append(expect, KeyValue{int64(i), strconv.Itoa(i)})
+	}
+	for _, unordered := range []bool{false, true} {
+		h, err := NewRESTHandler("workers", &ManyModel{n: 50},
+			WithDataType(KeyValue{}), WithKey(KEY),
+			WithMarshalWorkers(4, unordered))
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.ResponseTransformer = slow
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil),
+			map[string]string{})
+		var a []KeyValue
+		if err = json.Unmarshal(w.Body.Bytes(), &a); err != nil {
+			t.Fatal(err, w.Body)
+		}
+		if unordered {
+			sort.Slice(a, func(i, j int) bool {
+				return a[i].Key < a[j].Key
+			})
+		}
+		if !reflect.DeepEqual(a, expect) {
+			t.Fatalf("unordered %v: Expect %v, got %v", unordered,
+				expect, a)
+		}
+	}
+	h, err := NewRESTHandler("workers", &ManyModel{n: 50,
+		fail: errors.New("failed")}, WithDataType(KeyValue{}),
+		WithKey(KEY), WithMarshalWorkers(4, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil),
+		map[string]string{})
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("Expect status 500, got %d", w.Code)
+	}
+	if _, err = NewRESTHandler("workers", &ManyModel{},
+		WithDataType(KeyValue{}), WithKey(KEY),
+		WithMarshalWorkers(-1, false)); err == nil {
+		t.Fatal("Expect error for negative MarshalWorkers")
+	}
+}
+
+func TestObjectPool(t *testing.T) {
+	h, err := NewRESTHandler("pool", &Model{}, WithDataType(KeyValue{}),
+		WithKey(KEY), WithObjectPool())
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := h.newObject().(*KeyValue)
+	v.Key, v.Value = 1, "One"
+	h.releaseObject(v)
+	if *v != (KeyValue{}) {
+		t.Fatalf("Expect released object zeroed, got %+v", v)
+	}
+}
+
+func benchmarkPut(b *testing.B, opts ...Option) {
+	opts = append(opts, WithDataType(KeyValue{}), WithKey(KEY))
+	h, err := NewRESTHandler("bench", &Model{}, opts...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	j, _ := json.Marshal(KeyValue{1, "Paul"})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := httptest.NewRequest(http.MethodPut, "/1", bytes.NewReader(j))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r, map[string]string{KEY: "1"})
+	}
+}
+
+func BenchmarkPut(b *testing.B) {
+	benchmarkPut(b)
+}
+
+func BenchmarkPutPooled(b *testing.B) {
+	benchmarkPut(b, WithObjectPool())
+}
+
+// CancelModel stops producing once the context is done.
+type CancelModel struct {
+	Model
+	stopped chan bool
+}
+
+func (t *CancelModel) GetAllContext(ctx context.Context,
+	kvpairs map[string]string) (interface{}, error) {
+	c := make(chan interface{})
+	go func() {
+		defer close(c)
+		c <- errors.New("failed")
+		for {
+			select {
+			case c <- KeyValue{}:
+			case <-ctx.Done():
+				t.stopped <- true
+				return
+			}
+		}
+	}()
+	return c, nil
+}
+
+func TestContextModel(t *testing.T) {
+	m := &CancelModel{stopped: make(chan bool, 1)}
+	h, err := NewRESTHandler("context", m, WithDataType(KeyValue{}),
+		WithKey(KEY))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.DrainTimeout = time.Second
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil),
+		map[string]string{})
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("Expect status 500, got %d", w.Code)
+	}
+	select {
+	case <-m.stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Expect producer to stop")
+	}
+}
+
+// TypedModel sends items on a typed channel.
+type TypedModel struct {
+	Model
+}
+
+func (t *TypedModel) GetAll(kvpairs map[string]string) (interface{}, error) {
+	c := make(chan KeyValue)
+	go func() {
+		for _, v := range []string{"Zero", "One"} {
+			c <- KeyValue{int64(len(v)), v}
+		}
+		close(c)
+	}()
+	return c, nil
+}
+
+// StreamModel yields items without a channel.
+type StreamModel struct {
+	Model
+}
+
+func (t *StreamModel) GetAllStream(ctx context.Context,
+	kvpairs map[string]string, yield func(v interface{}) error) error {
+	for _, v := range []string{"Zero", "One"} {
+		if err := yield(&KeyValue{int64(len(v)), v}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestStreaming(t *testing.T) {
+	expect := `[{"id":4,"value":"Zero"},{"id":3,"value":"One"}]`
+	for _, m := range []ModelInterface{&TypedModel{}, &StreamModel{}} {
+		h, err := NewRESTHandler("stream", m, WithDataType(KeyValue{}),
+			WithKey(KEY))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil),
+			map[string]string{})
+		if w.Body.String() != expect {
+			t.Fatalf("%T: Expect %s, got %s", m, expect, w.Body)
+		}
+	}
+}
+
+func TestConditionalHandler(t *testing.T) {
+	h, err := NewRESTHandler("conditional", &Model{},
+		WithDataType(KeyValue{}), WithKey(KEY))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(ConditionalHandler(goroute.Handle(
+		"/", `(?P<key>[[:alnum:]]*)`, h)))
+	defer s.Close()
+	dataStore[55] = "Fifty-five"
+	defer delete(dataStore, 55)
+	res, err := http.Get(s.URL + "/55")
+	if err != nil {
+		t.Fatal(err)
+	}
+	etag := res.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("Expect ETag")
+	}
+	Expect(t, res, []byte(`{"id":55,"value":"Fifty-five"}`))
+	req, _ := http.NewRequest(http.MethodGet, s.URL+"/55", nil)
+	req.Header.Set("If-None-Match", etag)
+	if res, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	Expect(t, res, http.StatusNotModified)
+	req.Header.Set("If-None-Match", `"other"`)
+	if res, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	Expect(t, res, http.StatusOK)
+}
+
+// ReadOnlyModel only implements Getter.
+type ReadOnlyModel struct{}
+
+func (t *ReadOnlyModel) Get(kvpairs map[string]string) (interface{}, error) {
+	return &KeyValue{7, "Seven"}, nil
+}
+
+func TestPartialModel(t *testing.T) {
+	if _, err := PartialModel(struct{}{}); err == nil {
+		t.Fatal("Expect error for a model without methods")
+	}
+	m, err := PartialModel(&ReadOnlyModel{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewRESTHandler("partial", m, WithDataType(KeyValue{}),
+		WithKey(KEY))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodOptions, "/7", nil),
+		map[string]string{KEY: "7"})
+	if allow := w.Header().Get("Allow"); allow != "GET, HEAD, OPTIONS" {
+		t.Fatalf("Expect Allow: GET, HEAD, OPTIONS, got %s", allow)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/7", nil),
+		map[string]string{KEY: "7"})
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expect status 405, got %d", w.Code)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	if err := NameRoute("writer-item", "/writers/{id}"); err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveRoute("writer-item")
+	h, err := NewRESTHandler("writers", &Model{}, WithDataType(KeyValue{}),
+		WithRoute("writer-item"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Register(h); err != nil {
+		t.Fatal(err)
+	}
+	defer Unregister("writers")
+	if err = Register(h); err == nil {
+		t.Fatal("Expect error on duplicated resource name")
+	}
+	if Lookup("writers") != h {
+		t.Fatal("Expect registered resource")
+	}
+	type Book struct {
+		Title    string `json:"title"`
+		WriterID string `json:"writer_id" calm:"link=writers"`
+	}
+	v, err := links(&Book{"Walden", "thoreau"}, &Book{"Walden", "thoreau"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(v)
+	expect := `{"_links":{"writer_id":{"href":"/writers/thoreau"}},` +
+		`"title":"Walden","writer_id":"thoreau"}`
+	if string(b) != expect {
+		t.Fatalf("Expect `%s', got `%s'", expect, b)
+	}
+	type Review struct {
+		Title    string `json:"title"`
+		EditorID string `json:"editor_id" calm:"link=editors"`
+	}
+	v, err = links(&Review{"Walden", "ed"}, &Review{"Walden", "ed"})
+	if err != nil {
+		t.Fatalf("Expect unregistered link skipped, got %v", err)
+	}
+	if b, _ = json.Marshal(v); strings.Contains(string(b), LINKS) {
+		t.Fatalf("Expect no link, got `%s'", b)
+	}
+}
+
+// TxModel records the transaction of Put.
+type TxModel struct {
+	Model
+	tx *Tx
+}
+
+type Tx struct {
+	committed, rolledBack bool
+	fail                  bool
+}
+
+func (t *Tx) Commit() error {
+	if t.fail {
+		return errors.New("conflict")
+	}
+	t.committed = true
+	return nil
+}
+
+func (t *Tx) Rollback() error {
+	t.rolledBack = true
+	return nil
+}
+
+func (t *TxModel) Put(kvpairs map[string]string, v interface{}) error {
+	t.tx = WorkFor(kvpairs).(*Tx)
+	return t.Model.Put(kvpairs, v)
+}
+
+func TestUnitOfWork(t *testing.T) {
+	m := &TxModel{}
+	h, err := NewRESTHandler("work", m, WithDataType(KeyValue{}),
+		WithKey(KEY))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fail := false
+	u := &UnitOfWork{Begin: func(r *http.Request) (Work, error) {
+		return &Tx{fail: fail}, nil
+	}}
+	s := httptest.NewServer(goroute.Handle("/", `(?P<key>[[:alnum:]]*)`,
+		u.Wrap(h)))
+	defer s.Close()
+	dataStore[56] = "Fifty-six"
+	defer delete(dataStore, 56)
+	put := func(key int64) *http.Response {
+		j, _ := json.Marshal(KeyValue{key, "Changed"})
+		// the handle of the unit of work cannot be forged
+		req, _ := http.NewRequest(http.MethodPut,
+			fmt.Sprintf("%s/%d?_work=forged", s.URL, key),
+			bytes.NewReader(j))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	Expect(t, put(56), http.StatusOK)
+	if !m.tx.committed || m.tx.rolledBack {
+		t.Fatalf("Expect commit, got %+v", m.tx)
+	}
+	Expect(t, put(57), http.StatusNotFound)
+	if m.tx.committed || !m.tx.rolledBack {
+		t.Fatalf("Expect rollback, got %+v", m.tx)
+	}
+	fail = true
+	Expect(t, put(56), http.StatusInternalServerError)
+}
+
+// NamedModel returns its name for Get.
+type NamedModel struct {
+	Model
+	name string
+}
+
+func (t *NamedModel) Get(kvpairs map[string]string) (interface{}, error) {
+	return t.name, nil
+}
+
+func TestReplicaModel(t *testing.T) {
+	m := &ReplicaModel{
+		Primary:  &NamedModel{name: "primary"},
+		Replicas: []ModelInterface{&NamedModel{name: "replica"}},
+		Pin:      time.Minute,
+		Client: func(kvpairs map[string]string) string {
+			return kvpairs["client"]
+		},
+	}
+	alice := map[string]string{"client": "alice"}
+	bob := map[string]string{"client": "bob"}
+	if v, _ := m.Get(alice); v != "replica" {
+		t.Fatalf("Expect read from replica, got %v", v)
+	}
+	m.Delete(alice)
+	if v, _ := m.Get(alice); v != "primary" {
+		t.Fatalf("Expect read pinned to primary, got %v", v)
+	}
+	if v, _ := m.Get(bob); v != "replica" {
+		t.Fatalf("Expect other clients to read from replica, got %v", v)
+	}
+	m.Delete(map[string]string{})
+	if v, _ := m.Get(map[string]string{}); v != "replica" {
+		t.Fatalf("Expect anonymous reads unpinned, got %v", v)
+	}
+	h := &RESTHandler{Model: m}
+	if v, _ := h.getPrimary(bob); v != "primary" {
+		t.Fatalf("Expect mutations to read from primary, got %v", v)
+	}
+}
+
+func TestCacheWarmer(t *testing.T) {
+	if err := NameRoute("warm-item", "/warm/{key}"); err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveRoute("warm-item")
+	h, err := NewRESTHandler("warm", &Model{}, WithDataType(KeyValue{}),
+		WithKey(KEY), WithRoute("warm-item"),
+		WithCache(memcache.New("127.0.0.1:11211"), 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataStore[57] = "Fifty-seven"
+	defer delete(dataStore, 57)
+	w := &CacheWarmer{
+		Handler:   goroute.Handle("/warm/", `(?P<key>[[:alnum:]]*)`, h),
+		URLs:      []string{"/warm/"},
+		Resources: []*RESTHandler{h},
+	}
+	if err = w.Warm(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/warm/57", nil)
+	key := h.makeKey(r, map[string]string{KEY: "57"})
+	if v := h.cacheGet(key, 10); v == nil {
+		t.Fatal("Expect item cached")
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	s := NewScheduler()
+	done := make(chan bool, 1)
+	err := s.Add("cleanup", 10*time.Millisecond,
+		func(ctx context.Context) error {
+			select {
+			case done <- true:
+			default:
+			}
+			return errors.New("nothing to clean")
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Add("cleanup", time.Second, nil); err == nil {
+		t.Fatal("Expect error on duplicated job name")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err = s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Start(ctx); err == nil {
+		t.Fatal("Expect error on second Start")
+	}
+	<-done
+	for i := 0; i < 100 && s.Status()[0].Runs == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil), nil)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expect 404 without Authorize, got %d", w.Code)
+	}
+	s.Authorize = func(r *http.Request) bool { return true }
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil), nil)
+	list := []JobStatus{}
+	if err = json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Runs == 0 ||
+		list[0].LastError != "nothing to clean" {
+		t.Fatalf("Unexpected status %+v", list)
+	}
+}
+
+func TestLoadShedder(t *testing.T) {
+	block := make(chan bool)
+	started := make(chan bool)
+	next := HandlerFunc(func(w http.ResponseWriter, r *http.Request,
+		kvpairs map[string]string) {
+		started <- true
+		<-block
+	})
+	shedder := &LoadShedder{MaxConcurrent: 1, MaxQueue: 1,
+		QueueTimeout: time.Second, RetryAfter: 2 * time.Second}
+	h := shedder.Wrap(next)
+	serve := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil),
+			map[string]string{})
+		return w
+	}
+	go serve()
+	<-started
+	queued := make(chan *httptest.ResponseRecorder)
+	go func() { queued <- serve() }()
+	for i := 0; i < 100; i++ {
+		shedder.mutex.Lock()
+		n := shedder.queued
+		shedder.mutex.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	health := httptest.NewRecorder()
+	shedder.WrapHTTP(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})).ServeHTTP(health, httptest.NewRequest(http.MethodGet, "/_healthz",
+		nil))
+	if health.Code != http.StatusNoContent {
+		t.Fatalf("Expect health check to bypass the queue, got %d",
+			health.Code)
+	}
+	w := serve()
+	if w.Code != http.StatusServiceUnavailable ||
+		w.Header().Get("Retry-After") != "2" {
+		t.Fatalf("Expect 503 with Retry-After: 2, got %d %v", w.Code,
+			w.Header())
+	}
+	block <- true
+	<-started
+	block <- true
+	if w = <-queued; w.Code != http.StatusOK {
+		t.Fatalf("Expect queued request served, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	(&LoadShedder{}).Wrap(HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request, kvpairs map[string]string) {
+		w.WriteHeader(http.StatusNoContent)
+	})).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil),
+		map[string]string{})
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expect no limit without MaxConcurrent, got %d", w.Code)
+	}
+}
+
+func TestSLO(t *testing.T) {
+	// OnAlert blocks until received, which serve must not wait for
+	alerts := make(chan SLOStatus)
+	slo := &SLO{Name: "kv", Availability: 0.9, AlertBurnRate: 2.5,
+		OnAlert: func(s SLOStatus) { alerts <- s }}
+	status := http.StatusOK
+	h := slo.Wrap(HandlerFunc(func(w http.ResponseWriter, r *http.Request,
+		kvpairs map[string]string) {
+		w.WriteHeader(status)
+	}))
+	serve := func() {
+		h.ServeHTTP(httptest.NewRecorder(),
+			httptest.NewRequest(http.MethodGet, "/", nil), nil)
+	}
+	for i := 0; i < 8; i++ {
+		serve()
+	}
+	status = http.StatusInternalServerError
+	serve()
+	serve()
+	s := slo.Status()
+	if s.Requests != 10 || s.Errors != 2 || s.AvailabilityBurnRate < 1.99 {
+		t.Fatalf("Unexpected status %+v", s)
+	}
+	select {
+	case a := <-alerts:
+		t.Fatalf("Expect no alert yet, got %+v", a)
+	default:
+	}
+	serve()
+	select {
+	case <-alerts:
+	case <-time.After(time.Second):
+		t.Fatal("Expect one alert")
+	}
+}
+
+func TestDebugHandler(t *testing.T) {
+	h := DebugHandler(func(r *http.Request) bool {
+		return r.Header.Get("X-Debug-Token") == "secret"
+	})
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/_debug/goroutines", nil)
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expect 404 without token, got %d", w.Code)
+	}
+	r.Header.Set("X-Debug-Token", "secret")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK ||
+		!strings.Contains(w.Body.String(), "TestDebugHandler") {
+		t.Fatalf("Expect goroutine dump, got %d", w.Code)
+	}
+}
+
+// FailModel fails every Get.
+type FailModel struct {
+	Model
+}
+
+func (t *FailModel) Get(kvpairs map[string]string) (interface{}, error) {
+	return nil, errors.New("database is down")
+}
+
+func TestErrorReporter(t *testing.T) {
+	incidents := make(chan Incident, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		incident := Incident{}
+		json.NewDecoder(r.Body).Decode(&incident)
+		incidents <- incident
+	}))
+	defer hook.Close()
+	h, err := NewRESTHandler("report", &FailModel{},
+		WithDataType(KeyValue{}), WithKey(KEY),
+		WithErrorReporter(&WebhookReporter{URL: hook.URL}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/1", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	h.ServeHTTP(httptest.NewRecorder(), r, map[string]string{KEY: "1"})
+	select {
+	case incident := <-incidents:
+		if incident.Error != "database is down" ||
+			incident.Request.Header.Get("Authorization") != REDACTED ||
+			!strings.Contains(incident.Stack, "ServeHTTP") {
+			t.Fatalf("Unexpected incident %+v", incident)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expect incident reported")
+	}
+	h.ServeHTTP(httptest.NewRecorder(),
+		httptest.NewRequest(http.MethodDelete, "/", nil),
+		map[string]string{})
+	select {
+	case incident := <-incidents:
+		t.Fatalf("Expect 4xx not reported, got %+v", incident)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// reports beyond MaxInFlight are dropped
+	release := make(chan bool)
+	slow := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+	defer slow.Close()
+	defer close(release)
+	reporter := &WebhookReporter{URL: slow.URL, MaxInFlight: 1}
+	for i := 0; i < 3; i++ {
+		reporter.Report(context.Background(), errors.New("down"), nil,
+			RequestInfo{})
+	}
+	if n := reporter.Dropped(); n != 2 {
+		t.Fatalf("Expect 2 reports dropped, got %d", n)
+	}
+}
+
+func TestCapture(t *testing.T) {
+	type Account struct {
+		Name     string `json:"name"`
+		Password string `json:"password" calm:"pii"`
+	}
+	capture := &Capture{Size: 2, DataType: reflect.TypeOf(Account{})}
+	h := capture.Wrap(HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request, kvpairs map[string]string) {
+		b, _ := ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(b)
+	}))
+	for _, name := range []string{"a", "b", "c"} {
+		r := httptest.NewRequest(http.MethodPost, "/accounts",
+			strings.NewReader(`{"name":"`+name+`","password":"secret"}`))
+		r.Header.Set("Authorization", "Bearer secret")
+		h.ServeHTTP(httptest.NewRecorder(), r, map[string]string{})
+	}
+	list := capture.Exchanges()
+	if len(list) != 2 || !strings.Contains(list[0].RequestBody, `"b"`) ||
+		!strings.Contains(list[1].ResponseBody, `"c"`) {
+		t.Fatalf("Unexpected exchanges %+v", list)
+	}
+	for _, e := range list {
+		if strings.Contains(e.RequestBody+e.ResponseBody, "secret") ||
+			e.RequestHeader.Get("Authorization") != REDACTED {
+			t.Fatalf("Expect PII scrubbed, got %+v", e)
+		}
+	}
+	serve := func() int {
+		w := httptest.NewRecorder()
+		capture.ServeHTTP(w, httptest.NewRequest(http.MethodGet,
+			"/_capture", nil), map[string]string{})
+		return w.Code
+	}
+	if code := serve(); code != http.StatusNotFound {
+		t.Fatalf("Expect 404 without Authorize, got %d", code)
+	}
+	capture.Authorize = func(r *http.Request) bool { return true }
+	if code := serve(); code != http.StatusOK {
+		t.Fatalf("Expect 200, got %d", code)
+	}
+	// only MaxBody bytes are kept, but next reads the whole body
+	capture = &Capture{MaxBody: 4}
+	w := httptest.NewRecorder()
+	capture.Wrap(h).ServeHTTP(w, httptest.NewRequest(http.MethodPost,
+		"/accounts", strings.NewReader("0123456789")),
+		map[string]string{})
+	list = capture.Exchanges()
+	if w.Body.String() != "0123456789" || len(list) != 1 ||
+		list[0].RequestBody != "0123" {
+		t.Fatalf("Expect body truncated in capture only, got %s %+v",
+			w.Body.String(), list)
+	}
+}
+
+func TestFaultInjector(t *testing.T) {
+	next := HandlerFunc(func(w http.ResponseWriter, r *http.Request,
+		kvpairs map[string]string) {
+		w.Write([]byte(`{"id":1,"value":"One"}`))
+	})
+	f := &FaultInjector{ErrorStatus: http.StatusBadGateway, ErrorRate: 0.5,
+		Rand: func() float64 { return 0.2 }}
+	w := httptest.NewRecorder()
+	f.Wrap(next).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil),
+		nil)
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("Expect injected 502, got %d", w.Code)
+	}
+	f = &FaultInjector{TruncateRate: 1}
+	s := httptest.NewServer(goroute.Handle("/", ".*", f.Wrap(next)))
+	defer s.Close()
+	res, err := http.Get(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadAll(res.Body); err == nil {
+		t.Fatalf("Expect truncated body, got `%s'", b)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	s := JSONSchema(reflect.TypeOf([]KeyValue{}))
+	if err := Validate(s, []byte(`[{"id":1,"value":"One"}]`)); err != nil {
+		t.Fatal(err)
+	}
+	err := Validate(s, []byte(`[{"id":1.5,"value":"One"}]`))
+	if err == nil || !strings.HasPrefix(err.Error(), "/0/id:") {
+		t.Fatalf("Expect error at /0/id, got %v", err)
+	}
+}
+
+// DownModel fails every Get while down.
+type DownModel struct {
+	Model
+	down bool
+}
+
+func (t *DownModel) Get(kvpairs map[string]string) (interface{}, error) {
+	if t.down {
+		return nil, errors.New("database is down")
+	}
+	return t.Model.Get(kvpairs)
+}
+
+func (t *DownModel) GetAll(kvpairs map[string]string) (interface{}, error) {
+	if t.down {
+		return nil, errors.New("database is down")
+	}
+	return t.Model.GetAll(kvpairs)
+}
+
+func (t *DownModel) Post(kvpairs map[string]string, v interface{}) (
+	string, error) {
+	if t.down {
+		return "", errors.New("database is down")
+	}
+	return t.Model.Post(kvpairs, v)
+}
+
+func TestStaleCache(t *testing.T) {
+	dataStore[58] = "Fresh"
+	m := &DownModel{}
+	h, err := NewRESTHandler("stale", m, WithDataType(KeyValue{}),
+		WithKey(KEY), WithCache(memcache.New("127.0.0.1:11211"), 60),
+		WithStaleCache(3600))
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(id string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stale/"+id,
+			nil), map[string]string{KEY: id})
+		return w
+	}
+	w := get("58")
+	if w.Code != http.StatusOK || w.Header().Get(STALE_HEADER) != "" {
+		t.Fatalf("Expect fresh response, got %d %v", w.Code, w.Header())
+	}
+	// expire the cached response but not its stale copy
+	r := httptest.NewRequest(http.MethodGet, "/stale/58", nil)
+	if err = h.Cache.Delete(h.makeKey(r, map[string]string{})); err != nil {
+		t.Fatal(err)
+	}
+	m.down = true
+	w = get("58")
+	if w.Code != http.StatusOK || w.Header().Get(STALE_HEADER) != "true" ||
+		!strings.Contains(w.Body.String(), "Fresh") {
+		t.Fatalf("Expect stale response, got %d %v %s", w.Code, w.Header(),
+			w.Body.String())
+	}
+	if w = get("59"); w.Code != http.StatusInternalServerError {
+		t.Fatalf("Expect 500 without stale copy, got %d", w.Code)
+	}
+}
+
+func TestFallback(t *testing.T) {
+	h, err := NewRESTHandler("fallback", &DownModel{down: true},
+		WithDataType(KeyValue{}), WithKey(KEY),
+		WithFallback(&Fallback{Class: 5, Item: true,
+			StatusCode: http.StatusServiceUnavailable,
+			Body:       Msg{"Under maintenance"}}),
+		WithFallback(&Fallback{Class: 5, Collection: true,
+			Body: []KeyValue{}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/1", nil),
+		map[string]string{KEY: "1"})
+	if w.Code != http.StatusServiceUnavailable ||
+		!strings.Contains(w.Body.String(), "maintenance") {
+		t.Fatalf("Expect maintenance message, got %d %s", w.Code,
+			w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil),
+		map[string]string{})
+	if w.Code != http.StatusOK || w.Body.String() != "[]" {
+		t.Fatalf("Expect empty collection, got %d %s", w.Code,
+			w.Body.String())
+	}
+	// a failed write must not look successful
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/",
+		strings.NewReader(`{"id":79,"value":"x"}`)), map[string]string{})
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("Expect 500, got %d %s", w.Code, w.Body.String())
+	}
+	// 4xx are not covered
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/1",
+		strings.NewReader("[]")), map[string]string{KEY: "1"})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expect 400, got %d", w.Code)
+	}
+}
+
+// SchemaModel reports its schema version.
+type SchemaModel struct {
+	Model
+	version string
+}
+
+func (t *SchemaModel) SchemaVersion() (string, error) {
+	return t.version, nil
+}
+
+func TestSchemaGuard(t *testing.T) {
+	dataStore[60] = "Guarded"
+	m := &SchemaModel{version: "41"}
+	refused, err := NewRESTHandler("guard", m, WithDataType(KeyValue{}),
+		WithKey(KEY), WithSchemaGuard("42", false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewRESTHandler("guard", m, WithDataType(KeyValue{}),
+		WithKey(KEY), WithSchemaGuard("42", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := func(method string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, "/60",
+			strings.NewReader(`{"value":"Guarded"}`)),
+			map[string]string{KEY: "60"})
+		return w.Code
+	}
+	w := httptest.NewRecorder()
+	refused.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/60", nil),
+		map[string]string{KEY: "60"})
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expect reads refused, got %d", w.Code)
+	}
+	if status := serve(http.MethodGet); status != http.StatusOK {
+		t.Fatalf("Expect reads served, got %d", status)
+	}
+	status := serve(http.MethodPut)
+	if status != http.StatusServiceUnavailable {
+		t.Fatalf("Expect writes refused, got %d", status)
+	}
+	m.version = "42"
+	if err = h.CheckSchema(); err != nil {
+		t.Fatal(err)
+	}
+	if status := serve(http.MethodPut); status != http.StatusOK {
+		t.Fatalf("Expect writes served, got %d", status)
+	}
+	if err = refused.CheckSchema(); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	refused.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/60", nil),
+		map[string]string{KEY: "60"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expect reads resumed, got %d", w.Code)
+	}
+}
+
+func TestOptionsPreflight(t *testing.T) {
+	dataStore[61] = "Head"
+	h, err := NewRESTHandler("preflight", &Model{},
+		WithDataType(KeyValue{}), WithKey(KEY))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.ExtraMethods = []string{"LOCK"}
+	r := httptest.NewRequest(http.MethodOptions, "/", nil)
+	r.Header.Set("Origin", "http://example.com")
+	r.Header.Set("Access-Control-Request-Method", "POST")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r, map[string]string{})
+	expect := "GET, HEAD, POST, OPTIONS, LOCK"
+	allow := w.Header().Get("Access-Control-Allow-Methods")
+	if allow != expect {
+		t.Fatalf("Expect %s, got %s", expect, allow)
+	}
+	if w.Code != http.StatusNoContent ||
+		w.Header().Get("Content-Length") != "" {
+		t.Fatalf("Expect 204 without Content-Length, got %d %v", w.Code,
+			w.Header())
+	}
+	s := httptest.NewServer(goroute.Handle(
+		"/", `(?P<key>[[:alnum:]]*)`, h))
+	defer s.Close()
+	res, err := http.Head(s.URL + "/61")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK || res.ContentLength == 0 {
+		t.Fatalf("Expect HEAD served, got %d %d", res.StatusCode,
+			res.ContentLength)
+	}
+}
+
+func TestStatusPolicy(t *testing.T) {
+	delete(dataStore, 62)
+	h, err := NewRESTHandler("strict", &Model{}, WithDataType(KeyValue{}),
+		WithKey(KEY), WithStatusPolicy(STATUS_STRICT))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := func(method, body string,
+		kvpairs map[string]string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, "/62",
+			strings.NewReader(body)), kvpairs)
+		return w
+	}
+	w := serve(http.MethodPost, `{"id":62,"value":"Strict"}`,
+		map[string]string{})
+	if w.Code != http.StatusCreated || w.Header().Get("Location") == "" {
+		t.Fatalf("Expect 201 with Location, got %d %v", w.Code, w.Header())
+	}
+	w = serve(http.MethodPut, `{"value":"Stricter"}`,
+		map[string]string{KEY: "62"})
+	if w.Code != http.StatusNoContent || w.Body.Len() != 0 {
+		t.Fatalf("Expect 204, got %d %s", w.Code, w.Body.String())
+	}
+	w = serve(http.MethodDelete, "", map[string]string{KEY: "62"})
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expect 204, got %d", w.Code)
+	}
+}
+
+func TestReadJSON(t *testing.T) {
+	for body, expect := range map[string]string{
+		"":                        EMPTY_BODY,
+		" \n":                     EMPTY_BODY,
+		`{"value":"a"} {}`:        TRAILING_DATA,
+		`{"value":"a"}x`:          TRAILING_DATA,
+		`{"value":1}`:             TYPE_MISMATCH,
+		`{"value":`:               "unexpected EOF",
+		`{"value":"a"}` + "\n\t ": "",
+	} {
+		r := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(body))
+		_, err := readJSON(&KeyValue{}, r, false, false)
+		if expect == "" {
+			if err != nil {
+				t.Fatalf("%q: %v", body, err)
+			}
+			continue
+		}
+		e, ok := err.(*Error)
+		if !ok || e.StatusCode != http.StatusBadRequest ||
+			!strings.Contains(e.Message, expect) {
+			t.Fatalf("%q: expect 400 %s, got %v", body, expect, err)
+		}
+	}
+}
+
+func TestCharset(t *testing.T) {
+	for _, test := range []struct {
+		contentType, body string
+		status            int
+	}{
+		{"application/json", "\xef\xbb\xbf{\"value\":\"a\"}", 0},
+		{"application/json; charset=UTF-8", `{"value":"a"}`, 0},
+		{"application/json; charset=utf-16", `{"value":"a"}`,
+			http.StatusUnsupportedMediaType},
+		{"application/json", "\xff\xfe{\x00}\x00",
+			http.StatusUnsupportedMediaType},
+	} {
+		r := httptest.NewRequest(http.MethodPut, "/",
+			strings.NewReader(test.body))
+		r.Header.Set("Content-Type", test.contentType)
+		v := &KeyValue{}
+		_, err := readJSON(v, r, false, false)
+		if test.status == 0 {
+			if err != nil || v.Value != "a" {
+				t.Fatalf("%q: %v", test.body, err)
+			}
+			continue
+		}
+		if e, ok := err.(*Error); !ok || e.StatusCode != test.status {
+			t.Fatalf("%q: expect %d, got %v", test.body, test.status, err)
+		}
+	}
+}
+
+// BodyModel keeps the raw body of the last Post.
+type BodyModel struct {
+	Model
+	body []byte
+}
+
+func (t *BodyModel) Post(kvpairs map[string]string, v interface{}) (
+	string, error) {
+	t.body = RawBody(kvpairs)
+	return "1", nil
+}
+
+func TestKeepBody(t *testing.T) {
+	m := &BodyModel{}
+	h, err := NewRESTHandler("body", m, WithDataType(KeyValue{}),
+		WithKey(KEY), WithKeepBody())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `{"value": "signed", "id": 1}`
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(
+		http.MethodPost, "/", strings.NewReader(body)), map[string]string{})
+	if string(m.body) != body {
+		t.Fatalf("Expect %s, got %s", body, m.body)
+	}
+	h.KeepBody = false
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(
+		http.MethodPost, "/?_body=forged", strings.NewReader(body)),
+		map[string]string{})
+	if m.body != nil {
+		t.Fatalf("Expect no body, got %s", m.body)
+	}
+	h.KeepBody = true
+	h.ComputedSchema = Schema{"size": Schema{"type": "integer"}}
+	body = `{"value": "signed", "id": 1, "size": 6}`
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(
+		http.MethodPost, "/", strings.NewReader(body)), map[string]string{})
+	if string(m.body) != body {
+		t.Fatalf("Expect the body as sent, got %s", m.body)
+	}
+}
+
+func TestExampleMock(t *testing.T) {
+	h, err := NewRESTHandler("mock", nil, WithDataType(KeyValue{}),
+		WithKey(KEY),
+		WithExample(http.MethodGet, true, nil, KeyValue{7, "Seven"}),
+		WithExample(http.MethodPost, false, KeyValue{8, "Eight"},
+			map[string]string{"id": "8"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	intro := h.SelfIntro()
+	if e := intro.Item[http.MethodGet].Example; e == nil ||
+		e.Response != (KeyValue{7, "Seven"}) {
+		t.Fatalf("Expect example in SelfIntro, got %v", e)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/7", nil),
+		map[string]string{KEY: "7"})
+	if w.Body.String() != `{"id":7,"value":"Seven"}` {
+		t.Fatalf("Unexpected mock response %s", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodOptions, "/7", nil),
+		map[string]string{KEY: "7"})
+	if allow := w.Header().Get("Allow"); allow != "GET, HEAD, OPTIONS" {
+		t.Fatalf("Expect Allow: GET, HEAD, OPTIONS, got %s", allow)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/7", nil),
+		map[string]string{KEY: "7"})
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expect 405, got %d", w.Code)
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	h, err := NewRESTHandler("sandbox", &FailModel{},
+		WithDataType(KeyValue{}), WithKey(KEY),
+		WithSandbox(true, &KeyValue{Value: "One"}, &KeyValue{Value: "Two"}),
+		WithReadModel(&FailModel{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil),
+		map[string]string{})
+	expect := `[{"id":0,"value":"One"},{"id":0,"value":"Two"}]`
+	if w.Body.String() != expect {
+		t.Fatalf("Expect %s, got %s", expect, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/2", nil),
+		map[string]string{KEY: "2"})
+	if w.Body.String() != `{"id":0,"value":"Two"}` {
+		t.Fatalf("Unexpected sandbox response %s", w.Body.String())
+	}
+}
+
+type Priced struct {
+	ID    int64  `json:"id" calm:"id"`
+	Name  string `json:"name"`
+	Price int    `json:"price" calm:"flag=pricing"`
+}
+
+// PricedModel has a single item.
+type PricedModel struct {
+	Model
+}
+
+func (t *PricedModel) Get(kvpairs map[string]string) (interface{}, error) {
+	return &Priced{1, "Tea", 30}, nil
+}
+
+func TestFeatureFlags(t *testing.T) {
+	flags := &Flags{
+		Provider: StaticFlags{
+			"pricing": {Principals: []string{"alice"}},
+			"beta":    {Percent: 100},
+		},
+		Principal: func(r *http.Request, kvpairs map[string]string) string {
+			return r.Header.Get("X-User")
+		},
+	}
+	h, err := NewRESTHandler("flags", &PricedModel{},
+		WithDataType(Priced{}), WithKey(KEY), WithFlags(flags))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gate := (&FeatureGate{flags, "beta"}).Wrap(h)
+	get := func(user string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/1", nil)
+		r.Header.Set("X-User", user)
+		w := httptest.NewRecorder()
+		gate.ServeHTTP(w, r, map[string]string{KEY: "1"})
+		return w
+	}
+	if w := get(""); w.Code != http.StatusNotFound {
+		t.Fatalf("Expect 404 for anonymous, got %d", w.Code)
+	}
+	if w := get("bob"); w.Body.String() != `{"id":1,"name":"Tea"}` {
+		t.Fatalf("Expect price hidden, got %s", w.Body.String())
+	}
+	if w := get("alice"); !strings.Contains(w.Body.String(), `"price":30`) {
+		t.Fatalf("Expect price shown, got %s", w.Body.String())
+	}
+	// writes answer with what GET would send
+	m, _ := NewMemoryModel(KEY, reflect.TypeOf(Priced{}))
+	h, err = NewRESTHandler("flags", m, WithDataType(Priced{}), WithKey(KEY),
+		WithFlags(flags), WithReturnCreated())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/",
+		strings.NewReader(`{"name":"Coffee","price":40}`))
+	r.Header.Set("X-User", "bob")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r, map[string]string{})
+	if w.Code != http.StatusCreated ||
+		w.Body.String() != `{"id":1,"name":"Coffee"}` {
+		t.Fatalf("Expect price hidden on creation, got %d %s", w.Code,
+			w.Body.String())
+	}
+	h.ReturnDiff = true
+	r = httptest.NewRequest(http.MethodPut, "/1",
+		strings.NewReader(`{"name":"Latte","price":50}`))
+	r.Header.Set("X-User", "bob")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r, map[string]string{KEY: "1"})
+	if strings.Contains(w.Body.String(), "price") ||
+		!strings.Contains(w.Body.String(), "Latte") {
+		t.Fatalf("Expect price hidden in the diff, got %s", w.Body.String())
+	}
+}
+
+type Renamed struct {
+	ID       int64  `json:"id"`
+	FullName string `json:"full_name" calm:"was=name"`
+}
+
+// RenamedModel keeps a single Renamed.
+type RenamedModel struct {
+	Model
+	v Renamed
+}
+
+func (t *RenamedModel) Get(kvpairs map[string]string) (interface{}, error) {
+	return &t.v, nil
+}
+
+func (t *RenamedModel) Put(kvpairs map[string]string, v interface{}) error {
+	t.v = *v.(*Renamed)
+	return nil
+}
+
+func TestRenamedField(t *testing.T) {
+	m := &RenamedModel{}
+	h, err := NewRESTHandler("renamed", m, WithDataType(Renamed{}),
+		WithKey(KEY))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/1",
+		strings.NewReader(`{"id":1,"name":"John Lee"}`)),
+		map[string]string{KEY: "1"})
+	if m.v.FullName != "John Lee" {
+		t.Fatalf("Expect old name understood, got %+v %s", m.v,
+			w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/1", nil),
+		map[string]string{KEY: "1"})
+	expect := `{"full_name":"John Lee","id":1,"name":"John Lee"}`
+	if w.Body.String() != expect {
+		t.Fatalf("Expect %s, got %s", expect, w.Body.String())
+	}
+}
+
+func TestFieldPolicy(t *testing.T) {
+	SetFieldPolicy("v2", FIELDS_STRICT)
+	h, err := NewRESTHandler("fields", &RenamedModel{},
+		WithDataType(Renamed{}), WithKey(KEY))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `{"id":1,"full_name":"John Lee","nickname":"J"}`
+	for path, expect := range map[string]int{
+		"/v1/fields/1": http.StatusOK,
+		"/fields/1":    http.StatusOK,
+		"/v2/fields/1": http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPut, path,
+			strings.NewReader(body)), map[string]string{KEY: "1"})
+		if w.Code != expect {
+			t.Fatalf("%s: expect %d, got %d %s", path, expect, w.Code,
+				w.Body.String())
+		}
+	}
+	h.FieldPolicy = FIELDS_LENIENT
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/v2/fields/1",
+		strings.NewReader(body)), map[string]string{KEY: "1"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expect override, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+// IndexModel creates objects on Put like a search index.
+type IndexModel struct {
+	Model
+	objects map[string]interface{}
+}
+
+func (t *IndexModel) Put(kvpairs map[string]string, v interface{}) error {
+	t.objects[kvpairs[KEY]] = v
+	return nil
+}
+
+func TestCompositeModel(t *testing.T) {
+	primary, _ := NewMemoryModel(KEY, reflect.TypeOf(Versioned{}))
+	search := &IndexModel{objects: make(map[string]interface{})}
+	m := &CompositeModel{Writers: []ModelInterface{primary, search},
+		Key: KEY}
+	primary.Post(nil, &Versioned{Name: "first"})
+	id, err := m.Post(nil, &Versioned{Name: "go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := search.objects[id].(*Versioned); id != "2" || !ok ||
+		v.ID != 2 {
+		t.Fatalf("Expect id 2 everywhere, got %s %+v", id, search.objects)
+	}
+	index, _ := NewMemoryModel(KEY, reflect.TypeOf(Versioned{}))
+	m = &CompositeModel{Writers: []ModelInterface{primary, index},
+		Key: KEY}
+	err = m.Put(map[string]string{KEY: id}, &Versioned{Name: "golang"})
+	e, ok := err.(*PartialError)
+	if !ok || len(e.Failed) != 1 || e.Failed[1] != ErrNotFound {
+		t.Fatalf("Expect partial failure of writer 1, got %v", err)
+	}
+	m.Partial = func(kvpairs map[string]string, err *PartialError) error {
+		return nil
+	}
+	if err = m.Delete(map[string]string{KEY: id}); err != nil {
+		t.Fatalf("Expect partial failure accepted, got %v", err)
+	}
+	if err = m.Delete(map[string]string{KEY: id}); err != ErrNotFound {
+		t.Fatalf("Expect primary failure returned, got %v", err)
+	}
+	if _, err = NewCompositeModel(nil); err == nil {
+		t.Fatal("Expect error without writers")
+	}
+	if _, err = (&CompositeModel{}).Get(nil); err == nil {
+		t.Fatal("Expect error without writers")
+	}
+	// Model fails to Put a Versioned
+	if m, err = NewCompositeModel(nil, primary, &Model{}); err != nil {
+		t.Fatal(err)
+	}
+	m.Key = KEY
+	h, err := NewRESTHandler("composite", m, WithDataType(Versioned{}),
+		WithKey(KEY))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/",
+		strings.NewReader(`{"name":"partial"}`)), map[string]string{})
+	if w.Code != http.StatusCreated ||
+		w.Header().Get("Warning") != PARTIAL_WARNING ||
+		!strings.Contains(w.Body.String(), `"3"`) {
+		t.Fatalf("Expect 201 with the id and a warning, got %d %v %s",
+			w.Code, w.Header(), w.Body.String())
+	}
+}
+
+func TestReadModel(t *testing.T) {
+	h, err := NewRESTHandler("cqrs", &Model{}, WithDataType(KeyValue{}),
+		WithKey(KEY), WithReadModel(&NamedModel{name: "projection"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataStore[63] = "Sixty-two"
+	defer delete(dataStore, 63)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/63",
+		strings.NewReader(`{"id":63,"value":"Sixty-three"}`)),
+		map[string]string{KEY: "63"})
+	if dataStore[63] != "Sixty-three" {
+		t.Fatalf("Expect written to Model, got %d %s", w.Code,
+			w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/63", nil),
+		map[string]string{KEY: "63"})
+	if w.Body.String() != `"projection"` {
+		t.Fatalf("Expect read from ReadModel, got %s", w.Body.String())
+	}
+}
+
+func TestEventModel(t *testing.T) {
+	m := &EventModel{Resource: "events", Key: KEY,
+		DataType: reflect.TypeOf(KeyValue{}), Store: NewMemoryEventStore(),
+		Snapshots: 1}
+	h, err := NewRESTHandler("events", m, WithDataType(KeyValue{}),
+		WithKey(KEY), WithVersions(m.Versions()),
+		WithPrincipal(func(r *http.Request) string {
+			return r.Header.Get("X-User")
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := m.Post(nil, &KeyValue{Value: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kvpairs := map[string]string{KEY: id}
+	m.Put(kvpairs, &KeyValue{Value: "b"})
+	if v, _ := m.Get(kvpairs); v.(*KeyValue).Value != "b" {
+		t.Fatalf("Expect b, got %+v", v)
+	}
+	m.Delete(kvpairs)
+	if _, err = m.Get(kvpairs); err != ErrNotFound {
+		t.Fatalf("Expect deleted, got %v", err)
+	}
+	if id, _ = m.Post(nil, &KeyValue{Value: "c"}); id != "2" {
+		t.Fatalf("Expect new id 2, got %s", id)
+	}
+	w := httptest.NewRecorder()
+	h.History().ServeHTTP(w, httptest.NewRequest(http.MethodGet,
+		"/1/_history", nil), map[string]string{KEY: "1"})
+	list := []*Revision{}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list) != 3 || string(list[1].Data) != `{"id":0,"value":"b"}` ||
+		!list[2].Deleted {
+		t.Fatalf("Expect 3 revisions, got %s", w.Body.String())
+	}
+	r := httptest.NewRequest(http.MethodPut, "/2?_principal=mallory",
+		strings.NewReader(`{"id":2,"value":"d"}`))
+	r.Header.Set("X-User", "alice")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r, map[string]string{KEY: "2"})
+	events, _ := m.Store.Load("events", "2", 1)
+	if len(events) != 1 || events[0].Author != "alice" {
+		t.Fatalf("Expect an event by alice, got %d %+v", w.Code, events)
+	}
+	// the snapshot of 2 is evicted by the one of 1, then rebuilt
+	m.Get(map[string]string{KEY: "1"})
+	if v, _ := m.Get(map[string]string{KEY: "2"}); v.(*KeyValue).Value !=
+		"d" {
+		t.Fatalf("Expect d, got %+v", v)
+	}
+	// ids posted explicitly are skipped
+	m = &EventModel{Resource: "events", Key: KEY,
+		DataType: reflect.TypeOf(Versioned{}), Store: NewMemoryEventStore()}
+	if id, err = m.Post(nil, &Versioned{ID: 2}); err != nil || id != "2" {
+		t.Fatalf("Expect id 2, got %s %v", id, err)
+	}
+	if id, err = m.Post(nil, &Versioned{}); err != nil || id != "3" {
+		t.Fatalf("Expect new id 3, got %s %v", id, err)
+	}
+}
+
+type Versioned struct {
+	ID      int64  `json:"id" calm:"id"`
+	Version int64  `json:"version" calm:"version"`
+	Name    string `json:"name"`
+}
+
+func TestVersionField(t *testing.T) {
+	m, _ := NewMemoryModel(KEY, reflect.TypeOf(Versioned{}))
+	h, err := NewRESTHandler("versioned", m, WithDataType(Versioned{}),
+		WithKey(KEY))
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(method, body string) int {
+		w := httptest.NewRecorder()
+		kvpairs := map[string]string{KEY: "1"}
+		if method == http.MethodPost {
+			kvpairs = map[string]string{}
+		}
+		h.ServeHTTP(w, httptest.NewRequest(method, "/versioned",
+			strings.NewReader(body)), kvpairs)
+		return w.Code
+	}
+	send(http.MethodPost, `{"name":"a"}`)
+	for i, c := range []struct {
+		method, body string
+		expect       int
+	}{
+		{http.MethodPut, `{"version":1,"name":"b"}`, http.StatusOK},
+		{http.MethodPut, `{"version":1,"name":"c"}`, http.StatusConflict},
+		{http.MethodPatch, `[{"op":"replace","path":"/version","value":1}]`,
+			http.StatusConflict},
+		{http.MethodPatch, `[{"op":"replace","path":"/version","value":2},` +
+			`{"op":"replace","path":"/name","value":"d"}]`, http.StatusOK},
+	} {
+		if code := send(c.method, c.body); code != c.expect {
+			t.Fatalf("%d: expect %d, got %d", i, c.expect, code)
+		}
+	}
+	v, _ := m.Get(map[string]string{KEY: "1"})
+	if o := v.(*Versioned); o.Version != 3 || o.Name != "d" {
+		t.Fatalf("Expect version 3 of d, got %+v", o)
+	}
+}
+
+// MergeModel merges conflicting PATCHes known to be based on a
+// recorded version.
+type MergeModel struct {
+	*MemoryModel
+}
+
+func (t *MergeModel) Merge(original, theirs, mine interface{}) (
+	interface{}, error) {
+	if original == nil {
+		return nil, ErrVersionConflict
+	}
+	return mine, nil
+}
+
+func TestMerge(t *testing.T) {
+	m, _ := NewMemoryModel(KEY, reflect.TypeOf(Versioned{}))
+	var versions VersionStore
+	patch := func(body string) int {
+		h, err := NewRESTHandler("merged", &MergeModel{m},
+			WithDataType(Versioned{}), WithKey(KEY), WithVersions(versions))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPatch, "/merged/1",
+			strings.NewReader(body)), map[string]string{KEY: "1"})
+		return w.Code
+	}
+	versions = NewMemoryVersionStore()
+	m.Post(nil, &Versioned{Name: "a"})
+	versions.Append("merged", "1", &Revision{
+		Data: json.RawMessage(`{"id":1,"version":1,"name":"a"}`)})
+	m.Put(map[string]string{KEY: "1"}, &Versioned{Version: 2, Name: "b"})
+	stale := `[{"op":"replace","path":"/version","value":1},` +
+		`{"op":"replace","path":"/name","value":"c"}]`
+	if code := patch(stale); code != http.StatusOK {
+		t.Fatalf("Expect merged, got %d", code)
+	}
+	v, _ := m.Get(map[string]string{KEY: "1"})
+	if o := v.(*Versioned); o.Version != 3 || o.Name != "c" {
+		t.Fatalf("Expect version 3 of c, got %+v", o)
+	}
+	versions = nil
+	if code := patch(stale); code != http.StatusConflict {
+		t.Fatalf("Expect conflict without original, got %d", code)
+	}
+}
+
+func TestLinkHeaders(t *testing.T) {
+	for name, tmpl := range map[string]string{
+		"linked-item":   "/linked/{key}",
+		"linked":        "/linked/",
+		"linked-schema": "/schemas/linked",
+	} {
+		if err := NameRoute(name, tmpl); err != nil {
+			t.Fatal(err)
+		}
+		defer RemoveRoute(name)
+	}
+	h, err := NewRESTHandler("linked", &Model{}, WithDataType(KeyValue{}),
+		WithKey(KEY), WithRoute("linked-item"),
+		WithLinks("linked", "linked-schema"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataStore[64] = "Sixty-four"
+	defer delete(dataStore, 64)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet,
+		"http://example.com/linked/64", nil), map[string]string{KEY: "64"})
+	expect := []string{
+		`<http://example.com/linked/64>; rel="edit"`,
+		`<http://example.com/linked/>; rel="collection"`,
+		`<http://example.com/schemas/linked>; rel="describedby"`,
+	}
+	if links := w.Header()["Link"]; !reflect.DeepEqual(links, expect) {
+		t.Fatalf("Expect %v, got %v", expect, links)
+	}
+	if allow := w.Header().Get("Allow"); !strings.Contains(allow, "PUT") {
+		t.Fatalf("Expect Allow, got %q", allow)
+	}
+	w = httptest.NewRecorder()
+	h.SchemaHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet,
+		"/schemas/linked", nil), map[string]string{})
+	if !strings.Contains(w.Body.String(), `"value"`) {
+		t.Fatalf("Expect schema, got %s", w.Body.String())
+	}
+}
+
+func TestTimingHeaders(t *testing.T) {
+	h, err := NewRESTHandler("timing", &Model{}, WithDataType(KeyValue{}),
+		WithKey(KEY), WithCache(memcache.New("127.0.0.1:11211"), 60),
+		WithTiming(TimingOnRequest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataStore[65] = "Sixty-five"
+	defer delete(dataStore, 65)
+	// memcache outlives test runs
+	path := fmt.Sprintf("/timing/65?run=%d", time.Now().UnixNano())
+	get := func(debug bool) http.Header {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if debug {
+			r.Header.Set(DEBUG_HEADER, "1")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r, map[string]string{KEY: "65"})
+		return w.Header()
+	}
+	header := get(true)
+	if header.Get(CACHE_HEADER) != CACHE_MISS ||
+		header.Get(MODEL_TIME_HEADER) == "" ||
+		header.Get(RUNTIME_HEADER) == "" {
+		t.Fatalf("Expect miss with timings, got %v", header)
+	}
+	header = get(true)
+	if header.Get(CACHE_HEADER) != CACHE_HIT ||
+		header.Get(MODEL_TIME_HEADER) != "" {
+		t.Fatalf("Expect hit, got %v", header)
+	}
+	if header = get(false); header.Get(RUNTIME_HEADER) != "" {
+		t.Fatalf("Expect no timings, got %v", header)
+	}
+}
+
+func TestTTLFunc(t *testing.T) {
+	h, err := NewRESTHandler("ttl", &Model{}, WithDataType(KeyValue{}),
+		WithKey(KEY), WithCache(memcache.New("127.0.0.1:11211"), 0),
+		WithTTLFunc(func(r *http.Request, kvpairs map[string]string) int32 {
+			if kvpairs["tenant"] == "cached" {
+				return 60
+			}
+			return 0
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer delete(dataStore, 66)
+	run := time.Now().UnixNano()
+	get := func(tenant string) string {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet,
+			fmt.Sprintf("/ttl/66?tenant=%s&run=%d", tenant, run), nil),
+			map[string]string{KEY: "66"})
+		return w.Body.String()
+	}
+	for _, tenant := range []string{"cached", "fresh"} {
+		dataStore[66] = "Old"
+		get(tenant)
+		dataStore[66] = "New"
+		cached := strings.Contains(get(tenant), "Old")
+		if cached != (tenant == "cached") {
+			t.Fatalf("%s: expect cached %v", tenant, !cached)
+		}
+	}
+}
+
+func TestHashRing(t *testing.T) {
+	servers := []string{"10.0.0.1:11211", "10.0.0.2:11211",
+		"10.0.0.3:11211"}
+	before, err := NewHashRing(servers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, _ := NewHashRing(servers[:2]...)
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i)
+		a, _ := before.PickServer(key)
+		b, _ := after.PickServer(key)
+		if a.String() != servers[2] && a.String() != b.String() {
+			moved++
+		}
+	}
+	if moved != 0 {
+		t.Fatalf("Expect only keys of the removed server moved, got %d",
+			moved)
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	cache, err := NewCache(CacheConfig{Servers: []string{"127.0.0.1:11211"},
+		Timeout: time.Second, Consistent: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewRESTHandler("stats", &Model{}, WithDataType(KeyValue{}),
+		WithKey(KEY), WithCache(cache, 60))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataStore[67] = "Sixty-seven"
+	defer delete(dataStore, 67)
+	path := fmt.Sprintf("/stats/67?run=%d", time.Now().UnixNano())
+	for i := 0; i < 2; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(
+			http.MethodGet, path, nil), map[string]string{KEY: "67"})
+	}
+	stats := h.CacheStats()
+	if stats.Gets != 2 || stats.Hits != 1 || stats.Sets != 1 ||
+		stats.Errors != 0 {
+		t.Fatalf("Expect 2 gets, 1 hit and 1 set, got %+v", stats)
+	}
+}
+
+func TestLocalCache(t *testing.T) {
+	h, err := NewRESTHandler("local", &Model{}, WithDataType(KeyValue{}),
+		WithKey(KEY), WithLocalCache(NewLocalCache(10), 60))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer delete(dataStore, 68)
+	get := func() string {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/local/68",
+			nil), map[string]string{KEY: "68"})
+		return w.Body.String()
+	}
+	dataStore[68] = "Old"
+	get()
+	dataStore[68] = "New"
+	if body := get(); !strings.Contains(body, "Old") {
+		t.Fatalf("Expect served from LocalCache, got %s", body)
+	}
+	c := NewLocalCache(1)
+	c.Set("a", []byte("a"), 60)
+	c.Set("b", []byte("b"), 60)
+	if c.Get("a") != nil || c.Get("b") == nil {
+		t.Fatal("Expect least recently used evicted")
+	}
+	// memcache hits are kept locally for the ttl of the request
+	h, err = NewRESTHandler("local", &Model{}, WithDataType(KeyValue{}),
+		WithKey(KEY), WithCache(memcache.New("127.0.0.1:11211"), 3600),
+		WithLocalCache(NewLocalCache(10), 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := fmt.Sprintf("local-ttl-%d", time.Now().UnixNano())
+	h.cacheSet(key, []byte("a"), 3600)
+	h.LocalCache.Delete(key)
+	if h.cacheGet(key, 1) == nil {
+		t.Fatal("Expect memcache hit")
+	}
+	item := h.LocalCache.items[key].Value.(*localItem)
+	if time.Until(item.expires) > time.Second {
+		t.Fatalf("Expect kept for a second, got until %v", item.expires)
+	}
+}
+
+func TestCacheDemotion(t *testing.T) {
+	// nothing listens on port 1
+	h, err := NewRESTHandler("demoted", &Model{}, WithDataType(KeyValue{}),
+		WithKey(KEY), WithCache(memcache.New("127.0.0.1:1"), 60),
+		WithLocalCache(NewLocalCache(10), 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataStore[69] = "Sixty-nine"
+	defer delete(dataStore, 69)
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet,
+			fmt.Sprintf("/demoted/69?i=%d", i), nil),
+			map[string]string{KEY: "69"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expect served without memcache, got %d", w.Code)
+		}
+	}
+	if n := h.CacheStats().Errors; n != CACHE_FAILURES {
+		t.Fatalf("Expect memcache skipped after %d errors, got %d",
+			CACHE_FAILURES, n)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	if err := NameRoute("purged-item", "/purged/{key}"); err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveRoute("purged-item")
+	h, err := NewRESTHandler("purged", &Model{}, WithDataType(KeyValue{}),
+		WithKey(KEY), WithRoute("purged-item"),
+		WithCache(memcache.New("127.0.0.1:11211"), 60),
+		WithLocalCache(NewLocalCache(10), 60))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Register(h); err != nil {
+		t.Fatal(err)
+	}
+	defer Unregister("purged")
+	// memcache outlives test runs
+	if err = h.PurgeAll(); err != nil {
+		t.Fatal(err)
+	}
+	defer delete(dataStore, 70)
+	get := func() string {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/purged/70",
+			nil), map[string]string{KEY: "70"})
+		return w.Body.String()
+	}
+	admin := PurgeHandler(func(r *http.Request) bool {
+		return r.Header.Get("Authorization") == "Bearer admin"
+	})
+	for i, purge := range []func() error{
+		func() error { return h.PurgeID("70") },
+		h.PurgeAll,
+		func() error {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost,
+				"/_purge?resource=purged&url=/purged/70", nil)
+			r.Header.Set("Authorization", "Bearer admin")
+			admin.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				return fmt.Errorf("%d %s", w.Code, w.Body.String())
+			}
+			return nil
+		},
+	} {
+		h.PurgeURL("/purged/70")
+		dataStore[70] = "Old"
+		get()
+		dataStore[70] = "New"
+		if body := get(); !strings.Contains(body, "Old") {
+			t.Fatalf("%d: expect cached, got %s", i, body)
+		}
+		if err = purge(); err != nil {
+			t.Fatal(err)
+		}
+		if body := get(); !strings.Contains(body, "New") {
+			t.Fatalf("%d: expect purged, got %s", i, body)
+		}
+	}
+	scoped := func() string {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet,
+			"/purged/70?verbose=1", nil),
+			map[string]string{KEY: "70", SUBJECT_KEY: "bob"})
+		return w.Body.String()
+	}
+	dataStore[70] = "Old"
+	scoped()
+	dataStore[70] = "New"
+	if body := scoped(); !strings.Contains(body, "Old") {
+		t.Fatalf("Expect scoped entry cached, got %s", body)
+	}
+	if err = h.PurgeID("70"); err != nil {
+		t.Fatal(err)
+	}
+	if body := scoped(); !strings.Contains(body, "New") {
+		t.Fatalf("Expect scoped entry purged, got %s", body)
+	}
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest(http.MethodPost,
+		"/_purge?resource=purged", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expect 404 without authorization, got %d", w.Code)
+	}
+}
+
+func TestPurgeProfiles(t *testing.T) {
+	h, err := NewRESTHandler("purged-profiles", &Model{},
+		WithDataType(KeyValue{}), WithKey(KEY),
+		WithLocalCache(NewLocalCache(10), 60),
+		WithProfile("short", &Profile{Fields: []string{"value"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer delete(dataStore, 80)
+	get := func() string {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/purged/80", nil)
+		r.Header.Set("Prefer", "profile=short")
+		h.ServeHTTP(w, r, map[string]string{KEY: "80"})
+		return w.Body.String()
+	}
+	dataStore[80] = "Old"
+	get()
+	dataStore[80] = "New"
+	if err = h.PurgeURL("/purged/80"); err != nil {
+		t.Fatal(err)
+	}
+	if body := get(); body != `{"value":"New"}` {
+		t.Fatalf("Expect purged, got %s", body)
+	}
+}
+
+func TestImmutable(t *testing.T) {
+	h, err := NewRESTHandler("immutable", &Model{},
+		WithDataType(KeyValue{}), WithKey(KEY),
+		WithCache(memcache.New("127.0.0.1:11211"), 1),
+		WithImmutable(Immutable))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataStore[71] = "Seventy-one"
+	defer delete(dataStore, 71)
+	path := fmt.Sprintf("/immutable/71?run=%d", time.Now().UnixNano())
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil),
+		map[string]string{KEY: "71"})
+	if w.Header().Get("Cache-Control") != IMMUTABLE_CACHE_CONTROL {
+		t.Fatalf("Expect immutable, got %v", w.Header())
+	}
+	key := h.makeKey(httptest.NewRequest(http.MethodGet, path, nil),
+		map[string]string{})
+	if _, err = h.Cache.Get(key); err != nil {
+		t.Fatalf("Expect cached, got %v", err)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/immutable/71",
+		strings.NewReader(`{"value":"Changed"}`)),
+		map[string]string{KEY: "71"})
+	if w.Code != http.StatusMethodNotAllowed || dataStore[71] != "Seventy-one" {
+		t.Fatalf("Expect 405, got %d", w.Code)
+	}
+	// objects are still created, and collections grow
+	defer delete(dataStore, 81)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/immutable",
+		strings.NewReader(`{"id":81,"value":"Eighty-one"}`)),
+		map[string]string{})
+	if w.Code != http.StatusOK || dataStore[81] != "Eighty-one" {
+		t.Fatalf("Expect created, got %d %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/immutable", nil),
+		map[string]string{})
+	if w.Header().Get("Cache-Control") != "" {
+		t.Fatalf("Expect collection not immutable, got %v", w.Header())
+	}
+	if h.ttl(nil, map[string]string{}) == NEVER_EXPIRE {
+		t.Fatal("Expect collection to expire")
+	}
+	for id, expect := range map[string]string{
+		"71": "GET, HEAD, OPTIONS",
+		"":   "GET, HEAD, POST, OPTIONS",
+	} {
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodOptions,
+			"/immutable/"+id, nil), map[string]string{KEY: id})
+		if allow := w.Header().Get("Allow"); allow != expect {
+			t.Fatalf("Expect Allow: %s, got %s", expect, allow)
+		}
+	}
+}
+
+func TestReturnDeleted(t *testing.T) {
+	m, _ := NewMemoryModel(KEY, reflect.TypeOf(Versioned{}))
+	h, err := NewRESTHandler("deleted", m, WithDataType(Versioned{}),
+		WithKey(KEY), WithReturnDeleted())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Post(nil, &Versioned{Version: 2, Name: "a"})
+	del := func(ifMatch string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodDelete, "/deleted/1", nil)
+		if ifMatch != "" {
+			r.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r, map[string]string{KEY: "1"})
+		return w
+	}
+	for ifMatch, expect := range map[string]int{
+		"":    http.StatusPreconditionRequired,
+		`"1"`: http.StatusPreconditionFailed,
+	} {
+		if w := del(ifMatch); w.Code != expect {
+			t.Fatalf("%q: expect %d, got %d", ifMatch, expect, w.Code)
+		}
+	}
+	w := del(`"2"`)
+	if w.Code != http.StatusOK ||
+		w.Body.String() != `{"id":1,"version":2,"name":"a"}` {
+		t.Fatalf("Expect deleted object, got %d %s", w.Code,
+			w.Body.String())
+	}
+	if _, err = m.Get(map[string]string{KEY: "1"}); err != ErrNotFound {
+		t.Fatalf("Expect deleted, got %v", err)
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calmtest
+
+import (
+	"github.com/4freewifi/gocalm"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type Book struct {
+	ID    int64  `json:"id"`
+	Title string `json:"title"`
+}
+
+// BookModel returns title as a number for book 2, breaking its
+// contract.
+type BookModel struct {
+	gocalm.ModelInterface
+}
+
+func (t *BookModel) Get(kvpairs map[string]string) (interface{}, error) {
+	if kvpairs["id"] == "2" {
+		return map[string]interface{}{"id": 2, "title": 2}, nil
+	}
+	return &Book{1, "Walden"}, nil
+}
+
+func (t *BookModel) GetAll(kvpairs map[string]string) (interface{}, error) {
+	return []Book{{1, "Walden"}}, nil
+}
+
+// recorder collects failures instead of failing the test
+type recorder struct {
+	testing.TB
+	errors []string
+}
+
+func (t *recorder) Errorf(format string, args ...interface{}) {
+	t.errors = append(t.errors, format)
+}
+
+func (t *recorder) Helper() {}
+
+func TestCheckContract(t *testing.T) {
+	h, err := gocalm.NewRESTHandler("books", &BookModel{},
+		gocalm.WithDataType(Book{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := &resource{h}
+	rec := &recorder{TB: t}
+	CheckContract(rec, h, handler,
+		Case{httptest.NewRequest(http.MethodGet, "/", nil), false},
+		Case{httptest.NewRequest(http.MethodGet, "/1", nil), true})
+	if len(rec.errors) != 0 {
+		t.Fatalf("Unexpected failures %v", rec.errors)
+	}
+	CheckContract(rec, h, handler,
+		Case{httptest.NewRequest(http.MethodGet, "/2", nil), true})
+	if len(rec.errors) != 1 {
+		t.Fatalf("Expect contract broken, got %v", rec.errors)
+	}
+}
+
+// BookStore keeps books in memory.
+type BookStore struct {
+	gocalm.ModelInterface
+	mutex sync.Mutex
+	books map[string]Book
+	next  int64
+}
+
+func (t *BookStore) Get(kvpairs map[string]string) (interface{}, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	b, ok := t.books[kvpairs["id"]]
+	if !ok {
+		return nil, gocalm.ErrNotFound
+	}
+	return &b, nil
+}
+
+func (t *BookStore) GetAll(kvpairs map[string]string) (interface{}, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	books := []Book{}
+	for _, b := range t.books {
+		books = append(books, b)
+	}
+	return books, nil
+}
+
+func (t *BookStore) Put(kvpairs map[string]string, v interface{}) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	id := kvpairs["id"]
+	b, ok := t.books[id]
+	if !ok {
+		return gocalm.ErrNotFound
+	}
+	b.Title = v.(*Book).Title
+	t.books[id] = b
+	return nil
+}
+
+func (t *BookStore) Post(kvpairs map[string]string, v interface{}) (
+	string, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.next++
+	b := *v.(*Book)
+	b.ID = t.next
+	id := strconv.FormatInt(t.next, 10)
+	t.books[id] = b
+	return id, nil
+}
+
+func (t *BookStore) Delete(kvpairs map[string]string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if _, ok := t.books[kvpairs["id"]]; !ok {
+		return gocalm.ErrNotFound
+	}
+	delete(t.books, kvpairs["id"])
+	return nil
+}
+
+func TestRunModelTests(t *testing.T) {
+	n := 0
+	factory := func() interface{} {
+		n++
+		return &Book{Title: "Volume " + strconv.Itoa(n)}
+	}
+	RunModelTests(t, &BookStore{books: map[string]Book{}}, factory)
+	RunModelTests(t, &BookStore{books: map[string]Book{}}, factory,
+		gocalm.WithStatusPolicy(gocalm.STATUS_STRICT))
+}
+
+type Note struct {
+	ID      string    `json:"id" calm:"id"`
+	Created time.Time `json:"created" calm:"created_at"`
+}
+
+// NoteModel keeps the last posted note.
+type NoteModel struct {
+	gocalm.ModelInterface
+	last *Note
+}
+
+func (t *NoteModel) Post(kvpairs map[string]string, v interface{}) (
+	string, error) {
+	t.last = v.(*Note)
+	return t.last.ID, nil
+}
+
+func TestFakes(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewClock(start)
+	m := &NoteModel{}
+	h, err := gocalm.NewRESTHandler("notes", m, gocalm.WithDataType(Note{}),
+		gocalm.WithClock(clock), gocalm.WithIDGenerator(&Sequence{Last: 41}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Hour)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/",
+		strings.NewReader(`{}`)), map[string]string{})
+	expect := Note{"42", start.Add(time.Hour)}
+	if m.last == nil || *m.last != expect {
+		t.Fatalf("Expect %v, got %v", expect, m.last)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	b, err := Canonical([]byte(`{"b":1.50,"a":[true,null]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "{\n  \"a\": [\n    true,\n    null\n  ],\n  \"b\": 1.50\n}\n"
+	if string(b) != expect {
+		t.Fatalf("Expect %q, got %q", expect, b)
+	}
+	h, err := gocalm.NewRESTHandler("books", &BookModel{},
+		gocalm.WithDataType(Book{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	(&resource{h}).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	Snapshot(t, "books", w.Body.Bytes())
+}
+
+type Tag struct {
+	ID   string `json:"id" calm:"id"`
+	Name string `json:"name"`
+}
+
+func TestMemoryModel(t *testing.T) {
+	m, err := gocalm.NewMemoryModel("id", reflect.TypeOf(Tag{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	RunModelTests(t, m, func() interface{} {
+		n++
+		return &Tag{Name: "tag" + strconv.Itoa(n)}
+	})
+}
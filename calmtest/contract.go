@@ -0,0 +1,70 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package calmtest helps testing services built with gocalm.
+package calmtest
+
+import (
+	"github.com/4freewifi/gocalm"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+var msgSchema = gocalm.JSONSchema(reflect.TypeOf(gocalm.Msg{}))
+
+// Case is a request to check against the contract of a resource.
+type Case struct {
+	Request *http.Request
+	// Item is true if Request is for an item rather than the
+	// collection.
+	Item bool
+}
+
+// CheckContract serves every case with handler and fails t if a
+// response does not match the schemas documented by resource, as in
+// its SelfIntro. Error responses must be a gocalm.Msg.
+func CheckContract(t testing.TB, resource *gocalm.RESTHandler,
+	handler http.Handler, cases ...Case) {
+	t.Helper()
+	intro := resource.SelfIntro()
+	for _, c := range cases {
+		r := c.Request
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code == http.StatusNoContent || w.Code == http.StatusNotModified ||
+			r.Method == http.MethodHead || r.Method == http.MethodOptions {
+			continue
+		}
+		methods := intro.Collection
+		if c.Item {
+			methods = intro.Item
+		}
+		schema := msgSchema
+		if w.Code < 400 {
+			m, ok := methods[r.Method]
+			if !ok {
+				t.Errorf("%s %s: %d for undocumented method",
+					r.Method, r.URL, w.Code)
+				continue
+			}
+			schema = m.Response
+		}
+		if err := gocalm.Validate(schema, w.Body.Bytes()); err != nil {
+			t.Errorf("%s %s: %d response breaks contract: %v",
+				r.Method, r.URL, w.Code, err)
+		}
+	}
+}
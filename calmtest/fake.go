@@ -0,0 +1,59 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calmtest
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Clock is a gocalm.Clock standing still until advanced.
+type Clock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+// NewClock returns a Clock set to now.
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+func (c *Clock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// Advance moves c forward by d.
+func (c *Clock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Sequence is a gocalm.IDGenerator of consecutive integers following
+// Last.
+type Sequence struct {
+	mutex sync.Mutex
+	Last  int64
+}
+
+func (s *Sequence) NewID() (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Last++
+	return strconv.FormatInt(s.Last, 10), nil
+}
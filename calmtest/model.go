@@ -0,0 +1,180 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calmtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/4freewifi/gocalm"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// resource serves a RESTHandler at "/" for the collection and "/<id>"
+// for items.
+type resource struct {
+	h *gocalm.RESTHandler
+}
+
+func (t *resource) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	kvpairs := map[string]string{}
+	if id := strings.TrimPrefix(r.URL.Path, "/"); id != "" {
+		kvpairs[t.h.Key] = id
+	}
+	t.h.ServeHTTP(w, r, kvpairs)
+}
+
+func (t *resource) do(method, id string, v interface{}) (
+	*httptest.ResponseRecorder, error) {
+	var body []byte
+	if v != nil {
+		var err error
+		if body, err = json.Marshal(v); err != nil {
+			return nil, err
+		}
+	}
+	r := httptest.NewRequest(method, "/"+url.PathEscape(id),
+		bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	t.ServeHTTP(w, r)
+	return w, nil
+}
+
+// subset reports whether every field of JSON object a equals the one
+// in b, ignoring key.
+func subset(a, b []byte, key string) bool {
+	x := map[string]interface{}{}
+	y := map[string]interface{}{}
+	if json.Unmarshal(a, &x) != nil || json.Unmarshal(b, &y) != nil {
+		return false
+	}
+	for k, v := range x {
+		if k == key {
+			continue
+		}
+		u, _ := json.Marshal(v)
+		w, _ := json.Marshal(y[k])
+		if !bytes.Equal(u, w) {
+			return false
+		}
+	}
+	return true
+}
+
+// RunModelTests exercises model through the HTTP surface of a
+// RESTHandler: POST, GET, PUT and DELETE round-trips, listing, not
+// found after delete, and rejection of bodies of the wrong type.
+// factory returns a pointer to a new valid object, which must differ
+// from call to call. opts configure the RESTHandler, whose DataType
+// defaults to the type returned by factory.
+func RunModelTests(t *testing.T, model gocalm.ModelInterface,
+	factory func() interface{}, opts ...gocalm.Option) {
+	opts = append([]gocalm.Option{gocalm.WithDataType(factory())}, opts...)
+	h, err := gocalm.NewRESTHandler("conformance", model, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := &resource{h}
+	expect := func(w *httptest.ResponseRecorder, err error, status int) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != status {
+			t.Fatalf("Expect status %d, got %d: %s", status, w.Code,
+				w.Body.String())
+		}
+	}
+	// mutations succeed with 200 or 204 depending on StatusPolicy
+	succeed := func(w *httptest.ResponseRecorder, err error) {
+		t.Helper()
+		if err == nil && w.Code == http.StatusNoContent {
+			return
+		}
+		expect(w, err, http.StatusOK)
+	}
+	var id string
+	created := factory()
+	t.Run("Post", func(t *testing.T) {
+		w, err := res.do(http.MethodPost, "", created)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusOK && w.Code != http.StatusCreated {
+			t.Fatalf("Expect status 200 or 201, got %d: %s", w.Code,
+				w.Body.String())
+		}
+		v := map[string]interface{}{}
+		if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+			t.Fatalf("Post response %s: %v", w.Body.String(), err)
+		}
+		if v[h.Key] == nil {
+			v[h.Key] = v["id"]
+		}
+		if v[h.Key] == nil {
+			t.Fatalf("No id in %s", w.Body.String())
+		}
+		id = fmt.Sprint(v[h.Key])
+	})
+	if id == "" {
+		t.FailNow()
+	}
+	check := func(t *testing.T, v interface{}) {
+		w, err := res.do(http.MethodGet, id, nil)
+		expect(w, err, http.StatusOK)
+		b, _ := json.Marshal(v)
+		if !subset(b, w.Body.Bytes(), h.Key) {
+			t.Fatalf("Expect %s, got %s", b, w.Body.String())
+		}
+	}
+	t.Run("Get", func(t *testing.T) {
+		check(t, created)
+	})
+	t.Run("GetAll", func(t *testing.T) {
+		w, err := res.do(http.MethodGet, "", nil)
+		expect(w, err, http.StatusOK)
+		list := []json.RawMessage{}
+		if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+			t.Fatalf("GetAll response %s: %v", w.Body.String(), err)
+		}
+		if len(list) == 0 {
+			t.Fatal("GetAll is empty after Post")
+		}
+	})
+	t.Run("Put", func(t *testing.T) {
+		v := factory()
+		w, err := res.do(http.MethodPut, id, v)
+		succeed(w, err)
+		check(t, v)
+	})
+	t.Run("TypeMismatch", func(t *testing.T) {
+		w, err := res.do(http.MethodPut, id, []interface{}{})
+		expect(w, err, http.StatusBadRequest)
+	})
+	t.Run("Delete", func(t *testing.T) {
+		w, err := res.do(http.MethodDelete, id, nil)
+		succeed(w, err)
+	})
+	t.Run("NotFound", func(t *testing.T) {
+		w, err := res.do(http.MethodGet, id, nil)
+		expect(w, err, http.StatusNotFound)
+		w, err = res.do(http.MethodDelete, id, nil)
+		expect(w, err, http.StatusNotFound)
+	})
+}
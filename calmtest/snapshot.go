@@ -0,0 +1,86 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package calmtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"github.com/4freewifi/gocalm"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// SNAPSHOT_DIR is where Snapshot keeps recorded responses.
+const SNAPSHOT_DIR = "testdata"
+
+var update = flag.Bool("update", false, "update snapshots in testdata")
+
+// Canonical returns b indented with sorted keys, numbers kept as they
+// are.
+func Canonical(b []byte) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// Snapshot compares JSON body with the one recorded in
+// testdata/<name>.json, or records it when the test runs with
+// -update.
+func Snapshot(t testing.TB, name string, body []byte) {
+	t.Helper()
+	got, err := Canonical(body)
+	if err != nil {
+		t.Fatalf("snapshot %s: %v", name, err)
+	}
+	path := filepath.Join(SNAPSHOT_DIR, name+".json")
+	if *update {
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(path, got, 0644)
+		}
+		if err != nil {
+			t.Fatalf("snapshot %s: %v", name, err)
+		}
+		return
+	}
+	expect, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		t.Fatalf("snapshot %s is not recorded, run with -update", name)
+	}
+	if err != nil {
+		t.Fatalf("snapshot %s: %v", name, err)
+	}
+	if bytes.Equal(expect, got) {
+		return
+	}
+	ops, err := gocalm.Diff(expect, got)
+	if err != nil {
+		t.Fatalf("snapshot %s: %v", name, err)
+	}
+	diff, _ := json.Marshal(ops)
+	t.Errorf("snapshot %s differs, run with -update if expected: %s",
+		name, diff)
+}
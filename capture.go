@@ -0,0 +1,212 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// CAPTURE_HEADER set to 1 asks Capture to record the request.
+const CAPTURE_HEADER = "X-Capture"
+
+// Exchange is a captured request and its response.
+type Exchange struct {
+	Time           time.Time     `json:"time"`
+	Duration       time.Duration `json:"duration"`
+	Method         string        `json:"method"`
+	URL            string        `json:"url"`
+	RequestHeader  http.Header   `json:"request_header"`
+	RequestBody    string        `json:"request_body,omitempty"`
+	Status         int           `json:"status"`
+	ResponseHeader http.Header   `json:"response_header"`
+	ResponseBody   string        `json:"response_body,omitempty"`
+}
+
+// Capture is a middleware recording the requests and responses that
+// match Filter in a ring buffer, so that failures can be reproduced.
+// Credential headers are redacted, and so are the TAG_PII fields of
+// bodies if DataType is set.
+type Capture struct {
+	// Size of the ring buffer, default 100
+	Size int
+	// Filter selects exchanges to keep. The default keeps 5xx
+	// responses and requests with CAPTURE_HEADER set to 1.
+	Filter func(r *http.Request, status int) bool
+	// DataType of the request and response bodies. Optional.
+	DataType reflect.Type
+	// MaxBody is the number of body bytes kept, default 64KiB
+	MaxBody int
+	// Authorize allows requests to read the exchanges, see
+	// ServeHTTP. Others get 404, all of them if nil.
+	Authorize func(r *http.Request) bool
+
+	mutex sync.Mutex
+	ring  []Exchange
+	next  int
+}
+
+func defaultCaptureFilter(r *http.Request, status int) bool {
+	return status >= 500 || r.Header.Get(CAPTURE_HEADER) == "1"
+}
+
+// captureWriter keeps the status and the beginning of the body.
+type captureWriter struct {
+	statusWriter
+	max int
+	buf bytes.Buffer
+}
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	if n := w.max - w.buf.Len(); n > 0 {
+		if n > len(b) {
+			n = len(b)
+		}
+		w.buf.Write(b[:n])
+	}
+	return w.statusWriter.Write(b)
+}
+
+// peekBody reads up to n bytes of the body of r and puts them back in
+// front of the rest, so that the whole body is not held in memory.
+func peekBody(r *http.Request, n int) ([]byte, error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(n)))
+	if err != nil {
+		return nil, err
+	}
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b), r.Body), r.Body}
+	return b, nil
+}
+
+func (t *Capture) maxBody() int {
+	if t.MaxBody == 0 {
+		return 64 << 10
+	}
+	return t.MaxBody
+}
+
+// scrub returns body with PII redacted, truncated to MaxBody. A
+// truncated body cannot be parsed to redact it, so it is dropped if
+// there may be PII in it.
+func (t *Capture) scrub(body []byte) string {
+	if len(body) > t.maxBody() {
+		if t.DataType != nil {
+			return REDACTED
+		}
+		return string(body[:t.maxBody()])
+	}
+	if t.DataType != nil {
+		body = redactJSON(t.DataType, body)
+	}
+	return string(body)
+}
+
+func (t *Capture) add(e Exchange) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	size := t.Size
+	if size <= 0 {
+		size = 100
+	}
+	if len(t.ring) < size {
+		t.ring = append(t.ring, e)
+		return
+	}
+	t.ring[t.next] = e
+	t.next = (t.next + 1) % size
+}
+
+// Exchanges returns the captured exchanges, oldest first.
+func (t *Capture) Exchanges() []Exchange {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	list := make([]Exchange, 0, len(t.ring))
+	list = append(list, t.ring[t.next:]...)
+	return append(list, t.ring[:t.next]...)
+}
+
+// Wrap returns a Handler that serves next and captures the exchange.
+func (t *Capture) Wrap(next Handler) Handler {
+	return HandlerFunc(func(w http.ResponseWriter, r *http.Request,
+		kvpairs map[string]string) {
+		// one byte more tells scrub that the body is truncated
+		body, err := peekBody(r, t.maxBody()+1)
+		if err != nil {
+			sendError(w, r, err)
+			return
+		}
+		start := time.Now()
+		cw := &captureWriter{
+			statusWriter: statusWriter{ResponseWriter: w},
+			max:          t.maxBody() + 1,
+		}
+		next.ServeHTTP(cw, r, kvpairs)
+		status := cw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		filter := t.Filter
+		if filter == nil {
+			filter = defaultCaptureFilter
+		}
+		if !filter(r, status) {
+			return
+		}
+		t.add(Exchange{
+			Time:           start,
+			Duration:       time.Since(start),
+			Method:         r.Method,
+			URL:            r.URL.String(),
+			RequestHeader:  scrubHeader(r.Header),
+			RequestBody:    t.scrub(body),
+			Status:         status,
+			ResponseHeader: scrubHeader(w.Header()),
+			ResponseBody:   t.scrub(cw.buf.Bytes()),
+		})
+	})
+}
+
+// ServeHTTP responds to GET with the captured exchanges, e.g. on an
+// admin route, if allowed by Authorize.
+func (t *Capture) ServeHTTP(w http.ResponseWriter, r *http.Request,
+	kvpairs map[string]string) {
+	if t.Authorize == nil || !t.Authorize(r) {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if r.Method != http.MethodGet {
+		sendError(w, r, ErrNotImplemented)
+		return
+	}
+	b, err := json.Marshal(t.Exchanges())
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+	w.Write(b)
+}
@@ -0,0 +1,233 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command calmbench generates concurrent GET load on every route of a
+// running gocalm service and reports latency histograms and cache
+// hits per route.
+//
+// The route table is the JSON served by gocalm.RoutesHandler, or a
+// file of the same format. Route variables are filled with -var:
+//
+//	calmbench -base http://localhost:8080 \
+//		-routes http://localhost:8080/_routes -var id=1 -c 16 -d 10s
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/4freewifi/gocalm"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BUCKETS is the number of histogram buckets, the first one holding
+// latencies below 1ms and each next one doubling.
+const BUCKETS = 14
+
+type vars map[string]string
+
+func (v vars) String() string {
+	return fmt.Sprint(map[string]string(v))
+}
+
+func (v vars) Set(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 {
+		return fmt.Errorf("`%s' is not name=value", s)
+	}
+	v[kv[0]] = kv[1]
+	return nil
+}
+
+// result accumulates the outcome of requests to a route.
+type result struct {
+	mutex     sync.Mutex
+	latencies []time.Duration
+	buckets   [BUCKETS]int
+	statuses  map[int]int
+	cache     map[string]int
+	errors    int
+}
+
+func bucket(d time.Duration) int {
+	i := 0
+	for limit := time.Millisecond; d >= limit && i < BUCKETS-1; limit *= 2 {
+		i++
+	}
+	return i
+}
+
+func (t *result) add(d time.Duration, res *http.Response, err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if err != nil {
+		t.errors++
+		return
+	}
+	t.latencies = append(t.latencies, d)
+	t.buckets[bucket(d)]++
+	t.statuses[res.StatusCode]++
+	// counted per value to tell cache hits from misses
+	if v := res.Header.Get(gocalm.CACHE_HEADER); v != "" {
+		t.cache[strings.ToUpper(v)]++
+	}
+}
+
+func (t *result) percentile(p int) time.Duration {
+	if len(t.latencies) == 0 {
+		return 0
+	}
+	return t.latencies[(len(t.latencies)-1)*p/100]
+}
+
+func (t *result) print(w io.Writer, name, path string, elapsed time.Duration) {
+	sort.Slice(t.latencies, func(i, j int) bool {
+		return t.latencies[i] < t.latencies[j]
+	})
+	n := len(t.latencies)
+	fmt.Fprintf(w, "%s %s\n", name, path)
+	fmt.Fprintf(w, "  requests %d, errors %d, %.1f req/s\n", n, t.errors,
+		float64(n)/elapsed.Seconds())
+	fmt.Fprintf(w, "  p50 %v, p90 %v, p99 %v\n", t.percentile(50),
+		t.percentile(90), t.percentile(99))
+	fmt.Fprintf(w, "  status %v\n", t.statuses)
+	if len(t.cache) != 0 {
+		hits := 0
+		for v, c := range t.cache {
+			if strings.HasPrefix(v, "HIT") {
+				hits += c
+			}
+		}
+		fmt.Fprintf(w, "  cache %v, hit ratio %.2f\n", t.cache,
+			float64(hits)/float64(n))
+	}
+	limit := time.Millisecond
+	for i, c := range t.buckets {
+		label := "< " + limit.String()
+		if i == BUCKETS-1 {
+			label = ">= " + (limit / 2).String()
+		}
+		if c != 0 {
+			fmt.Fprintf(w, "  %-10s %6d %s\n", label, c,
+				strings.Repeat("*", c*50/n))
+		}
+		limit *= 2
+	}
+}
+
+// run sends GET requests to u from concurrency workers for duration.
+func run(client *http.Client, u string, concurrency int,
+	duration time.Duration) *result {
+	t := &result{statuses: map[int]int{}, cache: map[string]int{}}
+	deadline := time.Now().Add(duration)
+	wg := sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				start := time.Now()
+				res, err := client.Get(u)
+				if err == nil {
+					io.Copy(ioutil.Discard, res.Body)
+					res.Body.Close()
+				}
+				t.add(time.Since(start), res, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return t
+}
+
+// load reads the route table from a URL or a file.
+func load(src string) (map[string]string, error) {
+	var r io.ReadCloser
+	if strings.HasPrefix(src, "http://") ||
+		strings.HasPrefix(src, "https://") {
+		res, err := http.Get(src)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			return nil, fmt.Errorf("%s: %s", src, res.Status)
+		}
+		r = res.Body
+	} else {
+		f, err := os.Open(src)
+		if err != nil {
+			return nil, err
+		}
+		r = f
+	}
+	defer r.Close()
+	m := map[string]string{}
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, fmt.Errorf("%s: %v", src, err)
+	}
+	return m, nil
+}
+
+func main() {
+	v := vars{}
+	base := flag.String("base", "http://localhost:8080",
+		"base URL of the service")
+	src := flag.String("routes", "",
+		"URL or file of the route table served by gocalm.RoutesHandler")
+	concurrency := flag.Int("c", 8, "concurrent requests per route")
+	duration := flag.Duration("d", 10*time.Second, "duration per route")
+	flag.Var(v, "var", "route variable as name=value, repeatable")
+	flag.Parse()
+	if *src == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	table, err := load(*src)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	names := make([]string, 0, len(table))
+	for name := range table {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	client := &http.Client{
+		Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency},
+		Timeout:   30 * time.Second,
+	}
+	for _, name := range names {
+		if err = gocalm.NameRoute(name, table[name]); err != nil {
+			fmt.Fprintf(os.Stderr, "skip %s: %v\n", name, err)
+			continue
+		}
+		path, err := gocalm.URLFor(name, v)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "skip %s: %v\n", name, err)
+			continue
+		}
+		start := time.Now()
+		t := run(client, strings.TrimSuffix(*base, "/")+path,
+			*concurrency, *duration)
+		t.print(os.Stdout, name, path, time.Since(start))
+	}
+}
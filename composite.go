@@ -0,0 +1,193 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"sort"
+	"strings"
+)
+
+// PARTIAL_WARNING is the Warning header of a POST that created the
+// object in the first writer of a CompositeModel but failed in others.
+const PARTIAL_WARNING = `199 - "Partial write"`
+
+var errNoWriters = errors.New("CompositeModel has no Writers")
+
+// CompositeModel reads from Reader and writes to every model of
+// Writers in order, e.g. a SQL primary, then a search index, then a
+// cache. The first writer is the system of record: if it fails, the
+// others are not written to. Failures of later writers do not undo
+// earlier writes and are reported as a *PartialError.
+type CompositeModel struct {
+	// Reader defaults to the first writer
+	Reader  ModelInterface
+	Writers []ModelInterface
+	// Key is the name of the id in kvpairs, needed by Post with
+	// more than one writer.
+	Key string
+	// Partial, if set, is called on a partial failure and its result
+	// is the result of the write, e.g. nil after queueing a repair.
+	Partial func(kvpairs map[string]string, err *PartialError) error
+}
+
+// NewCompositeModel returns a CompositeModel writing to writers, of
+// which there must be at least one, and reading from reader, or from
+// the first writer if reader is nil.
+func NewCompositeModel(reader ModelInterface,
+	writers ...ModelInterface) (*CompositeModel, error) {
+	if len(writers) == 0 {
+		return nil, errNoWriters
+	}
+	return &CompositeModel{Reader: reader, Writers: writers}, nil
+}
+
+// PartialError tells which writers of a CompositeModel failed, by
+// their index in Writers, after the first one succeeded.
+type PartialError struct {
+	Failed map[int]error
+}
+
+func (e *PartialError) Error() string {
+	indexes := make([]int, 0, len(e.Failed))
+	for i := range e.Failed {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	a := make([]string, len(indexes))
+	for j, i := range indexes {
+		a[j] = fmt.Sprintf("writer %d: %v", i, e.Failed[i])
+	}
+	return "partial write, " + strings.Join(a, ", ")
+}
+
+// write calls f with each writer in order.
+func (t *CompositeModel) write(kvpairs map[string]string,
+	f func(m ModelInterface) error) error {
+	if len(t.Writers) == 0 {
+		return errNoWriters
+	}
+	if err := f(t.Writers[0]); err != nil {
+		return err
+	}
+	var partial *PartialError
+	for i, m := range t.Writers[1:] {
+		if err := f(m); err != nil {
+			glog.Errorf("CompositeModel writer %d: %v", i+1, err)
+			if partial == nil {
+				partial = &PartialError{Failed: make(map[int]error)}
+			}
+			partial.Failed[i+1] = err
+		}
+	}
+	switch {
+	case partial == nil:
+		return nil
+	case t.Partial != nil:
+		return t.Partial(kvpairs, partial)
+	}
+	return partial
+}
+
+func (t *CompositeModel) reader() (ModelInterface, error) {
+	switch {
+	case t.Reader != nil:
+		return t.Reader, nil
+	case len(t.Writers) == 0:
+		return nil, errNoWriters
+	}
+	return t.Writers[0], nil
+}
+
+func (t *CompositeModel) Get(kvpairs map[string]string) (interface{}, error) {
+	m, err := t.reader()
+	if err != nil {
+		return nil, err
+	}
+	return m.Get(kvpairs)
+}
+
+func (t *CompositeModel) GetAll(kvpairs map[string]string) (interface{}, error) {
+	m, err := t.reader()
+	if err != nil {
+		return nil, err
+	}
+	return m.GetAll(kvpairs)
+}
+
+func (t *CompositeModel) Put(kvpairs map[string]string, v interface{}) error {
+	return t.write(kvpairs, func(m ModelInterface) error {
+		return m.Put(kvpairs, v)
+	})
+}
+
+func (t *CompositeModel) PutAll(kvpairs map[string]string, v interface{}) error {
+	return t.write(kvpairs, func(m ModelInterface) error {
+		return m.PutAll(kvpairs, v)
+	})
+}
+
+func (t *CompositeModel) Patch(kvpairs map[string]string, original interface{},
+	patched interface{}) error {
+	return t.write(kvpairs, func(m ModelInterface) error {
+		return m.Patch(kvpairs, original, patched)
+	})
+}
+
+// Post posts v to the first writer only, so that the id it gives is
+// the id everywhere, and puts v under that id to later writers, which
+// must create objects on Put. It returns the id also on a partial
+// failure, which ServeHTTP answers with 201 and PARTIAL_WARNING so
+// that the client does not post again.
+func (t *CompositeModel) Post(kvpairs map[string]string, v interface{}) (
+	id string, err error) {
+	if len(t.Writers) > 1 && t.Key == "" {
+		return "", errors.New("CompositeModel Key is empty")
+	}
+	first := true
+	err = t.write(kvpairs, func(m ModelInterface) error {
+		if !first {
+			put := make(map[string]string, len(kvpairs)+1)
+			for k, s := range kvpairs {
+				put[k] = s
+			}
+			put[t.Key] = id
+			return m.Put(put, v)
+		}
+		first = false
+		var err error
+		if id, err = m.Post(kvpairs, v); err != nil {
+			return err
+		}
+		return assignID(v, IDGeneratorFunc(func() (string, error) {
+			return id, nil
+		}))
+	})
+	return
+}
+
+func (t *CompositeModel) Delete(kvpairs map[string]string) error {
+	return t.write(kvpairs, func(m ModelInterface) error {
+		return m.Delete(kvpairs)
+	})
+}
+
+func (t *CompositeModel) DeleteAll(kvpairs map[string]string) error {
+	return t.write(kvpairs, func(m ModelInterface) error {
+		return m.DeleteAll(kvpairs)
+	})
+}
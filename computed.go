@@ -0,0 +1,111 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// Computed returns the name and value of a field derived from v, as
+// returned by Model, e.g. an age from a birthdate or a URL from an id.
+// An empty name adds nothing.
+type Computed func(ctx context.Context, v interface{}) (name string,
+	value interface{})
+
+// compute adds the computed fields of v to its representation rep.
+func (h *RESTHandler) compute(r *http.Request, v interface{},
+	rep interface{}) (interface{}, error) {
+	if len(h.Computed) == 0 {
+		return rep, nil
+	}
+	fields := make(map[string]interface{}, len(h.Computed))
+	for _, f := range h.Computed {
+		if name, value := f(r.Context(), v); name != "" {
+			fields[name] = value
+		}
+	}
+	return mergeFields(rep, fields)
+}
+
+// dataSchema returns the JSON Schema of DataType with the computed
+// fields as read-only properties, and time fields described by h.Times.
+func (h *RESTHandler) dataSchema() Schema {
+	s := JSONSchema(h.DataType)
+	h.describeTimes(s)
+	properties, ok := s["properties"].(Schema)
+	if !ok {
+		return s
+	}
+	for name, schema := range h.ComputedSchema {
+		p := Schema{"readOnly": true}
+		if m, ok := schema.(Schema); ok {
+			for k, v := range m {
+				p[k] = v
+			}
+		}
+		properties[name] = p
+	}
+	return s
+}
+
+// checkComputed makes sure computed fields do not hide fields of
+// DataType, which clients could not write anymore.
+func (h *RESTHandler) checkComputed() error {
+	properties, _ := JSONSchema(h.DataType)["properties"].(Schema)
+	for name := range h.ComputedSchema {
+		if _, ok := properties[name]; ok {
+			return fmt.Errorf("computed field `%s' is a field of %s",
+				name, h.DataType)
+		}
+	}
+	return nil
+}
+
+// dropComputed removes the computed fields, which are read-only, from
+// the JSON object in the body of r. Other bodies are left for readJSON
+// to report.
+func (h *RESTHandler) dropComputed(r *http.Request) error {
+	if len(h.ComputedSchema) == 0 {
+		return nil
+	}
+	b, err := readBody(r)
+	if err != nil {
+		return err
+	}
+	m := make(map[string]json.RawMessage)
+	if json.Unmarshal(bytes.TrimPrefix(b, utf8BOM), &m) != nil {
+		return nil
+	}
+	dropped := false
+	for name := range h.ComputedSchema {
+		if _, ok := m[name]; ok {
+			delete(m, name)
+			dropped = true
+		}
+	}
+	if !dropped {
+		return nil
+	}
+	if b, err = json.Marshal(m); err != nil {
+		return err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(b))
+	return nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DEBUG_PREFIX is the path DebugHandler is meant to be mounted at.
+const DEBUG_PREFIX = "/_debug/"
+
+// MAX_CPU_PROFILE limits the seconds of a CPU profile.
+const MAX_CPU_PROFILE = 60
+
+// DebugHandler serves runtime diagnostics under DEBUG_PREFIX to
+// requests allowed by authorize, and 404 to others:
+//
+//	/_debug/vars               command line, goroutines and memstats
+//	/_debug/goroutines         stacks of every goroutine
+//	/_debug/pprof/<profile>    e.g. heap or allocs, ?debug=1 for text
+//	/_debug/pprof/profile      CPU profile, ?seconds=30
+//
+// Profiles are written with runtime/pprof, so unlike net/http/pprof
+// and expvar nothing is registered on http.DefaultServeMux.
+func DebugHandler(authorize func(r *http.Request) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authorize == nil || !authorize(r) {
+			http.NotFound(w, r)
+			return
+		}
+		path := strings.TrimPrefix(r.URL.Path, DEBUG_PREFIX)
+		switch {
+		case path == "vars":
+			serveVars(w)
+		case path == "goroutines":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			pprof.Lookup("goroutine").WriteTo(w, 2)
+		case path == "pprof/profile":
+			serveCPUProfile(w, r)
+		case strings.HasPrefix(path, "pprof/"):
+			p := pprof.Lookup(strings.TrimPrefix(path, "pprof/"))
+			if p == nil {
+				http.NotFound(w, r)
+				return
+			}
+			debug, _ := strconv.Atoi(r.FormValue("debug"))
+			if debug == 0 {
+				w.Header().Set("Content-Type", "application/octet-stream")
+			} else {
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			}
+			p.WriteTo(w, debug)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+func serveVars(w http.ResponseWriter) {
+	var memstats runtime.MemStats
+	runtime.ReadMemStats(&memstats)
+	b, err := json.Marshal(map[string]interface{}{
+		"cmdline":    os.Args,
+		"goroutines": runtime.NumGoroutine(),
+		"memstats":   memstats,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(b)
+}
+
+func serveCPUProfile(w http.ResponseWriter, r *http.Request) {
+	seconds, err := strconv.Atoi(r.FormValue("seconds"))
+	if err != nil || seconds <= 0 {
+		seconds = 30
+	}
+	if seconds > MAX_CPU_PROFILE {
+		seconds = MAX_CPU_PROFILE
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if err = pprof.StartCPUProfile(w); err != nil {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		http.Error(w, fmt.Sprintf("Cannot profile: %v", err),
+			http.StatusInternalServerError)
+		return
+	}
+	select {
+	case <-time.After(time.Duration(seconds) * time.Second):
+	case <-r.Context().Done():
+	}
+	pprof.StopCPUProfile()
+}
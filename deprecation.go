@@ -0,0 +1,94 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DEPRECATION_LOG_INTERVAL is how often the use of a deprecated
+// resource is logged at most per caller.
+const DEPRECATION_LOG_INTERVAL = time.Hour
+
+// Deprecation marks a RESTHandler as deprecated.
+type Deprecation struct {
+	// Since when the resource is deprecated
+	Since time.Time `json:"since"`
+	// Successor is the URL of the replacement, if any
+	Successor string `json:"successor,omitempty"`
+
+	// logged holds the callers logged since interval started
+	mutex    sync.Mutex
+	interval time.Time
+	logged   map[string]bool
+}
+
+// Deprecated returns a Deprecation to be set as
+// RESTHandler.Deprecation.
+func Deprecated(since time.Time, successor string) *Deprecation {
+	return &Deprecation{Since: since, Successor: successor}
+}
+
+// first reports whether caller is seen for the first time in the
+// current DEPRECATION_LOG_INTERVAL.
+func (d *Deprecation) first(caller string, now time.Time) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if now.Sub(d.interval) >= DEPRECATION_LOG_INTERVAL {
+		d.interval = now
+		d.logged = make(map[string]bool)
+	}
+	if d.logged[caller] {
+		return false
+	}
+	d.logged[caller] = true
+	return true
+}
+
+// caller identifies the client of r for logging.
+func (h *RESTHandler) caller(r *http.Request) string {
+	if p := h.principal(r); p != "" {
+		return p
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// deprecate sets the Deprecation (RFC 9745) and successor Link
+// headers and logs who is still using h, once per caller and
+// DEPRECATION_LOG_INTERVAL.
+func (h *RESTHandler) deprecate(w http.ResponseWriter, r *http.Request) {
+	d := h.Deprecation
+	if d == nil {
+		return
+	}
+	header := w.Header()
+	header.Set("Deprecation", fmt.Sprintf("@%d", d.Since.Unix()))
+	if d.Successor != "" {
+		header.Add("Link", fmt.Sprintf(`<%s>; rel="successor-version"`,
+			d.Successor))
+	}
+	if caller := h.caller(r); d.first(caller, time.Now()) {
+		glog.Warningf("Deprecated %s used by %s: %s %s", h.Name, caller,
+			r.Method, r.URL)
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"encoding/json"
+	"github.com/golang/glog"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PatchOp is an operation of a JSON Patch (RFC 6902).
+type PatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// DiffMsg is the response of PUT and PATCH when
+// RESTHandler.ReturnDiff is set.
+type DiffMsg struct {
+	Message string    `json:"message"`
+	Diff    []PatchOp `json:"diff"`
+}
+
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// Diff returns the JSON Patch that turns JSON document a into b. An
+// empty a is taken as no document at all.
+func Diff(a, b []byte) ([]PatchOp, error) {
+	var va, vb interface{}
+	if err := json.Unmarshal(b, &vb); err != nil {
+		return nil, err
+	}
+	ops := []PatchOp{}
+	if len(a) == 0 {
+		return appendOp(ops, "add", "", vb)
+	}
+	if err := json.Unmarshal(a, &va); err != nil {
+		return nil, err
+	}
+	return diff(ops, "", va, vb)
+}
+
+func appendOp(ops []PatchOp, op, path string, v interface{}) (
+	[]PatchOp, error) {
+	p := PatchOp{Op: op, Path: path}
+	if op != "remove" {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		p.Value = b
+	}
+	return append(ops, p), nil
+}
+
+func diff(ops []PatchOp, path string, a, b interface{}) (
+	[]PatchOp, error) {
+	var err error
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(a)+len(b))
+		for k := range a {
+			keys = append(keys, k)
+		}
+		for k := range b {
+			if _, ok := a[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			p := path + "/" + pointerEscaper.Replace(k)
+			va, inA := a[k]
+			vb, inB := b[k]
+			switch {
+			case !inB:
+				ops, err = appendOp(ops, "remove", p, nil)
+			case !inA:
+				ops, err = appendOp(ops, "add", p, vb)
+			default:
+				ops, err = diff(ops, p, va, vb)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return ops, nil
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			break
+		}
+		for i := range a {
+			p := path + "/" + strconv.Itoa(i)
+			if ops, err = diff(ops, p, a[i], b[i]); err != nil {
+				return nil, err
+			}
+		}
+		return ops, nil
+	}
+	if reflect.DeepEqual(a, b) {
+		return ops, nil
+	}
+	return appendOp(ops, "replace", path, b)
+}
+
+// sendDiff responds to a successful PUT or PATCH of kvpairs with the
+// JSON Patch between the representations GET sends of the previous
+// object, nil if there was none, and of the new one.
+func (h *RESTHandler) sendDiff(w http.ResponseWriter, r *http.Request,
+	kvpairs map[string]string, previous, current interface{}) {
+	var a []byte
+	var err error
+	if previous != nil {
+		if a, err = h.representation(r, kvpairs, previous); err != nil {
+			panic(err)
+		}
+	}
+	b, err := h.representation(r, kvpairs, current)
+	if err != nil {
+		panic(err)
+	}
+	ops, err := Diff(a, b)
+	if err != nil {
+		panic(err)
+	}
+	if b, err = json.Marshal(DiffMsg{Translate(r, SUCCESS, 1), ops}); err != nil {
+		panic(err)
+	}
+	glog.Infof("%s %s: %d %s", r.Method, r.URL, http.StatusOK, SUCCESS)
+	h.write(w, r, b)
+}
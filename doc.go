@@ -0,0 +1,214 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Param describes a path or query parameter.
+type Param struct {
+	Name        string `json:"name"`
+	In          string `json:"in"`
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+}
+
+// SelfIntro describes a RESTHandler for API consumers.
+type SelfIntro struct {
+	Name       string                  `json:"name"`
+	Path       string                  `json:"path,omitempty"`
+	Params     []Param                 `json:"params"`
+	Schema     Schema                  `json:"schema"`
+	Example    interface{}             `json:"example,omitempty"`
+	Item       map[string]MethodSchema `json:"item"`
+	Collection map[string]MethodSchema `json:"collection"`
+	Auth       bool                    `json:"auth"`
+	Deprecated *Deprecation            `json:"deprecated,omitempty"`
+}
+
+// queryParams lists the query parameters understood by h itself.
+func (h *RESTHandler) queryParams() []Param {
+	params := []Param{
+		{EMBED_PARAM, "query", "string",
+			"comma separated related resources to embed"},
+		{REFS_PARAM, "query", "string",
+			"related objects as `full' (default) or `id'"},
+	}
+	if h.JSONP {
+		params = append(params, Param{CALLBACK_PARAM, "query", "string",
+			"JSONP callback"})
+	}
+	return params
+}
+
+// SelfIntro describes h: its parameters, DataType schema with an
+// example, and the methods supported on items and the collection.
+func (h *RESTHandler) SelfIntro() SelfIntro {
+	intro := SelfIntro{
+		Name:       h.Name,
+		Schema:     h.dataSchema(),
+		Example:    reflect.New(h.DataType).Interface(),
+		Item:       h.describe(true),
+		Collection: h.describe(false),
+		Auth:       h.Principal != nil,
+		Deprecated: h.Deprecation,
+	}
+	if h.Route != "" {
+		routes.RLock()
+		intro.Path = routes.m[h.Route]
+		routes.RUnlock()
+	}
+	names := []string{h.Key}
+	for name := range h.Vars {
+		if name != h.Key {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names[1:])
+	for _, name := range names {
+		typ, ok := h.Vars[name]
+		if !ok {
+			typ = VAR_STRING
+		}
+		intro.Params = append(intro.Params, Param{
+			Name: name,
+			In:   "path",
+			Type: typ,
+		})
+	}
+	intro.Params = append(intro.Params, h.queryParams()...)
+	return intro
+}
+
+var docTemplate = template.Must(template.New("doc").Funcs(template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.MarshalIndent(v, "", "  ")
+		return string(b), err
+	},
+	"curl": func(method, url string, schema MethodSchema) string {
+		if schema.Request == nil {
+			return "curl -X " + method + " '" + url + "'"
+		}
+		return "curl -X " + method + " -H 'Content-Type: application/json'" +
+			" -d @body.json '" + url + "'"
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>API</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+pre { background: #f4f4f4; padding: 0.5em; overflow: auto; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 0.2em 0.5em; text-align: left; }
+</style>
+</head>
+<body>
+<h1>API</h1>
+<ul>{{range .}}<li><a href="#{{.Intro.Name}}">{{.Intro.Name}}</a></li>{{end}}</ul>
+{{range .}}{{$doc := .}}
+<h2 id="{{.Intro.Name}}">{{.Intro.Name}}</h2>
+{{if .Intro.Path}}<p><code>{{.Intro.Path}}</code></p>{{end}}
+{{if .Intro.Auth}}<p>Authentication required.</p>{{end}}
+{{with .Intro.Deprecated}}<p><strong>Deprecated since {{.Since.Format "2006-01-02"}}.</strong>
+{{if .Successor}}Use <a href="{{.Successor}}">{{.Successor}}</a> instead.{{end}}</p>{{end}}
+<table>
+<tr><th>Parameter</th><th>In</th><th>Type</th><th>Description</th></tr>
+{{range .Intro.Params}}<tr><td>{{.Name}}</td><td>{{.In}}</td><td>{{.Type}}</td><td>{{.Description}}</td></tr>
+{{end}}</table>
+<h3>Schema</h3>
+<pre>{{json .Intro.Schema}}</pre>
+<h3>Example</h3>
+<pre>{{json .Intro.Example}}</pre>
+<h3>Collection</h3>
+{{range $method, $schema := .Intro.Collection}}<h4>{{$method}}</h4>
+<pre>{{curl $method $doc.Collection $schema}}</pre>
+{{with $schema.Example}}<pre>{{json .}}</pre>{{end}}
+{{end}}
+<h3>Item</h3>
+{{range $method, $schema := .Intro.Item}}<h4>{{$method}}</h4>
+<pre>{{curl $method $doc.Item $schema}}</pre>
+{{with $schema.Example}}<pre>{{json .}}</pre>{{end}}
+{{end}}
+{{end}}
+</body>
+</html>
+`))
+
+// htmlDoc is what docTemplate renders for one handler.
+type htmlDoc struct {
+	Intro      SelfIntro
+	Collection string
+	Item       string
+}
+
+// DocHandler serves the SelfIntro of handlers, typically mounted at
+// /_doc. It responds in JSON, or as a readable HTML page if the client
+// prefers text/html.
+func DocHandler(handlers ...*RESTHandler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		intros := make([]SelfIntro, len(handlers))
+		for i, h := range handlers {
+			intros[i] = h.SelfIntro()
+		}
+		offer, ok := negotiate(r.Header["Accept"],
+			[]string{"application/json", "text/html"})
+		if !ok {
+			sendJSONMsg(w, r, http.StatusNotAcceptable, NOT_ACCEPTABLE)
+			return
+		}
+		w.Header().Add("Vary", "Accept")
+		if offer == "text/html" {
+			serveHTMLDoc(w, r, intros)
+			return
+		}
+		b, err := json.Marshal(intros)
+		if err != nil {
+			sendInternalError(err, w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write(b)
+	})
+}
+
+func serveHTMLDoc(w http.ResponseWriter, r *http.Request, intros []SelfIntro) {
+	docs := make([]htmlDoc, len(intros))
+	for i, intro := range intros {
+		docs[i].Intro = intro
+		if intro.Path == "" {
+			continue
+		}
+		item := AbsoluteURL(r, intro.Path)
+		docs[i].Item = item
+		// the collection is the item path without the last segment
+		docs[i].Collection = item[:strings.LastIndex(item, "/")+1]
+	}
+	buf := bytes.Buffer{}
+	if err := docTemplate.Execute(&buf, docs); err != nil {
+		sendInternalError(err, w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,75 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"strings"
+)
+
+const (
+	// EMBED_PARAM is the query parameter listing related resources
+	// to embed, e.g. ?embed=author,comments
+	EMBED_PARAM = "embed"
+	// EMBEDDED is the name of the field holding embedded resources
+	EMBEDDED = "_embedded"
+)
+
+// Embeddable is optionally implemented by Model to support
+// ?embed=. gocalm calls Embed for every object returned by Get or
+// GetAll and nests the result under EMBEDDED.
+type Embeddable interface {
+	// Embed returns the resources related to v named by names,
+	// keyed by name. Unknown names should be ignored.
+	Embed(kvpairs map[string]string, v interface{}, names []string) (
+		map[string]interface{}, error)
+}
+
+// embedNames returns the names requested by EMBED_PARAM.
+func embedNames(kvpairs map[string]string) []string {
+	s := kvpairs[EMBED_PARAM]
+	if s == "" {
+		return nil
+	}
+	names := []string{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// embed nests the related resources of the object v requested in
+// kvpairs into its representation r.
+func (h *RESTHandler) embed(kvpairs map[string]string, v interface{},
+	r interface{}) (interface{}, error) {
+	m, ok := h.reader().(Embeddable)
+	if !ok {
+		return r, nil
+	}
+	names := embedNames(kvpairs)
+	if len(names) == 0 {
+		return r, nil
+	}
+	related, err := m.Embed(kvpairs, v, names)
+	if err != nil {
+		return nil, err
+	}
+	if len(related) == 0 {
+		return r, nil
+	}
+	return mergeFields(r, map[string]interface{}{EMBEDDED: related})
+}
@@ -0,0 +1,445 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Types of the events appended by EventModel.
+const (
+	EVENT_CREATED  = "created"
+	EVENT_REPLACED = "replaced"
+	EVENT_PATCHED  = "patched"
+	EVENT_DELETED  = "deleted"
+)
+
+const (
+	// EVENT_SNAPSHOTS is the default of EventModel.Snapshots.
+	EVENT_SNAPSHOTS = 1024
+	// EVENT_LOCKS is the number of locks the changes of objects of an
+	// EventModel are serialized with, by hash of their id.
+	EVENT_LOCKS = 64
+)
+
+// Event is a change of an object of an EventModel.
+type Event struct {
+	Seq    int             `json:"seq"`
+	Type   string          `json:"type"`
+	Time   time.Time       `json:"time"`
+	Author string          `json:"author,omitempty"`
+	Data   json.RawMessage `json:"data,omitempty"`
+}
+
+// EventStore keeps the events of objects. Implementations must be safe
+// for concurrent use.
+type EventStore interface {
+	// Append stores e as the next event of object id of resource
+	// and sets e.Seq, starting from 1.
+	Append(resource, id string, e *Event) error
+	// Load returns the events of object id after seq, oldest first.
+	Load(resource, id string, after int) ([]*Event, error)
+	// IDs returns the ids of the objects of resource with events, in
+	// order of their first event.
+	IDs(resource string) ([]string, error)
+}
+
+// MemoryEventStore is an EventStore in memory.
+type MemoryEventStore struct {
+	mutex  sync.RWMutex
+	events map[string][]*Event
+	ids    map[string][]string
+}
+
+func NewMemoryEventStore() *MemoryEventStore {
+	return &MemoryEventStore{
+		events: make(map[string][]*Event),
+		ids:    make(map[string][]string),
+	}
+}
+
+func (s *MemoryEventStore) Append(resource, id string, e *Event) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	k := resource + "\n" + id
+	if len(s.events[k]) == 0 {
+		s.ids[resource] = append(s.ids[resource], id)
+	}
+	e.Seq = len(s.events[k]) + 1
+	c := *e
+	s.events[k] = append(s.events[k], &c)
+	return nil
+}
+
+func (s *MemoryEventStore) Load(resource, id string, after int) ([]*Event,
+	error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	events := s.events[resource+"\n"+id]
+	if after > len(events) {
+		after = len(events)
+	}
+	list := make([]*Event, 0, len(events)-after)
+	for _, e := range events[after:] {
+		c := *e
+		list = append(list, &c)
+	}
+	return list, nil
+}
+
+func (s *MemoryEventStore) IDs(resource string) ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return append([]string(nil), s.ids[resource]...), nil
+}
+
+// EventModel is a ModelInterface appending every change of objects of
+// DataType to Store as an Event, authored by PRINCIPAL_KEY. The current
+// state of an object is built by folding its events, starting from a
+// snapshot kept in memory. The history of objects is served from the
+// same events with WithVersions(m.Versions()).
+type EventModel struct {
+	// Resource names the objects in Store
+	Resource string
+	// Key is the name of the id in kvpairs
+	Key      string
+	DataType reflect.Type
+	Store    EventStore
+	Clock    Clock
+	// Fold returns state, the JSON of an object or nil if there is
+	// none, with e applied. It defaults to taking the Data of e, or
+	// nil for EVENT_DELETED.
+	Fold func(state []byte, e *Event) ([]byte, error)
+	// Snapshots is how many objects snapshots are kept of, the least
+	// recently used being evicted, default EVENT_SNAPSHOTS.
+	Snapshots int
+
+	once      sync.Once
+	snapshots *LocalCache
+	locks     [EVENT_LOCKS]sync.Mutex
+	// next is the last id Post numbered, once counted
+	idMutex sync.Mutex
+	counted bool
+	next    int
+}
+
+func foldEvent(state []byte, e *Event) ([]byte, error) {
+	if e.Type == EVENT_DELETED {
+		return nil, nil
+	}
+	return e.Data, nil
+}
+
+// fold applies events to state.
+func (m *EventModel) fold(state []byte, events []*Event) ([]byte, error) {
+	fold := m.Fold
+	if fold == nil {
+		fold = foldEvent
+	}
+	var err error
+	for _, e := range events {
+		if state, err = fold(state, e); err != nil {
+			return nil, fmt.Errorf("%s event %d: %v", e.Type, e.Seq, err)
+		}
+	}
+	return state, nil
+}
+
+// lock returns the lock of the changes of object id.
+func (m *EventModel) lock(id string) *sync.Mutex {
+	f := fnv.New32a()
+	f.Write([]byte(id))
+	return &m.locks[f.Sum32()%EVENT_LOCKS]
+}
+
+// snapshot returns the last snapshot of object id: its JSON, nil if
+// there is none, as of event seq.
+func (m *EventModel) snapshot(id string) (seq int, state []byte) {
+	m.once.Do(func() {
+		n := m.Snapshots
+		if n == 0 {
+			n = EVENT_SNAPSHOTS
+		}
+		m.snapshots = NewLocalCache(n)
+	})
+	b := m.snapshots.Get(id)
+	i := bytes.IndexByte(b, '\n')
+	if i < 0 {
+		return 0, nil
+	}
+	seq, _ = strconv.Atoi(string(b[:i]))
+	if i+1 < len(b) {
+		state = append([]byte(nil), b[i+1:]...)
+	}
+	return seq, state
+}
+
+// state returns the current JSON of object id, or nil if there is
+// none.
+func (m *EventModel) state(id string) ([]byte, error) {
+	seq, state := m.snapshot(id)
+	events, err := m.Store.Load(m.Resource, id, seq)
+	if err != nil || len(events) == 0 {
+		return state, err
+	}
+	if state, err = m.fold(state, events); err != nil {
+		return nil, err
+	}
+	seq = events[len(events)-1].Seq
+	m.snapshots.Set(id, append([]byte(strconv.Itoa(seq)+"\n"), state...),
+		NEVER_EXPIRE)
+	return state, nil
+}
+
+// append appends an event of type t with the JSON of v to object id.
+// The lock of id must be held.
+func (m *EventModel) append(kvpairs map[string]string, id, t string,
+	v interface{}) error {
+	e := &Event{Type: t, Author: kvpairs[PRINCIPAL_KEY]}
+	if m.Clock == nil {
+		e.Time = SystemClock.Now()
+	} else {
+		e.Time = m.Clock.Now()
+	}
+	if v != nil {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		e.Data = b
+	}
+	return m.Store.Append(m.Resource, id, e)
+}
+
+// decode returns a new DataType object decoded from b.
+func (m *EventModel) decode(b []byte) (interface{}, error) {
+	v := reflect.New(m.DataType).Interface()
+	if err := json.Unmarshal(b, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (m *EventModel) Get(kvpairs map[string]string) (interface{}, error) {
+	state, err := m.state(kvpairs[m.Key])
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		return nil, ErrNotFound
+	}
+	return m.decode(state)
+}
+
+func (m *EventModel) GetAll(kvpairs map[string]string) (interface{}, error) {
+	ids, err := m.Store.IDs(m.Resource)
+	if err != nil {
+		return nil, err
+	}
+	a := reflect.MakeSlice(reflect.SliceOf(m.DataType), 0, len(ids))
+	for _, id := range ids {
+		state, err := m.state(id)
+		if err != nil {
+			return nil, err
+		}
+		if state == nil {
+			continue
+		}
+		v, err := m.decode(state)
+		if err != nil {
+			return nil, err
+		}
+		a = reflect.Append(a, reflect.ValueOf(v).Elem())
+	}
+	return a.Interface(), nil
+}
+
+// change appends an event of type t with v to the existing object
+// identified in kvpairs.
+func (m *EventModel) change(kvpairs map[string]string, t string,
+	v interface{}) error {
+	id := kvpairs[m.Key]
+	// keep the id field if the body leaves it out
+	err := assignID(v, IDGeneratorFunc(func() (string, error) {
+		return id, nil
+	}))
+	if err != nil {
+		return err
+	}
+	lock := m.lock(id)
+	lock.Lock()
+	defer lock.Unlock()
+	state, err := m.state(id)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return ErrNotFound
+	}
+	return m.append(kvpairs, id, t, v)
+}
+
+func (m *EventModel) Put(kvpairs map[string]string, v interface{}) error {
+	return m.change(kvpairs, EVENT_REPLACED, v)
+}
+
+func (m *EventModel) PutAll(kvpairs map[string]string, v interface{}) error {
+	return ErrNotImplemented
+}
+
+func (m *EventModel) Patch(kvpairs map[string]string, original interface{},
+	patched interface{}) error {
+	return m.change(kvpairs, EVENT_PATCHED, patched)
+}
+
+// nextID numbers a new object: after the count of objects ever
+// created, deleted ones included, the first time, and then after the
+// last one numbered, skipping ids already taken.
+func (m *EventModel) nextID() (string, error) {
+	m.idMutex.Lock()
+	defer m.idMutex.Unlock()
+	if !m.counted {
+		ids, err := m.Store.IDs(m.Resource)
+		if err != nil {
+			return "", err
+		}
+		m.next, m.counted = len(ids), true
+	}
+	for {
+		m.next++
+		id := strconv.Itoa(m.next)
+		events, err := m.Store.Load(m.Resource, id, 0)
+		if err != nil {
+			return "", err
+		}
+		if len(events) == 0 {
+			return id, nil
+		}
+	}
+}
+
+// Post numbers objects without an id with nextID.
+func (m *EventModel) Post(kvpairs map[string]string, v interface{}) (
+	string, error) {
+	err := assignID(v, IDGeneratorFunc(m.nextID))
+	if err != nil {
+		return "", err
+	}
+	id := idOf(v)
+	if id == "" {
+		if id, err = m.nextID(); err != nil {
+			return "", err
+		}
+	}
+	lock := m.lock(id)
+	lock.Lock()
+	defer lock.Unlock()
+	state, err := m.state(id)
+	if err != nil {
+		return "", err
+	}
+	if state != nil {
+		return "", &Error{
+			StatusCode: http.StatusConflict,
+			Message:    fmt.Sprintf("%s already exists", id),
+		}
+	}
+	return id, m.append(kvpairs, id, EVENT_CREATED, v)
+}
+
+func (m *EventModel) Delete(kvpairs map[string]string) error {
+	id := kvpairs[m.Key]
+	lock := m.lock(id)
+	lock.Lock()
+	defer lock.Unlock()
+	state, err := m.state(id)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return ErrNotFound
+	}
+	return m.append(kvpairs, id, EVENT_DELETED, nil)
+}
+
+func (m *EventModel) DeleteAll(kvpairs map[string]string) error {
+	ids, err := m.Store.IDs(m.Resource)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		err = m.Delete(map[string]string{m.Key: id,
+			PRINCIPAL_KEY: kvpairs[PRINCIPAL_KEY]})
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// Versions returns a VersionStore serving the events of m as
+// revisions, for WithVersions. Its Append does nothing since every
+// change is already an event.
+func (m *EventModel) Versions() VersionStore {
+	return eventVersions{m}
+}
+
+type eventVersions struct {
+	m *EventModel
+}
+
+func (t eventVersions) Append(resource, id string, rev *Revision) error {
+	return nil
+}
+
+// List returns the events of object id as revisions holding the state
+// after each event.
+func (t eventVersions) List(resource, id string) ([]*Revision, error) {
+	events, err := t.m.Store.Load(t.m.Resource, id, 0)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*Revision, len(events))
+	var state []byte
+	for i, e := range events {
+		if state, err = t.m.fold(state, events[i:i+1]); err != nil {
+			return nil, err
+		}
+		list[i] = &Revision{
+			Rev:     e.Seq,
+			Time:    e.Time,
+			Author:  e.Author,
+			Deleted: state == nil,
+			Data:    state,
+		}
+	}
+	return list, nil
+}
+
+func (t eventVersions) Get(resource, id string, n int) (*Revision, error) {
+	list, err := t.List(resource, id)
+	if err != nil || n < 1 || n > len(list) {
+		return nil, err
+	}
+	return list[n-1], nil
+}
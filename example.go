@@ -0,0 +1,64 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Example is a sample request and response of a method, shown in
+// SelfIntro and served in mock mode.
+type Example struct {
+	Request  interface{} `json:"request,omitempty"`
+	Response interface{} `json:"response,omitempty"`
+}
+
+// exampleKey identifies the method of an item or the collection.
+type exampleKey struct {
+	method string
+	item   bool
+}
+
+func (h *RESTHandler) example(method string, item bool) *Example {
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	return h.examples[exampleKey{method, item}]
+}
+
+// serveExample answers r with the example response in mock mode,
+// where h has no Model.
+func (h *RESTHandler) serveExample(w http.ResponseWriter, r *http.Request,
+	kvpairs map[string]string, item bool) {
+	if r.Method == http.MethodOptions {
+		h.serveOptions(w, r, kvpairs, item)
+		return
+	}
+	e := h.example(r.Method, item)
+	if e == nil {
+		panic(ErrNotImplemented)
+	}
+	b, err := json.Marshal(e.Response)
+	if err != nil {
+		panic(err)
+	}
+	if r.Method == http.MethodPost && h.StatusPolicy == STATUS_STRICT {
+		w.WriteHeader(http.StatusCreated)
+	}
+	if _, err = w.Write(b); err != nil {
+		panic(err)
+	}
+}
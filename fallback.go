@@ -0,0 +1,96 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"encoding/json"
+	"github.com/golang/glog"
+	"net/http"
+)
+
+// Fallback is a response sent instead of errors of a status class,
+// e.g. an empty collection or a maintenance message when the database
+// is down. It applies after stale copies, see WithStaleCache.
+type Fallback struct {
+	// Class is the first digit of the statuses replaced, e.g. 5
+	// for 5xx.
+	Class int
+	// Item and Collection select the requests covered. If neither
+	// is set, both are.
+	Item       bool
+	Collection bool
+	// Methods are the methods covered, default GET and HEAD. Writes
+	// should only be covered with an error StatusCode, lest clients
+	// believe they succeeded.
+	Methods []string
+	// StatusCode, default 200, and Body, marshaled to JSON, are
+	// sent instead of the error.
+	StatusCode int
+	Body       interface{}
+	// Handler, if set, serves the request instead of StatusCode
+	// and Body.
+	Handler Handler
+}
+
+func (f *Fallback) covers(method string, status int, item bool) bool {
+	if status/100 != f.Class || !f.coversMethod(method) {
+		return false
+	}
+	if !f.Item && !f.Collection {
+		return true
+	}
+	return item && f.Item || !item && f.Collection
+}
+
+func (f *Fallback) coversMethod(method string) bool {
+	if f.Methods == nil {
+		return method == http.MethodGet || method == http.MethodHead
+	}
+	for _, m := range f.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// fallback sends the first of h.Fallbacks covering an error of status
+// and reports whether there is one.
+func (h *RESTHandler) fallback(w http.ResponseWriter, r *http.Request,
+	kvpairs map[string]string, status int) bool {
+	item := kvpairs[h.Key] != ""
+	for _, f := range h.Fallbacks {
+		if !f.covers(r.Method, status, item) {
+			continue
+		}
+		glog.Warningf("%s %s: %d replaced by fallback", r.Method, r.URL,
+			status)
+		if f.Handler != nil {
+			f.Handler.ServeHTTP(w, r, kvpairs)
+			return true
+		}
+		b, err := json.Marshal(f.Body)
+		if err != nil {
+			glog.Errorf("%s fallback: %v", h.Name, err)
+			return false
+		}
+		if f.StatusCode != 0 {
+			w.WriteHeader(f.StatusCode)
+		}
+		w.Write(b)
+		return true
+	}
+	return false
+}
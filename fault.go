@@ -0,0 +1,88 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// FaultInjector is a middleware for testing client resilience in
+// staging. Each fault happens on the given fraction of requests.
+type FaultInjector struct {
+	// Latency is added before serving
+	Latency     time.Duration
+	LatencyRate float64
+	// ErrorStatus, default 500, is sent instead of serving
+	ErrorStatus int
+	ErrorRate   float64
+	// TruncateRate is the fraction of responses cut in half, after
+	// which the connection is aborted.
+	TruncateRate float64
+	// Rand returns a number in [0, 1), default math/rand.Float64
+	Rand func() float64
+}
+
+func (t *FaultInjector) hit(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	random := t.Rand
+	if random == nil {
+		random = rand.Float64
+	}
+	return random() < rate
+}
+
+// Wrap returns a Handler that serves next with faults injected.
+func (t *FaultInjector) Wrap(next Handler) Handler {
+	return HandlerFunc(func(w http.ResponseWriter, r *http.Request,
+		kvpairs map[string]string) {
+		if t.hit(t.LatencyRate) {
+			select {
+			case <-time.After(t.Latency):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if t.hit(t.ErrorRate) {
+			status := t.ErrorStatus
+			if status == 0 {
+				status = http.StatusInternalServerError
+			}
+			sendJSONMsg(w, r, status, "Injected fault")
+			return
+		}
+		if !t.hit(t.TruncateRate) {
+			next.ServeHTTP(w, r, kvpairs)
+			return
+		}
+		tw := &bufferWriter{ResponseWriter: w}
+		next.ServeHTTP(tw, r, kvpairs)
+		if tw.status == 0 {
+			tw.status = http.StatusOK
+		}
+		// announce the full length so the client notices the cut
+		w.Header().Set("Content-Length", strconv.Itoa(tw.buf.Len()))
+		w.WriteHeader(tw.status)
+		w.Write(tw.buf.Bytes()[:tw.buf.Len()/2])
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		panic(http.ErrAbortHandler)
+	})
+}
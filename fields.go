@@ -0,0 +1,73 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// FieldPolicy decides whether request bodies may carry fields unknown
+// to DataType.
+type FieldPolicy int
+
+const (
+	// FIELDS_VERSION follows the policy declared for the API version
+	// with SetFieldPolicy, and is lenient without one.
+	FIELDS_VERSION FieldPolicy = iota
+	// FIELDS_LENIENT ignores unknown fields.
+	FIELDS_LENIENT
+	// FIELDS_STRICT rejects unknown fields with 400.
+	FIELDS_STRICT
+)
+
+var versionPattern = regexp.MustCompile(`^v[0-9]+$`)
+
+var fieldPolicies = struct {
+	sync.RWMutex
+	m map[string]FieldPolicy
+}{m: make(map[string]FieldPolicy)}
+
+// SetFieldPolicy declares the FieldPolicy of API version, e.g. "v2",
+// which is the first segment of request paths such as /v2/books/1.
+// Handlers whose FieldPolicy is FIELDS_VERSION follow it.
+func SetFieldPolicy(version string, p FieldPolicy) {
+	fieldPolicies.Lock()
+	defer fieldPolicies.Unlock()
+	fieldPolicies.m[version] = p
+}
+
+// apiVersion returns the API version in path, or "".
+func apiVersion(path string) string {
+	s := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]
+	if !versionPattern.MatchString(s) {
+		return ""
+	}
+	return s
+}
+
+// strictFields tells whether unknown fields in the body of r are
+// rejected.
+func (h *RESTHandler) strictFields(r *http.Request) bool {
+	p := h.FieldPolicy
+	if p == FIELDS_VERSION {
+		fieldPolicies.RLock()
+		p = fieldPolicies.m[apiVersion(r.URL.Path)]
+		fieldPolicies.RUnlock()
+	}
+	return p == FIELDS_STRICT
+}
@@ -0,0 +1,215 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"bytes"
+	"encoding/json"
+	"hash/fnv"
+	"net/http"
+	"reflect"
+)
+
+// TAG_FLAG is the `calm' struct tag option gating a field behind a
+// feature flag, e.g. `calm:"flag=new_price"'. Gated fields are left
+// out of responses unless the flag is enabled.
+const TAG_FLAG = "flag"
+
+// FlagContext is what a feature flag is evaluated for.
+type FlagContext struct {
+	Request *http.Request
+	Kvpairs map[string]string
+	// Principal and Tenant identify the caller, if known
+	Principal string
+	Tenant    string
+}
+
+// FlagProvider tells whether feature flags are enabled. Providers
+// backed by a flag service must be safe for concurrent use and should
+// answer from a local copy of the rules.
+type FlagProvider interface {
+	Enabled(flag string, c *FlagContext) bool
+}
+
+// FlagProviderFunc adapts an ordinary function to FlagProvider.
+type FlagProviderFunc func(flag string, c *FlagContext) bool
+
+func (f FlagProviderFunc) Enabled(flag string, c *FlagContext) bool {
+	return f(flag, c)
+}
+
+// FlagRule tells who a flag of StaticFlags is enabled for.
+type FlagRule struct {
+	// On enables the flag for everybody
+	On         bool
+	Principals []string
+	Tenants    []string
+	// Percent of callers enabled, chosen by a hash of the flag and
+	// the principal, or the tenant without one, so that each caller
+	// keeps its answer.
+	Percent int
+}
+
+// StaticFlags is a FlagProvider of fixed rules by flag name. Unknown
+// flags are disabled.
+type StaticFlags map[string]FlagRule
+
+func contains(a []string, s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (s StaticFlags) Enabled(flag string, c *FlagContext) bool {
+	rule, ok := s[flag]
+	switch {
+	case !ok:
+		return false
+	case rule.On:
+		return true
+	case c.Principal != "" && contains(rule.Principals, c.Principal):
+		return true
+	case c.Tenant != "" && contains(rule.Tenants, c.Tenant):
+		return true
+	}
+	who := c.Principal
+	if who == "" {
+		who = c.Tenant
+	}
+	if who == "" || rule.Percent <= 0 {
+		return false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(flag + "\n" + who))
+	return int(h.Sum32()%100) < rule.Percent
+}
+
+// Flags evaluates feature flags of Provider for requests.
+type Flags struct {
+	Provider FlagProvider
+	// Principal and Tenant identify the caller, e.g. from
+	// SUBJECT_KEY or a path variable. Optional.
+	Principal func(r *http.Request, kvpairs map[string]string) string
+	Tenant    func(r *http.Request, kvpairs map[string]string) string
+}
+
+// Enabled tells whether flag is enabled for the request.
+func (t *Flags) Enabled(flag string, r *http.Request,
+	kvpairs map[string]string) bool {
+	c := &FlagContext{Request: r, Kvpairs: kvpairs}
+	if t.Principal != nil {
+		c.Principal = t.Principal(r, kvpairs)
+	}
+	if t.Tenant != nil {
+		c.Tenant = t.Tenant(r, kvpairs)
+	}
+	return t.Provider.Enabled(flag, c)
+}
+
+// FeatureGate is a middleware serving requests only if Flag is
+// enabled, and 404 otherwise as if the endpoint did not exist.
+type FeatureGate struct {
+	Flags *Flags
+	Flag  string
+}
+
+func (t *FeatureGate) Wrap(next Handler) Handler {
+	return HandlerFunc(func(w http.ResponseWriter, r *http.Request,
+		kvpairs map[string]string) {
+		if !t.Flags.Enabled(t.Flag, r, kvpairs) {
+			sendError(w, r, ErrNotFound)
+			return
+		}
+		next.ServeHTTP(w, r, kvpairs)
+	})
+}
+
+// flagOf returns the flag gating f, or "".
+func flagOf(f reflect.StructField) string {
+	if flags := tagValues(f, TAG_FLAG); len(flags) != 0 {
+		return flags[0]
+	}
+	return ""
+}
+
+// hasFlags reports whether values of type t may contain gated fields.
+func hasFlags(t reflect.Type) bool {
+	return hasFields(TAG_FLAG, t, func(f reflect.StructField) bool {
+		return flagOf(f) != ""
+	})
+}
+
+// dropFields removes from v, the decoded JSON of a value of type t,
+// the fields whose flag is not enabled.
+func dropFields(t reflect.Type, v interface{}, enabled func(string) bool) {
+	walkFields(t, v, func(f reflect.StructField, name string,
+		m map[string]interface{}) bool {
+		if flag := flagOf(f); flag != "" && !enabled(flag) {
+			delete(m, name)
+			return false
+		}
+		return true
+	})
+}
+
+// shape rewrites b, the JSON response to r: fields of disabled flags
+// are removed, times are sent in UTC if h.Times is set and renamed
+// fields are also sent under their old names.
+// Responses are cached as they come from Model so that this is done
+// per request.
+func (h *RESTHandler) shape(r *http.Request, kvpairs map[string]string,
+	b []byte) []byte {
+	gate := h.Flags != nil && hasFlags(h.DataType)
+	alias := hasRenamed(h.DataType)
+	times := h.normalizesTimes(h.DataType)
+	if !gate && !alias && !times {
+		return b
+	}
+	t := h.DataType
+	if kvpairs[h.Key] == "" {
+		t = reflect.SliceOf(t)
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		panic(err)
+	}
+	if gate {
+		enabled := make(map[string]bool)
+		dropFields(t, v, func(flag string) bool {
+			on, ok := enabled[flag]
+			if !ok {
+				on = h.Flags.Enabled(flag, r, kvpairs)
+				enabled[flag] = on
+			}
+			return on
+		})
+	}
+	if times {
+		v = normalizeTimes(t, v, h.Times)
+	}
+	if alias {
+		renameFields(t, v, true)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
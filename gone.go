@@ -0,0 +1,69 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"context"
+	"github.com/golang/glog"
+	"net/http"
+	"sync/atomic"
+)
+
+const (
+	// CLIENT_GONE_STATUS is the status, never sent, of requests
+	// whose client disconnected, as logged by nginx.
+	CLIENT_GONE_STATUS = 499
+	CLIENT_GONE        = "Client Closed Request"
+)
+
+// ErrClientGone stops serving a request whose client disconnected.
+var ErrClientGone *Error = &Error{
+	StatusCode: CLIENT_GONE_STATUS,
+	Message:    CLIENT_GONE,
+}
+
+// isGone reports whether the client of r disconnected, net/http then
+// canceling its context.
+func isGone(r *http.Request) bool {
+	return r.Context().Err() == context.Canceled
+}
+
+// goneOr returns ErrClientGone instead of err if the client of r
+// disconnected, err then being a consequence, e.g. context.Canceled.
+func goneOr(r *http.Request, err error) error {
+	if err != nil && isGone(r) {
+		return ErrClientGone
+	}
+	return err
+}
+
+// clientGone logs and counts a request abandoned by its client, which
+// gets no response.
+func (h *RESTHandler) clientGone(r *http.Request) {
+	glog.Infof("%s %s: %d %s", r.Method, r.URL, CLIENT_GONE_STATUS,
+		CLIENT_GONE)
+	if h.gone != nil {
+		atomic.AddInt64(h.gone, 1)
+	}
+}
+
+// ClientsGone returns the number of requests whose client disconnected
+// before the response was sent.
+func (h *RESTHandler) ClientsGone() int64 {
+	if h.gone == nil {
+		return 0
+	}
+	return atomic.LoadInt64(h.gone)
+}
@@ -0,0 +1,107 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"net/http"
+	"sync/atomic"
+)
+
+// SCHEMA_MISMATCH is the message of requests refused by SchemaGuard.
+const SCHEMA_MISMATCH = "Schema version mismatch"
+
+// States of a guarded RESTHandler
+const (
+	schemaOK int32 = iota
+	schemaReadOnly
+	schemaRefused
+)
+
+// SchemaVersioner is implemented by models that can tell the schema
+// version of their backend.
+type SchemaVersioner interface {
+	SchemaVersion() (string, error)
+}
+
+// SchemaGuard stops a RESTHandler from serving a backend whose schema
+// version is not the one expected by the binary, e.g. during rolling
+// deploys.
+type SchemaGuard struct {
+	// Expect is the schema version the binary is built for
+	Expect string
+	// ReadOnly keeps serving reads on mismatch instead of refusing
+	// everything.
+	ReadOnly bool
+}
+
+// CheckSchema compares the schema version reported by Model with
+// h.SchemaGuard. On mismatch or failure it stops serving writes, or
+// everything unless ReadOnly, and returns the error. It is called by
+// NewRESTHandler and may be called again, e.g. by a Scheduler, to
+// resume once versions match.
+func (h *RESTHandler) CheckSchema() error {
+	g := h.SchemaGuard
+	if g == nil {
+		return nil
+	}
+	m, ok := h.Model.(SchemaVersioner)
+	if !ok {
+		return errors.New("Model does not implement SchemaVersioner")
+	}
+	version, err := m.SchemaVersion()
+	if err == nil && version != g.Expect {
+		err = fmt.Errorf("schema version %s, expect %s", version,
+			g.Expect)
+	}
+	if err == nil {
+		atomic.StoreInt32(&h.schemaState, schemaOK)
+		return nil
+	}
+	state := schemaRefused
+	if g.ReadOnly {
+		state = schemaReadOnly
+	}
+	if atomic.SwapInt32(&h.schemaState, state) != state {
+		glog.Errorf("%s: %v", h.Name, err)
+	}
+	return err
+}
+
+// guard panics if r is refused by h.SchemaGuard.
+func (h *RESTHandler) guard(r *http.Request) {
+	if err := h.refused(r); err != nil {
+		panic(err)
+	}
+}
+
+// refused returns the error of r if it is refused by h.SchemaGuard.
+func (h *RESTHandler) refused(r *http.Request) error {
+	switch atomic.LoadInt32(&h.schemaState) {
+	case schemaReadOnly:
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			return nil
+		}
+	case schemaOK:
+		return nil
+	}
+	return &Error{
+		StatusCode: http.StatusServiceUnavailable,
+		Message:    SCHEMA_MISMATCH,
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Headers of HMAC signed requests
+const (
+	SIGNATURE_HEADER           = "X-Signature"
+	SIGNATURE_KEY_HEADER       = "X-Signature-Key"
+	SIGNATURE_TIMESTAMP_HEADER = "X-Signature-Timestamp"
+	// SIGNATURE_KEY is the name in kvpairs of the verified key id
+	SIGNATURE_KEY = "_signature_key"
+)
+
+// readBody reads the body of r and replaces it so it can be read
+// again.
+func readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(b))
+	return b, nil
+}
+
+// signature computes the hex HMAC-SHA256 over method, request URI,
+// timestamp and body digest, separated by newlines.
+func signature(secret []byte, r *http.Request, timestamp string,
+	body []byte) string {
+	digest := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(r.Method + "\n" + r.URL.RequestURI() + "\n" +
+		timestamp + "\n" + hex.EncodeToString(digest[:])))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest signs r with the secret of keyID for verification by
+// HMACVerifier. It must be called right before sending r.
+func SignRequest(r *http.Request, keyID string, secret []byte) error {
+	body, err := readBody(r)
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	r.Header.Set(SIGNATURE_KEY_HEADER, keyID)
+	r.Header.Set(SIGNATURE_TIMESTAMP_HEADER, timestamp)
+	r.Header.Set(SIGNATURE_HEADER, signature(secret, r, timestamp, body))
+	return nil
+}
+
+// HMACVerifier is a middleware verifying HMAC signed requests made by
+// SignRequest. A signature is only accepted once and within Window of
+// its timestamp.
+type HMACVerifier struct {
+	// Secret returns the secret of keyID, or nil if unknown
+	Secret func(keyID string) []byte
+	// Window is the accepted clock skew, default 5 minutes
+	Window time.Duration
+
+	mutex sync.Mutex
+	seen  map[string]bool
+	// expiring lists seen in the order they expire
+	expiring []seenSignature
+}
+
+type seenSignature struct {
+	sig     string
+	expires time.Time
+}
+
+func (t *HMACVerifier) window() time.Duration {
+	if t.Window == 0 {
+		return 5 * time.Minute
+	}
+	return t.Window
+}
+
+// replayed records sig and reports whether it has been seen before.
+func (t *HMACVerifier) replayed(sig string, now time.Time) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.seen == nil {
+		t.seen = make(map[string]bool)
+	}
+	for len(t.expiring) != 0 && now.After(t.expiring[0].expires) {
+		delete(t.seen, t.expiring[0].sig)
+		t.expiring = t.expiring[1:]
+	}
+	if t.seen[sig] {
+		return true
+	}
+	t.seen[sig] = true
+	t.expiring = append(t.expiring,
+		seenSignature{sig, now.Add(2 * t.window())})
+	return false
+}
+
+// Verify checks the signature of r.
+func (t *HMACVerifier) Verify(r *http.Request) error {
+	unauthorized := &Error{
+		StatusCode: http.StatusUnauthorized,
+		Message:    "Invalid signature",
+	}
+	keyID := r.Header.Get(SIGNATURE_KEY_HEADER)
+	timestamp := r.Header.Get(SIGNATURE_TIMESTAMP_HEADER)
+	sig := r.Header.Get(SIGNATURE_HEADER)
+	secret := t.Secret(keyID)
+	if secret == nil || sig == "" {
+		return unauthorized
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return unauthorized
+	}
+	now := time.Now()
+	skew := math.Abs(float64(now.Unix() - ts))
+	if skew > t.window().Seconds() {
+		return &Error{
+			StatusCode: http.StatusUnauthorized,
+			Message:    "Signature expired",
+		}
+	}
+	body, err := readBody(r)
+	if err != nil {
+		return err
+	}
+	expect := signature(secret, r, timestamp, body)
+	if !hmac.Equal([]byte(sig), []byte(expect)) {
+		return unauthorized
+	}
+	if t.replayed(sig, now) {
+		return &Error{
+			StatusCode: http.StatusUnauthorized,
+			Message:    "Signature replayed",
+		}
+	}
+	return nil
+}
+
+// Wrap returns a Handler that serves next only for correctly signed
+// requests, putting the key id into kvpairs as SIGNATURE_KEY.
+func (t *HMACVerifier) Wrap(next Handler) Handler {
+	return HandlerFunc(func(w http.ResponseWriter, r *http.Request,
+		kvpairs map[string]string) {
+		if err := t.Verify(r); err != nil {
+			sendError(w, r, err)
+			return
+		}
+		kvpairs[SIGNATURE_KEY] = r.Header.Get(SIGNATURE_KEY_HEADER)
+		next.ServeHTTP(w, r, kvpairs)
+	})
+}
@@ -0,0 +1,205 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// LOCALES_KEY is the name in kvpairs of the comma separated
+	// language tags accepted by the client, most preferred first.
+	LOCALES_KEY = "_locales"
+	// LOCALE_KEY is the name in kvpairs of the locale chosen from
+	// RESTHandler.Locales.
+	LOCALE_KEY = "_locale"
+)
+
+// Catalog translates messages generated by gocalm.
+type Catalog interface {
+	// Translate returns msg in language lang with count n, or ""
+	// if it has no translation.
+	Translate(lang, msg string, n int) string
+}
+
+// MapCatalog is a Catalog backed by maps of language tag to message
+// to plural forms. The first form is singular, the second one, if
+// any, is used when n != 1.
+type MapCatalog map[string]map[string][]string
+
+func (c MapCatalog) Translate(lang, msg string, n int) string {
+	forms := c[lang][msg]
+	switch {
+	case len(forms) == 0:
+		return ""
+	case n != 1 && len(forms) > 1:
+		return forms[1]
+	}
+	return forms[0]
+}
+
+var builtinCatalog = MapCatalog{
+	"zh-TW": {
+		SUCCESS:       {"成功"},
+		NOT_FOUND:     {"找不到"},
+		NOT_ALLOWED:   {"不允許的方法"},
+		TYPE_MISMATCH: {"型別不符"},
+		EMPTY_BODY:    {"請求內容為空"},
+		TRAILING_DATA: {"JSON 之後有多餘的資料"},
+		NOT_ACCEPTABLE: {
+			"支援的 Content-Type: application/json"},
+		VERSION_CONFLICT:    {"版本衝突"},
+		UNSUPPORTED_CHARSET: {"支援的字元集: utf-8"},
+	},
+	"zh-CN": {
+		SUCCESS:       {"成功"},
+		NOT_FOUND:     {"未找到"},
+		NOT_ALLOWED:   {"不允许的方法"},
+		TYPE_MISMATCH: {"类型不匹配"},
+		EMPTY_BODY:    {"请求内容为空"},
+		TRAILING_DATA: {"JSON 之后有多余的数据"},
+		NOT_ACCEPTABLE: {
+			"支持的 Content-Type: application/json"},
+		VERSION_CONFLICT:    {"版本冲突"},
+		UNSUPPORTED_CHARSET: {"支持的字符集: utf-8"},
+	},
+}
+
+var catalogs = struct {
+	sync.RWMutex
+	a []Catalog
+}{a: []Catalog{builtinCatalog}}
+
+// RegisterCatalog adds c to the catalogs used to translate messages.
+// Catalogs registered later take precedence.
+func RegisterCatalog(c Catalog) {
+	catalogs.Lock()
+	defer catalogs.Unlock()
+	catalogs.a = append([]Catalog{c}, catalogs.a...)
+}
+
+// normalizeTag returns the language tag with the language in lower
+// case and a two letter region in upper case, e.g. zh-TW.
+func normalizeTag(tag string) string {
+	parts := strings.Split(strings.ToLower(tag), "-")
+	for i := 1; i < len(parts); i++ {
+		if len(parts[i]) == 2 {
+			parts[i] = strings.ToUpper(parts[i])
+		}
+	}
+	return strings.Join(parts, "-")
+}
+
+// languages returns the normalized language tags in the
+// Accept-Language header of r ordered by quality. Tags with q=0 are
+// dropped.
+func languages(r *http.Request) []string {
+	type lang struct {
+		tag string
+		q   float64
+	}
+	langs := []lang{}
+	for _, h := range r.Header["Accept-Language"] {
+		for _, element := range strings.Split(h, ",") {
+			params := strings.Split(element, ";")
+			tag := normalizeTag(strings.TrimSpace(params[0]))
+			if tag == "" {
+				continue
+			}
+			q := 1.0
+			for _, p := range params[1:] {
+				p = strings.TrimSpace(p)
+				if !strings.HasPrefix(p, "q=") {
+					continue
+				}
+				f, err := strconv.ParseFloat(p[2:], 64)
+				if err == nil {
+					q = f
+				}
+			}
+			if q > 0 {
+				langs = append(langs, lang{tag, q})
+			}
+		}
+	}
+	sort.SliceStable(langs, func(i, j int) bool {
+		return langs[i].q > langs[j].q
+	})
+	tags := make([]string, len(langs))
+	for i, l := range langs {
+		tags[i] = l.tag
+	}
+	return tags
+}
+
+// Translate returns msg in the language most preferred by the client
+// of r for which a translation exists, or msg itself. A language also
+// matches its prefix, e.g. fr-FR matches fr, as in matchLocale.
+func Translate(r *http.Request, msg string, n int) string {
+	catalogs.RLock()
+	defer catalogs.RUnlock()
+	for _, lang := range languages(r) {
+		for {
+			for _, c := range catalogs.a {
+				if s := c.Translate(lang, msg, n); s != "" {
+					return s
+				}
+			}
+			i := strings.LastIndex(lang, "-")
+			if i < 0 {
+				break
+			}
+			lang = lang[:i]
+		}
+	}
+	return msg
+}
+
+// matchLocale returns the first of the ranked tags supported, or the
+// first supported locale if there is no match. A tag also matches a
+// supported locale that is its prefix, e.g. en-US matches en.
+func matchLocale(tags []string, supported []string) string {
+	for _, tag := range tags {
+		for {
+			for _, s := range supported {
+				if strings.EqualFold(tag, s) {
+					return s
+				}
+			}
+			i := strings.LastIndex(tag, "-")
+			if i < 0 {
+				break
+			}
+			tag = tag[:i]
+		}
+	}
+	return supported[0]
+}
+
+// setLocales puts the ranked languages of the client into kvpairs as
+// LOCALES_KEY and the best match of h.Locales as LOCALE_KEY.
+func (h *RESTHandler) setLocales(r *http.Request,
+	kvpairs map[string]string) {
+	if len(h.Locales) == 0 {
+		return
+	}
+	tags := languages(r)
+	kvpairs[LOCALES_KEY] = strings.Join(tags, ",")
+	kvpairs[LOCALE_KEY] = matchLocale(tags, h.Locales)
+}
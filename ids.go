@@ -0,0 +1,210 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Value of the `calm' struct tag marking the id field of DataType. It
+// must be a string or an integer.
+const TAG_ID = "id"
+
+// IDGenerator generates ids for new objects. Set
+// RESTHandler.IDGenerator to have gocalm fill the id field of objects
+// before Post.
+type IDGenerator interface {
+	NewID() (string, error)
+}
+
+// IDGeneratorFunc adapts an ordinary function to IDGenerator.
+type IDGeneratorFunc func() (string, error)
+
+func (f IDGeneratorFunc) NewID() (string, error) {
+	return f()
+}
+
+// Ready-made generators.
+var (
+	UUIDv4 IDGenerator = IDGeneratorFunc(newUUIDv4)
+	UUIDv7 IDGenerator = IDGeneratorFunc(newUUIDv7)
+	ULID   IDGenerator = IDGeneratorFunc(newULID)
+)
+
+func formatUUID(b []byte) string {
+	s := hex.EncodeToString(b)
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] +
+		"-" + s[20:32]
+}
+
+func newUUIDv4() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return formatUUID(b), nil
+}
+
+// putMillis writes the lower 48 bits of the unix time in milliseconds
+// in big endian into b[0:6].
+func putMillis(b []byte, t time.Time) {
+	ms := uint64(t.UnixNano() / int64(time.Millisecond))
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], ms)
+	copy(b[:6], buf[2:])
+}
+
+func newUUIDv7() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b[6:]); err != nil {
+		return "", err
+	}
+	putMillis(b, time.Now())
+	b[6] = b[6]&0x0f | 0x70
+	b[8] = b[8]&0x3f | 0x80
+	return formatUUID(b), nil
+}
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+func newULID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b[6:]); err != nil {
+		return "", err
+	}
+	putMillis(b, time.Now())
+	// 128 bits as 26 base32 digits, the first one holding 3 bits
+	hi := binary.BigEndian.Uint64(b[:8])
+	lo := binary.BigEndian.Uint64(b[8:])
+	s := make([]byte, 26)
+	for i := 25; i >= 0; i-- {
+		s[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(s), nil
+}
+
+// SNOWFLAKE_EPOCH is the custom epoch of Snowflake ids, 2015-01-01
+// in unix milliseconds.
+const SNOWFLAKE_EPOCH = 1420070400000
+
+// Snowflake generates 63-bit time ordered integer ids made of 41 bits
+// of milliseconds since SNOWFLAKE_EPOCH, a 10-bit node number and a
+// 12-bit sequence.
+type Snowflake struct {
+	mutex    sync.Mutex
+	node     int64
+	last     int64
+	sequence int64
+}
+
+// NewSnowflake returns a Snowflake generator for node, which must be
+// unique among running instances and less than 1024.
+func NewSnowflake(node int64) (*Snowflake, error) {
+	if node < 0 || node >= 1<<10 {
+		return nil, errors.New("snowflake node must be in [0, 1024)")
+	}
+	return &Snowflake{node: node}, nil
+}
+
+func (s *Snowflake) NewID() (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now().UnixNano()/int64(time.Millisecond) - SNOWFLAKE_EPOCH
+	if now < s.last {
+		return "", errors.New("clock moved backwards")
+	}
+	if now == s.last {
+		s.sequence = (s.sequence + 1) & (1<<12 - 1)
+		if s.sequence == 0 {
+			// sequence exhausted, wait for the next millisecond
+			for now <= s.last {
+				time.Sleep(time.Millisecond)
+				now = time.Now().UnixNano()/
+					int64(time.Millisecond) - SNOWFLAKE_EPOCH
+			}
+		}
+	} else {
+		s.sequence = 0
+	}
+	s.last = now
+	return strconv.FormatInt(now<<22|s.node<<12|s.sequence, 10), nil
+}
+
+// assignID sets the field tagged TAG_ID of v, a pointer to struct, to
+// a new id from g unless it is already set.
+func assignID(v interface{}, g IDGenerator) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+	rv = rv.Elem()
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		if !hasTag(rt.Field(i), TAG_ID) {
+			continue
+		}
+		field := rv.Field(i)
+		if !field.CanSet() || !isZero(field) {
+			return nil
+		}
+		id, err := g.NewID()
+		if err != nil {
+			return err
+		}
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(id)
+		case reflect.Int, reflect.Int32, reflect.Int64:
+			n, err := strconv.ParseInt(id, 10, 64)
+			if err != nil {
+				return err
+			}
+			if field.OverflowInt(n) {
+				return fmt.Errorf("id %s overflows %s", id, field.Type())
+			}
+			field.SetInt(n)
+		case reflect.Uint, reflect.Uint32, reflect.Uint64:
+			n, err := strconv.ParseUint(id, 10, 64)
+			if err != nil {
+				return err
+			}
+			if field.OverflowUint(n) {
+				return fmt.Errorf("id %s overflows %s", id, field.Type())
+			}
+			field.SetUint(n)
+		default:
+			return errors.New("id field must be string or integer")
+		}
+		return nil
+	}
+	return nil
+}
+
+func isZero(v reflect.Value) bool {
+	return reflect.DeepEqual(v.Interface(),
+		reflect.Zero(v.Type()).Interface())
+}
@@ -0,0 +1,70 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"net/http"
+	"strings"
+)
+
+// IMMUTABLE_CACHE_CONTROL is sent on GET responses of immutable
+// resources. max-age is a year, the longest RFC 9111 suggests.
+const IMMUTABLE_CACHE_CONTROL = "public, max-age=31536000, immutable"
+
+// NEVER_EXPIRE is the cache expiration of immutable resources, which
+// stay cached until evicted.
+const NEVER_EXPIRE = -1
+
+// Immutable makes every object of a RESTHandler immutable, see
+// WithImmutable.
+func Immutable(kvpairs map[string]string) bool {
+	return true
+}
+
+// immutable tells whether the object or collection in kvpairs is
+// immutable.
+func (h *RESTHandler) immutable(kvpairs map[string]string) bool {
+	return h.ImmutableFunc != nil && h.ImmutableFunc(kvpairs)
+}
+
+// frozen tells whether the GET response to kvpairs never changes,
+// which only holds for objects as collections still grow.
+func (h *RESTHandler) frozen(kvpairs map[string]string) bool {
+	return kvpairs[h.Key] != "" && h.immutable(kvpairs)
+}
+
+// freeze answers mutations of immutable resources with 405, letting
+// POST through to collections, and marks GET responses to immutable
+// objects as immutable. It returns false if r is rejected.
+func (h *RESTHandler) freeze(w http.ResponseWriter, r *http.Request,
+	kvpairs map[string]string) bool {
+	if !h.immutable(kvpairs) {
+		return true
+	}
+	item := kvpairs[h.Key] != ""
+	switch {
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		if item {
+			w.Header().Set("Cache-Control", IMMUTABLE_CACHE_CONTROL)
+		}
+	case r.Method == http.MethodOptions:
+	case r.Method == http.MethodPost && !item:
+	default:
+		w.Header().Set("Allow", strings.Join(h.allowed(kvpairs, item), ", "))
+		sendError(w, r, ErrNotImplemented)
+		return false
+	}
+	return true
+}
@@ -15,74 +15,229 @@
 package gocalm
 
 import (
+	"bytes"
 	"encoding/json"
 	"github.com/golang/glog"
+	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
-	"regexp"
+	"reflect"
+	"strconv"
 	"strings"
 )
 
-// readJSON reads from http.Request, decode it as a JSON object into
-// v, then return the read []byte and error if any.
-func readJSON(v interface{}, r *http.Request) (b []byte, err error) {
-	body := r.Body
-	defer body.Close()
-	b, err = ioutil.ReadAll(body)
-	if err != nil {
-		glog.Errorln(err)
-		return
+// UNSUPPORTED_CHARSET is the message of ErrUnsupportedCharset.
+const UNSUPPORTED_CHARSET = "Supported charset: utf-8"
+
+// ErrUnsupportedCharset refuses request bodies in other encodings than
+// UTF-8, of which US-ASCII is a subset.
+var ErrUnsupportedCharset *Error = &Error{
+	StatusCode: http.StatusUnsupportedMediaType,
+	Message:    UNSUPPORTED_CHARSET,
+}
+
+var (
+	utf8BOM = []byte{0xef, 0xbb, 0xbf}
+	utf16BE = []byte{0xfe, 0xff}
+	utf16LE = []byte{0xff, 0xfe}
+)
+
+// readUTF8 reads the body of r, without the UTF-8 byte order mark some
+// clients prepend. A charset other than UTF-8 in Content-Type, or a
+// UTF-16 byte order mark, gives ErrUnsupportedCharset.
+func readUTF8(r *http.Request) ([]byte, error) {
+	defer r.Body.Close()
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err == nil {
+		switch strings.ToLower(params["charset"]) {
+		case "", "utf-8", "utf8", "us-ascii":
+		default:
+			return nil, ErrUnsupportedCharset
+		}
 	}
-	err = json.Unmarshal(b, v)
+	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(b, utf16BE) || bytes.HasPrefix(b, utf16LE) {
+		return nil, ErrUnsupportedCharset
+	}
+	return bytes.TrimPrefix(b, utf8BOM), nil
+}
+
+// readJSON reads from http.Request with readUTF8, decode it as a JSON
+// object into v, then return the read []byte and error if any. An
+// empty body, invalid JSON or data after the JSON value gives a 400
+// Error, a JSON value of the wrong type ErrTypeMismatch. Old names of
+// renamed fields, see TAG_WAS, are understood. If strict, fields
+// unknown to v give a 400 Error too. If number, numbers decoded into
+// interface{} values are json.Number instead of float64.
+func readJSON(v interface{}, r *http.Request, strict, number bool) (
+	b []byte, err error) {
+	if b, err = readUTF8(r); err != nil {
 		glog.Warningln(err)
+		return
+	}
+	if len(bytes.TrimSpace(b)) == 0 {
+		return b, ErrEmptyBody
+	}
+	data := b
+	if t := reflect.TypeOf(v); hasRenamed(t) {
+		// on error leave it to the decoder to report
+		if data, err = unrename(t, b); err != nil {
+			data = b
+		}
+	}
+	d := json.NewDecoder(bytes.NewReader(data))
+	if strict {
+		d.DisallowUnknownFields()
+	}
+	if number {
+		d.UseNumber()
+	}
+	if err = d.Decode(v); err == nil {
+		if _, err = d.Token(); err == io.EOF {
+			return b, nil
+		}
+		err = ErrTrailingData
+	}
+	glog.Warningln(err)
+	switch err.(type) {
+	case *Error:
+	case *json.UnmarshalTypeError:
+		err = ErrTypeMismatch
+	default:
+		err = &Error{
+			StatusCode: http.StatusBadRequest,
+			Message:    err.Error(),
+		}
 	}
 	return
 }
 
-var mediaRange *regexp.Regexp
-var lws *regexp.Regexp
+// mediaRange is an element of the Accept header
+type mediaRange struct {
+	atype    string
+	asubtype string
+	params   int
+	q        float64
+}
+
+// parseAccept parses Accept header values as defined in RFC 7231
+// section 5.3.2. Invalid elements are skipped.
+func parseAccept(accepts []string) []mediaRange {
+	ranges := []mediaRange{}
+	for _, accept := range accepts {
+		for _, element := range strings.Split(accept, ",") {
+			params := strings.Split(element, ";")
+			types := strings.Split(strings.TrimSpace(params[0]), "/")
+			if len(types) != 2 || types[0] == "" || types[1] == "" ||
+				types[0] == "*" && types[1] != "*" {
+				glog.Warningf("Invalid media range: %s", element)
+				continue
+			}
+			m := mediaRange{
+				atype:    strings.ToLower(types[0]),
+				asubtype: strings.ToLower(types[1]),
+				q:        1,
+			}
+			for _, p := range params[1:] {
+				kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+				if len(kv) != 2 {
+					continue
+				}
+				if strings.ToLower(kv[0]) != "q" {
+					m.params++
+					continue
+				}
+				// accept-params start at q, ignore extensions
+				q, err := strconv.ParseFloat(kv[1], 64)
+				if err == nil && q >= 0 && q <= 1 {
+					m.q = q
+				}
+				break
+			}
+			ranges = append(ranges, m)
+		}
+	}
+	return ranges
+}
 
-// acceptJSON check the HTTP Accept header to see if application/json
-// is accepted.
-func acceptJSON(accept string) bool {
-	accept = lws.ReplaceAllString(accept, "")
-	elements := strings.Split(accept, ",")
-	for _, element := range elements {
-		match := mediaRange.FindStringSubmatch(element)
-		if match == nil {
-			glog.Warningf("Invalid Content-Type: %s\n", element)
-			return false
+// quality returns the quality of media type offer according to the
+// most specific matching range, or -1 if none matches.
+func quality(ranges []mediaRange, offer string) float64 {
+	types := strings.SplitN(offer, "/", 2)
+	q := -1.0
+	specificity := -1
+	for _, m := range ranges {
+		s := 0
+		switch {
+		case m.atype == types[0] && m.asubtype == types[1]:
+			s = 2
+		case m.atype == types[0] && m.asubtype == "*":
+			s = 1
+		case m.atype == "*":
+			s = 0
+		default:
+			continue
 		}
-		atype := match[1]
-		asubtype := match[2]
-		if (atype == "*" || atype == "application") &&
-			(asubtype == "*" || asubtype == "json") {
-			return true
+		s = s*100 + m.params
+		if s > specificity {
+			specificity = s
+			q = m.q
 		}
 	}
-	return false
+	return q
 }
 
-func init() {
-	var err error
+// negotiate chooses the media type in offers with the highest quality
+// in the Accept header values. Ties go to the earlier offer. Without
+// any Accept header the first offer is chosen. ok is false if no
+// offer is acceptable.
+func negotiate(accepts []string, offers []string) (offer string, ok bool) {
+	if len(accepts) == 0 {
+		return offers[0], true
+	}
+	ranges := parseAccept(accepts)
+	best := 0.0
+	for _, o := range offers {
+		if q := quality(ranges, o); q > best {
+			best = q
+			offer = o
+		}
+	}
+	return offer, best > 0
+}
 
-	// Accept         = "Accept" ":"
-	//                  #( media-range [ accept-params ] )
-	// media-range    = ( "*/*"
-	//                  | ( type "/" "*" )
-	//                  | ( type "/" subtype )
-	//                  ) *( ";" parameter )
-	// accept-params  = ";" "q" "=" qvalue *( accept-extension )
-	// accept-extension = ";" token [ "=" ( token | quoted-string ) ]
-	mediaRange, err = regexp.Compile(`([[:alnum:]\*]+)/([[:alnum:]\*]+).*`)
-	if err != nil {
-		panic(err)
+// unmarshal decodes the JSON b into v, using json.Number for numbers
+// in interface{} values if number.
+func unmarshal(b []byte, v interface{}, number bool) error {
+	if !number {
+		return json.Unmarshal(b, v)
 	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	return d.Decode(v)
+}
 
-	// LWS            = [CRLF] 1*( SP | HT )
-	lws, err = regexp.Compile(`[\r\n][ \t]+`)
+// mergeFields marshals v, which must be encoded as a JSON object, and
+// adds fields to it. Existing fields with the same names are
+// replaced.
+func mergeFields(v interface{}, fields map[string]interface{}) (
+	map[string]json.RawMessage, error) {
+	b, err := json.Marshal(v)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	m := make(map[string]json.RawMessage)
+	if err = json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	for k, f := range fields {
+		if m[k], err = json.Marshal(f); err != nil {
+			return nil, err
+		}
 	}
+	return m, nil
 }
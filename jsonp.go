@@ -0,0 +1,71 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"net/http"
+	"regexp"
+)
+
+// CALLBACK_PARAM is the query parameter naming the JSONP callback.
+const CALLBACK_PARAM = "callback"
+
+var callbackName *regexp.Regexp
+
+// jsonpCallback returns the JSONP callback requested by r if JSONP is
+// enabled on h. A callback that is not a plain JavaScript identifier
+// path is rejected with 400.
+func (h *RESTHandler) jsonpCallback(r *http.Request) string {
+	if !h.JSONP || r.Method != http.MethodGet {
+		return ""
+	}
+	callback := r.URL.Query().Get(CALLBACK_PARAM)
+	if callback == "" {
+		return ""
+	}
+	if len(callback) > 128 || !callbackName.MatchString(callback) {
+		panic(&Error{
+			StatusCode: http.StatusBadRequest,
+			Message:    "Invalid callback",
+		})
+	}
+	return callback
+}
+
+// jsonpBody returns b wrapped in a call to callback and sets the
+// headers of a script. The leading comment defends against Rosetta
+// Flash style attacks.
+func jsonpBody(w http.ResponseWriter, callback string, b []byte) []byte {
+	header := w.Header()
+	header.Set("Content-Type", "application/javascript; charset=utf-8")
+	header.Set("X-Content-Type-Options", "nosniff")
+	buf := make([]byte, 0, len(callback)+len(b)+8)
+	buf = append(buf, "/**/"...)
+	buf = append(buf, callback...)
+	buf = append(buf, '(')
+	buf = append(buf, b...)
+	buf = append(buf, ");"...)
+	return buf
+}
+
+func init() {
+	var err error
+
+	callbackName, err = regexp.Compile(
+		`^[[:alpha:]_$][[:alnum:]_$]*(\.[[:alpha:]_$][[:alnum:]_$]*)*$`)
+	if err != nil {
+		panic(err)
+	}
+}
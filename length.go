@@ -0,0 +1,42 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// BUFFER_MAX is the default of RESTHandler.BufferMax.
+const BUFFER_MAX = 1 << 20
+
+// bufferMax returns the size limit of responses sent with
+// Content-Length.
+func (h *RESTHandler) bufferMax() int {
+	if h.BufferMax == 0 {
+		return BUFFER_MAX
+	}
+	return h.BufferMax
+}
+
+// setLength sets the Content-Length of a response body of n bytes if
+// it is at most max, so that keep-alive connections need no chunked
+// encoding and HEAD tells the size. Larger bodies are left to net/http
+// to send chunked.
+func setLength(w http.ResponseWriter, n int, max int) {
+	if n <= max {
+		w.Header().Set("Content-Length", strconv.Itoa(n))
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"net/http"
+	"strings"
+)
+
+// link sets the Allow header and RFC 8288 Link headers to related
+// resources of a GET response: "edit" for items that can be changed,
+// "collection" for items and "describedby" for the schema. URLs are
+// built from Route, CollectionRoute and SchemaRoute. Nothing is sent
+// unless CollectionRoute or SchemaRoute is set.
+func (h *RESTHandler) link(w http.ResponseWriter, r *http.Request,
+	kvpairs map[string]string, item bool) {
+	if h.CollectionRoute == "" && h.SchemaRoute == "" {
+		return
+	}
+	header := w.Header()
+	allowed := h.allowed(kvpairs, item)
+	header.Set("Allow", strings.Join(allowed, ", "))
+	add := func(rel, name string) {
+		p, err := URLFor(name, kvpairs)
+		if err != nil {
+			glog.Warningf("%s link %s: %v", h.Name, rel, err)
+			return
+		}
+		header.Add("Link", fmt.Sprintf(`<%s>; rel="%s"`, AbsoluteURL(r, p),
+			rel))
+	}
+	if item && h.Route != "" && (contains(allowed, http.MethodPut) ||
+		contains(allowed, http.MethodPatch) ||
+		contains(allowed, http.MethodDelete)) {
+		add("edit", h.Route)
+	}
+	if item && h.CollectionRoute != "" {
+		add("collection", h.CollectionRoute)
+	}
+	if h.SchemaRoute != "" {
+		add("describedby", h.SchemaRoute)
+	}
+}
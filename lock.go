@@ -0,0 +1,227 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// TAG_VERSION marks an integer field holding the version of objects,
+// e.g. `calm:"version"'. POST sets it to 1. PUT and PATCH must carry
+// the stored version, or fail with ErrVersionConflict, and increment
+// it. PATCH documents carry it with a replace operation, and are not
+// checked without one. gocalm checks the version before calling
+// Model, so Model must still write only if the stored version is one
+// less than the new one to rule out concurrent writes in between.
+const TAG_VERSION = "version"
+
+const VERSION_CONFLICT = "Version conflict"
+
+var ErrVersionConflict *Error = &Error{
+	StatusCode: http.StatusConflict,
+	Message:    VERSION_CONFLICT,
+}
+
+var ErrPreconditionRequired *Error = &Error{
+	StatusCode: http.StatusPreconditionRequired,
+	Message:    http.StatusText(http.StatusPreconditionRequired),
+}
+
+var ErrPreconditionFailed *Error = &Error{
+	StatusCode: http.StatusPreconditionFailed,
+	Message:    http.StatusText(http.StatusPreconditionFailed),
+}
+
+// versionIndex returns the index of the field of struct type t
+// tagged TAG_VERSION, or -1.
+func versionIndex(t reflect.Type) int {
+	if t.Kind() != reflect.Struct {
+		return -1
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		switch f.Type.Kind() {
+		case reflect.Int, reflect.Int32, reflect.Int64:
+			if hasTag(f, TAG_VERSION) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// versionField returns the version field of v, a pointer to struct,
+// if any.
+func versionField(v interface{}) (reflect.Value, bool) {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if !rv.IsValid() {
+		return rv, false
+	}
+	i := versionIndex(rv.Type())
+	if i < 0 {
+		return rv, false
+	}
+	return rv.Field(i), true
+}
+
+// storedVersion returns the version of v as returned by Model, which
+// need not be of DataType.
+func (h *RESTHandler) storedVersion(v interface{}) (int64, error) {
+	if field, ok := versionField(v); ok {
+		return field.Int(), nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+	o := reflect.New(h.DataType).Interface()
+	if err = json.Unmarshal(b, o); err != nil {
+		return 0, err
+	}
+	field, _ := versionField(o)
+	return field.Int(), nil
+}
+
+// lock checks that the version of v, the new object, is the one of
+// stored, then increments it. Objects without a version field and a
+// nil stored are let through.
+func (h *RESTHandler) lock(stored, v interface{}) error {
+	field, ok := versionField(v)
+	if !ok || stored == nil {
+		return nil
+	}
+	n, err := h.storedVersion(stored)
+	if err != nil {
+		return err
+	}
+	if field.Int() != n {
+		return ErrVersionConflict
+	}
+	field.SetInt(n + 1)
+	return nil
+}
+
+// initVersion sets the version of v, a new object, to 1.
+func initVersion(v interface{}) {
+	if field, ok := versionField(v); ok && field.CanSet() {
+		field.SetInt(1)
+	}
+}
+
+// Merger is implemented by models resolving version conflicts of
+// PATCH.
+type Merger interface {
+	// Merge returns mine, the patched object, merged with theirs,
+	// the stored one. original is the object as of the version mine
+	// is based on, or nil if unknown. Merge returns
+	// ErrVersionConflict if they cannot be merged.
+	Merge(original, theirs, mine interface{}) (interface{}, error)
+}
+
+// revisionAt returns object id as of version n from Versions, or nil.
+func (h *RESTHandler) revisionAt(id string, n int64) (interface{}, error) {
+	if h.Versions == nil {
+		return nil, nil
+	}
+	list, err := h.Versions.List(h.Name, id)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(list) - 1; i >= 0; i-- {
+		if list[i].Deleted {
+			continue
+		}
+		v := reflect.New(h.DataType).Interface()
+		if err = json.Unmarshal(list[i].Data, v); err != nil {
+			return nil, err
+		}
+		if field, ok := versionField(v); ok && field.Int() == n {
+			return v, nil
+		}
+	}
+	return nil, nil
+}
+
+// merge resolves the version conflict of mine with Merge of Model, if
+// implemented, and returns the merged object with the next version.
+func (h *RESTHandler) merge(id string, theirs, mine interface{}) (
+	interface{}, error) {
+	m, ok := h.Model.(Merger)
+	if !ok {
+		return nil, ErrVersionConflict
+	}
+	field, _ := versionField(mine)
+	original, err := h.revisionAt(id, field.Int())
+	if err != nil {
+		return nil, err
+	}
+	merged, err := m.Merge(original, theirs, mine)
+	if err != nil {
+		return nil, err
+	}
+	n, err := h.storedVersion(theirs)
+	if err != nil {
+		return nil, err
+	}
+	if field, ok = versionField(merged); !ok {
+		return nil, ErrTypeMismatch
+	}
+	field.SetInt(n + 1)
+	return merged, nil
+}
+
+// ifMatch checks the If-Match header of r, which must hold the version
+// of stored, e.g. If-Match: "3", or "*".
+func (h *RESTHandler) ifMatch(r *http.Request, stored interface{}) error {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return ErrPreconditionRequired
+	}
+	n, err := h.storedVersion(stored)
+	if err != nil {
+		return err
+	}
+	version := strconv.FormatInt(n, 10)
+	for _, t := range strings.Split(header, ",") {
+		t = strings.Trim(strings.TrimSpace(t), `"`)
+		if t == "*" || t == version {
+			return nil
+		}
+	}
+	return ErrPreconditionFailed
+}
+
+// lastRepresentation returns what GET would send of the object to be
+// deleted, after checking If-Match if it has a version.
+func (h *RESTHandler) lastRepresentation(r *http.Request,
+	kvpairs map[string]string) (interface{}, error) {
+	v, err := h.getPrimary(kvpairs)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, ErrNotFound
+	}
+	if versionIndex(h.DataType) >= 0 {
+		if err = h.ifMatch(r, v); err != nil {
+			return nil, err
+		}
+	}
+	return h.represent(r, kvpairs, v)
+}
@@ -0,0 +1,227 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+)
+
+// MemoryModel is a ModelInterface keeping objects of a DataType in
+// memory, e.g. for sandboxes and tests. Objects are stored as JSON so
+// callers never share them. Ids come from the field tagged calm:"id"
+// or else are consecutive integers, and GetAll lists objects in
+// creation order, so the same seed always gives the same data.
+type MemoryModel struct {
+	// Key is the name of the id in kvpairs
+	Key      string
+	DataType reflect.Type
+	// UseNumber decodes numbers in interface{} values as json.Number
+	UseNumber bool
+
+	mutex   sync.RWMutex
+	ids     []string
+	objects map[string][]byte
+	last    int64
+}
+
+// NewMemoryModel returns a MemoryModel of dataType objects filled with
+// seed, whose elements are posted in order.
+func NewMemoryModel(key string, dataType reflect.Type,
+	seed ...interface{}) (*MemoryModel, error) {
+	m := &MemoryModel{
+		Key:      key,
+		DataType: dataType,
+		objects:  make(map[string][]byte),
+	}
+	for _, v := range seed {
+		if _, err := m.Post(nil, v); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// idOf returns the value of the field tagged TAG_ID of v, a pointer to
+// struct, or "" if there is none.
+func idOf(v interface{}) string {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return ""
+	}
+	rv = rv.Elem()
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		if hasTag(rt.Field(i), TAG_ID) {
+			return fmt.Sprint(rv.Field(i).Interface())
+		}
+	}
+	return ""
+}
+
+// decode returns a new DataType object decoded from b.
+func (m *MemoryModel) decode(b []byte) (interface{}, error) {
+	v := reflect.New(m.DataType).Interface()
+	if err := unmarshal(b, v, m.UseNumber); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func (m *MemoryModel) Get(kvpairs map[string]string) (interface{}, error) {
+	m.mutex.RLock()
+	b, ok := m.objects[kvpairs[m.Key]]
+	m.mutex.RUnlock()
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return m.decode(b)
+}
+
+func (m *MemoryModel) GetAll(kvpairs map[string]string) (interface{}, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	a := reflect.MakeSlice(reflect.SliceOf(m.DataType), 0, len(m.ids))
+	for _, id := range m.ids {
+		v, err := m.decode(m.objects[id])
+		if err != nil {
+			return nil, err
+		}
+		a = reflect.Append(a, reflect.ValueOf(v).Elem())
+	}
+	return a.Interface(), nil
+}
+
+func (m *MemoryModel) Put(kvpairs map[string]string, v interface{}) error {
+	id := kvpairs[m.Key]
+	// keep the id field if the body leaves it out
+	err := assignID(v, IDGeneratorFunc(func() (string, error) {
+		return id, nil
+	}))
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.objects[id]; !ok {
+		return ErrNotFound
+	}
+	m.objects[id] = b
+	return nil
+}
+
+func (m *MemoryModel) PutAll(kvpairs map[string]string, v interface{}) error {
+	return ErrNotImplemented
+}
+
+func (m *MemoryModel) Patch(kvpairs map[string]string, original interface{},
+	patched interface{}) error {
+	return m.Put(kvpairs, patched)
+}
+
+func (m *MemoryModel) Post(kvpairs map[string]string, v interface{}) (
+	string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	next := IDGeneratorFunc(func() (string, error) {
+		return strconv.FormatInt(m.last+1, 10), nil
+	})
+	if err := assignID(v, next); err != nil {
+		return "", err
+	}
+	id := idOf(v)
+	if id == "" {
+		id = strconv.FormatInt(m.last+1, 10)
+	}
+	if _, ok := m.objects[id]; ok {
+		return "", &Error{
+			StatusCode: http.StatusConflict,
+			Message:    fmt.Sprintf("%s already exists", id),
+		}
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	m.last++
+	m.ids = append(m.ids, id)
+	m.objects[id] = b
+	return id, nil
+}
+
+func (m *MemoryModel) Delete(kvpairs map[string]string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	id := kvpairs[m.Key]
+	if _, ok := m.objects[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.objects, id)
+	for i, s := range m.ids {
+		if s == id {
+			m.ids = append(m.ids[:i], m.ids[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (m *MemoryModel) DeleteAll(kvpairs map[string]string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.ids = nil
+	m.objects = make(map[string][]byte)
+	return nil
+}
+
+// sandbox holds the seed of WithSandbox
+type sandbox struct {
+	seed []interface{}
+}
+
+// enterSandbox replaces h.Model as requested by WithSandbox, and
+// drops h.ReadModel so that GET is served by the sandbox too.
+func (h *RESTHandler) enterSandbox() error {
+	if h.sandbox == nil {
+		return nil
+	}
+	h.ReadModel = nil
+	if len(h.sandbox.seed) == 0 {
+		if len(h.examples) == 0 {
+			return errors.New("sandbox needs seed or examples")
+		}
+		h.Model = nil
+		return nil
+	}
+	if h.DataType == nil {
+		return errors.New("DataType is nil")
+	}
+	m, err := NewMemoryModel(h.Key, h.DataType, h.sandbox.seed...)
+	if err != nil {
+		return err
+	}
+	m.UseNumber = h.UseNumber
+	h.Model = m
+	return nil
+}
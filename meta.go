@@ -0,0 +1,259 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Values of the `calm' struct tag managed by gocalm. Fields tagged
+// TAG_CREATED_AT or TAG_UPDATED_AT must be time.Time or *time.Time,
+// fields tagged TAG_CREATED_BY or TAG_UPDATED_BY must be string.
+const (
+	TAG_NAME       = "calm"
+	TAG_CREATED_AT = "created_at"
+	TAG_UPDATED_AT = "updated_at"
+	TAG_CREATED_BY = "created_by"
+	TAG_UPDATED_BY = "updated_by"
+)
+
+// PRINCIPAL_KEY is the name in kvpairs of the caller told by
+// RESTHandler.Principal, set for the Model on changes.
+const PRINCIPAL_KEY = "_principal"
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// Clock tells the time used for metadata fields and revisions, so
+// that tests can fix it.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// SystemClock is the default Clock returning time.Now.
+var SystemClock Clock = systemClock{}
+
+// hasTag reports whether the `calm' tag of f contains option.
+func hasTag(f reflect.StructField, option string) bool {
+	for _, o := range strings.Split(f.Tag.Get(TAG_NAME), ",") {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+// tagValues returns the values of the `calm' tag options of f in the
+// form option=value.
+func tagValues(f reflect.StructField, option string) []string {
+	var values []string
+	for _, o := range strings.Split(f.Tag.Get(TAG_NAME), ",") {
+		if strings.HasPrefix(o, option+"=") {
+			values = append(values, o[len(option)+1:])
+		}
+	}
+	return values
+}
+
+// fieldSearch is a type searched by hasFields for the fields of kind.
+type fieldSearch struct {
+	kind string
+	t    reflect.Type
+}
+
+// searched caches the answers of hasFields
+var searched sync.Map
+
+// hasFields reports whether values of type t may contain struct fields
+// that match accepts, caching the answer under kind.
+func hasFields(kind string, t reflect.Type,
+	match func(reflect.StructField) bool) bool {
+	k := fieldSearch{kind, t}
+	if v, ok := searched.Load(k); ok {
+		return v.(bool)
+	}
+	b := searchFields(t, match, make(map[reflect.Type]bool))
+	searched.Store(k, b)
+	return b
+}
+
+func searchFields(t reflect.Type, match func(reflect.StructField) bool,
+	seen map[reflect.Type]bool) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return searchFields(t.Elem(), match, seen)
+	case reflect.Struct:
+		if seen[t] {
+			return false
+		}
+		seen[t] = true
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if match(f) || searchFields(f.Type, match, seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// walkFields calls visit for every field of the objects in v, the
+// decoded JSON of a value of type t, with its JSON name and the object
+// m holding it. The value of the field is walked too if visit returns
+// true. Fields of embedded structs are visited as fields of m.
+func walkFields(t reflect.Type, v interface{}, visit func(
+	f reflect.StructField, name string, m map[string]interface{}) bool) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array:
+		if a, ok := v.([]interface{}); ok {
+			for _, e := range a {
+				walkFields(t.Elem(), e, visit)
+			}
+		}
+	case reflect.Map:
+		if m, ok := v.(map[string]interface{}); ok {
+			for _, e := range m {
+				walkFields(t.Elem(), e, visit)
+			}
+		}
+	case reflect.Struct:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return
+		}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.Anonymous && f.Tag.Get("json") == "" {
+				ft := f.Type
+				if ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				if ft.Kind() == reflect.Struct {
+					walkFields(ft, m, visit)
+					continue
+				}
+			}
+			name := jsonName(f)
+			if name != "" && visit(f, name, m) {
+				walkFields(f.Type, m[name], visit)
+			}
+		}
+	}
+}
+
+// setTime sets field to now if it is time.Time or *time.Time.
+func setTime(field reflect.Value, now time.Time) {
+	switch {
+	case field.Type() == timeType:
+		field.Set(reflect.ValueOf(now))
+	case field.Kind() == reflect.Ptr && field.Type().Elem() == timeType:
+		field.Set(reflect.ValueOf(&now))
+	}
+}
+
+// stamp sets the metadata fields of v, a pointer to struct. Creation
+// fields are only set if create is true. who is left unset if empty.
+func stamp(v interface{}, now time.Time, who string, create bool) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return
+	}
+	rv = rv.Elem()
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		field := rv.Field(i)
+		if !field.CanSet() {
+			continue
+		}
+		if hasTag(f, TAG_UPDATED_AT) || create && hasTag(f, TAG_CREATED_AT) {
+			setTime(field, now)
+		}
+		if who == "" || field.Kind() != reflect.String {
+			continue
+		}
+		if hasTag(f, TAG_UPDATED_BY) || create && hasTag(f, TAG_CREATED_BY) {
+			field.SetString(who)
+		}
+	}
+}
+
+// hasCreation reports whether struct type t has creation fields.
+func hasCreation(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return false
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if hasTag(f, TAG_CREATED_AT) || hasTag(f, TAG_CREATED_BY) {
+			return true
+		}
+	}
+	return false
+}
+
+// keepCreation copies the creation fields of stored into v, a pointer
+// to struct, so that clients can neither forge nor erase them. If
+// stored is nil they are set as for a new object.
+func keepCreation(stored, v interface{}, now time.Time, who string) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return
+	}
+	rv = rv.Elem()
+	var sv reflect.Value
+	if stored != nil {
+		sv = reflect.Indirect(reflect.ValueOf(stored))
+		if sv.Type() != rv.Type() {
+			return
+		}
+	}
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		field := rv.Field(i)
+		if !field.CanSet() ||
+			!hasTag(f, TAG_CREATED_AT) && !hasTag(f, TAG_CREATED_BY) {
+			continue
+		}
+		switch {
+		case sv.IsValid():
+			field.Set(sv.Field(i))
+		case hasTag(f, TAG_CREATED_AT):
+			setTime(field, now)
+		case who != "" && field.Kind() == reflect.String:
+			field.SetString(who)
+		default:
+			field.Set(reflect.Zero(field.Type()))
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/golang/glog"
+	"reflect"
+	"sync"
+)
+
+// fingerprints caches the schema fingerprint of each DataType
+var fingerprints sync.Map
+
+// Fingerprint returns a short digest of the JSON Schema of t, which
+// changes whenever fields are added, removed, renamed or retyped.
+func Fingerprint(t reflect.Type) string {
+	if f, ok := fingerprints.Load(t); ok {
+		return f.(string)
+	}
+	b, err := json.Marshal(JSONSchema(t))
+	if err != nil {
+		panic(err)
+	}
+	sum := md5.Sum(b)
+	f := hex.EncodeToString(sum[:4])
+	fingerprints.Store(t, f)
+	return f
+}
+
+// cacheVersion prefixes cached values so entries written for another
+// DataType schema are not served.
+func (h *RESTHandler) cacheVersion() string {
+	if h.CacheVersion != "" {
+		return h.CacheVersion
+	}
+	return Fingerprint(h.DataType)
+}
+
+// versioned prepends the cache version to value.
+func (h *RESTHandler) versioned(value []byte) []byte {
+	version := h.cacheVersion()
+	b := make([]byte, 0, len(version)+1+len(value))
+	b = append(b, version...)
+	b = append(b, '\n')
+	return append(b, value...)
+}
+
+// unversioned strips the cache version from value, migrating it with
+// h.MigrateCache if it is from another version. It returns nil if the
+// value cannot be used.
+func (h *RESTHandler) unversioned(key string, value []byte) []byte {
+	i := bytes.IndexByte(value, '\n')
+	if i < 0 {
+		return nil
+	}
+	version := string(value[:i])
+	value = value[i+1:]
+	if version == h.cacheVersion() {
+		return value
+	}
+	if h.MigrateCache == nil {
+		glog.V(1).Infof("memcache Get '%s' version %s", key, version)
+		return nil
+	}
+	value, err := h.MigrateCache(version, value)
+	if err != nil {
+		glog.Warningf("memcache Get '%s' migrate %s: %v", key, version,
+			err)
+		return nil
+	}
+	if value != nil {
+		h.cacheSet(key, value, h.expiration())
+	}
+	return value
+}
@@ -0,0 +1,427 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SUBJECT_KEY is the name in kvpairs of the subject of a validated
+// OAuth2 token.
+const SUBJECT_KEY = "_subject"
+
+// ErrInvalidToken is returned by TokenValidator for tokens that are
+// malformed, expired or not active.
+var ErrInvalidToken = errors.New("invalid token")
+
+// TokenInfo is what a TokenValidator knows about a valid token.
+type TokenInfo struct {
+	Subject  string
+	ClientID string
+	Scopes   []string
+	Expiry   time.Time
+}
+
+// HasScope reports whether the token is granted scope.
+func (t *TokenInfo) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenValidator validates OAuth2 bearer tokens.
+type TokenValidator interface {
+	Validate(token string) (*TokenInfo, error)
+}
+
+// Introspector validates tokens with an RFC 7662 introspection
+// endpoint.
+type Introspector struct {
+	Endpoint     string
+	ClientID     string
+	ClientSecret string
+	// Client defaults to http.DefaultClient
+	Client *http.Client
+}
+
+func (t *Introspector) Validate(token string) (*TokenInfo, error) {
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	form := url.Values{"token": {token}}
+	req, err := http.NewRequest(http.MethodPost, t.Endpoint,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if t.ClientID != "" {
+		req.SetBasicAuth(t.ClientID, t.ClientSecret)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspection: %s", res.Status)
+	}
+	v := struct {
+		Active   bool   `json:"active"`
+		Scope    string `json:"scope"`
+		ClientID string `json:"client_id"`
+		Subject  string `json:"sub"`
+		Exp      int64  `json:"exp"`
+	}{}
+	if err = json.NewDecoder(res.Body).Decode(&v); err != nil {
+		return nil, err
+	}
+	if !v.Active {
+		return nil, ErrInvalidToken
+	}
+	info := &TokenInfo{
+		Subject:  v.Subject,
+		ClientID: v.ClientID,
+		Scopes:   strings.Fields(v.Scope),
+	}
+	if v.Exp != 0 {
+		info.Expiry = time.Unix(v.Exp, 0)
+	}
+	return info, nil
+}
+
+// JWKSValidator validates RS256 and ES256 signed JWT access tokens
+// with keys fetched from a JWKS endpoint.
+type JWKSValidator struct {
+	URL string
+	// Issuer and Audience, if set, must match the claims
+	Issuer   string
+	Audience string
+	// Client defaults to http.DefaultClient
+	Client *http.Client
+
+	mutex   sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// JWKS_REFRESH_MIN is the minimum interval between fetches of the key
+// set triggered by unknown key ids.
+const JWKS_REFRESH_MIN = time.Minute
+
+func decodeSegment(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := decodeSegment(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// fetch reloads the key set. The caller holds t.mutex.
+func (t *JWKSValidator) fetch() error {
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	t.fetched = time.Now()
+	res, err := client.Get(t.URL)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("jwks: %s", res.Status)
+	}
+	set := struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}{}
+	if err = json.NewDecoder(res.Body).Decode(&set); err != nil {
+		return err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		switch {
+		case k.Kty == "RSA":
+			n, err := decodeBigInt(k.N)
+			if err != nil {
+				return err
+			}
+			e, err := decodeBigInt(k.E)
+			if err != nil {
+				return err
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case k.Kty == "EC" && k.Crv == "P-256":
+			x, err := decodeBigInt(k.X)
+			if err != nil {
+				return err
+			}
+			y, err := decodeBigInt(k.Y)
+			if err != nil {
+				return err
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{
+				Curve: elliptic.P256(), X: x, Y: y}
+		}
+	}
+	t.keys = keys
+	return nil
+}
+
+// key returns the public key kid, fetching the key set if needed.
+func (t *JWKSValidator) key(kid string) (crypto.PublicKey, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if k, ok := t.keys[kid]; ok {
+		return k, nil
+	}
+	if time.Since(t.fetched) >= JWKS_REFRESH_MIN || t.keys == nil {
+		if err := t.fetch(); err != nil {
+			return nil, err
+		}
+	}
+	if k, ok := t.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, ErrInvalidToken
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed string,
+	sig []byte) bool {
+	digest := sha256.Sum256([]byte(signed))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return alg == "RS256" && rsa.VerifyPKCS1v15(
+			k, crypto.SHA256, digest[:], sig) == nil
+	case *ecdsa.PublicKey:
+		if alg != "ES256" || len(sig) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(k, digest[:], r, s)
+	}
+	return false
+}
+
+// audience is the JWT aud claim, a string or an array of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+func (t *JWKSValidator) Validate(token string) (*TokenInfo, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+	b, err := decodeSegment(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if err = json.Unmarshal(b, &header); err != nil {
+		return nil, ErrInvalidToken
+	}
+	sig, err := decodeSegment(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	key, err := t.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if !verifySignature(header.Alg, key, parts[0]+"."+parts[1], sig) {
+		return nil, ErrInvalidToken
+	}
+	if b, err = decodeSegment(parts[1]); err != nil {
+		return nil, ErrInvalidToken
+	}
+	claims := struct {
+		Issuer   string   `json:"iss"`
+		Audience audience `json:"aud"`
+		Subject  string   `json:"sub"`
+		ClientID string   `json:"client_id"`
+		Scope    string   `json:"scope"`
+		Exp      int64    `json:"exp"`
+		Nbf      int64    `json:"nbf"`
+	}{}
+	if err = json.Unmarshal(b, &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	now := time.Now().Unix()
+	if claims.Exp == 0 || now >= claims.Exp || now < claims.Nbf {
+		return nil, ErrInvalidToken
+	}
+	if t.Issuer != "" && claims.Issuer != t.Issuer {
+		return nil, ErrInvalidToken
+	}
+	if t.Audience != "" {
+		ok := false
+		for _, a := range claims.Audience {
+			ok = ok || a == t.Audience
+		}
+		if !ok {
+			return nil, ErrInvalidToken
+		}
+	}
+	return &TokenInfo{
+		Subject:  claims.Subject,
+		ClientID: claims.ClientID,
+		Scopes:   strings.Fields(claims.Scope),
+		Expiry:   time.Unix(claims.Exp, 0),
+	}, nil
+}
+
+// cachedToken is a validation result kept by OAuth2.
+type cachedToken struct {
+	info    *TokenInfo
+	expires time.Time
+}
+
+// OAuth2 is a resource server middleware accepting bearer tokens
+// validated by Validator.
+type OAuth2 struct {
+	Validator TokenValidator
+	// Realm reported in WWW-Authenticate
+	Realm string
+	// Scope returns the scope required by r. The default requires
+	// SCOPE_READ for GET, HEAD and OPTIONS, SCOPE_WRITE otherwise.
+	Scope func(r *http.Request) string
+	// CacheTTL is how long validation results are kept, bounded by
+	// the token expiry. 0 disables the cache.
+	CacheTTL time.Duration
+
+	mutex sync.Mutex
+	cache map[[sha256.Size]byte]cachedToken
+}
+
+// OAUTH2_CACHE_MAX bounds the number of cached validation results.
+const OAUTH2_CACHE_MAX = 10000
+
+func (t *OAuth2) validate(token string) (*TokenInfo, error) {
+	if t.CacheTTL <= 0 {
+		return t.Validator.Validate(token)
+	}
+	sum := sha256.Sum256([]byte(token))
+	now := time.Now()
+	t.mutex.Lock()
+	c, ok := t.cache[sum]
+	t.mutex.Unlock()
+	if ok && now.Before(c.expires) {
+		return c.info, nil
+	}
+	info, err := t.Validator.Validate(token)
+	if err != nil {
+		return nil, err
+	}
+	expires := now.Add(t.CacheTTL)
+	if !info.Expiry.IsZero() && info.Expiry.Before(expires) {
+		expires = info.Expiry
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.cache == nil || len(t.cache) >= OAUTH2_CACHE_MAX {
+		t.cache = make(map[[sha256.Size]byte]cachedToken)
+	}
+	t.cache[sum] = cachedToken{info, expires}
+	return info, nil
+}
+
+// challenge sends status with an RFC 6750 WWW-Authenticate header.
+func (t *OAuth2) challenge(w http.ResponseWriter, r *http.Request,
+	status int, params ...string) {
+	c := fmt.Sprintf(`Bearer realm="%s"`, t.Realm)
+	for i := 0; i+1 < len(params); i += 2 {
+		c += fmt.Sprintf(`, %s="%s"`, params[i], params[i+1])
+	}
+	w.Header().Set("WWW-Authenticate", c)
+	sendJSONMsg(w, r, status, http.StatusText(status))
+}
+
+// Wrap returns a Handler that serves next only for requests with a
+// valid bearer token granted the required scope. The subject of the
+// token is put into kvpairs as SUBJECT_KEY.
+func (t *OAuth2) Wrap(next Handler) Handler {
+	return HandlerFunc(func(w http.ResponseWriter, r *http.Request,
+		kvpairs map[string]string) {
+		auth := r.Header.Get("Authorization")
+		if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+			t.challenge(w, r, http.StatusUnauthorized)
+			return
+		}
+		info, err := t.validate(strings.TrimSpace(auth[7:]))
+		if err == ErrInvalidToken {
+			t.challenge(w, r, http.StatusUnauthorized,
+				"error", "invalid_token")
+			return
+		}
+		if err != nil {
+			sendInternalError(err, w, r)
+			return
+		}
+		scope := defaultScope(r)
+		if t.Scope != nil {
+			scope = t.Scope(r)
+		}
+		if scope != "" && !info.HasScope(scope) {
+			t.challenge(w, r, http.StatusForbidden,
+				"error", "insufficient_scope", "scope", scope)
+			return
+		}
+		kvpairs[SUBJECT_KEY] = info.Subject
+		next.ServeHTTP(w, r, kvpairs)
+	})
+}
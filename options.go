@@ -0,0 +1,513 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bradfitz/gomemcache/memcache"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// DEFAULT_KEY is the name of the primary key used by NewRESTHandler
+// unless WithKey is given.
+const DEFAULT_KEY = "id"
+
+// Option configures a RESTHandler created by NewRESTHandler.
+type Option func(h *RESTHandler) error
+
+// NewRESTHandler creates a RESTHandler serving model, applies opts in
+// order and validates the result, so a misconfigured handler fails
+// here instead of at request time.
+func NewRESTHandler(name string, model ModelInterface, opts ...Option) (
+	*RESTHandler, error) {
+	h := &RESTHandler{
+		Name:  name,
+		Model: model,
+		Key:   DEFAULT_KEY,
+	}
+	h.cacheStats = &cacheStats{}
+	h.purgeState = &purgeState{}
+	h.gone = new(int64)
+	for _, opt := range opts {
+		if err := opt(h); err != nil {
+			return nil, fmt.Errorf("RESTHandler %s: %v", name, err)
+		}
+	}
+	if err := h.enterSandbox(); err != nil {
+		return nil, fmt.Errorf("RESTHandler %s: %v", name, err)
+	}
+	if err := h.validate(); err != nil {
+		return nil, fmt.Errorf("RESTHandler %s: %v", name, err)
+	}
+	if err := h.checkComputed(); err != nil {
+		return nil, fmt.Errorf("RESTHandler %s: %v", name, err)
+	}
+	// a mismatch is logged, and h refuses requests until a later
+	// CheckSchema passes
+	h.CheckSchema()
+	return h, nil
+}
+
+// validate checks required fields of h.
+func (h *RESTHandler) validate() error {
+	switch {
+	case h.Name == "":
+		return errors.New("Name is empty")
+	case h.Model == nil && len(h.examples) == 0:
+		return errors.New("Model is nil without examples")
+	case h.DataType == nil:
+		return errors.New("DataType is nil")
+	case h.Key == "":
+		return errors.New("Key is empty")
+	case h.Expiration < 0:
+		return errors.New("Expiration is negative")
+	case h.MarshalWorkers < 0:
+		return errors.New("MarshalWorkers is negative")
+	case h.Expiration != 0 && h.Cache == nil && h.LocalCache == nil:
+		return errors.New("Cache is nil while Expiration is set")
+	case h.TTLFunc != nil && h.Cache == nil && h.LocalCache == nil:
+		return errors.New("Cache is nil while TTLFunc is set")
+	case h.LocalExpiration < 0:
+		return errors.New("LocalExpiration is negative")
+	case h.StaleExpiration < 0:
+		return errors.New("StaleExpiration is negative")
+	case h.BufferMax < 0:
+		return errors.New("BufferMax is negative")
+	case h.StaleExpiration != 0 && h.Cache == nil && h.LocalCache == nil:
+		return errors.New("Cache is nil while StaleExpiration is set")
+	}
+	return nil
+}
+
+// WithDataType sets DataType to the type of v, which may be a value
+// or a pointer to it.
+func WithDataType(v interface{}) Option {
+	return func(h *RESTHandler) error {
+		t := reflect.TypeOf(v)
+		if t == nil {
+			return errors.New("DataType is nil")
+		}
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		h.DataType = t
+		return nil
+	}
+}
+
+// WithKey sets the name of the primary key in request path.
+func WithKey(key string) Option {
+	return func(h *RESTHandler) error {
+		h.Key = key
+		return nil
+	}
+}
+
+// WithCache enables caching in memcache for the given seconds.
+func WithCache(cache *memcache.Client, seconds int32) Option {
+	return func(h *RESTHandler) error {
+		if cache == nil {
+			return errors.New("Cache is nil")
+		}
+		h.Cache = cache
+		h.Expiration = seconds
+		return nil
+	}
+}
+
+// WithStaleCache keeps responses for the given seconds to be served
+// when Model fails. It requires WithCache or WithLocalCache.
+func WithStaleCache(seconds int32) Option {
+	return func(h *RESTHandler) error {
+		h.StaleExpiration = seconds
+		return nil
+	}
+}
+
+// WithFallback adds f to the fallbacks replacing error responses.
+func WithFallback(f *Fallback) Option {
+	return func(h *RESTHandler) error {
+		if f.Class < 1 || f.Class > 5 {
+			return errors.New("Fallback Class must be in [1, 5]")
+		}
+		h.Fallbacks = append(h.Fallbacks, f)
+		return nil
+	}
+}
+
+// WithCacheKeys encrypts cached values with the given AES keys, the
+// first one being current.
+func WithCacheKeys(keys ...[]byte) Option {
+	return func(h *RESTHandler) error {
+		for _, key := range keys {
+			if _, err := newGCM(key); err != nil {
+				return err
+			}
+		}
+		h.CacheKeys = keys
+		return nil
+	}
+}
+
+// WithVars declares the types of variables in kvpairs.
+func WithVars(vars map[string]string) Option {
+	return func(h *RESTHandler) error {
+		h.Vars = vars
+		return nil
+	}
+}
+
+// WithRoute sets the name of the item route to build Location.
+func WithRoute(name string) Option {
+	return func(h *RESTHandler) error {
+		h.Route = name
+		return nil
+	}
+}
+
+// WithReturnDiff makes PUT and PATCH respond with the JSON Patch
+// between the previous and the new object.
+func WithReturnDiff() Option {
+	return func(h *RESTHandler) error {
+		h.ReturnDiff = true
+		return nil
+	}
+}
+
+// WithVersions records the history of objects in store.
+func WithVersions(store VersionStore) Option {
+	return func(h *RESTHandler) error {
+		h.Versions = store
+		return nil
+	}
+}
+
+// WithTrash keeps deleted objects in store for retention, or until
+// restored if 0. See ScheduleTrash to remove expired ones.
+func WithTrash(store TrashStore, retention time.Duration) Option {
+	return func(h *RESTHandler) error {
+		if store == nil {
+			return errors.New("Trash is nil")
+		}
+		if retention < 0 {
+			return errors.New("TrashRetention is negative")
+		}
+		h.Trash = store
+		h.TrashRetention = retention
+		return nil
+	}
+}
+
+// WithComputed adds the fields f computes, whose schemas properties
+// gives by name.
+func WithComputed(properties Schema, f Computed) Option {
+	return func(h *RESTHandler) error {
+		if f == nil {
+			return errors.New("Computed is nil")
+		}
+		if h.ComputedSchema == nil {
+			h.ComputedSchema = Schema{}
+		}
+		for name, schema := range properties {
+			h.ComputedSchema[name] = schema
+		}
+		h.Computed = append(h.Computed, f)
+		return nil
+	}
+}
+
+// WithObjectPool reuses the objects request bodies are decoded into,
+// resetting them with Resetter if implemented. Model must not keep
+// references to the objects passed to Put, Patch or Post.
+func WithObjectPool() Option {
+	return func(h *RESTHandler) error {
+		h.objects = &sync.Pool{}
+		return nil
+	}
+}
+
+// WithErrorReporter reports requests failed with 5xx to reporter.
+func WithErrorReporter(reporter ErrorReporter) Option {
+	return func(h *RESTHandler) error {
+		h.ErrorReporter = reporter
+		return nil
+	}
+}
+
+// WithReturnCreated makes POST respond with the created object.
+func WithReturnCreated() Option {
+	return func(h *RESTHandler) error {
+		h.ReturnCreated = true
+		return nil
+	}
+}
+
+// WithKeepBody makes the raw request body available to Model through
+// RawBody.
+func WithKeepBody() Option {
+	return func(h *RESTHandler) error {
+		h.KeepBody = true
+		return nil
+	}
+}
+
+// WithFlags gates fields of DataType behind feature flags.
+func WithFlags(flags *Flags) Option {
+	return func(h *RESTHandler) error {
+		h.Flags = flags
+		return nil
+	}
+}
+
+// WithStatusPolicy sets the status codes of successful mutations.
+func WithStatusPolicy(p StatusPolicy) Option {
+	return func(h *RESTHandler) error {
+		h.StatusPolicy = p
+		return nil
+	}
+}
+
+// WithLinks sets CollectionRoute and SchemaRoute to send Link headers
+// to related resources. Either may be empty.
+func WithLinks(collection, schema string) Option {
+	return func(h *RESTHandler) error {
+		h.CollectionRoute = collection
+		h.SchemaRoute = schema
+		return nil
+	}
+}
+
+// WithTiming sets the function telling whether to send timing
+// headers, e.g. TimingAlways or TimingOnRequest.
+func WithTiming(f func(r *http.Request) bool) Option {
+	return func(h *RESTHandler) error {
+		h.Timing = f
+		return nil
+	}
+}
+
+// WithLocalCache puts cache in front of memcache, keeping values for
+// at most seconds, or as long as in memcache if 0. Without WithCache,
+// seconds is also the Expiration.
+func WithLocalCache(cache *LocalCache, seconds int32) Option {
+	return func(h *RESTHandler) error {
+		if cache == nil {
+			return errors.New("LocalCache is nil")
+		}
+		h.LocalCache = cache
+		h.LocalExpiration = seconds
+		if h.Expiration == 0 {
+			h.Expiration = seconds
+		}
+		return nil
+	}
+}
+
+// WithReturnDeleted makes DELETE respond with the deleted object, see
+// ReturnDeleted.
+func WithReturnDeleted() Option {
+	return func(h *RESTHandler) error {
+		h.ReturnDeleted = true
+		return nil
+	}
+}
+
+// WithImmutable sets the function telling which objects are
+// immutable, e.g. Immutable.
+func WithImmutable(f func(kvpairs map[string]string) bool) Option {
+	return func(h *RESTHandler) error {
+		h.ImmutableFunc = f
+		return nil
+	}
+}
+
+// WithTTLFunc sets the function resolving the cache expiration of
+// each GET, see TTLFunc.
+func WithTTLFunc(f func(r *http.Request,
+	kvpairs map[string]string) int32) Option {
+	return func(h *RESTHandler) error {
+		h.TTLFunc = f
+		return nil
+	}
+}
+
+// WithReadModel sets the model serving GET, see ReadModel.
+func WithReadModel(m ModelInterface) Option {
+	return func(h *RESTHandler) error {
+		h.ReadModel = m
+		return nil
+	}
+}
+
+// WithFieldPolicy sets the FieldPolicy, overriding the one of the API
+// version.
+func WithFieldPolicy(p FieldPolicy) Option {
+	return func(h *RESTHandler) error {
+		h.FieldPolicy = p
+		return nil
+	}
+}
+
+// WithPrincipal sets the function returning the caller identity.
+func WithPrincipal(f func(r *http.Request) string) Option {
+	return func(h *RESTHandler) error {
+		h.Principal = f
+		return nil
+	}
+}
+
+// WithIDGenerator sets the generator of ids for new objects.
+func WithIDGenerator(g IDGenerator) Option {
+	return func(h *RESTHandler) error {
+		h.IDGenerator = g
+		return nil
+	}
+}
+
+// WithClock sets the clock telling the time of changes.
+func WithClock(c Clock) Option {
+	return func(h *RESTHandler) error {
+		h.Clock = c
+		return nil
+	}
+}
+
+// WithSchemaGuard checks that Model, a SchemaVersioner, reports the
+// schema version expect. On mismatch every request is refused, or
+// only writes if readOnly, until CheckSchema passes.
+func WithSchemaGuard(expect string, readOnly bool) Option {
+	return func(h *RESTHandler) error {
+		if _, ok := h.Model.(SchemaVersioner); !ok {
+			return errors.New("Model does not implement SchemaVersioner")
+		}
+		h.SchemaGuard = &SchemaGuard{Expect: expect, ReadOnly: readOnly}
+		return nil
+	}
+}
+
+// WithExample attaches the sample request and response of method on
+// an item or the collection. They are shown in SelfIntro, and served
+// as is if Model is nil, making h a mock.
+func WithExample(method string, item bool, request,
+	response interface{}) Option {
+	return func(h *RESTHandler) error {
+		if h.examples == nil {
+			h.examples = make(map[exampleKey]*Example)
+		}
+		h.examples[exampleKey{method, item}] = &Example{request, response}
+		return nil
+	}
+}
+
+// WithSandbox, if enabled, replaces Model with a MemoryModel filled
+// with seed, or with the examples if there is no seed, so that h
+// serves a faithful fake without any backend.
+func WithSandbox(enabled bool, seed ...interface{}) Option {
+	return func(h *RESTHandler) error {
+		if enabled {
+			h.sandbox = &sandbox{seed}
+		}
+		return nil
+	}
+}
+
+// WithLocales sets the locales supported by Model, default first.
+func WithLocales(locales ...string) Option {
+	return func(h *RESTHandler) error {
+		h.Locales = locales
+		return nil
+	}
+}
+
+// WithVary adds request headers the response depends on.
+func WithVary(headers ...string) Option {
+	return func(h *RESTHandler) error {
+		h.Vary = append(h.Vary, headers...)
+		return nil
+	}
+}
+
+// WithProfile defines the response profile name, e.g. PROFILE_MINIMAL.
+func WithProfile(name string, p *Profile) Option {
+	return func(h *RESTHandler) error {
+		if name == "" || p == nil {
+			return errors.New("Profile is empty")
+		}
+		if h.Profiles == nil {
+			h.Profiles = make(map[string]*Profile)
+		}
+		h.Profiles[name] = p
+		return nil
+	}
+}
+
+// WithBufferMax sets the size above which responses are sent chunked,
+// see BufferMax.
+func WithBufferMax(n int) Option {
+	return func(h *RESTHandler) error {
+		h.BufferMax = n
+		return nil
+	}
+}
+
+// WithUseNumber decodes numbers as json.Number, see UseNumber.
+func WithUseNumber() Option {
+	return func(h *RESTHandler) error {
+		h.UseNumber = true
+		return nil
+	}
+}
+
+// WithTimes normalizes time.Time fields with p, see TimePolicy.
+func WithTimes(p *TimePolicy) Option {
+	return func(h *RESTHandler) error {
+		if p == nil {
+			return errors.New("TimePolicy is nil")
+		}
+		h.Times = p
+		return nil
+	}
+}
+
+// WithMarshalWorkers marshals the items of GetAll with n goroutines,
+// in any order if unordered, see MarshalWorkers.
+func WithMarshalWorkers(n int, unordered bool) Option {
+	return func(h *RESTHandler) error {
+		h.MarshalWorkers = n
+		h.Unordered = unordered
+		return nil
+	}
+}
+
+// WithJSONP enables JSONP for GET requests.
+func WithJSONP() Option {
+	return func(h *RESTHandler) error {
+		h.JSONP = true
+		return nil
+	}
+}
+
+// WithDeprecation marks the resource as deprecated since the given
+// time in favor of successor, which may be empty.
+func WithDeprecation(since time.Time, successor string) Option {
+	return func(h *RESTHandler) error {
+		h.Deprecation = Deprecated(since, successor)
+		return nil
+	}
+}
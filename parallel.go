@@ -0,0 +1,143 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// errAssembled stops the items of GetAll once a worker has failed.
+var errAssembled = errors.New("gocalm: assembly aborted")
+
+// marshaled is an item of GetAll turned into JSON by a worker.
+type marshaled struct {
+	i   int
+	v   interface{}
+	b   []byte
+	err error
+}
+
+// marshalItem represents v and marshals it without the newline added
+// by json.Encoder.
+func (h *RESTHandler) marshalItem(r *http.Request,
+	kvpairs map[string]string, v interface{}) ([]byte, error) {
+	v, err := h.represent(r, kvpairs, v)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err = json.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes()[:buf.Len()-1], nil
+}
+
+// assembleParallel builds the JSON array of the items each yields with
+// h.MarshalWorkers goroutines representing and marshaling them.
+func (h *RESTHandler) assembleParallel(r *http.Request,
+	kvpairs map[string]string,
+	each func(yield func(interface{}) error) error) ([]byte, error) {
+	n := h.MarshalWorkers
+	items := make(chan marshaled, n)
+	results := make(chan marshaled, n)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for k := 0; k < n; k++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for m := range items {
+				m.b, m.err = h.marshalItem(r, kvpairs, m.v)
+				select {
+				case results <- m:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	type assembled struct {
+		b   []byte
+		err error
+	}
+	out := make(chan assembled, 1)
+	go func() {
+		b, err := h.collect(results)
+		if err != nil {
+			close(done)
+		}
+		out <- assembled{b, err}
+	}()
+	i := 0
+	err := each(func(v interface{}) error {
+		select {
+		case items <- marshaled{i: i, v: v}:
+			i++
+			return nil
+		case <-done:
+			return errAssembled
+		}
+	})
+	close(items)
+	wg.Wait()
+	close(results)
+	a := <-out
+	if a.err != nil {
+		return nil, a.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return a.b, nil
+}
+
+// collect joins the JSON of results into an array, in the order the
+// items were received unless h.Unordered is set. It returns on the
+// first error.
+func (h *RESTHandler) collect(results <-chan marshaled) ([]byte, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	buf.WriteByte('[')
+	pending := make(map[int][]byte)
+	next := 0
+	write := func(b []byte) {
+		if next != 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(b)
+		next++
+	}
+	for m := range results {
+		if m.err != nil {
+			return nil, m.err
+		}
+		if h.Unordered {
+			write(m.b)
+			continue
+		}
+		pending[m.i] = m.b
+		for b, ok := pending[next]; ok; b, ok = pending[next] {
+			delete(pending, next)
+			write(b)
+		}
+	}
+	buf.WriteByte(']')
+	// buf goes back to the pool
+	return append([]byte(nil), buf.Bytes()...), nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Single method parts of ModelInterface, for models that only support
+// some methods. See PartialModel.
+type (
+	Getter interface {
+		Get(kvpairs map[string]string) (interface{}, error)
+	}
+	Lister interface {
+		GetAll(kvpairs map[string]string) (interface{}, error)
+	}
+	Putter interface {
+		Put(kvpairs map[string]string, v interface{}) error
+	}
+	Patcher interface {
+		Patch(kvpairs map[string]string, original interface{},
+			patched interface{}) error
+	}
+	Poster interface {
+		Post(kvpairs map[string]string, v interface{}) (string, error)
+	}
+	Deleter interface {
+		Delete(kvpairs map[string]string) error
+	}
+)
+
+// partialModel implements ModelInterface with the methods of m,
+// failing the others with ErrNotImplemented.
+type partialModel struct {
+	m interface{}
+}
+
+// PartialModel returns a ModelInterface for m, which implements any of
+// Getter, Lister, Putter, Patcher, Poster and Deleter. It fails if m
+// implements none of them. The other methods respond 405 and are left
+// out of the Allow header.
+func PartialModel(m interface{}) (ModelInterface, error) {
+	switch m.(type) {
+	case Getter, Lister, Putter, Patcher, Poster, Deleter:
+		return &partialModel{m}, nil
+	}
+	return nil, errors.New("model implements no method")
+}
+
+// allows reports whether method is supported on an item if item is
+// true or else on the collection.
+func (t *partialModel) allows(method string, item bool) bool {
+	var ok bool
+	switch method {
+	case http.MethodGet:
+		if item {
+			_, ok = t.m.(Getter)
+		} else {
+			_, ok = t.m.(Lister)
+		}
+	case http.MethodPut:
+		_, ok = t.m.(Putter)
+	case http.MethodPatch:
+		_, ok = t.m.(Patcher)
+	case http.MethodPost:
+		_, ok = t.m.(Poster)
+	case http.MethodDelete:
+		_, ok = t.m.(Deleter)
+	default:
+		ok = true
+	}
+	return ok
+}
+
+func (t *partialModel) Get(kvpairs map[string]string) (interface{}, error) {
+	if m, ok := t.m.(Getter); ok {
+		return m.Get(kvpairs)
+	}
+	return nil, ErrNotImplemented
+}
+
+func (t *partialModel) GetAll(kvpairs map[string]string) (interface{}, error) {
+	if m, ok := t.m.(Lister); ok {
+		return m.GetAll(kvpairs)
+	}
+	return nil, ErrNotImplemented
+}
+
+func (t *partialModel) Put(kvpairs map[string]string, v interface{}) error {
+	if m, ok := t.m.(Putter); ok {
+		return m.Put(kvpairs, v)
+	}
+	return ErrNotImplemented
+}
+
+func (t *partialModel) PutAll(kvpairs map[string]string, v interface{}) error {
+	return ErrNotImplemented
+}
+
+func (t *partialModel) Patch(kvpairs map[string]string, original interface{},
+	patched interface{}) error {
+	if m, ok := t.m.(Patcher); ok {
+		return m.Patch(kvpairs, original, patched)
+	}
+	return ErrNotImplemented
+}
+
+func (t *partialModel) Post(kvpairs map[string]string, v interface{}) (
+	string, error) {
+	if m, ok := t.m.(Poster); ok {
+		return m.Post(kvpairs, v)
+	}
+	return "", ErrNotImplemented
+}
+
+func (t *partialModel) Delete(kvpairs map[string]string) error {
+	if m, ok := t.m.(Deleter); ok {
+		return m.Delete(kvpairs)
+	}
+	return ErrNotImplemented
+}
+
+func (t *partialModel) DeleteAll(kvpairs map[string]string) error {
+	return ErrNotImplemented
+}
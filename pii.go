@@ -0,0 +1,103 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"encoding/json"
+	"net/url"
+	"reflect"
+)
+
+const (
+	// TAG_PII marks a field holding personal or sensitive data,
+	// e.g. `calm:"pii"'. Its value is redacted wherever gocalm logs
+	// objects, serves their history and reports errors. Revisions are
+	// stored as they are, so reverts restore it.
+	TAG_PII = "pii"
+	// REDACTED replaces the values of TAG_PII fields.
+	REDACTED = "[REDACTED]"
+)
+
+// Redact returns the JSON of v with the values of TAG_PII fields
+// replaced by REDACTED, for use in logs.
+func Redact(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err.Error()
+	}
+	return string(redactJSON(reflect.TypeOf(v), b))
+}
+
+// redactJSON redacts b, the JSON of a value of type t.
+func redactJSON(t reflect.Type, b []byte) []byte {
+	if t == nil || !hasPII(t) {
+		return b
+	}
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return b
+	}
+	v = redact(t, v)
+	redacted, err := json.Marshal(v)
+	if err != nil {
+		return b
+	}
+	return redacted
+}
+
+// redactQuery returns u with the query values named as TAG_PII fields
+// of t, e.g. filters, redacted.
+func redactQuery(t reflect.Type, u *url.URL) string {
+	if t == nil || u.RawQuery == "" || !hasPII(t) {
+		return u.String()
+	}
+	values := u.Query()
+	m := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		m[k] = v[0]
+	}
+	redact(t, m)
+	for k := range values {
+		if m[k] == REDACTED {
+			values[k] = []string{REDACTED}
+		}
+	}
+	c := *u
+	c.RawQuery = values.Encode()
+	return c.String()
+}
+
+// hasPII reports whether values of type t may contain TAG_PII fields.
+func hasPII(t reflect.Type) bool {
+	return hasFields(TAG_PII, t, func(f reflect.StructField) bool {
+		return hasTag(f, TAG_PII)
+	})
+}
+
+// redact replaces TAG_PII values in v, the decoded JSON of a value of
+// type t.
+func redact(t reflect.Type, v interface{}) interface{} {
+	walkFields(t, v, func(f reflect.StructField, name string,
+		m map[string]interface{}) bool {
+		if !hasTag(f, TAG_PII) {
+			return true
+		}
+		if m[name] != nil {
+			m[name] = REDACTED
+		}
+		return false
+	})
+	return v
+}
@@ -0,0 +1,44 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"github.com/golang/glog"
+	"net/http"
+)
+
+// StatusPolicy decides the status codes of successful mutations.
+type StatusPolicy int
+
+const (
+	// STATUS_LEGACY answers 200 with a Msg to PUT, PATCH and
+	// DELETE, and 200 with the id to POST.
+	STATUS_LEGACY StatusPolicy = iota
+	// STATUS_STRICT answers 204 to PUT, PATCH and DELETE without a
+	// body to send, and 201 to POST, as in RFC 7231.
+	STATUS_STRICT
+)
+
+// sendSuccess answers a successful PUT, PATCH or DELETE without a
+// body to send.
+func (h *RESTHandler) sendSuccess(w http.ResponseWriter, r *http.Request) {
+	if h.StatusPolicy != STATUS_STRICT {
+		sendJSONMsg(w, r, http.StatusOK, SUCCESS)
+		return
+	}
+	glog.Infof("%s %s: %d", r.Method, r.URL, http.StatusNoContent)
+	w.Header().Del("Content-Type")
+	w.WriteHeader(http.StatusNoContent)
+}
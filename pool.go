@@ -0,0 +1,74 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"bytes"
+	"reflect"
+	"sync"
+)
+
+// POOLED_BUFFER_MAX is the capacity above which buffers are left to
+// the garbage collector rather than pooled.
+const POOLED_BUFFER_MAX = 1 << 16
+
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+func getBuffer() *bytes.Buffer {
+	return bufPool.Get().(*bytes.Buffer)
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > POOLED_BUFFER_MAX {
+		return
+	}
+	buf.Reset()
+	bufPool.Put(buf)
+}
+
+// Resetter is implemented by DataType to clear pooled objects more
+// cheaply than zeroing them.
+type Resetter interface {
+	Reset()
+}
+
+// newObject returns a pointer to a new or pooled DataType to decode a
+// request body into.
+func (h *RESTHandler) newObject() interface{} {
+	if h.objects != nil {
+		if v := h.objects.Get(); v != nil {
+			return v
+		}
+	}
+	return reflect.New(h.DataType).Interface()
+}
+
+// releaseObject returns v to the pool once the request is served.
+func (h *RESTHandler) releaseObject(v interface{}) {
+	if h.objects == nil {
+		return
+	}
+	if resetter, ok := v.(Resetter); ok {
+		resetter.Reset()
+	} else {
+		e := reflect.ValueOf(v).Elem()
+		e.Set(reflect.Zero(e.Type()))
+	}
+	h.objects.Put(v)
+}
@@ -0,0 +1,116 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+const (
+	// PROFILE_KEY is the name in kvpairs of the response profile
+	// chosen from RESTHandler.Profiles.
+	PROFILE_KEY = "_profile"
+	// PROFILE_MINIMAL is the profile chosen by Prefer: return=minimal
+	// unless a profile is named.
+	PROFILE_MINIMAL = "minimal"
+)
+
+// Profile is a named shape of responses for a class of clients,
+// requested with Prefer: profile=name.
+type Profile struct {
+	// Fields are the JSON names of the fields sent, all if empty
+	Fields []string
+	// Embed are the related resources embedded when the request
+	// does not give EMBED_PARAM, see Embeddable.
+	Embed []string
+}
+
+// preferences parses the Prefer header of r as defined in RFC 7240,
+// ignoring parameters.
+func preferences(r *http.Request) map[string]string {
+	prefs := make(map[string]string)
+	for _, header := range r.Header["Prefer"] {
+		for _, pref := range strings.Split(header, ",") {
+			pref = strings.TrimSpace(strings.SplitN(pref, ";", 2)[0])
+			kv := strings.SplitN(pref, "=", 2)
+			name := strings.ToLower(strings.TrimSpace(kv[0]))
+			if name == "" {
+				continue
+			}
+			if _, ok := prefs[name]; ok {
+				// the first occurrence wins
+				continue
+			}
+			value := ""
+			if len(kv) == 2 {
+				value = strings.Trim(strings.TrimSpace(kv[1]), `"`)
+			}
+			prefs[name] = value
+		}
+	}
+	return prefs
+}
+
+// setProfile puts the profile requested by a GET, if defined, into
+// kvpairs as PROFILE_KEY and its embedded resources as EMBED_PARAM
+// unless given, and acknowledges it with Preference-Applied.
+func (h *RESTHandler) setProfile(w http.ResponseWriter, r *http.Request,
+	kvpairs map[string]string) {
+	delete(kvpairs, PROFILE_KEY)
+	if len(h.Profiles) == 0 || r.Method != http.MethodGet &&
+		r.Method != http.MethodHead {
+		return
+	}
+	prefs := preferences(r)
+	name, applied := prefs["profile"], "profile="+prefs["profile"]
+	if _, ok := h.Profiles[name]; !ok {
+		if prefs["return"] != PROFILE_MINIMAL {
+			return
+		}
+		name, applied = PROFILE_MINIMAL, "return=minimal"
+	}
+	p, ok := h.Profiles[name]
+	if !ok {
+		return
+	}
+	kvpairs[PROFILE_KEY] = name
+	if kvpairs[EMBED_PARAM] == "" && len(p.Embed) != 0 {
+		kvpairs[EMBED_PARAM] = strings.Join(p.Embed, ",")
+	}
+	w.Header().Set("Preference-Applied", applied)
+}
+
+// profileFields keeps only the fields of the profile in kvpairs in
+// the representation rep.
+func (h *RESTHandler) profileFields(kvpairs map[string]string,
+	rep interface{}) (interface{}, error) {
+	p := h.Profiles[kvpairs[PROFILE_KEY]]
+	if p == nil || len(p.Fields) == 0 {
+		return rep, nil
+	}
+	m, err := mergeFields(rep, nil)
+	if err != nil {
+		return nil, err
+	}
+	kept := make(map[string]json.RawMessage, len(p.Fields))
+	for _, name := range p.Fields {
+		if v, ok := m[name]; ok {
+			kept[name] = v
+		}
+	}
+	return kept, nil
+}
@@ -0,0 +1,257 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"errors"
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/golang/glog"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// PURGE_PREFIX is the memcache key prefix of the generations of
+	// a RESTHandler, changed by PurgeAll and PurgeURL.
+	PURGE_PREFIX = "gocalm-purge/"
+	// PURGE_POLL is how often a RESTHandler reads each generation
+	// from memcache, so purges take up to this long on other servers.
+	PURGE_POLL = 5 * time.Second
+	// PURGE_BUCKETS is the number of generations PurgeURL changes, by
+	// hash of the path, so paths sharing a bucket are purged together.
+	PURGE_BUCKETS = 1024
+)
+
+// purgeState is the cache generations of a RESTHandler, shared by its
+// copies: one of every entry and one of each bucket of paths.
+type purgeState struct {
+	mutex   sync.Mutex
+	all     purgeGen
+	buckets [PURGE_BUCKETS]purgeGen
+}
+
+// purgeGen is a cache generation and when it was last read from
+// memcache or changed.
+type purgeGen struct {
+	gen     string
+	checked time.Time
+}
+
+// pathBucket returns the purge bucket of path.
+func pathBucket(path string) int {
+	f := fnv.New32a()
+	f.Write([]byte(path))
+	return int(f.Sum32() % PURGE_BUCKETS)
+}
+
+// genKey returns the memcache key of the generation of bucket i, or
+// of every entry if i is negative.
+func (h *RESTHandler) genKey(i int) string {
+	if i < 0 {
+		return PURGE_PREFIX + h.Name
+	}
+	return PURGE_PREFIX + h.Name + "/" + strconv.Itoa(i)
+}
+
+// generation returns the cache generation of path, mixed into cache
+// keys so that PurgeAll and PurgeURL drop every variant at once.
+func (h *RESTHandler) generation(path string) string {
+	t := h.purgeState
+	if t == nil {
+		return ""
+	}
+	i := pathBucket(path)
+	all := h.current(&t.all, h.genKey(-1))
+	if gen := h.current(&t.buckets[i], h.genKey(i)); gen != "" {
+		return all + "/" + gen
+	}
+	return all
+}
+
+// current returns g, read from memcache key once per PURGE_POLL. The
+// read is done outside the mutex, and dropped if g changed meanwhile.
+func (h *RESTHandler) current(g *purgeGen, key string) string {
+	t := h.purgeState
+	t.mutex.Lock()
+	gen, checked := g.gen, g.checked
+	due := h.Cache != nil && time.Since(checked) >= PURGE_POLL &&
+		h.cacheStats.healthy()
+	if due {
+		checked = time.Now()
+		g.checked = checked
+	}
+	t.mutex.Unlock()
+	if !due {
+		return gen
+	}
+	item, err := h.Cache.Get(key)
+	switch err {
+	case nil:
+	case memcache.ErrCacheMiss:
+		return gen
+	default:
+		glog.Warningf("memcache Get '%s' error: %v", key, err)
+		return gen
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if g.checked.Equal(checked) {
+		g.gen = string(item.Value)
+	}
+	return g.gen
+}
+
+// bump changes g, stored at memcache key.
+func (h *RESTHandler) bump(g *purgeGen, key string) error {
+	gen := strconv.FormatInt(time.Now().UnixNano(), 36)
+	t := h.purgeState
+	t.mutex.Lock()
+	g.gen, g.checked = gen, time.Now()
+	t.mutex.Unlock()
+	if h.Cache == nil {
+		return nil
+	}
+	return h.Cache.Set(&memcache.Item{Key: key, Value: []byte(gen)})
+}
+
+// PurgeAll drops every cache entry of h, on other servers sharing the
+// memcache within PURGE_POLL.
+func (h *RESTHandler) PurgeAll() error {
+	t := h.purgeState
+	if t == nil {
+		return errors.New("RESTHandler not created by NewRESTHandler")
+	}
+	if err := h.bump(&t.all, h.genKey(-1)); err != nil {
+		return err
+	}
+	glog.Infof("%s cache purged", h.Name)
+	return nil
+}
+
+// PurgeURL drops the cache entries, stale copies included, of GET
+// requests of the path of u in every query, scope, locale, profile and
+// Vary variant, and those of paths sharing its bucket. Other servers
+// sharing the memcache drop them within PURGE_POLL. A RESTHandler not
+// created by NewRESTHandler has no generations, and only drops the
+// entries of u itself without scope() or Vary.
+func (h *RESTHandler) PurgeURL(u string) error {
+	parsed, err := url.ParseRequestURI(u)
+	if err != nil {
+		return err
+	}
+	if t := h.purgeState; t != nil {
+		i := pathBucket(parsed.Path)
+		err = h.bump(&t.buckets[i], h.genKey(i))
+	} else {
+		err = h.purgeKeys(parsed)
+	}
+	if err != nil {
+		return err
+	}
+	glog.Infof("%s cache purged: %s", h.Name, u)
+	return nil
+}
+
+// purgeKeys drops the cache entries of GET requests of u in every
+// locale and profile of h.
+func (h *RESTHandler) purgeKeys(u *url.URL) error {
+	r := &http.Request{Method: http.MethodGet, URL: u, Header: http.Header{}}
+	locales := append([]string{""}, h.Locales...)
+	profiles := []string{""}
+	for name := range h.Profiles {
+		profiles = append(profiles, name)
+	}
+	for _, locale := range locales {
+		for _, profile := range profiles {
+			key := h.makeKey(r, map[string]string{LOCALE_KEY: locale,
+				PROFILE_KEY: profile})
+			if err := h.purgeKey(key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// purgeKey drops the cache entry key and its stale copy.
+func (h *RESTHandler) purgeKey(key string) error {
+	for _, k := range []string{key, key + STALE_SUFFIX} {
+		if h.LocalCache != nil {
+			h.LocalCache.Delete(k)
+		}
+		if h.Cache == nil {
+			continue
+		}
+		err := h.Cache.Delete(k)
+		if err != nil && err != memcache.ErrCacheMiss {
+			return err
+		}
+	}
+	return nil
+}
+
+// PurgeID drops the cache entries of object id, whose URL is built
+// from Route, see PurgeURL.
+func (h *RESTHandler) PurgeID(id string) error {
+	if h.Route == "" {
+		return errors.New("Route is empty")
+	}
+	u, err := URLFor(h.Route, map[string]string{h.Key: id})
+	if err != nil {
+		return err
+	}
+	return h.PurgeURL(u)
+}
+
+// PurgeHandler serves cache purges of registered resources to requests
+// allowed by authorize, and 404 to others. POST with the query
+// parameters resource and either id or url purges those entries, and
+// with resource alone every entry of the resource.
+func PurgeHandler(authorize func(r *http.Request) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authorize == nil || !authorize(r) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if r.Method != http.MethodPost {
+			sendError(w, r, ErrNotImplemented)
+			return
+		}
+		h := Lookup(r.FormValue("resource"))
+		if h == nil {
+			sendError(w, r, ErrNotFound)
+			return
+		}
+		var err error
+		switch {
+		case r.FormValue("id") != "":
+			err = h.PurgeID(r.FormValue("id"))
+		case r.FormValue("url") != "":
+			err = h.PurgeURL(r.FormValue("url"))
+		default:
+			err = h.PurgeAll()
+		}
+		if err != nil {
+			sendError(w, r, err)
+			return
+		}
+		sendJSONMsg(w, r, http.StatusOK, SUCCESS)
+	})
+}
@@ -0,0 +1,141 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+const (
+	// TAG_REF marks a field holding a related object. It may name
+	// the item route of the related resource, e.g.
+	// `calm:"ref=author-item"`, whose id variable must be called
+	// DEFAULT_KEY, or a registered resource with a Route.
+	TAG_REF = "ref"
+	// REFS_PARAM selects how related objects are serialized:
+	// REFS_FULL (default) or REFS_ID.
+	REFS_PARAM = "refs"
+	REFS_FULL  = "full"
+	REFS_ID    = "id"
+)
+
+// Ref is the ID-only representation of a related object.
+type Ref struct {
+	ID   interface{} `json:"id"`
+	Href string      `json:"href,omitempty"`
+}
+
+// tagValue returns the value of option `name=value' in the `calm'
+// tag of f and whether the option is present at all.
+func tagValue(f reflect.StructField, name string) (string, bool) {
+	for _, o := range strings.Split(f.Tag.Get(TAG_NAME), ",") {
+		if o == name {
+			return "", true
+		}
+		if strings.HasPrefix(o, name+"=") {
+			return o[len(name)+1:], true
+		}
+	}
+	return "", false
+}
+
+// jsonName returns the name of f in JSON, or "" if it is skipped.
+func jsonName(f reflect.StructField) string {
+	tag := f.Tag.Get("json")
+	if tag == "-" || f.PkgPath != "" {
+		return ""
+	}
+	name := strings.Split(tag, ",")[0]
+	if name == "" {
+		return f.Name
+	}
+	return name
+}
+
+// objectID returns the id of v, a struct or a pointer to it, taken
+// from the field tagged TAG_ID or else the field named "id" in JSON.
+func objectID(v reflect.Value) (interface{}, bool) {
+	v = reflect.Indirect(v)
+	if v.Kind() != reflect.Struct {
+		return nil, false
+	}
+	t := v.Type()
+	var found interface{}
+	ok := false
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if hasTag(f, TAG_ID) {
+			return v.Field(i).Interface(), true
+		}
+		if !ok && jsonName(f) == "id" {
+			found, ok = v.Field(i).Interface(), true
+		}
+	}
+	return found, ok
+}
+
+// refs replaces related objects in v with Ref stubs when the client
+// asked for REFS_ID.
+func refs(kvpairs map[string]string, v interface{}) (interface{}, error) {
+	if kvpairs[REFS_PARAM] != REFS_ID {
+		return v, nil
+	}
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		return v, nil
+	}
+	t := rv.Type()
+	stubs := make(map[string]interface{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		route, ok := tagValue(f, TAG_REF)
+		name := jsonName(f)
+		if !ok || name == "" {
+			continue
+		}
+		field := rv.Field(i)
+		if field.Kind() == reflect.Ptr && field.IsNil() {
+			continue
+		}
+		id, ok := objectID(field)
+		if !ok {
+			return nil, fmt.Errorf("%s.%s: related object has no id",
+				t.Name(), f.Name)
+		}
+		ref := Ref{ID: id}
+		if route != "" {
+			var href string
+			var err error
+			if Lookup(route) != nil {
+				href, err = resourceURL(route, id)
+			} else {
+				href, err = URLFor(route, map[string]string{
+					DEFAULT_KEY: fmt.Sprint(id),
+				})
+			}
+			if err != nil {
+				return nil, err
+			}
+			ref.Href = href
+		}
+		stubs[name] = ref
+	}
+	if len(stubs) == 0 {
+		return v, nil
+	}
+	return mergeFields(v, stubs)
+}
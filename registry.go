@@ -0,0 +1,138 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+const (
+	// TAG_LINK marks a field holding the id of an object of another
+	// registered resource, e.g. `calm:"link=authors"'. Its URL is
+	// added under LINKS. See also TAG_ON_DELETE.
+	TAG_LINK = "link"
+	// LINKS is the name of the field holding links to related
+	// resources.
+	LINKS = "_links"
+)
+
+// Link points to a related resource.
+type Link struct {
+	Href string `json:"href"`
+}
+
+var registry = struct {
+	sync.RWMutex
+	m map[string]*RESTHandler
+}{m: make(map[string]*RESTHandler)}
+
+// Register adds h to the registry of resources by its Name, which
+// must be unique, so that other resources can link to it.
+func Register(h *RESTHandler) error {
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.m[h.Name]; ok {
+		return fmt.Errorf("resource `%s' already registered", h.Name)
+	}
+	registry.m[h.Name] = h
+	return nil
+}
+
+// Unregister removes resource name from the registry, e.g. when a
+// test or a reload registers it again.
+func Unregister(name string) {
+	registry.Lock()
+	defer registry.Unlock()
+	delete(registry.m, name)
+}
+
+// Lookup returns the registered resource name, or nil.
+func Lookup(name string) *RESTHandler {
+	registry.RLock()
+	defer registry.RUnlock()
+	return registry.m[name]
+}
+
+// Registered returns the registered resources sorted by name.
+func Registered() []*RESTHandler {
+	registry.RLock()
+	defer registry.RUnlock()
+	handlers := make([]*RESTHandler, 0, len(registry.m))
+	for _, h := range registry.m {
+		handlers = append(handlers, h)
+	}
+	sort.Slice(handlers, func(i, j int) bool {
+		return handlers[i].Name < handlers[j].Name
+	})
+	return handlers
+}
+
+// resourceURL returns the path of object id of the registered
+// resource name, built from its Route.
+func resourceURL(name string, id interface{}) (string, error) {
+	h := Lookup(name)
+	if h == nil {
+		return "", fmt.Errorf("resource `%s' not registered", name)
+	}
+	if h.Route == "" {
+		return "", fmt.Errorf("resource `%s' has no Route", name)
+	}
+	s := fmt.Sprint(id)
+	return URLFor(h.Route, map[string]string{h.Key: s, DEFAULT_KEY: s})
+}
+
+// unlinked holds the TAG_LINK fields warned about by links.
+var unlinked sync.Map
+
+// links adds the URLs of the objects referred to by TAG_LINK fields
+// of v to its representation rep. Fields whose resource is not
+// registered or has no Route get no link, with a warning once.
+func links(v interface{}, rep interface{}) (interface{}, error) {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		return rep, nil
+	}
+	t := rv.Type()
+	m := make(map[string]Link)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		resource, ok := tagValue(f, TAG_LINK)
+		name := jsonName(f)
+		if !ok || name == "" || resource == "" {
+			continue
+		}
+		field := reflect.Indirect(rv.Field(i))
+		if !field.IsValid() || isZero(field) {
+			continue
+		}
+		href, err := resourceURL(resource, field.Interface())
+		if err != nil {
+			where := t.String() + "." + f.Name
+			if _, warned := unlinked.LoadOrStore(where, true); !warned {
+				glog.Warningf("%s: no link: %v", where, err)
+			}
+			continue
+		}
+		m[name] = Link{href}
+	}
+	if len(m) == 0 {
+		return rep, nil
+	}
+	return mergeFields(rep, map[string]interface{}{LINKS: m})
+}
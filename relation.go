@@ -0,0 +1,364 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// TAG_ON_DELETE is the `calm' struct tag option of a TAG_LINK
+	// field telling what happens to the object when the linked one is
+	// deleted, e.g. `calm:"link=authors,ondelete=restrict"'.
+	TAG_ON_DELETE = "ondelete"
+	// ON_DELETE_RESTRICT refuses to delete an object still linked.
+	ON_DELETE_RESTRICT = "restrict"
+	// ON_DELETE_NULLIFY clears the link field of dependents.
+	ON_DELETE_NULLIFY = "nullify"
+	// ON_DELETE_DELETE deletes dependents too.
+	ON_DELETE_DELETE = "delete"
+)
+
+const (
+	// REFERENCED is the message of the 409 Error listing the
+	// dependents restricting a DELETE.
+	REFERENCED = "Referenced by %s"
+	// DANGLING is the message of the 422 Error listing the fields
+	// referring to missing objects.
+	DANGLING = "Dangling references: %s"
+)
+
+// Relation declares that objects of resource Child refer to objects
+// of resource Parent by their field Field, named as in JSON, which
+// the Child handler checks on writes. OnDelete is empty or one of
+// ON_DELETE_RESTRICT, ON_DELETE_NULLIFY and ON_DELETE_DELETE, enforced
+// by the Parent handler on DELETE.
+type Relation struct {
+	Parent   string
+	Child    string
+	Field    string
+	OnDelete string
+}
+
+var relations = struct {
+	sync.RWMutex
+	list []Relation
+}{}
+
+// Relate declares rel in addition to those given by struct tags,
+// e.g. for a DataType that cannot be tagged. Declaring rel again has
+// no effect.
+func Relate(rel Relation) error {
+	switch rel.OnDelete {
+	case "", ON_DELETE_RESTRICT, ON_DELETE_NULLIFY, ON_DELETE_DELETE:
+	default:
+		return fmt.Errorf("invalid OnDelete `%s'", rel.OnDelete)
+	}
+	if rel.Parent == "" || rel.Child == "" || rel.Field == "" {
+		return fmt.Errorf("incomplete relation %+v", rel)
+	}
+	relations.Lock()
+	defer relations.Unlock()
+	for _, other := range relations.list {
+		if other == rel {
+			return nil
+		}
+	}
+	relations.list = append(relations.list, rel)
+	return nil
+}
+
+// relationsTo returns the relations of registered resources to
+// resource parent with an OnDelete policy.
+func relationsTo(parent string) []Relation {
+	list := []Relation{}
+	for _, h := range Registered() {
+		for _, rel := range relationsFrom(h) {
+			if rel.Parent == parent && rel.OnDelete != "" {
+				list = append(list, rel)
+			}
+		}
+	}
+	return list
+}
+
+// relationsFrom returns the relations of h to registered resources,
+// declared by TAG_LINK or by Relate.
+func relationsFrom(h *RESTHandler) []Relation {
+	relations.RLock()
+	list := []Relation{}
+	for _, rel := range relations.list {
+		if rel.Child == h.Name {
+			list = append(list, rel)
+		}
+	}
+	relations.RUnlock()
+	t := h.DataType
+	if t.Kind() != reflect.Struct {
+		return list
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		resource, ok := tagValue(f, TAG_LINK)
+		if !ok || resource == "" || jsonName(f) == "" {
+			continue
+		}
+		policy, _ := tagValue(f, TAG_ON_DELETE)
+		list = append(list, Relation{
+			Parent:   resource,
+			Child:    h.Name,
+			Field:    jsonName(f),
+			OnDelete: policy,
+		})
+	}
+	return list
+}
+
+// checkRefs returns a 422 Error listing the fields of v referring to
+// objects missing from their registered resource. Zero fields and
+// resources not registered are not checked.
+func (h *RESTHandler) checkRefs(v interface{}) error {
+	var dangling []string
+	for _, rel := range relationsFrom(h) {
+		parent := Lookup(rel.Parent)
+		field, ok := fieldByJSON(reflect.ValueOf(v), rel.Field)
+		if parent == nil || !ok {
+			continue
+		}
+		field = reflect.Indirect(field)
+		if !field.IsValid() || isZero(field) {
+			continue
+		}
+		id := fmt.Sprint(field.Interface())
+		found, err := parent.Model.Get(map[string]string{parent.Key: id})
+		if err == ErrNotFound || err == nil && found == nil {
+			dangling = append(dangling, rel.Field+"="+id)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(dangling) == 0 {
+		return nil
+	}
+	return &Error{
+		StatusCode: http.StatusUnprocessableEntity,
+		Message:    fmt.Sprintf(DANGLING, strings.Join(dangling, ", ")),
+	}
+}
+
+// fieldByJSON returns the field of struct v named name in JSON.
+func fieldByJSON(v reflect.Value, name string) (reflect.Value, bool) {
+	v = reflect.Indirect(v)
+	if v.Kind() != reflect.Struct {
+		return reflect.Value{}, false
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if jsonName(t.Field(i)) == name {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// dependents returns the ids of the objects of resource rel.Child
+// linked to object id. It scans every object GetAll returns.
+func dependents(ctx context.Context, rel Relation, id string) (
+	*RESTHandler, []string, error) {
+	child := Lookup(rel.Child)
+	if child == nil {
+		return nil, nil, fmt.Errorf("resource `%s' not registered",
+			rel.Child)
+	}
+	ids := []string{}
+	err := child.items(ctx, map[string]string{}, func(v interface{}) error {
+		field, ok := fieldByJSON(reflect.ValueOf(v), rel.Field)
+		if !ok {
+			return nil
+		}
+		field = reflect.Indirect(field)
+		if !field.IsValid() || fmt.Sprint(field.Interface()) != id {
+			return nil
+		}
+		childID, ok := objectID(reflect.ValueOf(v))
+		if !ok {
+			return fmt.Errorf("resource `%s': item has no id", rel.Child)
+		}
+		ids = append(ids, fmt.Sprint(childID))
+		return nil
+	})
+	return child, ids, err
+}
+
+// cascadeStep nullifies Field of object ID of h, or deletes it if
+// Field is empty.
+type cascadeStep struct {
+	h     *RESTHandler
+	ID    string
+	Field string
+}
+
+// plan adds to steps what deleting object id of h implies, dependents
+// first, and to blocking the dependents restricting it or immutable
+// ones it would change. seen guards against cycles.
+func (h *RESTHandler) plan(ctx context.Context, id string,
+	seen map[string]bool, steps *[]cascadeStep, blocking *[]string) error {
+	if seen[h.Name+"/"+id] {
+		return nil
+	}
+	seen[h.Name+"/"+id] = true
+	for _, rel := range relationsTo(h.Name) {
+		child, ids, err := dependents(ctx, rel, id)
+		if err != nil {
+			return err
+		}
+		for _, childID := range ids {
+			if child.frozen(map[string]string{child.Key: childID}) {
+				*blocking = append(*blocking, rel.Child+"/"+childID)
+				continue
+			}
+			switch rel.OnDelete {
+			case ON_DELETE_RESTRICT:
+				*blocking = append(*blocking, rel.Child+"/"+childID)
+			case ON_DELETE_NULLIFY:
+				*steps = append(*steps,
+					cascadeStep{child, childID, rel.Field})
+			case ON_DELETE_DELETE:
+				err = child.plan(ctx, childID, seen, steps, blocking)
+				if err != nil {
+					return err
+				}
+				*steps = append(*steps, cascadeStep{child, childID, ""})
+			}
+		}
+	}
+	return nil
+}
+
+// cascade enforces the relations to the object in kvpairs before it
+// is deleted: a 409 Error lists the dependents restricting it, even
+// indirectly, or else dependents are nullified or deleted as declared.
+// This is not atomic: the dependents changed before a failure, or
+// before the deletion of the object itself fails, stay changed. Those
+// deleted are kept in the Trash of their resource, if any, to be
+// restored.
+func (h *RESTHandler) cascade(r *http.Request,
+	kvpairs map[string]string) error {
+	var steps []cascadeStep
+	var blocking []string
+	err := h.plan(r.Context(), kvpairs[h.Key], map[string]bool{}, &steps,
+		&blocking)
+	if err != nil {
+		return err
+	}
+	if len(blocking) != 0 {
+		sort.Strings(blocking)
+		return &Error{
+			StatusCode: http.StatusConflict,
+			Message: fmt.Sprintf(REFERENCED,
+				strings.Join(blocking, ", ")),
+		}
+	}
+	for _, step := range steps {
+		if step.Field == "" {
+			err = step.h.remove(r, step.ID)
+		} else {
+			err = step.h.nullify(r, step.ID, step.Field)
+		}
+		if err != nil {
+			return fmt.Errorf("%s/%s: %v", step.h.Name, step.ID, err)
+		}
+	}
+	return nil
+}
+
+// nullify clears field of object id, bumps its version and purges its
+// cache entries.
+func (h *RESTHandler) nullify(r *http.Request, id, field string) error {
+	kvpairs := map[string]string{h.Key: id}
+	h.keepPrincipal(r, kvpairs)
+	stored, err := h.getPrimary(kvpairs)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	v := reflect.New(h.DataType).Interface()
+	if err = json.Unmarshal(b, v); err != nil {
+		return err
+	}
+	f, ok := fieldByJSON(reflect.ValueOf(v), field)
+	if !ok {
+		return fmt.Errorf("no field `%s'", field)
+	}
+	f.Set(reflect.Zero(f.Type()))
+	if err = h.lock(stored, v); err != nil {
+		return err
+	}
+	if err = h.Model.Put(kvpairs, v); err != nil {
+		return err
+	}
+	h.record(r, id, v)
+	h.purgeObject(id)
+	return nil
+}
+
+// remove deletes object id, keeping it in the trash and purging its
+// cache entries.
+func (h *RESTHandler) remove(r *http.Request, id string) error {
+	kvpairs := map[string]string{h.Key: id}
+	h.keepPrincipal(r, kvpairs)
+	item, err := h.trashed(r, kvpairs)
+	if err != nil {
+		return err
+	}
+	if err = h.discard(item); err != nil {
+		return err
+	}
+	if err = h.Model.Delete(kvpairs); err != nil {
+		h.undiscard(item)
+		return err
+	}
+	h.record(r, id, nil)
+	h.purgeObject(id)
+	return nil
+}
+
+// purgeObject drops the cache entries of object id: by PurgeID with a
+// Route, else by PurgeAll. Failures are logged since the change itself
+// succeeded.
+func (h *RESTHandler) purgeObject(id string) {
+	var err error
+	if h.Route != "" {
+		err = h.PurgeID(id)
+	} else if h.purgeState != nil {
+		err = h.PurgeAll()
+	}
+	if err != nil {
+		glog.Warningf("%s/%s purge error: %v", h.Name, id, err)
+	}
+}
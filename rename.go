@@ -0,0 +1,76 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+)
+
+// TAG_WAS is the `calm' struct tag option giving the former JSON name
+// of a renamed field, e.g. `json:"full_name" calm:"was=name"'. During
+// the transition the field is sent under both names, and requests
+// using the old name are still understood.
+const TAG_WAS = "was"
+
+// hasRenamed reports whether values of type t may contain renamed
+// fields.
+func hasRenamed(t reflect.Type) bool {
+	return hasFields(TAG_WAS, t, func(f reflect.StructField) bool {
+		return len(tagValues(f, TAG_WAS)) != 0
+	})
+}
+
+// renameFields copies renamed fields of v, the decoded JSON of a
+// value of type t, to their old names if out is true, or else from
+// their old names if the new one is missing.
+func renameFields(t reflect.Type, v interface{}, out bool) {
+	walkFields(t, v, func(f reflect.StructField, name string,
+		m map[string]interface{}) bool {
+		for _, old := range tagValues(f, TAG_WAS) {
+			if out {
+				if value, ok := m[name]; ok {
+					m[old] = value
+				}
+				continue
+			}
+			if value, ok := m[old]; ok {
+				if _, exists := m[name]; !exists {
+					m[name] = value
+				}
+				delete(m, old)
+			}
+		}
+		return true
+	})
+}
+
+// unrename returns the JSON b of a value of type t with old field
+// names replaced by the current ones.
+func unrename(t reflect.Type, b []byte) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return nil, ErrTrailingData
+	}
+	renameFields(t, v, false)
+	return json.Marshal(v)
+}
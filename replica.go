@@ -0,0 +1,156 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PrimaryGetter is implemented by models that can read an object from
+// their source of truth. RESTHandler reads the stored object of PUT,
+// PATCH and DELETE by GetPrimary, so version checks and merges never
+// run on stale data.
+type PrimaryGetter interface {
+	GetPrimary(kvpairs map[string]string) (interface{}, error)
+}
+
+// getPrimary reads the object of kvpairs by GetPrimary of Model, if
+// implemented, else by Get.
+func (h *RESTHandler) getPrimary(kvpairs map[string]string) (
+	interface{}, error) {
+	if m, ok := h.Model.(PrimaryGetter); ok {
+		return m.GetPrimary(kvpairs)
+	}
+	return h.Model.Get(kvpairs)
+}
+
+// ReplicaModel routes Get and GetAll to Replicas in turn and every
+// write to Primary. Clients identified by Client read from Primary
+// for Pin after their own writes, so they see them.
+type ReplicaModel struct {
+	Primary  ModelInterface
+	Replicas []ModelInterface
+	// Pin is how long a client reads from Primary after writing
+	Pin time.Duration
+	// Client identifies the client from kvpairs, e.g. by
+	// APIKEY_KEY or SUBJECT_KEY. Reads are not pinned without it,
+	// or for clients it returns "" for.
+	Client func(kvpairs map[string]string) string
+
+	next     uint32
+	mutex    sync.Mutex
+	writes   map[string]time.Time
+	expiring []pinnedWrite
+}
+
+// pinnedWrite is a write of client at a time, in the order they
+// expire.
+type pinnedWrite struct {
+	client string
+	at     time.Time
+}
+
+// reader returns the model to read from.
+func (t *ReplicaModel) reader(kvpairs map[string]string) ModelInterface {
+	if len(t.Replicas) == 0 {
+		return t.Primary
+	}
+	if t.Client != nil && t.Pin > 0 {
+		if client := t.Client(kvpairs); client != "" {
+			t.mutex.Lock()
+			last, ok := t.writes[client]
+			t.mutex.Unlock()
+			if ok && time.Since(last) < t.Pin {
+				return t.Primary
+			}
+		}
+	}
+	i := atomic.AddUint32(&t.next, 1)
+	return t.Replicas[int(i)%len(t.Replicas)]
+}
+
+// wrote records a write of the client in kvpairs.
+func (t *ReplicaModel) wrote(kvpairs map[string]string) {
+	if t.Client == nil || t.Pin <= 0 {
+		return
+	}
+	client := t.Client(kvpairs)
+	if client == "" {
+		return
+	}
+	now := time.Now()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.writes == nil {
+		t.writes = make(map[string]time.Time)
+	}
+	for len(t.expiring) > 0 && now.Sub(t.expiring[0].at) >= t.Pin {
+		w := t.expiring[0]
+		t.expiring = t.expiring[1:]
+		if t.writes[w.client] == w.at {
+			delete(t.writes, w.client)
+		}
+	}
+	t.writes[client] = now
+	t.expiring = append(t.expiring, pinnedWrite{client, now})
+}
+
+// GetPrimary reads from Primary regardless of pinning.
+func (t *ReplicaModel) GetPrimary(kvpairs map[string]string) (
+	interface{}, error) {
+	return t.Primary.Get(kvpairs)
+}
+
+func (t *ReplicaModel) Get(kvpairs map[string]string) (interface{}, error) {
+	return t.reader(kvpairs).Get(kvpairs)
+}
+
+func (t *ReplicaModel) GetAll(kvpairs map[string]string) (interface{}, error) {
+	return t.reader(kvpairs).GetAll(kvpairs)
+}
+
+func (t *ReplicaModel) Put(kvpairs map[string]string, v interface{}) error {
+	defer t.wrote(kvpairs)
+	return t.Primary.Put(kvpairs, v)
+}
+
+func (t *ReplicaModel) PutAll(kvpairs map[string]string, v interface{}) error {
+	defer t.wrote(kvpairs)
+	return t.Primary.PutAll(kvpairs, v)
+}
+
+func (t *ReplicaModel) Patch(kvpairs map[string]string, original interface{},
+	patched interface{}) error {
+	defer t.wrote(kvpairs)
+	return t.Primary.Patch(kvpairs, original, patched)
+}
+
+func (t *ReplicaModel) Post(kvpairs map[string]string, v interface{}) (
+	string, error) {
+	defer t.wrote(kvpairs)
+	return t.Primary.Post(kvpairs, v)
+}
+
+func (t *ReplicaModel) Delete(kvpairs map[string]string) error {
+	defer t.wrote(kvpairs)
+	return t.Primary.Delete(kvpairs)
+}
+
+func (t *ReplicaModel) DeleteAll(kvpairs map[string]string) error {
+	defer t.wrote(kvpairs)
+	return t.Primary.DeleteAll(kvpairs)
+}
@@ -0,0 +1,190 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RequestInfo describes the request that failed.
+type RequestInfo struct {
+	Handler    string      `json:"handler"`
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	RemoteAddr string      `json:"remote_addr"`
+	Header     http.Header `json:"header"`
+}
+
+// sensitiveHeaders are redacted from reports and captures
+var sensitiveHeaders = []string{"Authorization", "Cookie", "Set-Cookie",
+	"Proxy-Authorization", APIKEY_HEADER, SIGNATURE_HEADER}
+
+func scrubHeader(h http.Header) http.Header {
+	h = h.Clone()
+	for _, k := range sensitiveHeaders {
+		if h.Get(k) != "" {
+			h.Set(k, REDACTED)
+		}
+	}
+	return h
+}
+
+func requestInfo(h *RESTHandler, r *http.Request) RequestInfo {
+	return RequestInfo{
+		Handler:    h.Name,
+		Method:     r.Method,
+		URL:        redactQuery(h.DataType, r.URL),
+		RemoteAddr: r.RemoteAddr,
+		Header:     scrubHeader(r.Header),
+	}
+}
+
+// ErrorReporter is told about every request a RESTHandler fails with
+// a 5xx status, with the stack where the error was raised.
+type ErrorReporter interface {
+	Report(ctx context.Context, err error, stack []byte, info RequestInfo)
+}
+
+// ErrorReporterFunc adapts an ordinary function to ErrorReporter.
+type ErrorReporterFunc func(ctx context.Context, err error, stack []byte,
+	info RequestInfo)
+
+func (f ErrorReporterFunc) Report(ctx context.Context, err error,
+	stack []byte, info RequestInfo) {
+	f(ctx, err, stack, info)
+}
+
+// Incident is the body WebhookReporter posts.
+type Incident struct {
+	Error   string      `json:"error"`
+	Stack   string      `json:"stack"`
+	Time    time.Time   `json:"time"`
+	Request RequestInfo `json:"request"`
+}
+
+// WEBHOOK_IN_FLIGHT is the default of WebhookReporter.MaxInFlight.
+const WEBHOOK_IN_FLIGHT = 8
+
+// WebhookReporter posts an Incident as JSON to URL for every report,
+// in the background so that responses are not delayed.
+type WebhookReporter struct {
+	URL    string
+	Client *http.Client
+	// Timeout of a post, default 10 seconds
+	Timeout time.Duration
+	// MaxInFlight bounds the posts under way, default
+	// WEBHOOK_IN_FLIGHT. Reports beyond are dropped, e.g. during an
+	// outage.
+	MaxInFlight int
+
+	once    sync.Once
+	slots   chan struct{}
+	dropped int64
+}
+
+// Dropped returns the number of reports dropped as MaxInFlight posts
+// were under way.
+func (t *WebhookReporter) Dropped() int64 {
+	return atomic.LoadInt64(&t.dropped)
+}
+
+func (t *WebhookReporter) Report(ctx context.Context, err error,
+	stack []byte, info RequestInfo) {
+	b, e := json.Marshal(Incident{
+		Error:   err.Error(),
+		Stack:   string(stack),
+		Time:    time.Now(),
+		Request: info,
+	})
+	if e != nil {
+		glog.Errorf("webhook report: %v", e)
+		return
+	}
+	t.once.Do(func() {
+		n := t.MaxInFlight
+		if n <= 0 {
+			n = WEBHOOK_IN_FLIGHT
+		}
+		t.slots = make(chan struct{}, n)
+	})
+	select {
+	case t.slots <- struct{}{}:
+	default:
+		atomic.AddInt64(&t.dropped, 1)
+		glog.Warningf("webhook report dropped: %v", err)
+		return
+	}
+	go func() {
+		defer func() { <-t.slots }()
+		t.post(b)
+	}()
+}
+
+func (t *WebhookReporter) post(b []byte) {
+	timeout := t.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodPost, t.URL, bytes.NewReader(b))
+	if err != nil {
+		glog.Errorf("webhook report: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		glog.Errorf("webhook report: %v", err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		glog.Errorf("webhook report: %s", res.Status)
+	}
+}
+
+// report passes the recovered value e to h.ErrorReporter if it fails
+// the request with a 5xx status.
+func (h *RESTHandler) report(r *http.Request, e interface{}, stack []byte) {
+	if h.ErrorReporter == nil {
+		return
+	}
+	var err error
+	switch v := e.(type) {
+	case *Error:
+		if v.StatusCode < 500 {
+			return
+		}
+		err = v
+	case error:
+		err = v
+	default:
+		err = fmt.Errorf("Error: %v", v)
+	}
+	h.ErrorReporter.Report(r.Context(), err, stack, requestInfo(h, r))
+}
@@ -0,0 +1,134 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RETRY_AFTER is the delay suggested by 429 and 503 responses that do
+// not set Retry-After themselves.
+const RETRY_AFTER = time.Second
+
+// BackoffPolicy tells clients how to retry 429 and 503 responses:
+// wait Retry-After if given, or else InitialMS multiplied by
+// Multiplier after each attempt up to MaxMS, randomized between 0 and
+// the delay if Jitter, for at most MaxAttempts attempts.
+type BackoffPolicy struct {
+	InitialMS   int64   `json:"initial_ms"`
+	MaxMS       int64   `json:"max_ms"`
+	Multiplier  float64 `json:"multiplier"`
+	Jitter      bool    `json:"jitter"`
+	MaxAttempts int     `json:"max_attempts"`
+}
+
+// Backoff is the policy sent with 429 and 503 responses and served by
+// BackoffHandler. It may be changed before serving.
+var Backoff = &BackoffPolicy{
+	InitialMS:   1000,
+	MaxMS:       60000,
+	Multiplier:  2,
+	Jitter:      true,
+	MaxAttempts: 5,
+}
+
+// RetryMsg is the body of 429 and 503 responses. RetryAfter is in
+// seconds, as in the Retry-After header.
+type RetryMsg struct {
+	Message    string         `json:"message"`
+	RetryAfter int            `json:"retry_after"`
+	Backoff    *BackoffPolicy `json:"backoff,omitempty"`
+}
+
+// retryable reports whether responses with status should be retried
+// later.
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests ||
+		status == http.StatusServiceUnavailable
+}
+
+// setRetryAfter sets Retry-After to d rounded up to whole seconds, at
+// least 1.
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	seconds := int((d + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+}
+
+// retryMsg returns the body of a 429 or 503 response with msg, setting
+// Retry-After to RETRY_AFTER unless already set in seconds.
+func retryMsg(w http.ResponseWriter, msg string) RetryMsg {
+	seconds, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		setRetryAfter(w, RETRY_AFTER)
+		seconds, _ = strconv.Atoi(w.Header().Get("Retry-After"))
+	}
+	return RetryMsg{Message: msg, RetryAfter: seconds, Backoff: Backoff}
+}
+
+// BackoffHandler serves Backoff to GET so that clients can fetch the
+// policy up front.
+func BackoffHandler() Handler {
+	return HandlerFunc(func(w http.ResponseWriter, r *http.Request,
+		kvpairs map[string]string) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if r.Method != http.MethodGet {
+			sendError(w, r, ErrNotImplemented)
+			return
+		}
+		b, err := json.Marshal(Backoff)
+		if err != nil {
+			sendError(w, r, err)
+			return
+		}
+		w.Write(b)
+	})
+}
+
+// RetryDelay tells a client how long to wait before retrying the
+// request that got res, attempt being the number of retries so far,
+// according to Retry-After and p. ok is false if res should not be
+// retried.
+func (p *BackoffPolicy) RetryDelay(res *http.Response, attempt int) (
+	d time.Duration, ok bool) {
+	if !retryable(res.StatusCode) || attempt >= p.MaxAttempts {
+		return 0, false
+	}
+	after := res.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(after); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(after); err == nil {
+		if d = time.Until(t); d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	ms := float64(p.InitialMS) * math.Pow(p.Multiplier, float64(attempt))
+	if ms > float64(p.MaxMS) {
+		ms = float64(p.MaxMS)
+	}
+	if p.Jitter {
+		ms *= rand.Float64()
+	}
+	return time.Duration(ms) * time.Millisecond, true
+}
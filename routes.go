@@ -0,0 +1,114 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+var routes = struct {
+	sync.RWMutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+// NameRoute registers the path template tmpl, e.g.
+// `/books/{id:int}`, under name so that URLs can be built with
+// URLFor. Names must be unique.
+func NameRoute(name, tmpl string) error {
+	if _, _, err := PathTemplate(tmpl); err != nil {
+		return err
+	}
+	routes.Lock()
+	defer routes.Unlock()
+	if _, ok := routes.m[name]; ok {
+		return fmt.Errorf("route `%s' already exists", name)
+	}
+	shape := routeShape(tmpl)
+	for other, t := range routes.m {
+		if routeShape(t) == shape {
+			return fmt.Errorf("route `%s' %s conflicts with `%s' %s",
+				name, tmpl, other, t)
+		}
+	}
+	routes.m[name] = tmpl
+	return nil
+}
+
+// RemoveRoute removes the route name, e.g. when a test or a reload
+// names it again.
+func RemoveRoute(name string) {
+	routes.Lock()
+	defer routes.Unlock()
+	delete(routes.m, name)
+}
+
+// routeShape returns tmpl with its variables anonymized, so that
+// templates matching the same paths have the same shape.
+func routeShape(tmpl string) string {
+	return templateVar.ReplaceAllString(tmpl, "{}")
+}
+
+// Routes returns the registered route templates by name, e.g. for
+// debugging and tests.
+func Routes() map[string]string {
+	routes.RLock()
+	defer routes.RUnlock()
+	m := make(map[string]string, len(routes.m))
+	for name, tmpl := range routes.m {
+		m[name] = tmpl
+	}
+	return m
+}
+
+// RoutesHandler serves Routes as JSON, e.g. for cmd/calmbench.
+func RoutesHandler() Handler {
+	return HandlerFunc(func(w http.ResponseWriter, r *http.Request,
+		kvpairs map[string]string) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := writeJSON(w, Routes()); err != nil {
+			sendError(w, r, err)
+		}
+	})
+}
+
+// URLFor builds the path of the route registered as name with its
+// variables replaced by vars. Every variable in the template must be
+// present in vars.
+func URLFor(name string, vars map[string]string) (string, error) {
+	routes.RLock()
+	tmpl, ok := routes.m[name]
+	routes.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("route `%s' not found", name)
+	}
+	var err error
+	s := templateVar.ReplaceAllStringFunc(tmpl, func(m string) string {
+		v := templateVar.FindStringSubmatch(m)[1]
+		value, ok := vars[v]
+		if !ok {
+			err = fmt.Errorf("route `%s' missing variable `%s'",
+				name, v)
+			return ""
+		}
+		return url.PathEscape(value)
+	})
+	if err != nil {
+		return "", err
+	}
+	return s, nil
+}
@@ -0,0 +1,173 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang/glog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// JobStatus reports the state of a scheduled job.
+type JobStatus struct {
+	Name      string    `json:"name"`
+	Every     string    `json:"every"`
+	Running   bool      `json:"running"`
+	Runs      int64     `json:"runs"`
+	LastRun   time.Time `json:"last_run"`
+	LastError string    `json:"last_error,omitempty"`
+	NextRun   time.Time `json:"next_run"`
+}
+
+type job struct {
+	every  time.Duration
+	run    func(ctx context.Context) error
+	status JobStatus
+}
+
+// Scheduler runs named jobs periodically in the background. It serves
+// the status of its jobs as a Handler, e.g. on an admin route.
+type Scheduler struct {
+	// Authorize allows requests to read the status, see ServeHTTP.
+	// Others get 404, all of them if nil.
+	Authorize func(r *http.Request) bool
+
+	mutex   sync.Mutex
+	jobs    map[string]*job
+	started bool
+}
+
+func NewScheduler() *Scheduler {
+	return &Scheduler{jobs: make(map[string]*job)}
+}
+
+// Add registers run to be called every interval, first after one
+// interval has passed. Jobs cannot be added once started.
+func (s *Scheduler) Add(name string, every time.Duration,
+	run func(ctx context.Context) error) error {
+	if every <= 0 {
+		return errors.New("interval must be positive")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.started {
+		return errors.New("scheduler already started")
+	}
+	if _, ok := s.jobs[name]; ok {
+		return fmt.Errorf("job `%s' already exists", name)
+	}
+	s.jobs[name] = &job{
+		every:  every,
+		run:    run,
+		status: JobStatus{Name: name, Every: every.String()},
+	}
+	return nil
+}
+
+// Start runs the jobs until ctx is done. A run still in progress when
+// the next one is due delays it rather than overlapping. Starting
+// twice is an error.
+func (s *Scheduler) Start(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.started {
+		return errors.New("scheduler already started")
+	}
+	s.started = true
+	for _, j := range s.jobs {
+		j.status.NextRun = time.Now().Add(j.every)
+		go s.loop(ctx, j)
+	}
+	return nil
+}
+
+func (s *Scheduler) loop(ctx context.Context, j *job) {
+	ticker := time.NewTicker(j.every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.runJob(ctx, j)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Scheduler) runJob(ctx context.Context, j *job) {
+	s.mutex.Lock()
+	j.status.Running = true
+	j.status.LastRun = time.Now()
+	s.mutex.Unlock()
+	err := func() (err error) {
+		defer func() {
+			if e := recover(); e != nil {
+				err = fmt.Errorf("panic: %v", e)
+			}
+		}()
+		return j.run(ctx)
+	}()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	j.status.Running = false
+	j.status.Runs++
+	j.status.NextRun = time.Now().Add(j.every)
+	j.status.LastError = ""
+	if err != nil {
+		glog.Errorf("job %s: %v", j.status.Name, err)
+		j.status.LastError = err.Error()
+	}
+}
+
+// Status returns the status of every job sorted by name.
+func (s *Scheduler) Status() []JobStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	list := make([]JobStatus, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		list = append(list, j.status)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// ServeHTTP responds to GET with the status of the jobs, if allowed by
+// Authorize.
+func (s *Scheduler) ServeHTTP(w http.ResponseWriter, r *http.Request,
+	kvpairs map[string]string) {
+	if s.Authorize == nil || !s.Authorize(r) {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if r.Method != http.MethodGet {
+		sendError(w, r, ErrNotImplemented)
+		return
+	}
+	b, err := json.Marshal(s.Status())
+	if err != nil {
+		sendError(w, r, err)
+		return
+	}
+	w.Write(b)
+}
@@ -0,0 +1,344 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// Schema is a JSON Schema document.
+type Schema map[string]interface{}
+
+var jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+
+// JSONSchema derives the JSON Schema of values of type t as encoded
+// by encoding/json.
+func JSONSchema(t reflect.Type) Schema {
+	return jsonSchema(t, make(map[reflect.Type]bool))
+}
+
+func jsonSchema(t reflect.Type, seen map[reflect.Type]bool) Schema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return Schema{"type": "string", "format": "date-time"}
+	case t.Implements(jsonMarshalerType) ||
+		reflect.PtrTo(t).Implements(jsonMarshalerType):
+		// cannot tell what it marshals to
+		return Schema{}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return Schema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16,
+		reflect.Uint32, reflect.Uint64:
+		return Schema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return Schema{"type": "number"}
+	case reflect.String:
+		return Schema{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return Schema{"type": "string", "contentEncoding": "base64"}
+		}
+		return Schema{
+			"type":  "array",
+			"items": jsonSchema(t.Elem(), seen),
+		}
+	case reflect.Map:
+		return Schema{
+			"type":                 "object",
+			"additionalProperties": jsonSchema(t.Elem(), seen),
+		}
+	case reflect.Struct:
+		if seen[t] {
+			// recursive type
+			return Schema{"type": "object"}
+		}
+		seen[t] = true
+		defer delete(seen, t)
+		properties := Schema{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := jsonName(f)
+			if name == "" {
+				continue
+			}
+			if f.Anonymous && f.Tag.Get("json") == "" {
+				embedded := jsonSchema(f.Type, seen)
+				if p, ok := embedded["properties"].(Schema); ok {
+					for k, v := range p {
+						properties[k] = v
+					}
+				}
+				continue
+			}
+			s := jsonSchema(f.Type, seen)
+			if strings.Contains(f.Tag.Get("json"), ",string") {
+				s = Schema{"type": "string"}
+			}
+			properties[name] = s
+		}
+		return Schema{"type": "object", "properties": properties}
+	}
+	return Schema{}
+}
+
+// MethodSchema describes the request and response bodies of a method.
+type MethodSchema struct {
+	Request  Schema   `json:"request,omitempty"`
+	Response Schema   `json:"response,omitempty"`
+	Example  *Example `json:"example,omitempty"`
+}
+
+var msgSchema = JSONSchema(reflect.TypeOf(Msg{}))
+
+var diffMsgSchema = JSONSchema(reflect.TypeOf(DiffMsg{}))
+
+var patchSchema = Schema{
+	"type": "array",
+	"items": Schema{
+		"type": "object",
+		"properties": Schema{
+			"op":    Schema{"type": "string"},
+			"path":  Schema{"type": "string"},
+			"from":  Schema{"type": "string"},
+			"value": Schema{},
+		},
+		"required": []string{"op", "path"},
+	},
+}
+
+// SchemaHandler returns a Handler serving the JSON Schema of DataType,
+// e.g. to be registered as SchemaRoute.
+func (h *RESTHandler) SchemaHandler() Handler {
+	return HandlerFunc(func(w http.ResponseWriter, r *http.Request,
+		kvpairs map[string]string) {
+		w.Header().Set("Content-Type", "application/schema+json")
+		if err := writeJSON(w, h.dataSchema()); err != nil {
+			sendError(w, r, err)
+		}
+	})
+}
+
+// allowed returns the methods supported on an item if item is true or
+// else on the collection, as identified by kvpairs. Immutable ones
+// only allow reads, and POST to collections, as freeze does.
+func (h *RESTHandler) allowed(kvpairs map[string]string,
+	item bool) []string {
+	frozen := h.immutable(kvpairs)
+	methods := []string{http.MethodGet, http.MethodPost, http.MethodOptions}
+	if item {
+		methods = []string{http.MethodGet, http.MethodPut,
+			http.MethodPatch, http.MethodDelete, http.MethodOptions}
+	}
+	m, _ := h.Model.(*partialModel)
+	allowed := make([]string, 0, len(methods)+1+len(h.ExtraMethods))
+	for _, method := range methods {
+		if m != nil && !m.allows(method, item) {
+			continue
+		}
+		if frozen && method != http.MethodGet &&
+			method != http.MethodOptions && (item ||
+			method != http.MethodPost) {
+			continue
+		}
+		// a mock only serves its examples
+		if h.Model == nil && method != http.MethodOptions &&
+			h.example(method, item) == nil {
+			continue
+		}
+		allowed = append(allowed, method)
+		if method == http.MethodGet {
+			allowed = append(allowed, http.MethodHead)
+		}
+	}
+	if frozen {
+		return allowed
+	}
+	return append(allowed, h.ExtraMethods...)
+}
+
+// describe returns the schemas of the methods supported on an item or
+// on the collection.
+func (h *RESTHandler) describe(item bool) map[string]MethodSchema {
+	data := h.dataSchema()
+	if !item {
+		created := Schema{
+			"type": "object",
+			"properties": Schema{
+				"id": Schema{"type": "string"},
+			},
+		}
+		if h.ReturnCreated {
+			created = data
+		}
+		return h.withExamples(item, map[string]MethodSchema{
+			http.MethodGet:  {Response: Schema{"type": "array", "items": data}},
+			http.MethodPost: {Request: data, Response: created},
+		})
+	}
+	updated := msgSchema
+	if h.ReturnDiff {
+		updated = diffMsgSchema
+	}
+	deleted := msgSchema
+	if h.ReturnDeleted {
+		deleted = data
+	}
+	return h.withExamples(item, map[string]MethodSchema{
+		http.MethodGet:    {Response: data},
+		http.MethodPut:    {Request: data, Response: updated},
+		http.MethodPatch:  {Request: patchSchema, Response: updated},
+		http.MethodDelete: {Response: deleted},
+	})
+}
+
+// withExamples attaches the examples of h to methods.
+func (h *RESTHandler) withExamples(item bool,
+	methods map[string]MethodSchema) map[string]MethodSchema {
+	for method, schema := range methods {
+		schema.Example = h.example(method, item)
+		methods[method] = schema
+	}
+	return methods
+}
+
+// serveOptions answers OPTIONS with the Allow header, and with the
+// method schemas as body if h.DescribeOptions is set.
+func (h *RESTHandler) serveOptions(w http.ResponseWriter, r *http.Request,
+	kvpairs map[string]string, item bool) {
+	allow := strings.Join(h.allowed(kvpairs, item), ", ")
+	w.Header().Set("Allow", allow)
+	if r.Header.Get("Access-Control-Request-Method") != "" {
+		w.Header().Set("Access-Control-Allow-Methods", allow)
+	}
+	if !h.DescribeOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	methods := make(map[string]MethodSchema)
+	described := h.describe(item)
+	for _, method := range h.allowed(kvpairs, item) {
+		if schema, ok := described[method]; ok {
+			methods[method] = schema
+		}
+	}
+	b, err := json.Marshal(struct {
+		Methods map[string]MethodSchema `json:"methods"`
+	}{methods})
+	if err != nil {
+		panic(err)
+	}
+	if _, err = w.Write(b); err != nil {
+		panic(err)
+	}
+}
+
+// Validate checks the JSON document b against s. It understands the
+// subset of JSON Schema produced by JSONSchema: type, properties,
+// required, items and additionalProperties. null is accepted for any
+// type since encoding/json produces it for nil pointers, slices and
+// maps.
+func Validate(s Schema, b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	return validate(s, v, "")
+}
+
+func validate(s Schema, v interface{}, path string) error {
+	if v == nil {
+		return nil
+	}
+	location := path
+	if location == "" {
+		location = "/"
+	}
+	mismatch := func() error {
+		return fmt.Errorf("%s: expect %v, got %T", location, s["type"], v)
+	}
+	switch s["type"] {
+	case "object":
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return mismatch()
+		}
+		if required, ok := s["required"].([]string); ok {
+			for _, name := range required {
+				if _, ok := m[name]; !ok {
+					return fmt.Errorf("%s: missing %s", location, name)
+				}
+			}
+		}
+		properties, _ := s["properties"].(Schema)
+		additional, _ := s["additionalProperties"].(Schema)
+		for name, value := range m {
+			p, ok := properties[name].(Schema)
+			if !ok {
+				p = additional
+			}
+			if p == nil {
+				continue
+			}
+			err := validate(p, value, path+"/"+pointerEscaper.Replace(name))
+			if err != nil {
+				return err
+			}
+		}
+	case "array":
+		a, ok := v.([]interface{})
+		if !ok {
+			return mismatch()
+		}
+		items, _ := s["items"].(Schema)
+		for i, item := range a {
+			if items == nil {
+				break
+			}
+			err := validate(items, item, fmt.Sprintf("%s/%d", path, i))
+			if err != nil {
+				return err
+			}
+		}
+	case "string":
+		if _, ok := v.(string); !ok {
+			return mismatch()
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return mismatch()
+		}
+	case "number":
+		if _, ok := v.(float64); !ok {
+			return mismatch()
+		}
+	case "integer":
+		f, ok := v.(float64)
+		if !ok || f != math.Trunc(f) {
+			return mismatch()
+		}
+	}
+	return nil
+}
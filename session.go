@@ -0,0 +1,352 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/golang/glog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Session holds the data of a client session.
+type Session struct {
+	mutex   sync.Mutex
+	id      string
+	values  map[string]string
+	changed bool
+	expired bool
+	renewed bool
+}
+
+// Get returns the value of key in the session.
+func (s *Session) Get(key string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.values[key]
+}
+
+// Set sets key to value in the session.
+func (s *Session) Set(key, value string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.values[key] = value
+	s.changed = true
+}
+
+// Delete removes key from the session.
+func (s *Session) Delete(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.values, key)
+	s.changed = true
+}
+
+// Clear ends the session, e.g. on logout.
+func (s *Session) Clear() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.values = make(map[string]string)
+	s.changed = true
+	s.expired = true
+}
+
+// Renew gives the session a new id, keeping its values. Call it when
+// privileges change, e.g. on login, so that an id planted by an
+// attacker before (session fixation) is of no use after.
+func (s *Session) Renew() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.changed = true
+	s.renewed = true
+}
+
+// SessionStore keeps session data on the server side.
+type SessionStore interface {
+	// Load returns the values of session id, or nil if there is
+	// none.
+	Load(id string) (map[string]string, error)
+	Save(id string, values map[string]string, maxAge time.Duration) error
+	Delete(id string) error
+}
+
+// MemcacheSessionStore is a SessionStore in memcache.
+type MemcacheSessionStore struct {
+	Client *memcache.Client
+	// Prefix of memcache keys
+	Prefix string
+}
+
+func (t *MemcacheSessionStore) Load(id string) (map[string]string, error) {
+	item, err := t.Client.Get(t.Prefix + id)
+	if err == memcache.ErrCacheMiss {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string)
+	if err = json.Unmarshal(item.Value, &values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func (t *MemcacheSessionStore) Save(id string, values map[string]string,
+	maxAge time.Duration) error {
+	b, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	return t.Client.Set(&memcache.Item{
+		Key:        t.Prefix + id,
+		Value:      b,
+		Expiration: int32(maxAge / time.Second),
+	})
+}
+
+func (t *MemcacheSessionStore) Delete(id string) error {
+	err := t.Client.Delete(t.Prefix + id)
+	if err == memcache.ErrCacheMiss {
+		return nil
+	}
+	return err
+}
+
+// Sessions is a middleware managing cookie sessions. Without Store,
+// session values are kept in the cookie itself, encrypted and
+// authenticated with AES-GCM. With Store, the cookie only carries an
+// encrypted random session id.
+type Sessions struct {
+	// Keys are 16, 24 or 32 byte AES keys. The first one encrypts,
+	// all of them are tried to decrypt so keys can be rotated.
+	Keys [][]byte
+	// Name of the cookie, default "session"
+	Name string
+	// MaxAge of the session, default 24 hours
+	MaxAge time.Duration
+	// Secure restricts the cookie to HTTPS
+	Secure bool
+	Store  SessionStore
+}
+
+type sessionContextKey struct{}
+
+// SessionFrom returns the session of r within Sessions.Wrap, or nil.
+func SessionFrom(r *http.Request) *Session {
+	s, _ := r.Context().Value(sessionContextKey{}).(*Session)
+	return s
+}
+
+func (t *Sessions) name() string {
+	if t.Name == "" {
+		return "session"
+	}
+	return t.Name
+}
+
+func (t *Sessions) maxAge() time.Duration {
+	if t.MaxAge == 0 {
+		return 24 * time.Hour
+	}
+	return t.MaxAge
+}
+
+func (t *Sessions) seal(plaintext []byte) (string, error) {
+	if len(t.Keys) == 0 {
+		return "", errors.New("sessions: no key")
+	}
+	b, err := seal(t.Keys[0], plaintext, []byte(t.name()))
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (t *Sessions) open(s string) ([]byte, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return open(t.Keys, b, []byte(t.name()))
+}
+
+// sessionCookie is the content of the cookie
+type sessionCookie struct {
+	ID      string            `json:"id,omitempty"`
+	Values  map[string]string `json:"values,omitempty"`
+	Expires int64             `json:"exp"`
+}
+
+// load returns the session of r, or a new one.
+func (t *Sessions) load(r *http.Request) *Session {
+	s := &Session{values: make(map[string]string)}
+	cookie, err := r.Cookie(t.name())
+	if err != nil {
+		return s
+	}
+	b, err := t.open(cookie.Value)
+	if err != nil {
+		glog.V(1).Infof("session: %v", err)
+		return s
+	}
+	c := sessionCookie{}
+	if err = json.Unmarshal(b, &c); err != nil ||
+		time.Now().Unix() >= c.Expires {
+		return s
+	}
+	if t.Store == nil {
+		if c.Values != nil {
+			s.values = c.Values
+		}
+		return s
+	}
+	values, err := t.Store.Load(c.ID)
+	if err != nil {
+		glog.Errorf("session %s: %v", c.ID, err)
+		return s
+	}
+	if values != nil {
+		s.id = c.ID
+		s.values = values
+	}
+	return s
+}
+
+// save writes the session cookie if the session has changed.
+func (t *Sessions) save(w http.ResponseWriter, s *Session) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.changed {
+		return nil
+	}
+	s.changed = false
+	if s.expired {
+		if t.Store != nil && s.id != "" {
+			if err := t.Store.Delete(s.id); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     t.name(),
+			Path:     "/",
+			MaxAge:   -1,
+			Secure:   t.Secure,
+			HttpOnly: true,
+		})
+		return nil
+	}
+	maxAge := t.maxAge()
+	c := sessionCookie{Expires: time.Now().Add(maxAge).Unix()}
+	if t.Store == nil {
+		c.Values = s.values
+	} else {
+		if s.renewed && s.id != "" {
+			if err := t.Store.Delete(s.id); err != nil {
+				return err
+			}
+			s.id = ""
+		}
+		s.renewed = false
+		if s.id == "" {
+			id, err := randomHex(16)
+			if err != nil {
+				return err
+			}
+			s.id = id
+		}
+		if err := t.Store.Save(s.id, s.values, maxAge); err != nil {
+			return err
+		}
+		c.ID = s.id
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	value, err := t.seal(b)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     t.name(),
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(maxAge / time.Second),
+		Secure:   t.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// sessionWriter saves the session right before the response header
+// is written.
+type sessionWriter struct {
+	http.ResponseWriter
+	sessions *Sessions
+	session  *Session
+	written  bool
+}
+
+func (w *sessionWriter) WriteHeader(status int) {
+	if !w.written {
+		w.written = true
+		if err := w.sessions.save(w.ResponseWriter, w.session); err != nil {
+			glog.Errorf("session: %v", err)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *sessionWriter) Write(b []byte) (int, error) {
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *sessionWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		if !w.written {
+			w.WriteHeader(http.StatusOK)
+		}
+		f.Flush()
+	}
+}
+
+// Unwrap returns the wrapped ResponseWriter for http.ResponseController.
+func (w *sessionWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Wrap returns an http.Handler that makes the session available to
+// next through SessionFrom and saves it when the response starts.
+func (t *Sessions) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := t.load(r)
+		sw := &sessionWriter{ResponseWriter: w, sessions: t, session: s}
+		ctx := context.WithValue(r.Context(), sessionContextKey{}, s)
+		next.ServeHTTP(sw, r.WithContext(ctx))
+		if !sw.written {
+			sw.WriteHeader(http.StatusOK)
+		}
+	})
+}
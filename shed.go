@@ -0,0 +1,160 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PRIORITY_PATHS are served by LoadShedder regardless of load by
+// default. Paths ending with a slash match as prefixes.
+var PRIORITY_PATHS = []string{"/_healthz", "/_metrics", "/_admin/"}
+
+func defaultPriority(r *http.Request) bool {
+	for _, p := range PRIORITY_PATHS {
+		if r.URL.Path == p ||
+			strings.HasSuffix(p, "/") && strings.HasPrefix(r.URL.Path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *LoadShedder) priority(r *http.Request) bool {
+	if t.Priority != nil {
+		return t.Priority(r)
+	}
+	return defaultPriority(r)
+}
+
+// LoadShedder is an admission control middleware. It serves at most
+// MaxConcurrent requests at a time and queues up to MaxQueue more;
+// beyond that, or after waiting QueueTimeout, requests get 503 with
+// Retry-After.
+type LoadShedder struct {
+	// MaxConcurrent of 0 or less means no limit
+	MaxConcurrent int
+	MaxQueue      int
+	// QueueTimeout is how long a request may wait, default 1 second
+	QueueTimeout time.Duration
+	// RetryAfter is suggested to rejected clients, default 1 second
+	RetryAfter time.Duration
+	// Priority reports whether r bypasses the limits. The default
+	// lets through the PRIORITY_PATHS, so that orchestrators do not
+	// kill an overloaded but working instance.
+	Priority func(r *http.Request) bool
+
+	once   sync.Once
+	slots  chan struct{}
+	mutex  sync.Mutex
+	queued int
+}
+
+func (t *LoadShedder) init() {
+	t.slots = make(chan struct{}, t.MaxConcurrent)
+}
+
+// enqueue takes a place in the queue if there is one.
+func (t *LoadShedder) enqueue() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.queued >= t.MaxQueue {
+		return false
+	}
+	t.queued++
+	return true
+}
+
+func (t *LoadShedder) dequeue() {
+	t.mutex.Lock()
+	t.queued--
+	t.mutex.Unlock()
+}
+
+// acquire waits for a slot to serve r and reports whether one was
+// obtained.
+func (t *LoadShedder) acquire(r *http.Request) bool {
+	t.once.Do(t.init)
+	select {
+	case t.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if !t.enqueue() {
+		return false
+	}
+	defer t.dequeue()
+	timeout := t.QueueTimeout
+	if timeout == 0 {
+		timeout = time.Second
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case t.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+	return false
+}
+
+func (t *LoadShedder) release() {
+	<-t.slots
+}
+
+// shed rejects r with 503 and Retry-After.
+func (t *LoadShedder) shed(w http.ResponseWriter, r *http.Request) {
+	retry := t.RetryAfter
+	if retry == 0 {
+		retry = time.Second
+	}
+	setRetryAfter(w, retry)
+	sendJSONMsg(w, r, http.StatusServiceUnavailable,
+		http.StatusText(http.StatusServiceUnavailable))
+}
+
+// admit calls serve within the limits unless r has priority.
+func (t *LoadShedder) admit(w http.ResponseWriter, r *http.Request,
+	serve func()) {
+	if t.MaxConcurrent <= 0 || t.priority(r) {
+		serve()
+		return
+	}
+	if !t.acquire(r) {
+		t.shed(w, r)
+		return
+	}
+	defer t.release()
+	serve()
+}
+
+// Wrap returns a Handler that serves next within the limits.
+func (t *LoadShedder) Wrap(next Handler) Handler {
+	return HandlerFunc(func(w http.ResponseWriter, r *http.Request,
+		kvpairs map[string]string) {
+		t.admit(w, r, func() { next.ServeHTTP(w, r, kvpairs) })
+	})
+}
+
+// WrapHTTP is Wrap for an http.Handler, e.g. a whole ServeMux.
+func (t *LoadShedder) WrapHTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.admit(w, r, func() { next.ServeHTTP(w, r) })
+	})
+}
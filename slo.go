@@ -0,0 +1,217 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"encoding/json"
+	"github.com/golang/glog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// statusWriter records the status of the response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// SLOStatus reports the state of an SLO over its window. A burn rate
+// of 1 consumes the error budget exactly by the end of the window.
+type SLOStatus struct {
+	Name                 string  `json:"name"`
+	Requests             int64   `json:"requests"`
+	Errors               int64   `json:"errors"`
+	Slow                 int64   `json:"slow"`
+	AvailabilityBurnRate float64 `json:"availability_burn_rate"`
+	LatencyBurnRate      float64 `json:"latency_burn_rate"`
+}
+
+type sloBucket struct {
+	minute                 int64
+	requests, errors, slow int64
+}
+
+// SLO is a middleware tracking the availability and latency objectives
+// of a handler over a sliding window. Status 5xx counts against
+// availability, responses slower than Latency against latency.
+type SLO struct {
+	Name string
+	// Availability is the objective for non-5xx responses, e.g. 0.999
+	Availability float64
+	// LatencyTarget is the objective for responses within Latency,
+	// e.g. 0.99. 0 disables the latency SLO.
+	Latency       time.Duration
+	LatencyTarget float64
+	// Window is the period of the objectives, default 1 hour
+	Window time.Duration
+	// OnAlert, if set, is called at most once a minute while a burn
+	// rate exceeds AlertBurnRate. It runs in the background, one call
+	// at a time; alerts due while it runs are dropped.
+	AlertBurnRate float64
+	OnAlert       func(status SLOStatus)
+
+	mutex     sync.Mutex
+	buckets   []sloBucket
+	lastAlert int64
+	alerting  int32
+}
+
+func (t *SLO) window() time.Duration {
+	if t.Window == 0 {
+		return time.Hour
+	}
+	return t.Window
+}
+
+// record counts a response and returns the status if an alert is due.
+func (t *SLO) record(now time.Time, status int, elapsed time.Duration) (
+	SLOStatus, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	minutes := int(t.window() / time.Minute)
+	if minutes < 1 {
+		minutes = 1
+	}
+	if len(t.buckets) != minutes {
+		t.buckets = make([]sloBucket, minutes)
+	}
+	minute := now.Unix() / 60
+	b := &t.buckets[minute%int64(minutes)]
+	if b.minute != minute {
+		*b = sloBucket{minute: minute}
+	}
+	b.requests++
+	if status >= 500 {
+		b.errors++
+	}
+	if t.LatencyTarget > 0 && elapsed > t.Latency {
+		b.slow++
+	}
+	s := t.status(minute)
+	if t.OnAlert == nil || t.AlertBurnRate <= 0 || t.lastAlert == minute ||
+		s.AvailabilityBurnRate <= t.AlertBurnRate &&
+			s.LatencyBurnRate <= t.AlertBurnRate {
+		return s, false
+	}
+	t.lastAlert = minute
+	return s, true
+}
+
+// status sums the buckets within the window ending at minute.
+func (t *SLO) status(minute int64) SLOStatus {
+	s := SLOStatus{Name: t.Name}
+	for _, b := range t.buckets {
+		if minute-b.minute >= int64(len(t.buckets)) {
+			continue
+		}
+		s.Requests += b.requests
+		s.Errors += b.errors
+		s.Slow += b.slow
+	}
+	if s.Requests == 0 {
+		return s
+	}
+	n := float64(s.Requests)
+	if t.Availability > 0 && t.Availability < 1 {
+		s.AvailabilityBurnRate = float64(s.Errors) / n / (1 - t.Availability)
+	}
+	if t.LatencyTarget > 0 && t.LatencyTarget < 1 {
+		s.LatencyBurnRate = float64(s.Slow) / n / (1 - t.LatencyTarget)
+	}
+	return s
+}
+
+// Status returns the state of the SLO now.
+func (t *SLO) Status() SLOStatus {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.status(time.Now().Unix() / 60)
+}
+
+// alert calls OnAlert in the background unless a call is under way,
+// so that a slow callback neither delays responses nor piles up.
+func (t *SLO) alert(s SLOStatus) {
+	if !atomic.CompareAndSwapInt32(&t.alerting, 0, 1) {
+		glog.Warningf("SLO %s alert dropped: previous alert under way",
+			t.Name)
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&t.alerting, 0)
+		t.OnAlert(s)
+	}()
+}
+
+// Wrap returns a Handler that serves next and tracks its responses.
+func (t *SLO) Wrap(next Handler) Handler {
+	return HandlerFunc(func(w http.ResponseWriter, r *http.Request,
+		kvpairs map[string]string) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			err := recover()
+			status := sw.status
+			switch {
+			case err != nil:
+				status = http.StatusInternalServerError
+			case status == 0:
+				status = http.StatusOK
+			}
+			now := time.Now()
+			if s, alert := t.record(now, status, now.Sub(start)); alert {
+				t.alert(s)
+			}
+			if err != nil {
+				panic(err)
+			}
+		}()
+		next.ServeHTTP(sw, r, kvpairs)
+	})
+}
+
+// SLOHandler serves the status of slos as JSON, e.g. on an admin
+// route.
+func SLOHandler(slos ...*SLO) Handler {
+	return HandlerFunc(func(w http.ResponseWriter, r *http.Request,
+		kvpairs map[string]string) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		list := make([]SLOStatus, len(slos))
+		for i, s := range slos {
+			list[i] = s.Status()
+		}
+		b, err := json.Marshal(list)
+		if err != nil {
+			sendError(w, r, err)
+			return
+		}
+		w.Write(b)
+	})
+}
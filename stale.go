@@ -0,0 +1,59 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"github.com/golang/glog"
+	"net/http"
+)
+
+const (
+	// STALE_SUFFIX is appended to the cache key of stale copies
+	STALE_SUFFIX = ":stale"
+	// STALE_HEADER marks responses served from a stale copy
+	STALE_HEADER = "X-Stale"
+	// STALE_WARNING is the Warning header of stale responses
+	STALE_WARNING = `110 - "Response is Stale"`
+)
+
+// keepStale stores b as the stale copy of key if h.StaleExpiration is
+// set.
+func (h *RESTHandler) keepStale(key string, b []byte) {
+	if h.StaleExpiration == 0 {
+		return
+	}
+	h.cacheSet(key+STALE_SUFFIX, b, h.StaleExpiration)
+}
+
+// stale returns the stale copy of key to be sent instead of failing
+// with err, or nil if there is none. Only server errors are covered.
+func (h *RESTHandler) stale(w http.ResponseWriter, key string,
+	err error) []byte {
+	if h.StaleExpiration == 0 {
+		return nil
+	}
+	if e, ok := err.(*Error); ok && e.StatusCode < 500 {
+		return nil
+	}
+	b := h.cacheGet(key+STALE_SUFFIX, h.StaleExpiration)
+	if b == nil {
+		return nil
+	}
+	glog.Warningf("%s serves stale '%s': %v", h.Name, key, err)
+	header := w.Header()
+	header.Set("Warning", STALE_WARNING)
+	header.Set(STALE_HEADER, "true")
+	return b
+}
@@ -0,0 +1,173 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/golang/glog"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// DRAIN_TIMEOUT is the default of RESTHandler.DrainTimeout.
+const DRAIN_TIMEOUT = 5 * time.Second
+
+// ContextModel is implemented by models whose GetAll producers should
+// stop when ctx is done, which happens as soon as the response no
+// longer needs items, e.g. on error or client disconnect.
+type ContextModel interface {
+	GetAllContext(ctx context.Context, kvpairs map[string]string) (
+		interface{}, error)
+}
+
+// getAll calls GetAllContext of the model serving GET if it
+// implements ContextModel, or else GetAll.
+func (h *RESTHandler) getAll(ctx context.Context,
+	kvpairs map[string]string) (interface{}, error) {
+	m := h.reader()
+	if c, ok := m.(ContextModel); ok {
+		return c.GetAllContext(ctx, kvpairs)
+	}
+	return m.GetAll(kvpairs)
+}
+
+// items yields every item the model serving GET returns for kvpairs,
+// whether from GetAllStream, a channel or a slice.
+func (h *RESTHandler) items(ctx context.Context, kvpairs map[string]string,
+	yield func(v interface{}) error) error {
+	if m, ok := h.reader().(StreamingModel); ok {
+		return m.GetAllStream(ctx, kvpairs, yield)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	v, err := h.getAll(ctx, kvpairs)
+	if err != nil || v == nil {
+		return err
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Chan:
+		defer func() {
+			cancel()
+			h.drain(rv)
+		}()
+		err = receive(ctx, rv, yield)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len() && err == nil; i++ {
+			err = yield(rv.Index(i).Interface())
+		}
+	}
+	return err
+}
+
+func (h *RESTHandler) drainTimeout() time.Duration {
+	if h.DrainTimeout == 0 {
+		return DRAIN_TIMEOUT
+	}
+	return h.DrainTimeout
+}
+
+// StreamingModel is implemented by models that hand items of GetAll
+// to yield one by one instead of returning them. Streaming stops when
+// yield returns an error, which GetAllStream should return.
+type StreamingModel interface {
+	GetAllStream(ctx context.Context, kvpairs map[string]string,
+		yield func(v interface{}) error) error
+}
+
+// assemble builds the JSON array of the items each yields.
+func (h *RESTHandler) assemble(r *http.Request, kvpairs map[string]string,
+	each func(yield func(interface{}) error) error) ([]byte, error) {
+	if h.MarshalWorkers > 1 {
+		return h.assembleParallel(r, kvpairs, each)
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	enc := json.NewEncoder(buf)
+	buf.WriteByte('[')
+	i := 0
+	err := each(func(v interface{}) error {
+		if i != 0 {
+			buf.WriteByte(',')
+		}
+		v, err := h.represent(r, kvpairs, v)
+		if err != nil {
+			return err
+		}
+		if err = enc.Encode(v); err != nil {
+			return err
+		}
+		// drop the newline added by Encode
+		buf.Truncate(buf.Len() - 1)
+		i++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	buf.WriteByte(']')
+	// buf goes back to the pool
+	return append([]byte(nil), buf.Bytes()...), nil
+}
+
+// receive yields the items of channel c until it is closed or ctx is
+// done.
+func receive(ctx context.Context, c reflect.Value,
+	yield func(interface{}) error) error {
+	cases := []reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: c},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+	}
+	for {
+		chosen, v, ok := reflect.Select(cases)
+		if chosen == 1 {
+			return ctx.Err()
+		}
+		if !ok {
+			return nil
+		}
+		item := v.Interface()
+		if err, ok := item.(error); ok {
+			return err
+		}
+		if err := yield(item); err != nil {
+			return err
+		}
+	}
+}
+
+// drain receives the rest of channel c so that its producer can
+// finish, but gives up after h.DrainTimeout.
+func (h *RESTHandler) drain(c reflect.Value) {
+	timer := time.NewTimer(h.drainTimeout())
+	defer timer.Stop()
+	cases := []reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: c},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(timer.C)},
+	}
+	for {
+		chosen, _, ok := reflect.Select(cases)
+		if chosen == 1 {
+			glog.Warningf("%s: GetAll channel not closed within %v",
+				h.Name, h.drainTimeout())
+			return
+		}
+		if !ok {
+			return
+		}
+	}
+}
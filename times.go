@@ -0,0 +1,214 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// EPOCH_MILLIS_MIN is the smallest epoch time taken as milliseconds
+// rather than seconds, which would be in year 5138.
+const EPOCH_MILLIS_MIN = 1e11
+
+// TimePolicy normalizes the time.Time fields of DataType: requests may
+// give them in RFC 3339 or the formats below, and responses always
+// send them in RFC 3339 UTC.
+type TimePolicy struct {
+	// Layouts are accepted besides RFC 3339, e.g. "2006-01-02"
+	Layouts []string
+	// Epoch accepts numbers as seconds since the Unix epoch, or
+	// milliseconds from EPOCH_MILLIS_MIN on.
+	Epoch bool
+}
+
+// parse returns the time given by the JSON value v, a string or a
+// json.Number.
+func (p *TimePolicy) parse(v interface{}) (time.Time, bool) {
+	switch v := v.(type) {
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t, true
+		}
+		for _, layout := range p.Layouts {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t, true
+			}
+		}
+	case json.Number:
+		f, err := v.Float64()
+		if !p.Epoch || err != nil {
+			break
+		}
+		if math.Abs(f) >= EPOCH_MILLIS_MIN {
+			ms, err := v.Int64()
+			if err != nil {
+				ms = int64(f)
+			}
+			return time.Unix(0, ms*int64(time.Millisecond)), true
+		}
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*1e9)), true
+	}
+	return time.Time{}, false
+}
+
+// describe returns the description of time fields in the schema.
+func (p *TimePolicy) describe() string {
+	accepted := []string{"RFC 3339"}
+	if p.Epoch {
+		accepted = append(accepted, "epoch seconds",
+			"epoch milliseconds")
+	}
+	accepted = append(accepted, p.Layouts...)
+	return fmt.Sprintf("Sent in RFC 3339 UTC, accepted as %s",
+		strings.Join(accepted, ", "))
+}
+
+// hasTimes reports whether values of type t may contain time.Time
+// fields.
+func hasTimes(t reflect.Type) bool {
+	if isTime(t) {
+		return true
+	}
+	return hasFields("time", t, func(f reflect.StructField) bool {
+		return isTime(f.Type)
+	})
+}
+
+// isTime reports whether t is time.Time, or a pointer, slice, array or
+// map of it.
+func isTime(t reflect.Type) bool {
+	for {
+		switch t.Kind() {
+		case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+			t = t.Elem()
+		default:
+			return t == timeType
+		}
+	}
+}
+
+// normalizeTimes rewrites the time values in v, the decoded JSON of a
+// value of type t, as RFC 3339 in UTC. Values p cannot parse are left
+// for the decoder to report.
+func normalizeTimes(t reflect.Type, v interface{},
+	p *TimePolicy) interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == timeType {
+		if tm, ok := p.parse(v); ok {
+			return tm.UTC().Format(time.RFC3339Nano)
+		}
+		return v
+	}
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array:
+		if a, ok := v.([]interface{}); ok {
+			for i, e := range a {
+				a[i] = normalizeTimes(t.Elem(), e, p)
+			}
+		}
+	case reflect.Map:
+		if m, ok := v.(map[string]interface{}); ok {
+			for k, e := range m {
+				m[k] = normalizeTimes(t.Elem(), e, p)
+			}
+		}
+	case reflect.Struct:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return v
+		}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.Anonymous && f.Tag.Get("json") == "" {
+				normalizeTimes(f.Type, m, p)
+				continue
+			}
+			name := jsonName(f)
+			if e, ok := m[name]; ok && name != "" {
+				m[name] = normalizeTimes(f.Type, e, p)
+			}
+		}
+	}
+	return v
+}
+
+// normalizeTimesJSON applies normalizeTimes to the JSON b of a value
+// of type t. Invalid JSON is returned as is.
+func normalizeTimesJSON(t reflect.Type, b []byte, p *TimePolicy) []byte {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v interface{}
+	if d.Decode(&v) != nil {
+		return b
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return b
+	}
+	out, err := json.Marshal(normalizeTimes(t, v, p))
+	if err != nil {
+		return b
+	}
+	return out
+}
+
+// normalizesTimes reports whether h rewrites the time fields of
+// values of type t.
+func (h *RESTHandler) normalizesTimes(t reflect.Type) bool {
+	return h.Times != nil && hasTimes(t)
+}
+
+// readTimes rewrites the time fields of the DataType object in the
+// body of r, see TimePolicy.
+func (h *RESTHandler) readTimes(r *http.Request) error {
+	if !h.normalizesTimes(h.DataType) {
+		return nil
+	}
+	b, err := readBody(r)
+	if err != nil {
+		return err
+	}
+	b = normalizeTimesJSON(h.DataType, bytes.TrimPrefix(b, utf8BOM),
+		h.Times)
+	r.Body = ioutil.NopCloser(bytes.NewReader(b))
+	return nil
+}
+
+// describeTimes adds the description of TimePolicy to the date-time
+// properties of s.
+func (h *RESTHandler) describeTimes(s Schema) {
+	if h.Times == nil {
+		return
+	}
+	if s["format"] == "date-time" {
+		s["description"] = h.Times.describe()
+	}
+	for _, v := range s {
+		if v, ok := v.(Schema); ok {
+			h.describeTimes(v)
+		}
+	}
+}
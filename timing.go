@@ -0,0 +1,107 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// DEBUG_HEADER on a request asks for timing headers, see
+	// TimingOnRequest.
+	DEBUG_HEADER = "X-Calm-Debug"
+	// CACHE_HEADER tells whether GET was served from the cache
+	CACHE_HEADER = "X-Cache"
+	// RUNTIME_HEADER is the time spent in ServeHTTP in seconds
+	RUNTIME_HEADER = "X-Runtime"
+	// MODEL_TIME_HEADER is the time spent getting the response from
+	// Model in seconds
+	MODEL_TIME_HEADER = "X-Model-Time"
+	CACHE_HIT         = "HIT"
+	CACHE_MISS        = "MISS"
+)
+
+// TimingAlways sends timing headers on every response.
+func TimingAlways(r *http.Request) bool {
+	return true
+}
+
+// TimingOnRequest sends timing headers on responses to requests with
+// DEBUG_HEADER. Combine it with a check of the caller to keep timings
+// from the public.
+func TimingOnRequest(r *http.Request) bool {
+	return r.Header.Get(DEBUG_HEADER) != ""
+}
+
+// timing records where the time of a request went.
+type timing struct {
+	start time.Time
+	cache string
+	model time.Duration
+}
+
+type timingKey struct{}
+
+// timingOf returns the timing of r, or nil if not wanted.
+func timingOf(r *http.Request) *timing {
+	t, _ := r.Context().Value(timingKey{}).(*timing)
+	return t
+}
+
+// cached records a cache hit or miss.
+func (t *timing) cached(result string) {
+	if t != nil {
+		t.cache = result
+	}
+}
+
+// modelSince records the time spent on Model since start.
+func (t *timing) modelSince(start time.Time) {
+	if t != nil {
+		t.model += time.Since(start)
+	}
+}
+
+// startTiming returns r recording its timing if h.Timing asks for it.
+func (h *RESTHandler) startTiming(r *http.Request) *http.Request {
+	if h.Timing == nil || !h.Timing(r) {
+		return r
+	}
+	t := &timing{start: time.Now()}
+	return r.WithContext(context.WithValue(r.Context(), timingKey{}, t))
+}
+
+func seconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 6, 64)
+}
+
+// sendTiming sets the timing headers of the response to r, if any.
+func sendTiming(w http.ResponseWriter, r *http.Request) {
+	t := timingOf(r)
+	if t == nil {
+		return
+	}
+	header := w.Header()
+	if t.cache != "" {
+		header.Set(CACHE_HEADER, t.cache)
+	}
+	if t.model != 0 {
+		header.Set(MODEL_TIME_HEADER, seconds(t.model))
+	}
+	header.Set(RUNTIME_HEADER, seconds(time.Since(t.start)))
+}
@@ -0,0 +1,282 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/golang/glog"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TRASH_POLL is how often ScheduleTrash empties expired items.
+const TRASH_POLL = time.Minute
+
+// TrashItem is an object kept in the trash after DELETE.
+type TrashItem struct {
+	ID      string          `json:"id"`
+	Deleted time.Time       `json:"deleted"`
+	Author  string          `json:"author,omitempty"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// TrashStore keeps deleted objects until restored or expired.
+// Implementations must be safe for concurrent use.
+type TrashStore interface {
+	// Put stores item deleted from resource, replacing any item
+	// with the same ID.
+	Put(resource string, item *TrashItem) error
+	// List returns the items of resource, most recently deleted
+	// first.
+	List(resource string) ([]*TrashItem, error)
+	// Take removes and returns item id of resource, or nil if there
+	// is none.
+	Take(resource, id string) (*TrashItem, error)
+	// Expire removes the items of resource deleted before the given
+	// time and returns how many there were.
+	Expire(resource string, before time.Time) (int, error)
+}
+
+// MemoryTrashStore is a TrashStore in memory.
+type MemoryTrashStore struct {
+	mutex sync.Mutex
+	items map[string]map[string]*TrashItem
+}
+
+func NewMemoryTrashStore() *MemoryTrashStore {
+	return &MemoryTrashStore{items: make(map[string]map[string]*TrashItem)}
+}
+
+func (s *MemoryTrashStore) Put(resource string, item *TrashItem) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.items[resource] == nil {
+		s.items[resource] = make(map[string]*TrashItem)
+	}
+	c := *item
+	s.items[resource][item.ID] = &c
+	return nil
+}
+
+func (s *MemoryTrashStore) List(resource string) ([]*TrashItem, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	list := make([]*TrashItem, 0, len(s.items[resource]))
+	for _, item := range s.items[resource] {
+		c := *item
+		list = append(list, &c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Deleted.After(list[j].Deleted)
+	})
+	return list, nil
+}
+
+func (s *MemoryTrashStore) Take(resource, id string) (*TrashItem, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	item, ok := s.items[resource][id]
+	if !ok {
+		return nil, nil
+	}
+	delete(s.items[resource], id)
+	return item, nil
+}
+
+func (s *MemoryTrashStore) Expire(resource string, before time.Time) (
+	int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	n := 0
+	for id, item := range s.items[resource] {
+		if item.Deleted.Before(before) {
+			delete(s.items[resource], id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// trashed returns the object about to be deleted as stored by Model,
+// or nil if h has no Trash.
+func (h *RESTHandler) trashed(r *http.Request, kvpairs map[string]string) (
+	*TrashItem, error) {
+	if h.Trash == nil {
+		return nil, nil
+	}
+	v, err := h.getPrimary(kvpairs)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, ErrNotFound
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return &TrashItem{
+		ID:      kvpairs[h.Key],
+		Deleted: h.now(),
+		Author:  h.principal(r),
+		Data:    b,
+	}, nil
+}
+
+// discard puts item, if any, in the trash, before the object is
+// deleted so that it is never lost.
+func (h *RESTHandler) discard(item *TrashItem) error {
+	if item == nil {
+		return nil
+	}
+	return h.Trash.Put(h.Name, item)
+}
+
+// undiscard takes item, if any, out of the trash again after its
+// deletion failed. Failures are logged as the object is still there.
+func (h *RESTHandler) undiscard(item *TrashItem) {
+	if item == nil {
+		return
+	}
+	if _, err := h.Trash.Take(h.Name, item.ID); err != nil {
+		glog.Errorf("%s %s trash: %v", h.Name, item.ID, err)
+	}
+}
+
+// TrashHandler returns a Handler serving the trash of h: GET lists
+// the deleted objects, GET with h.Key in kvpairs returns one and POST
+// with it restores the object through Model.Post, checked as a POST
+// of the object would be, and answers its id, e.g.
+//
+//	goroute.Handle("/kv/", `_trash/?(?P<id>\d*)`, h.TrashHandler())
+func (h *RESTHandler) TrashHandler() Handler {
+	return HandlerFunc(func(w http.ResponseWriter, r *http.Request,
+		kvpairs map[string]string) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := h.serveTrash(w, r, kvpairs); err != nil {
+			sendError(w, r, err)
+		}
+	})
+}
+
+func (h *RESTHandler) serveTrash(w http.ResponseWriter, r *http.Request,
+	kvpairs map[string]string) error {
+	if h.Trash == nil {
+		return ErrNotImplemented
+	}
+	id := kvpairs[h.Key]
+	if id == "" {
+		if r.Method != http.MethodGet {
+			return ErrNotImplemented
+		}
+		list, err := h.Trash.List(h.Name)
+		if err != nil {
+			return err
+		}
+		return writeJSON(w, h.unexpired(list))
+	}
+	switch r.Method {
+	case http.MethodGet:
+		list, err := h.Trash.List(h.Name)
+		if err != nil {
+			return err
+		}
+		for _, item := range h.unexpired(list) {
+			if item.ID == id {
+				return writeJSON(w, item)
+			}
+		}
+		return ErrNotFound
+	case http.MethodPost:
+		return h.restore(w, r, kvpairs)
+	}
+	return ErrNotImplemented
+}
+
+// unexpired filters out the items older than TrashRetention, which the
+// scheduled job may not have removed yet.
+func (h *RESTHandler) unexpired(list []*TrashItem) []*TrashItem {
+	if h.TrashRetention == 0 {
+		return list
+	}
+	since := h.now().Add(-h.TrashRetention)
+	kept := list[:0]
+	for _, item := range list {
+		if !item.Deleted.Before(since) {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
+
+func (h *RESTHandler) restore(w http.ResponseWriter, r *http.Request,
+	kvpairs map[string]string) error {
+	if err := h.refused(r); err != nil {
+		return err
+	}
+	if !h.freeze(w, r, kvpairs) {
+		return nil
+	}
+	item, err := h.Trash.Take(h.Name, kvpairs[h.Key])
+	if err != nil {
+		return err
+	}
+	if item == nil || len(h.unexpired([]*TrashItem{item})) == 0 {
+		return ErrNotFound
+	}
+	var id string
+	v := reflect.New(h.DataType).Interface()
+	if err = json.Unmarshal(item.Data, v); err == nil {
+		err = h.checkRefs(v)
+	}
+	if err == nil {
+		h.keepPrincipal(r, kvpairs)
+		id, err = h.Model.Post(kvpairs, v)
+	}
+	if err != nil {
+		// keep it for another try
+		if e := h.Trash.Put(h.Name, item); e != nil {
+			glog.Errorf("%s %s trash: %v", h.Name, item.ID, e)
+		}
+		return err
+	}
+	h.record(r, id, v)
+	return writeJSON(w, map[string]string{"id": id})
+}
+
+// EmptyTrash removes the items deleted longer than TrashRetention ago.
+func (h *RESTHandler) EmptyTrash(ctx context.Context) error {
+	if h.Trash == nil || h.TrashRetention == 0 {
+		return nil
+	}
+	n, err := h.Trash.Expire(h.Name, h.now().Add(-h.TrashRetention))
+	if n > 0 {
+		glog.Infof("%s trash: %d expired", h.Name, n)
+	}
+	return err
+}
+
+// ScheduleTrash adds EmptyTrash to s, to run every TRASH_POLL.
+func (h *RESTHandler) ScheduleTrash(s *Scheduler) error {
+	if h.Trash == nil {
+		return errors.New("Trash is nil")
+	}
+	return s.Add("trash/"+h.Name, TRASH_POLL, h.EmptyTrash)
+}
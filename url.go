@@ -0,0 +1,141 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// TrustedProxies are the networks of the reverse proxies whose
+// Forwarded and X-Forwarded-* headers AbsoluteURL honors. It is empty
+// by default, so that clients cannot forge the URLs of Location and
+// Link headers. See TrustProxies.
+var TrustedProxies []*net.IPNet
+
+// TrustProxies sets TrustedProxies to the networks in CIDR notation,
+// e.g. "10.0.0.0/8". It is meant to be called once at startup.
+func TrustProxies(cidrs ...string) error {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		nets = append(nets, n)
+	}
+	TrustedProxies = nets
+	return nil
+}
+
+// fromTrustedProxy tells if r comes from one of TrustedProxies.
+func fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwarded parses the first element of the RFC 7239 Forwarded
+// header into lower-cased parameter names and unquoted values.
+func forwarded(r *http.Request) map[string]string {
+	params := make(map[string]string)
+	f := r.Header.Get("Forwarded")
+	if f == "" {
+		return params
+	}
+	element := strings.SplitN(f, ",", 2)[0]
+	for _, pair := range strings.Split(element, ";") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		params[strings.ToLower(kv[0])] = strings.Trim(kv[1], `"`)
+	}
+	return params
+}
+
+// firstValue returns the first of comma separated values in header
+// key, which is what the nearest proxy saw.
+func firstValue(r *http.Request, key string) string {
+	v := r.Header.Get(key)
+	return strings.TrimSpace(strings.SplitN(v, ",", 2)[0])
+}
+
+// AbsoluteURL builds the absolute URL of p as seen by the client of
+// r. It honors Forwarded and X-Forwarded-Host/Proto/Prefix set by
+// reverse proxies in TrustedProxies, and uses r.Host otherwise. p is
+// an escaped absolute path without query string.
+func AbsoluteURL(r *http.Request, p string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if !fromTrustedProxy(r) {
+		return scheme + "://" + r.Host + p
+	}
+	fwd := forwarded(r)
+	if proto := fwd["proto"]; proto != "" {
+		scheme = proto
+	} else if proto = firstValue(r, "X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	host := fwd["host"]
+	if host == "" {
+		host = firstValue(r, "X-Forwarded-Host")
+	}
+	if host == "" {
+		host = r.Host
+	}
+	prefix := firstValue(r, "X-Forwarded-Prefix")
+	if prefix != "" {
+		p = path.Join("/", prefix, p)
+	}
+	return scheme + "://" + host + p
+}
+
+// itemURL returns the absolute URL of the object id created by a
+// POST to the collection r. The route named h.Route is preferred
+// over appending id to the request path.
+func (h *RESTHandler) itemURL(r *http.Request, kvpairs map[string]string,
+	id string) (string, error) {
+	if h.Route == "" {
+		p := path.Join(r.URL.EscapedPath(), url.PathEscape(id))
+		return AbsoluteURL(r, p), nil
+	}
+	vars := make(map[string]string, len(kvpairs)+1)
+	for k, v := range kvpairs {
+		vars[k] = v
+	}
+	vars[h.Key] = id
+	p, err := URLFor(h.Route, vars)
+	if err != nil {
+		return "", err
+	}
+	return AbsoluteURL(r, p), nil
+}
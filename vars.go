@@ -0,0 +1,126 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	VAR_INT    = "int"
+	VAR_UUID   = "uuid"
+	VAR_STRING = "string"
+)
+
+var uuidPattern *regexp.Regexp
+var templateVar *regexp.Regexp
+
+// convertVar validates value against typ and returns its canonical
+// form. typ is one of VAR_INT, VAR_UUID, VAR_STRING or a time layout
+// such as "2006-01-02".
+func convertVar(typ, value string) (string, error) {
+	switch typ {
+	case "", VAR_STRING:
+		return value, nil
+	case VAR_INT:
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatInt(i, 10), nil
+	case VAR_UUID:
+		if !uuidPattern.MatchString(value) {
+			return "", fmt.Errorf("invalid uuid: %s", value)
+		}
+		return strings.ToLower(value), nil
+	}
+	t, err := time.Parse(typ, value)
+	if err != nil {
+		return "", err
+	}
+	return t.Format(typ), nil
+}
+
+// convertVars validates and converts typed variables in kvpairs in
+// place. Variables absent from kvpairs are left alone.
+func convertVars(types map[string]string, kvpairs map[string]string) error {
+	for name, typ := range types {
+		value, ok := kvpairs[name]
+		if !ok || value == "" {
+			continue
+		}
+		v, err := convertVar(typ, value)
+		if err != nil {
+			return &Error{
+				StatusCode: http.StatusBadRequest,
+				Message: fmt.Sprintf("Invalid %s `%s': expect %s",
+					name, value, typ),
+			}
+		}
+		kvpairs[name] = v
+	}
+	return nil
+}
+
+// PathTemplate translates a path template such as
+// `{id:int}/{date:2006-01-02}` into a regular expression with named
+// groups suitable for goroute, and returns the declared variable
+// types to be set as RESTHandler.Vars. A variable without type is a
+// string.
+func PathTemplate(tmpl string) (pattern string, types map[string]string,
+	err error) {
+	types = make(map[string]string)
+	matches := templateVar.FindAllStringSubmatchIndex(tmpl, -1)
+	buf := make([]string, 0, 2*len(matches)+1)
+	last := 0
+	for _, m := range matches {
+		name := tmpl[m[2]:m[3]]
+		typ := VAR_STRING
+		if m[4] >= 0 {
+			typ = tmpl[m[4]:m[5]]
+		}
+		if _, ok := types[name]; ok {
+			return "", nil, fmt.Errorf(
+				"duplicated variable `%s' in %s", name, tmpl)
+		}
+		types[name] = typ
+		buf = append(buf, regexp.QuoteMeta(tmpl[last:m[0]]),
+			fmt.Sprintf(`(?P<%s>[^/]*)`, name))
+		last = m[1]
+	}
+	buf = append(buf, regexp.QuoteMeta(tmpl[last:]))
+	return strings.Join(buf, ""), types, nil
+}
+
+func init() {
+	var err error
+
+	uuidPattern, err = regexp.Compile(
+		`^[[:xdigit:]]{8}-[[:xdigit:]]{4}-[[:xdigit:]]{4}-[[:xdigit:]]{4}-[[:xdigit:]]{12}$`)
+	if err != nil {
+		panic(err)
+	}
+
+	templateVar, err = regexp.Compile(
+		`\{([[:alpha:]_][[:alnum:]_]*)(?::([^{}]+))?\}`)
+	if err != nil {
+		panic(err)
+	}
+}
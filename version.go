@@ -0,0 +1,260 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/golang/glog"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// REV_KEY is the name of the revision number in kvpairs of the
+// handler returned by RESTHandler.History.
+const REV_KEY = "rev"
+
+// Revision is a recorded version of an object.
+type Revision struct {
+	Rev     int             `json:"rev"`
+	Time    time.Time       `json:"time"`
+	Author  string          `json:"author,omitempty"`
+	Deleted bool            `json:"deleted,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// VersionStore keeps the revisions of objects. Implementations must
+// be safe for concurrent use.
+type VersionStore interface {
+	// Append stores rev as the next revision of object id of
+	// resource and sets rev.Rev, starting from 1.
+	Append(resource, id string, rev *Revision) error
+	// List returns the revisions of object id, oldest first.
+	List(resource, id string) ([]*Revision, error)
+	// Get returns revision n of object id, or nil if there is none.
+	Get(resource, id string, n int) (*Revision, error)
+}
+
+// MemoryVersionStore is a VersionStore in memory.
+type MemoryVersionStore struct {
+	mutex     sync.RWMutex
+	revisions map[string][]*Revision
+}
+
+func NewMemoryVersionStore() *MemoryVersionStore {
+	return &MemoryVersionStore{revisions: make(map[string][]*Revision)}
+}
+
+func (s *MemoryVersionStore) Append(resource, id string, rev *Revision) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	k := resource + "\n" + id
+	rev.Rev = len(s.revisions[k]) + 1
+	c := *rev
+	s.revisions[k] = append(s.revisions[k], &c)
+	return nil
+}
+
+func (s *MemoryVersionStore) List(resource, id string) ([]*Revision, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	revisions := s.revisions[resource+"\n"+id]
+	list := make([]*Revision, len(revisions))
+	for i, rev := range revisions {
+		c := *rev
+		list[i] = &c
+	}
+	return list, nil
+}
+
+func (s *MemoryVersionStore) Get(resource, id string, n int) (*Revision, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	revisions := s.revisions[resource+"\n"+id]
+	if n < 1 || n > len(revisions) {
+		return nil, nil
+	}
+	c := *revisions[n-1]
+	return &c, nil
+}
+
+// record appends v, or a deletion if v is nil, to the history of
+// object id. Failures are logged since the change itself succeeded.
+func (h *RESTHandler) record(r *http.Request, id string, v interface{}) {
+	if h.Versions == nil {
+		return
+	}
+	rev := &Revision{
+		Time:    h.now(),
+		Author:  h.principal(r),
+		Deleted: v == nil,
+	}
+	if v != nil {
+		b, err := json.Marshal(v)
+		if err != nil {
+			glog.Errorf("%s %s revision: %v", h.Name, id, err)
+			return
+		}
+		rev.Data = b
+	}
+	if err := h.Versions.Append(h.Name, id, rev); err != nil {
+		glog.Errorf("%s %s revision: %v", h.Name, id, err)
+	}
+}
+
+// History returns a Handler serving the revisions of the object
+// identified by h.Key in kvpairs: GET lists them, GET with REV_KEY
+// returns one and POST with REV_KEY reverts the object to it, as a PUT
+// of the revision at the current version would, e.g.
+//
+//	goroute.Handle("/kv/", `(?P<id>\d+)/_history/?(?P<rev>\d*)`,
+//		h.History())
+func (h *RESTHandler) History() Handler {
+	return HandlerFunc(func(w http.ResponseWriter, r *http.Request,
+		kvpairs map[string]string) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := h.serveHistory(w, r, kvpairs); err != nil {
+			sendError(w, r, err)
+		}
+	})
+}
+
+func (h *RESTHandler) serveHistory(w http.ResponseWriter, r *http.Request,
+	kvpairs map[string]string) error {
+	if h.Versions == nil {
+		return ErrNotImplemented
+	}
+	id := kvpairs[h.Key]
+	if r.Method == http.MethodGet {
+		h.setLocales(r, kvpairs)
+		h.setProfile(w, r, kvpairs)
+	}
+	if kvpairs[REV_KEY] == "" {
+		if r.Method != http.MethodGet {
+			return ErrNotImplemented
+		}
+		list, err := h.Versions.List(h.Name, id)
+		if err != nil {
+			return err
+		}
+		if len(list) == 0 {
+			return ErrNotFound
+		}
+		for i, rev := range list {
+			if list[i], err = h.shapeRevision(r, kvpairs, rev); err != nil {
+				return err
+			}
+		}
+		return writeJSON(w, list)
+	}
+	n, err := strconv.Atoi(kvpairs[REV_KEY])
+	if err != nil {
+		return &Error{
+			StatusCode: http.StatusBadRequest,
+			Message:    "Invalid revision",
+		}
+	}
+	rev, err := h.Versions.Get(h.Name, id, n)
+	if err != nil {
+		return err
+	}
+	if rev == nil {
+		return ErrNotFound
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if rev, err = h.shapeRevision(r, kvpairs, rev); err != nil {
+			return err
+		}
+		return writeJSON(w, rev)
+	case http.MethodPost:
+		if rev.Deleted {
+			return &Error{
+				StatusCode: http.StatusConflict,
+				Message:    "Cannot revert to a deleted revision",
+			}
+		}
+		b, err := h.revertBody(kvpairs, rev)
+		if err != nil {
+			return err
+		}
+		put := r.WithContext(r.Context())
+		put.Method = http.MethodPut
+		put.Header = r.Header.Clone()
+		put.Header.Set("Content-Type", "application/json; charset=utf-8")
+		put.Body = ioutil.NopCloser(bytes.NewReader(b))
+		put.ContentLength = int64(len(b))
+		h.ServeHTTP(w, put, kvpairs)
+		return nil
+	}
+	return ErrNotImplemented
+}
+
+// revertBody returns the body of the PUT reverting object in kvpairs
+// to rev, at the version of the stored object if it has one.
+func (h *RESTHandler) revertBody(kvpairs map[string]string,
+	rev *Revision) ([]byte, error) {
+	v := reflect.New(h.DataType).Interface()
+	if err := json.Unmarshal(rev.Data, v); err != nil {
+		return nil, err
+	}
+	if field, ok := versionField(v); ok && field.CanSet() {
+		stored, err := h.getPrimary(kvpairs)
+		if err != nil && err != ErrNotFound {
+			return nil, err
+		}
+		if stored != nil {
+			n, err := h.storedVersion(stored)
+			if err != nil {
+				return nil, err
+			}
+			field.SetInt(n)
+		}
+	}
+	return json.Marshal(v)
+}
+
+// shapeRevision returns a copy of rev whose data is what GET would
+// send of it, with TAG_PII fields redacted.
+func (h *RESTHandler) shapeRevision(r *http.Request,
+	kvpairs map[string]string, rev *Revision) (*Revision, error) {
+	c := *rev
+	if len(rev.Data) == 0 {
+		return &c, nil
+	}
+	v := reflect.New(h.DataType).Interface()
+	if err := json.Unmarshal(rev.Data, v); err != nil {
+		return nil, err
+	}
+	b, err := h.representation(r, kvpairs, v)
+	if err != nil {
+		return nil, err
+	}
+	c.Data = redactJSON(h.DataType, b)
+	return &c, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
@@ -0,0 +1,116 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/glog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"time"
+)
+
+// CacheWarmer fills the cache by requesting hot URLs from Handler, so
+// that a fresh deploy does not send every request to the database.
+type CacheWarmer struct {
+	// Handler serves the URLs, e.g. the application's ServeMux
+	Handler http.Handler
+	// URLs are paths with query, e.g. "/books?sort=rank"
+	URLs []string
+	// Resources get every item returned by their GetAll warmed,
+	// using their Route to build item URLs.
+	Resources []*RESTHandler
+	// Header is sent with every request, e.g. Accept-Language
+	Header http.Header
+	// Interval between runs of Run, 0 to warm only once
+	Interval time.Duration
+}
+
+// itemURLs returns the paths of the items returned by GetAll of h.
+func itemURLs(ctx context.Context, h *RESTHandler) ([]string, error) {
+	if h.Route == "" {
+		return nil, fmt.Errorf("resource `%s' has no Route", h.Name)
+	}
+	urls := []string{}
+	yield := func(v interface{}) error {
+		id, ok := objectID(reflect.ValueOf(v))
+		if !ok {
+			return fmt.Errorf("resource `%s': item has no id", h.Name)
+		}
+		s := fmt.Sprint(id)
+		u, err := URLFor(h.Route, map[string]string{h.Key: s, DEFAULT_KEY: s})
+		if err != nil {
+			return err
+		}
+		urls = append(urls, u)
+		return nil
+	}
+	return urls, h.items(ctx, map[string]string{}, yield)
+}
+
+// Warm requests every URL once. Failures are logged and the first one
+// returned after all URLs are tried.
+func (t *CacheWarmer) Warm(ctx context.Context) error {
+	urls := append([]string{}, t.URLs...)
+	var first error
+	fail := func(err error) {
+		glog.Warningf("cache warming: %v", err)
+		if first == nil {
+			first = err
+		}
+	}
+	for _, h := range t.Resources {
+		u, err := itemURLs(ctx, h)
+		if err != nil {
+			fail(err)
+		}
+		urls = append(urls, u...)
+	}
+	for _, u := range urls {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		r := httptest.NewRequest(http.MethodGet, u, nil).WithContext(ctx)
+		for k, v := range t.Header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		t.Handler.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			fail(fmt.Errorf("GET %s: %d", u, w.Code))
+		}
+	}
+	return first
+}
+
+// Run warms the cache now and then every Interval until ctx is done.
+func (t *CacheWarmer) Run(ctx context.Context) {
+	t.Warm(ctx)
+	if t.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(t.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.Warm(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2013 John Lee <john@0xlab.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gocalm
+
+import (
+	"github.com/golang/glog"
+	"net/http"
+	"sync"
+)
+
+// WORK_KEY is the name in kvpairs of the id of the unit of work of the
+// request. Models get the Work with WorkFor.
+const WORK_KEY = "_work"
+
+// Work is a resource held for the duration of a request, e.g. a
+// database transaction.
+type Work interface {
+	Commit() error
+	Rollback() error
+}
+
+// works holds the Work of requests in progress by id
+var works sync.Map
+
+// WorkFor returns the Work of the request whose kvpairs are given, or
+// nil outside of UnitOfWork.
+func WorkFor(kvpairs map[string]string) Work {
+	w, ok := works.Load(kvpairs[WORK_KEY])
+	if !ok {
+		return nil
+	}
+	return w.(Work)
+}
+
+// UnitOfWork is a middleware that begins a Work for every request and
+// commits it right before a successful response is sent, or rolls it
+// back on error status or panic. If Commit fails, 500 is sent instead.
+type UnitOfWork struct {
+	Begin func(r *http.Request) (Work, error)
+}
+
+// workWriter ends the work when the status is known.
+type workWriter struct {
+	http.ResponseWriter
+	r       *http.Request
+	work    Work
+	ended   bool
+	discard bool
+}
+
+func (w *workWriter) end(status int) int {
+	w.ended = true
+	if status >= 400 {
+		if err := w.work.Rollback(); err != nil {
+			glog.Errorf("rollback: %v", err)
+		}
+		return status
+	}
+	if err := w.work.Commit(); err != nil {
+		glog.Errorf("commit: %v", err)
+		if err := w.work.Rollback(); err != nil {
+			glog.Errorf("rollback: %v", err)
+		}
+		return http.StatusInternalServerError
+	}
+	return status
+}
+
+func (w *workWriter) WriteHeader(status int) {
+	if w.ended {
+		return
+	}
+	if s := w.end(status); s != status {
+		w.discard = true
+		sendJSONMsg(w.ResponseWriter, w.r, s, "Commit failed")
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *workWriter) Write(b []byte) (int, error) {
+	if !w.ended {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.discard {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Wrap returns a Handler serving next within a unit of work.
+func (t *UnitOfWork) Wrap(next Handler) Handler {
+	return HandlerFunc(func(w http.ResponseWriter, r *http.Request,
+		kvpairs map[string]string) {
+		work, err := t.Begin(r)
+		if err != nil {
+			sendError(w, r, err)
+			return
+		}
+		id, err := randomHex(8)
+		if err != nil {
+			work.Rollback()
+			sendError(w, r, err)
+			return
+		}
+		works.Store(id, work)
+		defer works.Delete(id)
+		kvpairs[WORK_KEY] = id
+		ww := &workWriter{ResponseWriter: w, r: r, work: work}
+		defer func() {
+			if ww.ended {
+				return
+			}
+			if err := recover(); err != nil {
+				ww.end(http.StatusInternalServerError)
+				panic(err)
+			}
+			ww.WriteHeader(http.StatusOK)
+		}()
+		next.ServeHTTP(ww, r, kvpairs)
+	})
+}